@@ -0,0 +1,412 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/panjf2000/gnet/v2"
+	"go.uber.org/zap"
+)
+
+// Room visibilities.
+const (
+	roomPublic  = "public"
+	roomPrivate = "private"
+	roomInvite  = "invite"
+)
+
+var (
+	errUnknownACL   = errors.New("unknown room ACL")
+	errNotPermitted = errors.New("not permitted")
+)
+
+// roomACL controls who may join and publish to the rooms matching Room, a
+// path.Match pattern. Anyone may subscribe to a public room; a private one
+// admits the principals in Subscribe and an invite-only one those in
+// Invited. Publish, when set, narrows who may publish among the
+// subscribers; otherwise whoever may subscribe may publish.
+//
+// Principals are "*", "authenticated" for any connection with a session,
+// "user:<subject>" for one session subject and "tag:<key>=<value>" for
+// metadata the upgrade hook set. Tags a client sets itself never count.
+type roomACL struct {
+	Room       string   `json:"room"`
+	Visibility string   `json:"visibility"`
+	Subscribe  []string `json:"subscribe,omitempty"`
+	Publish    []string `json:"publish,omitempty"`
+	Invited    []string `json:"invited,omitempty"`
+}
+
+func (acl *roomACL) validate() error {
+	if _, err := path.Match(acl.Room, ""); err != nil || acl.Room == "" {
+		return errors.New("a valid room pattern is required")
+	}
+
+	switch acl.Visibility {
+	case "":
+		acl.Visibility = roomPublic
+	case roomPublic, roomPrivate, roomInvite:
+	default:
+		return fmt.Errorf("unknown visibility %q, want public, private or invite", acl.Visibility)
+	}
+
+	for _, list := range [][]string{acl.Subscribe, acl.Publish, acl.Invited} {
+		for _, p := range list {
+			if err := validPrincipal(p); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func validPrincipal(p string) error {
+	switch {
+	case p == "*", p == "authenticated":
+	case strings.HasPrefix(p, "user:") && len(p) > len("user:"):
+	case strings.HasPrefix(p, "tag:") && strings.Contains(p, "="):
+	default:
+		return fmt.Errorf("invalid principal %q", p)
+	}
+
+	return nil
+}
+
+// principalsMatch reports whether the client the upgrade hook gave
+// metadata is any of principals.
+func principalsMatch(principals []string, metadata map[string]string) bool {
+	subject := metadata["session_subject"]
+
+	for _, p := range principals {
+		switch {
+		case p == "*":
+			return true
+		case p == "authenticated":
+			if subject != "" {
+				return true
+			}
+		case strings.HasPrefix(p, "user:"):
+			if subject != "" && p[len("user:"):] == subject {
+				return true
+			}
+		case strings.HasPrefix(p, "tag:"):
+			if key, value, ok := cutTag(p[len("tag:"):]); ok {
+				if v, set := metadata[key]; set && v == value {
+					return true
+				}
+			}
+		}
+	}
+
+	return false
+}
+
+func (acl *roomACL) maySubscribe(metadata map[string]string) bool {
+	switch acl.Visibility {
+	case roomPrivate:
+		return principalsMatch(acl.Subscribe, metadata)
+	case roomInvite:
+		return principalsMatch(acl.Invited, metadata)
+	default:
+		return true
+	}
+}
+
+func (acl *roomACL) mayPublish(metadata map[string]string) bool {
+	if !acl.maySubscribe(metadata) {
+		return false
+	}
+
+	return len(acl.Publish) == 0 || principalsMatch(acl.Publish, metadata)
+}
+
+// roomACLs holds the ACLs in the order they were defined, the first whose
+// pattern matches a room deciding for it; rooms none match are public. It
+// writes them to file, when set, on every change. A nil roomACLs permits
+// everything.
+type roomACLs struct {
+	file string
+
+	mu   sync.RWMutex
+	acls []*roomACL
+}
+
+func loadRoomACLs(file string) (*roomACLs, error) {
+	l := &roomACLs{file: file}
+	if file == "" {
+		return l, nil
+	}
+
+	data, err := os.ReadFile(file)
+	if errors.Is(err, os.ErrNotExist) {
+		return l, nil
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("reading room ACLs: %w", err)
+	}
+
+	if err := json.Unmarshal(data, &l.acls); err != nil {
+		return nil, fmt.Errorf("parsing room ACLs %s: %w", file, err)
+	}
+
+	for _, acl := range l.acls {
+		if err := acl.validate(); err != nil {
+			return nil, fmt.Errorf("room ACL %q: %w", acl.Room, err)
+		}
+	}
+
+	return l, nil
+}
+
+func (l *roomACLs) lookup(room string) *roomACL {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	for _, acl := range l.acls {
+		if ok, _ := path.Match(acl.Room, room); ok {
+			return acl
+		}
+	}
+
+	return nil
+}
+
+// authorize returns errNotPermitted unless conn may subscribe to room, or
+// publish to it when publishing.
+func (l *roomACLs) authorize(conn gnet.Conn, room string, publishing bool) error {
+	var metadata map[string]string
+	if codec, ok := codecOf(conn); ok {
+		metadata = codec.metadata
+	}
+
+	return l.authorizeMetadata(metadata, room, publishing)
+}
+
+// authorizeMetadata is authorize for clients known by their metadata
+// alone, such as those of transports.
+func (l *roomACLs) authorizeMetadata(metadata map[string]string, room string, publishing bool) error {
+	if l == nil {
+		return nil
+	}
+
+	acl := l.lookup(room)
+	if acl == nil {
+		return nil
+	}
+
+	if publishing && !acl.mayPublish(metadata) || !publishing && !acl.maySubscribe(metadata) {
+		return errNotPermitted
+	}
+
+	return nil
+}
+
+func (l *roomACLs) list() []roomACL {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	acls := make([]roomACL, len(l.acls))
+	for i, acl := range l.acls {
+		acls[i] = *acl
+	}
+
+	return acls
+}
+
+// set replaces the ACL for the same pattern or appends a new one.
+func (l *roomACLs) set(acl *roomACL) error {
+	if err := acl.validate(); err != nil {
+		return err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	acls := append([]*roomACL(nil), l.acls...)
+
+	replaced := false
+	for i, existing := range acls {
+		if existing.Room == acl.Room {
+			acls[i], replaced = acl, true
+		}
+	}
+
+	if !replaced {
+		acls = append(acls, acl)
+	}
+
+	return l.commit(acls)
+}
+
+func (l *roomACLs) remove(room string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	acls := make([]*roomACL, 0, len(l.acls))
+	for _, acl := range l.acls {
+		if acl.Room != room {
+			acls = append(acls, acl)
+		}
+	}
+
+	if len(acls) == len(l.acls) {
+		return errUnknownACL
+	}
+
+	return l.commit(acls)
+}
+
+// invite adds principal to, or with uninvite removes it from, the invited
+// list of the ACL for room.
+func (l *roomACLs) invite(room, principal string, uninvite bool) (roomACL, error) {
+	if err := validPrincipal(principal); err != nil {
+		return roomACL{}, err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	acls := append([]*roomACL(nil), l.acls...)
+
+	for i, existing := range acls {
+		if existing.Room != room {
+			continue
+		}
+
+		acl := *existing
+		acl.Invited = nil
+
+		for _, p := range existing.Invited {
+			if p != principal {
+				acl.Invited = append(acl.Invited, p)
+			}
+		}
+
+		if !uninvite {
+			acl.Invited = append(acl.Invited, principal)
+		}
+
+		acls[i] = &acl
+
+		return acl, l.commit(acls)
+	}
+
+	return roomACL{}, errUnknownACL
+}
+
+// commit persists acls and makes them current. It must be called with l.mu
+// held.
+func (l *roomACLs) commit(acls []*roomACL) error {
+	if l.file != "" {
+		data, err := json.MarshalIndent(acls, "", "  ")
+		if err != nil {
+			return fmt.Errorf("encoding room ACLs: %w", err)
+		}
+
+		if err := writeFileAtomic(l.file, data); err != nil {
+			return fmt.Errorf("persisting room ACLs: %w", err)
+		}
+	}
+
+	l.acls = acls
+
+	return nil
+}
+
+type inviteRequest struct {
+	Room      string `json:"room"`
+	Principal string `json:"principal"`
+}
+
+// handleACLs lists room ACLs on GET, adds or replaces one on PUT and
+// deletes the one for ?room= on DELETE. Changing an ACL does not remove
+// members it no longer admits.
+func (a *adminServer) handleACLs(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, a.acls.list())
+	case http.MethodPut:
+		var acl roomACL
+		if err := json.NewDecoder(r.Body).Decode(&acl); err != nil {
+			http.Error(w, "invalid room ACL: "+err.Error(), http.StatusBadRequest)
+
+			return
+		}
+
+		if err := a.acls.set(&acl); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+
+			return
+		}
+
+		a.audit.Info("admin set room ACL",
+			zap.String("action", "set_acl"),
+			zap.String("room", acl.Room),
+			zap.String("visibility", acl.Visibility))
+
+		writeJSON(w, http.StatusOK, acl)
+	case http.MethodDelete:
+		room := r.URL.Query().Get("room")
+
+		if err := a.acls.remove(room); err != nil {
+			status := http.StatusInternalServerError
+			if errors.Is(err, errUnknownACL) {
+				status = http.StatusNotFound
+			}
+
+			http.Error(w, err.Error(), status)
+
+			return
+		}
+
+		a.audit.Info("admin delete room ACL", zap.String("action", "delete_acl"), zap.String("room", room))
+
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleInvites adds a principal to an invite list on POST and removes it
+// on DELETE, both taking {"room": ..., "principal": ...}.
+func (a *adminServer) handleInvites(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost && r.Method != http.MethodDelete {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+
+		return
+	}
+
+	var req inviteRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid invite: "+err.Error(), http.StatusBadRequest)
+
+		return
+	}
+
+	acl, err := a.acls.invite(req.Room, req.Principal, r.Method == http.MethodDelete)
+	if err != nil {
+		status := http.StatusBadRequest
+		if errors.Is(err, errUnknownACL) {
+			status = http.StatusNotFound
+		}
+
+		http.Error(w, err.Error(), status)
+
+		return
+	}
+
+	a.audit.Info("admin room invite",
+		zap.String("action", strings.ToLower(r.Method)+"_invite"),
+		zap.String("room", req.Room),
+		zap.String("principal", req.Principal))
+
+	writeJSON(w, http.StatusOK, acl)
+}
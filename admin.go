@@ -0,0 +1,569 @@
+package main
+
+import (
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gobwas/ws"
+	"github.com/panjf2000/gnet/v2"
+	"go.uber.org/zap"
+)
+
+var errUnknownConnection = errors.New("unknown connection")
+
+type connectionInfo struct {
+	ID         uint64 `json:"id"`
+	RemoteAddr string `json:"remote_addr"`
+	// User is the session subject of an authenticated connection.
+	User        string    `json:"user,omitempty"`
+	Rooms       []string  `json:"rooms"`
+	ConnectedAt time.Time `json:"connected_at"`
+	Uptime      string    `json:"uptime"`
+
+	Path     string            `json:"path,omitempty"`
+	Metadata map[string]string `json:"metadata,omitempty"`
+	Tags     map[string]string `json:"tags,omitempty"`
+}
+
+type roomInfo struct {
+	Name     string       `json:"name"`
+	Members  int          `json:"members"`
+	Seq      uint64       `json:"seq"`
+	Ordering orderingMode `json:"ordering"`
+}
+
+func (b *broadcastService) listConnections() []connectionInfo {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	now := time.Now()
+	infos := make([]connectionInfo, 0, len(b.connections))
+
+	for _, tc := range b.connections {
+		rooms := make([]string, 0, len(tc.subscriptions))
+		for name := range tc.subscriptions {
+			rooms = append(rooms, name)
+		}
+		sort.Strings(rooms)
+
+		infos = append(infos, connectionInfo{
+			ID:          tc.id,
+			RemoteAddr:  tc.remoteAddr,
+			User:        tc.metadata["session_subject"],
+			Rooms:       rooms,
+			ConnectedAt: tc.connectedAt,
+			Uptime:      now.Sub(tc.connectedAt).Round(time.Second).String(),
+			Path:        tc.path,
+			Metadata:    tc.metadata,
+			Tags:        copyTags(tc.tags),
+		})
+	}
+
+	sort.Slice(infos, func(i, j int) bool { return infos[i].ID < infos[j].ID })
+
+	return infos
+}
+
+func (b *broadcastService) listRooms() []roomInfo {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	infos := make([]roomInfo, 0, len(b.rooms))
+	for _, r := range b.rooms {
+		infos = append(infos, roomInfo{Name: r.name, Members: len(r.members), Seq: r.seq, Ordering: r.ordering})
+	}
+
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name < infos[j].Name })
+
+	return infos
+}
+
+func (b *broadcastService) connectionByID(id uint64) (gnet.Conn, bool) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	for c, tc := range b.connections {
+		if tc.id == id {
+			return c, true
+		}
+	}
+
+	return nil, false
+}
+
+// kick closes a connection as kicked, with reason as the detail.
+func (b *broadcastService) kick(id uint64, reason string) error {
+	c, ok := b.connectionByID(id)
+	if !ok {
+		return errUnknownConnection
+	}
+
+	return closeWith(c, closeKicked, reason)
+}
+
+// kickWithin is kick on behalf of an admin of tenant, to whom the
+// connections of other tenants are unknown. Only the admin token may kick
+// across tenants.
+func (b *broadcastService) kickWithin(tenant string, id uint64, reason string) error {
+	c, ok := b.connectionByID(id)
+	if !ok {
+		return errUnknownConnection
+	}
+
+	if codec, ok := codecOf(c); !ok || codec.tenant != tenant {
+		return errUnknownConnection
+	}
+
+	return closeWith(c, closeKicked, reason)
+}
+
+// adminServer exposes connection and room management, metrics and debug
+// endpoints over HTTP. It always runs on its own listener, never the public
+// websocket port, and every request must carry valid credentials.
+type adminServer struct {
+	addr    string
+	tlsCert string
+	tlsKey  string
+	auth    adminAuth
+	// publishTokens may only reach /broadcast and /publish, within their scope.
+	publishTokens []*publishToken
+	certs         *certificateLoader
+	reload        *reloader
+	ipFilter      *ipFilter
+	bans          *banList
+	acls          *roomACLs
+	bs            *broadcastService
+	migrator      *roomMigrator
+	extra         map[string]http.HandlerFunc
+	logger        *zap.Logger
+	// audit records exactly what admin operations sent where.
+	audit *zap.Logger
+}
+
+// adminAuth accepts either the bearer token or the basic-auth pair,
+// whichever are configured.
+type adminAuth struct {
+	token    string
+	user     string
+	password string
+}
+
+func (a adminAuth) configured() bool {
+	return a.token != "" || (a.user != "" && a.password != "")
+}
+
+func (a adminAuth) allows(r *http.Request) bool {
+	if a.token != "" {
+		if token, ok := bearerToken(r.Header.Get("Authorization")); ok && secureEqual(token, a.token) {
+			return true
+		}
+	}
+
+	if a.user != "" && a.password != "" {
+		if user, password, ok := r.BasicAuth(); ok && secureEqual(user, a.user) && secureEqual(password, a.password) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// bearerToken returns the token of an Authorization header value of the
+// Bearer scheme. Anything else, a bare token included, carries none.
+func bearerToken(authorization string) (string, bool) {
+	token, ok := strings.CutPrefix(authorization, "Bearer ")
+	if !ok || token == "" {
+		return "", false
+	}
+
+	return token, true
+}
+
+func secureEqual(got, want string) bool {
+	return subtle.ConstantTimeCompare([]byte(got), []byte(want)) == 1
+}
+
+func (a *adminServer) handler() http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/connections", a.handleConnections)
+	mux.HandleFunc("/connections/", a.handleConnection)
+	mux.HandleFunc("/rooms", a.handleRooms)
+	mux.HandleFunc("/events/rooms", a.handleRoomEvents)
+	mux.HandleFunc("/broadcast", a.handleBroadcast)
+	mux.HandleFunc("/publish", a.handlePublish)
+	mux.HandleFunc("/broadcast/rooms", a.handleWildcardBroadcast)
+	mux.HandleFunc("/amplification", a.handleAmplification)
+	mux.HandleFunc("/delivery", a.handleDelivery)
+	mux.HandleFunc("/stats", a.handleStats)
+	mux.Handle("/debug/vars", expvar.Handler())
+	mux.HandleFunc("/estimate", a.handleEstimate)
+	mux.HandleFunc("/guardrails", a.handleGuardrails)
+	mux.HandleFunc("/reload", a.handleReload)
+	mux.HandleFunc("/ipfilter", a.handleIPFilter)
+	mux.HandleFunc("/bans", a.handleBans)
+	mux.HandleFunc("/acls", a.handleACLs)
+	mux.HandleFunc("/acls/invites", a.handleInvites)
+	mux.HandleFunc("/tenants", a.handleTenants)
+	mux.HandleFunc("/retained", a.handleRetained)
+	mux.HandleFunc("/pools", a.handlePools)
+	mux.HandleFunc("/ipfilter/", a.handleIPFilter)
+	mux.HandleFunc("/migrations", a.handleMigrations)
+	mux.HandleFunc("/rooms/import", a.handleRoomImport)
+	mux.HandleFunc("/schedules", a.handleSchedules)
+	mux.HandleFunc("/cluster", a.handleCluster)
+	mux.HandleFunc("/hooks", a.handleHooks)
+
+	for pattern, fn := range a.extra {
+		mux.HandleFunc(pattern, fn)
+	}
+
+	return a.authenticate(mux)
+}
+
+func (a *adminServer) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !a.auth.allows(r) {
+			if t := a.publishTokenFor(r); t != nil && (r.URL.Path == "/broadcast" || r.URL.Path == "/publish") {
+				next.ServeHTTP(w, r.WithContext(withPublishToken(r.Context(), t)))
+
+				return
+			}
+
+			if a.auth.user != "" {
+				w.Header().Set("WWW-Authenticate", `Basic realm="wsb admin"`)
+			}
+
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (a *adminServer) handleConnections(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+
+		return
+	}
+
+	writeJSON(w, http.StatusOK, a.bs.listConnections())
+}
+
+// handleConnection kicks a connection on DELETE /connections/{id}?reason=
+// and
+// reports its counters on GET /connections/{id}/stats.
+func (a *adminServer) handleConnection(w http.ResponseWriter, r *http.Request) {
+	rest := strings.TrimPrefix(r.URL.Path, "/connections/")
+
+	wantStats := strings.HasSuffix(rest, "/stats")
+	if wantStats {
+		rest = strings.TrimSuffix(rest, "/stats")
+	}
+
+	id, err := strconv.ParseUint(rest, 10, 64)
+	if err != nil {
+		http.Error(w, "invalid connection id", http.StatusBadRequest)
+
+		return
+	}
+
+	if wantStats {
+		a.handleConnectionStats(w, r, id)
+
+		return
+	}
+
+	if r.Method != http.MethodDelete {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+
+		return
+	}
+
+	reason := r.URL.Query().Get("reason")
+
+	if err := a.bs.kick(id, reason); err != nil {
+		if errors.Is(err, errUnknownConnection) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+
+			return
+		}
+
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+
+		return
+	}
+
+	a.logger.Info("connection kicked", zap.Uint64("conn_id", id), zap.String("reason", reason))
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (a *adminServer) handleConnectionStats(w http.ResponseWriter, r *http.Request, id uint64) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+
+		return
+	}
+
+	c, ok := a.bs.connectionByID(id)
+	if !ok {
+		http.Error(w, errUnknownConnection.Error(), http.StatusNotFound)
+
+		return
+	}
+
+	stats, ok := a.bs.connectionStats(c)
+	if !ok {
+		http.Error(w, errUnknownConnection.Error(), http.StatusNotFound)
+
+		return
+	}
+
+	writeJSON(w, http.StatusOK, stats)
+}
+
+func (a *adminServer) handleRooms(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+
+		return
+	}
+
+	writeJSON(w, http.StatusOK, a.bs.listRooms())
+}
+
+// handleBroadcast sends the request body to every connection, or publishes it
+// to a single room when ?room= is set. Room payloads must be JSON, the same as
+// the data field of a publish frame. Scoped publish tokens must name a room
+// they cover and stay within their rate limit. A room publish repeating an
+// Idempotency-Key header is answered 200 without being sent again. With
+// ?where= the body goes only to connections whose tags match.
+func (a *adminServer) handleBroadcast(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+
+		return
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("reading body: %v", err), http.StatusBadRequest)
+
+		return
+	}
+
+	room := r.URL.Query().Get("room")
+	if !authorizePublish(w, r, room) {
+		return
+	}
+
+	if where := r.URL.Query().Get("where"); where != "" {
+		a.handleBroadcastWhere(w, r, room, where, body)
+
+		return
+	}
+
+	if room == "" {
+		err = a.bs.broadcastMessage(ws.OpText, body)
+		a.bs.msgAudit.record(httpSource(r), broadcastRoomName, 0, body, err)
+	} else if !json.Valid(body) {
+		http.Error(w, "room payload must be valid JSON", http.StatusBadRequest)
+
+		return
+	} else if _, report, perr := a.publishOnce(r, room, body); report == nil && perr == nil {
+		a.logger.Info("admin broadcast duplicate", zap.String("room", room), zap.String("idempotency_key", r.Header.Get("Idempotency-Key")))
+		w.WriteHeader(http.StatusOK)
+
+		return
+	} else {
+		err = perr
+	}
+
+	if err != nil {
+		http.Error(w, err.Error(), publishErrorStatus(err))
+
+		return
+	}
+
+	fields := []zap.Field{zap.String("room", room), zap.Int("size", len(body))}
+	if t := publishTokenFrom(r.Context()); t != nil {
+		fields = append(fields, zap.String("token", t.Name))
+	}
+
+	a.logger.Info("admin broadcast", fields...)
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// handleBroadcastWhere sends body to the connections whose tags match the
+// selector in ?where=, e.g. region=eu AND plan=pro.
+func (a *adminServer) handleBroadcastWhere(w http.ResponseWriter, r *http.Request, room, where string, body []byte) {
+	if room != "" {
+		http.Error(w, "room and where cannot be combined", http.StatusBadRequest)
+
+		return
+	}
+
+	sel, err := parseTagSelector(where)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+
+		return
+	}
+
+	matched, err := a.bs.broadcastWhere(sel, ws.OpText, body)
+
+	src := httpSource(r)
+	src.where = sel.String()
+	a.bs.msgAudit.record(src, broadcastRoomName, 0, body, err)
+
+	if err != nil {
+		http.Error(w, err.Error(), publishErrorStatus(err))
+
+		return
+	}
+
+	a.logger.Info("admin broadcast", zap.Stringer("where", sel), zap.Int("matched", matched), zap.Int("size", len(body)))
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// publishErrorStatus is the status an admin publish that failed with err
+// is answered with: 429 when a bandwidth quota refused it, so callers back
+// off, and 502 otherwise.
+func publishErrorStatus(err error) int {
+	if errors.Is(err, errBandwidthExceeded) {
+		return http.StatusTooManyRequests
+	}
+
+	return http.StatusBadGateway
+}
+
+// publishOnce publishes data to room unless the request repeats an
+// Idempotency-Key, in which case it returns what the first one recorded and
+// no delivery report.
+func (a *adminServer) publishOnce(r *http.Request, room string, data []byte) (roomMessage, *deliveryReport, error) {
+	identity, key := "admin", r.Header.Get("Idempotency-Key")
+	if t := publishTokenFrom(r.Context()); t != nil {
+		identity = "token:" + t.Name
+	}
+
+	if msg, fresh := a.bs.dedup.claim(identity, key); !fresh {
+		return msg, nil, nil
+	}
+
+	msg, report, err := a.bs.publishReport(r.Context(), room, data, nil)
+	a.bs.dedup.settle(identity, key, msg, err)
+	a.bs.msgAudit.record(httpSource(r), room, msg.seq, data, err)
+
+	return msg, &report, err
+}
+
+type publishResult struct {
+	Room      string `json:"room"`
+	Seq       uint64 `json:"seq"`
+	Duplicate bool   `json:"duplicate,omitempty"`
+	// Delivery is reported when the request asks with ?report=1.
+	Delivery *deliveryReport `json:"delivery,omitempty"`
+}
+
+// handlePublish publishes the body to ?room= for backend jobs that would
+// rather curl than hold a websocket open, and answers with the sequence it
+// got. A body not sent as application/json is published as a JSON string.
+func (a *adminServer) handlePublish(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+
+		return
+	}
+
+	room := r.URL.Query().Get("room")
+	if room == "" {
+		http.Error(w, "room is required", http.StatusBadRequest)
+
+		return
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("reading body: %v", err), http.StatusBadRequest)
+
+		return
+	}
+
+	if !authorizePublish(w, r, room) {
+		return
+	}
+
+	data := body
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType != "application/json" {
+		data, _ = json.Marshal(string(body))
+	} else if !json.Valid(body) {
+		http.Error(w, "body must be valid JSON", http.StatusBadRequest)
+
+		return
+	}
+
+	msg, report, err := a.publishOnce(r, room, data)
+	fresh := report != nil
+	if err != nil {
+		http.Error(w, err.Error(), publishErrorStatus(err))
+
+		return
+	}
+
+	fields := []zap.Field{zap.String("room", room), zap.Uint64("seq", msg.seq), zap.Bool("duplicate", !fresh)}
+	if t := publishTokenFrom(r.Context()); t != nil {
+		fields = append(fields, zap.String("token", t.Name))
+	}
+
+	a.logger.Info("http publish", fields...)
+
+	result := publishResult{Room: room, Seq: msg.seq, Duplicate: !fresh}
+	if r.URL.Query().Get("report") == "1" {
+		result.Delivery = report
+	}
+
+	writeJSON(w, http.StatusOK, result)
+}
+
+func (a *adminServer) serve() {
+	srv := &http.Server{
+		Addr:    a.addr,
+		Handler: a.handler(),
+	}
+
+	a.logger.Info("admin server is listening", zap.String("addr", a.addr), zap.Bool("tls", a.certs != nil))
+
+	var err error
+	if a.certs != nil {
+		srv.TLSConfig = &tls.Config{MinVersion: tls.VersionTLS12, GetCertificate: a.certs.getCertificate}
+		err = srv.ListenAndServeTLS("", "")
+	} else {
+		err = srv.ListenAndServe()
+	}
+
+	a.logger.Error("admin server exits", zap.Error(err))
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	_ = json.NewEncoder(w).Encode(v)
+}
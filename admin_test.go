@@ -0,0 +1,72 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// TestAdminPublishOverBandwidth checks every admin path that publishes to a
+// room answers 429 once the room is over its bandwidth quota.
+func TestAdminPublishOverBandwidth(t *testing.T) {
+	hub := newHookHub(4, "metered")
+	hub.bandwidth = &bandwidthQuotas{
+		window: time.Minute,
+		action: bandwidthReject,
+		rooms:  []bandwidthRule{{pattern: "metered", rate: 1}},
+		meters: make(map[string]*bandwidthMeter),
+	}
+
+	// Used up, as if the room had already broadcast a minute's quota.
+	if _, err := hub.bandwidth.admit("metered"); err != nil {
+		t.Fatal(err)
+	}
+	hub.bandwidth.charge("metered", 60)
+
+	a := &adminServer{auth: adminAuth{token: "secret"}, bs: hub, logger: zap.NewNop(), audit: zap.NewNop()}
+
+	for _, path := range []string{"/broadcast?room=metered", "/publish?room=metered"} {
+		req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(`{"n":1}`))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer secret")
+
+		w := httptest.NewRecorder()
+		a.handler().ServeHTTP(w, req)
+
+		if w.Code != http.StatusTooManyRequests {
+			t.Errorf("%s over quota = %d %s, want 429", path, w.Code, strings.TrimSpace(w.Body.String()))
+		}
+	}
+}
+
+func TestAdminAuthRequiresBearer(t *testing.T) {
+	auth := adminAuth{token: "secret"}
+
+	cases := []struct {
+		header string
+		allow  bool
+	}{
+		{header: "Bearer secret", allow: true},
+		{header: "secret"},
+		{header: "bearer secret"},
+		{header: "Basic secret"},
+		{header: "Bearer "},
+		{header: "Bearer secret2"},
+		{header: ""},
+	}
+
+	for _, tc := range cases {
+		req := httptest.NewRequest(http.MethodGet, "/connections", nil)
+		if tc.header != "" {
+			req.Header.Set("Authorization", tc.header)
+		}
+
+		if got := auth.allows(req); got != tc.allow {
+			t.Errorf("Authorization %q allowed = %v, want %v", tc.header, got, tc.allow)
+		}
+	}
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync/atomic"
+
+	"github.com/gobwas/ws"
+)
+
+// broadcastRoomName labels the raw broadcast path in fan-out stats, which
+// is not a room but costs the same way.
+const broadcastRoomName = "*"
+
+var errUnknownRoom = errors.New("unknown room")
+
+// fanoutStats counts payload bytes accepted from publishers against frame
+// bytes written to recipients; the ratio is the write amplification.
+type fanoutStats struct {
+	atomicMessages  uint64
+	atomicBytesIn   uint64
+	atomicBytesOut  uint64
+	atomicFramesOut uint64
+
+	delivery deliveryStats
+	// total, when set, counts the same again so the hub keeps totals
+	// across rooms that come and go.
+	total *fanoutStats
+}
+
+func (s *fanoutStats) received(n int) {
+	atomic.AddUint64(&s.atomicMessages, 1)
+	atomic.AddUint64(&s.atomicBytesIn, uint64(n))
+
+	if s.total != nil {
+		s.total.received(n)
+	}
+}
+
+func (s *fanoutStats) wrote(n int) {
+	atomic.AddUint64(&s.atomicFramesOut, 1)
+	atomic.AddUint64(&s.atomicBytesOut, uint64(n))
+
+	if s.total != nil {
+		s.total.wrote(n)
+	}
+}
+
+type amplificationInfo struct {
+	Room          string  `json:"room"`
+	Messages      uint64  `json:"messages"`
+	BytesIn       uint64  `json:"bytes_in"`
+	BytesOut      uint64  `json:"bytes_out"`
+	FramesOut     uint64  `json:"frames_out"`
+	Amplification float64 `json:"amplification"`
+}
+
+func (s *fanoutStats) info(room string) amplificationInfo {
+	info := amplificationInfo{
+		Room:      room,
+		Messages:  atomic.LoadUint64(&s.atomicMessages),
+		BytesIn:   atomic.LoadUint64(&s.atomicBytesIn),
+		BytesOut:  atomic.LoadUint64(&s.atomicBytesOut),
+		FramesOut: atomic.LoadUint64(&s.atomicFramesOut),
+	}
+
+	if info.BytesIn > 0 {
+		info.Amplification = float64(info.BytesOut) / float64(info.BytesIn)
+	}
+
+	return info
+}
+
+func (b *broadcastService) amplification() []amplificationInfo {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	infos := make([]amplificationInfo, 0, len(b.rooms)+1)
+	infos = append(infos, b.broadcastStats.info(broadcastRoomName))
+
+	for _, r := range b.rooms {
+		infos = append(infos, r.stats.info(r.name))
+	}
+
+	sort.Slice(infos[1:], func(i, j int) bool { return infos[i+1].Room < infos[j+1].Room })
+
+	return infos
+}
+
+type costEstimate struct {
+	Room             string `json:"room"`
+	PayloadBytes     int    `json:"payload_bytes"`
+	Recipients       int    `json:"recipients"`
+	FrameBytes       int    `json:"frame_bytes"`
+	TotalBytesOut    int    `json:"total_bytes_out"`
+	PausedRecipients int    `json:"paused_recipients"`
+}
+
+// estimateCost predicts what publishing size bytes to room would write right
+// now. Paused members are reported separately since they only cost memory
+// until they resume.
+func (b *broadcastService) estimateCost(room string, size int) (costEstimate, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	est := costEstimate{Room: room, PayloadBytes: size}
+
+	if room == broadcastRoomName {
+		est.Recipients = len(b.connections)
+		est.FrameBytes = frameSize(size)
+	} else {
+		r, ok := b.rooms[room]
+		if !ok {
+			return est, errUnknownRoom
+		}
+
+		for _, sub := range r.members {
+			if sub.paused {
+				est.PausedRecipients++
+				continue
+			}
+
+			est.Recipients++
+		}
+
+		est.FrameBytes = frameSize(roomEnvelopeSize(r.name, r.seq+1) + size)
+	}
+
+	est.TotalBytesOut = est.Recipients * est.FrameBytes
+
+	return est, nil
+}
+
+// roomEnvelopeSize is the length of a JSON message frame around its data.
+func roomEnvelopeSize(name string, seq uint64) int {
+	frame, err := jsonEncoding{}.encode(roomMessageFrame(name, roomMessage{seq: seq, data: []byte("0")}))
+	if err != nil {
+		return 0
+	}
+
+	return len(frame) - 1
+}
+
+// frameSize is the on-the-wire size of an unmasked server frame.
+func frameSize(payloadLen int) int {
+	return ws.HeaderSize(ws.Header{Length: int64(payloadLen)}) + payloadLen
+}
+
+func (a *adminServer) handleAmplification(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+
+		return
+	}
+
+	writeJSON(w, http.StatusOK, a.bs.amplification())
+}
+
+func (a *adminServer) handleEstimate(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+
+		return
+	}
+
+	q := r.URL.Query()
+
+	size, err := strconv.Atoi(q.Get("size"))
+	if err != nil || size < 0 {
+		http.Error(w, "size must be a non-negative integer", http.StatusBadRequest)
+
+		return
+	}
+
+	room := q.Get("room")
+	if room == "" {
+		room = broadcastRoomName
+	}
+
+	est, err := a.bs.estimateCost(room, size)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+
+		return
+	}
+
+	writeJSON(w, http.StatusOK, est)
+}
@@ -0,0 +1,333 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/gobwas/ws"
+	"go.uber.org/zap"
+)
+
+// announcement is a message the server sends on a schedule. Payload is a
+// text/template executed with announcementData; into a room, output that is
+// not JSON is sent as a JSON string. Without a room it goes to every
+// connection as a raw text frame.
+type announcement struct {
+	Name     string `json:"name"`
+	Schedule string `json:"schedule"`
+	Room     string `json:"room,omitempty"`
+	Payload  string `json:"payload"`
+
+	schedule schedule
+	payload  *template.Template
+}
+
+type announcementData struct {
+	Name        string
+	Room        string
+	Time        time.Time
+	Connections int
+}
+
+// announcer runs announcements, each from its own goroutine. Announcements
+// added after run starts are scheduled right away.
+type announcer struct {
+	bs     *broadcastService
+	logger *zap.Logger
+
+	mu            sync.Mutex
+	announcements []*announcement
+	running       bool
+}
+
+// loadAnnouncements reads a JSON array of announcements from file.
+func (a *announcer) loadAnnouncements(file string) error {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return fmt.Errorf("reading announcements: %w", err)
+	}
+
+	var announcements []*announcement
+	if err := json.Unmarshal(data, &announcements); err != nil {
+		return fmt.Errorf("parsing announcements %s: %w", file, err)
+	}
+
+	for _, an := range announcements {
+		if err := a.add(an); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (a *announcer) add(an *announcement) error {
+	if an.Name == "" {
+		return errors.New("announcement without a name")
+	}
+
+	var err error
+	if an.schedule, err = parseSchedule(an.Schedule); err != nil {
+		return fmt.Errorf("announcement %q: %w", an.Name, err)
+	}
+
+	if an.schedule.next(time.Now()).IsZero() {
+		return fmt.Errorf("announcement %q: schedule %q never fires", an.Name, an.Schedule)
+	}
+
+	if an.payload, err = template.New(an.Name).Parse(an.Payload); err != nil {
+		return fmt.Errorf("announcement %q: parsing payload: %w", an.Name, err)
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	for _, existing := range a.announcements {
+		if existing.Name == an.Name {
+			return fmt.Errorf("announcement %q is defined twice", an.Name)
+		}
+	}
+
+	a.announcements = append(a.announcements, an)
+
+	if a.running {
+		go a.loop(an)
+	}
+
+	return nil
+}
+
+func (a *announcer) run() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.running = true
+
+	for _, an := range a.announcements {
+		go a.loop(an)
+	}
+}
+
+func (a *announcer) loop(an *announcement) {
+	for {
+		now := time.Now()
+
+		next := an.schedule.next(now)
+		if next.IsZero() {
+			a.logger.Warn("announcement never fires again", zap.String("announcement", an.Name))
+
+			return
+		}
+
+		time.Sleep(next.Sub(now))
+
+		if err := a.announce(an, next); err != nil {
+			a.logger.Warn("sending announcement", zap.String("announcement", an.Name), zap.Error(err))
+		}
+	}
+}
+
+func (a *announcer) announce(an *announcement, at time.Time) error {
+	a.bs.mu.RLock()
+	connections := len(a.bs.connections)
+	a.bs.mu.RUnlock()
+
+	var buf bytes.Buffer
+	if err := an.payload.Execute(&buf, announcementData{Name: an.Name, Room: an.Room, Time: at, Connections: connections}); err != nil {
+		return fmt.Errorf("executing payload: %w", err)
+	}
+
+	if an.Room == "" {
+		return a.bs.broadcastMessage(ws.OpText, buf.Bytes())
+	}
+
+	data := buf.Bytes()
+	if !json.Valid(data) {
+		var err error
+		if data, err = json.Marshal(buf.String()); err != nil {
+			return err
+		}
+	}
+
+	return a.bs.publish(context.Background(), an.Room, data)
+}
+
+// schedule returns the first time after t it fires, or the zero time once
+// it never will again.
+type schedule interface {
+	next(t time.Time) time.Time
+}
+
+type everySchedule time.Duration
+
+func (s everySchedule) next(t time.Time) time.Time {
+	return t.Add(time.Duration(s))
+}
+
+// cronSchedule is a five-field cron expression: minute, hour, day of month,
+// month and day of week, each a bit set of the values it matches.
+type cronSchedule struct {
+	minute, hour, dom, month, dow uint64
+	// domAny and dowAny record a "*" field; when both day fields are
+	// restricted a day matching either one fires, as in cron.
+	domAny, dowAny bool
+}
+
+var scheduleShorthands = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+// parseSchedule accepts a five-field cron expression, one of the @hourly
+// style shorthands or "@every <duration>".
+func parseSchedule(s string) (schedule, error) {
+	s = strings.TrimSpace(s)
+
+	if rest := strings.TrimPrefix(s, "@every "); rest != s {
+		d, err := time.ParseDuration(strings.TrimSpace(rest))
+		if err != nil || d < time.Second {
+			return nil, fmt.Errorf("schedule %q: @every needs a duration of at least a second", s)
+		}
+
+		return everySchedule(d), nil
+	}
+
+	if expr, ok := scheduleShorthands[s]; ok {
+		s = expr
+	}
+
+	fields := strings.Fields(s)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("schedule %q: want five cron fields", s)
+	}
+
+	var (
+		c   cronSchedule
+		err error
+	)
+
+	bounds := []struct {
+		set      *uint64
+		min, max int
+	}{
+		{&c.minute, 0, 59},
+		{&c.hour, 0, 23},
+		{&c.dom, 1, 31},
+		{&c.month, 1, 12},
+		{&c.dow, 0, 7},
+	}
+
+	for i, b := range bounds {
+		if *b.set, err = parseCronField(fields[i], b.min, b.max); err != nil {
+			return nil, fmt.Errorf("schedule %q: %w", s, err)
+		}
+	}
+
+	// Sunday is both 0 and 7.
+	if c.dow&(1<<7) != 0 {
+		c.dow |= 1
+	}
+
+	c.domAny, c.dowAny = fields[2] == "*", fields[4] == "*"
+
+	return &c, nil
+}
+
+// parseCronField parses a comma-separated list of "*", "n" or "n-m", each
+// optionally followed by "/step".
+func parseCronField(field string, min, max int) (uint64, error) {
+	var set uint64
+
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+
+		if i := strings.IndexByte(part, '/'); i >= 0 {
+			n, err := strconv.Atoi(part[i+1:])
+			if err != nil || n < 1 {
+				return 0, fmt.Errorf("invalid step in %q", part)
+			}
+
+			step, part = n, part[:i]
+		}
+
+		lo, hi := min, max
+
+		if part != "*" {
+			var err error
+
+			bounds := strings.SplitN(part, "-", 2)
+			if lo, err = strconv.Atoi(bounds[0]); err != nil {
+				return 0, fmt.Errorf("invalid value %q", part)
+			}
+
+			hi = lo
+			if len(bounds) == 2 {
+				if hi, err = strconv.Atoi(bounds[1]); err != nil {
+					return 0, fmt.Errorf("invalid range %q", part)
+				}
+			} else if step > 1 {
+				hi = max
+			}
+		}
+
+		if lo < min || hi > max || lo > hi {
+			return 0, fmt.Errorf("%q is outside %d-%d", part, min, max)
+		}
+
+		for v := lo; v <= hi; v += step {
+			set |= 1 << uint(v)
+		}
+	}
+
+	return set, nil
+}
+
+func (c *cronSchedule) dayMatches(t time.Time) bool {
+	dom := c.dom&(1<<uint(t.Day())) != 0
+	dow := c.dow&(1<<uint(t.Weekday())) != 0
+
+	if c.domAny || c.dowAny {
+		return dom && dow
+	}
+
+	return dom || dow
+}
+
+func (c *cronSchedule) next(t time.Time) time.Time {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+
+	// A valid expression matches within a few years; one like "0 0 30 2 *"
+	// never does.
+	limit := t.AddDate(5, 0, 0)
+
+	for t.Before(limit) {
+		switch {
+		case c.month&(1<<uint(t.Month())) == 0:
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+		case !c.dayMatches(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+		case c.hour&(1<<uint(t.Hour())) == 0:
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+		case c.minute&(1<<uint(t.Minute())) == 0:
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+
+	return time.Time{}
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Over-quota rooms either have publishes refused or, throttled, conflated:
+// only the latest is delivered every -coalesce-interval, as under load
+// shedding.
+const (
+	bandwidthReject   = "reject"
+	bandwidthThrottle = "throttle"
+)
+
+var errBandwidthExceeded = errors.New("bandwidth quota exceeded")
+
+type bandwidthRule struct {
+	pattern string
+	rate    int64
+}
+
+// parseBandwidthRules parses comma-separated pattern=bytes-per-second pairs,
+// e.g. "video.*=5000000,*=100000". Patterns use path.Match syntax and the
+// first match wins.
+func parseBandwidthRules(s string) ([]bandwidthRule, error) {
+	var rules []bandwidthRule
+
+	for _, item := range splitList(s) {
+		i := strings.LastIndex(item, "=")
+		if i < 0 {
+			return nil, fmt.Errorf("bandwidth rule %q: want pattern=bytes", item)
+		}
+
+		pattern := item[:i]
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("bandwidth rule %q: %w", item, err)
+		}
+
+		rate, err := strconv.ParseInt(item[i+1:], 10, 64)
+		if err != nil || rate < 0 {
+			return nil, fmt.Errorf("bandwidth rule %q: invalid bytes per second", item)
+		}
+
+		rules = append(rules, bandwidthRule{pattern: pattern, rate: rate})
+	}
+
+	return rules, nil
+}
+
+// bandwidthQuotas meters the bytes rooms and tenants broadcast, payload
+// times recipients, over a sliding window of one-second buckets. A room or
+// tenant that has used rate times the window is over quota until enough of
+// the window slides by. A nil *bandwidthQuotas enforces nothing.
+type bandwidthQuotas struct {
+	window time.Duration
+	action string
+	rooms  []bandwidthRule
+	// tenantRate is a tenant's bytes per second, 0 for unlimited.
+	tenantRate func(tenant string) int64
+
+	mu        sync.Mutex
+	meters    map[string]*bandwidthMeter
+	lastSweep time.Time
+}
+
+type bandwidthMeter struct {
+	scope, name string
+	quota       int64
+
+	buckets []int64
+	stamps  []int64
+	last    time.Time
+
+	rejected, throttled uint64
+}
+
+// bandwidthUsage is a meter as /stats reports it: Used and Quota are bytes
+// within the window.
+type bandwidthUsage struct {
+	Scope     string `json:"scope"`
+	Name      string `json:"name"`
+	Used      int64  `json:"used"`
+	Quota     int64  `json:"quota"`
+	Rejected  uint64 `json:"rejected"`
+	Throttled uint64 `json:"throttled"`
+}
+
+func (m *bandwidthMeter) used(now time.Time) int64 {
+	since := now.Unix() - int64(len(m.buckets))
+
+	var used int64
+
+	for i, stamp := range m.stamps {
+		if stamp > since {
+			used += m.buckets[i]
+		}
+	}
+
+	return used
+}
+
+func (m *bandwidthMeter) add(now time.Time, n int64) {
+	sec := now.Unix()
+	i := int(sec % int64(len(m.buckets)))
+
+	if m.stamps[i] != sec {
+		m.stamps[i], m.buckets[i] = sec, 0
+	}
+
+	m.buckets[i] += n
+	m.last = now
+}
+
+// throttles reports whether over-quota publishes are conflated, which
+// needs the coalescer flushed.
+func (bq *bandwidthQuotas) throttles() bool {
+	return bq != nil && bq.action == bandwidthThrottle
+}
+
+func (bq *bandwidthQuotas) roomRate(name string) int64 {
+	for _, rule := range bq.rooms {
+		if ok, _ := path.Match(rule.pattern, name); ok {
+			return rule.rate
+		}
+	}
+
+	return 0
+}
+
+// metersOf returns the meters of room and its tenant that have a quota,
+// creating them if need be. It must be called with bq.mu held.
+func (bq *bandwidthQuotas) metersOf(room string) []*bandwidthMeter {
+	var meters []*bandwidthMeter
+
+	if m := bq.meter("room", room, bq.roomRate); m != nil {
+		meters = append(meters, m)
+	}
+
+	if i := strings.IndexByte(room, '/'); i >= 0 && bq.tenantRate != nil {
+		if m := bq.meter("tenant", room[:i], bq.tenantRate); m != nil {
+			meters = append(meters, m)
+		}
+	}
+
+	return meters
+}
+
+func (bq *bandwidthQuotas) meter(scope, name string, rateOf func(string) int64) *bandwidthMeter {
+	key := scope + ":" + name
+	if m, ok := bq.meters[key]; ok {
+		return m
+	}
+
+	rate := rateOf(name)
+	if rate <= 0 {
+		return nil
+	}
+
+	seconds := int(bq.window / time.Second)
+	if seconds < 1 {
+		seconds = 1
+	}
+
+	m := &bandwidthMeter{
+		scope:   scope,
+		name:    name,
+		quota:   rate * int64(seconds),
+		buckets: make([]int64, seconds),
+		stamps:  make([]int64, seconds),
+		last:    time.Now(),
+	}
+	bq.meters[key] = m
+
+	return m
+}
+
+// admit checks room and its tenant against their quotas before a publish.
+// Throttled is set when the publish should be conflated instead of refused.
+func (bq *bandwidthQuotas) admit(room string) (throttled bool, err error) {
+	if bq == nil {
+		return false, nil
+	}
+
+	bq.mu.Lock()
+	defer bq.mu.Unlock()
+
+	now := time.Now()
+
+	for _, m := range bq.metersOf(room) {
+		if m.used(now) < m.quota {
+			continue
+		}
+
+		if bq.action == bandwidthThrottle {
+			m.throttled++
+
+			return true, nil
+		}
+
+		m.rejected++
+
+		return false, fmt.Errorf("%s %w", m.scope, errBandwidthExceeded)
+	}
+
+	return false, nil
+}
+
+// charge meters n bytes broadcast in room.
+func (bq *bandwidthQuotas) charge(room string, n int64) {
+	if bq == nil || n <= 0 {
+		return
+	}
+
+	bq.mu.Lock()
+	defer bq.mu.Unlock()
+
+	now := time.Now()
+
+	for _, m := range bq.metersOf(room) {
+		m.add(now, n)
+	}
+
+	if now.Sub(bq.lastSweep) >= bq.window {
+		bq.sweep(now)
+	}
+}
+
+// sweep drops meters of rooms and tenants that broadcast nothing for a
+// whole window, counters included. It must be called with bq.mu held.
+func (bq *bandwidthQuotas) sweep(now time.Time) {
+	bq.lastSweep = now
+
+	for key, m := range bq.meters {
+		if now.Sub(m.last) > bq.window {
+			delete(bq.meters, key)
+		}
+	}
+}
+
+func (bq *bandwidthQuotas) usage() []bandwidthUsage {
+	if bq == nil {
+		return nil
+	}
+
+	bq.mu.Lock()
+	defer bq.mu.Unlock()
+
+	now := time.Now()
+
+	usage := make([]bandwidthUsage, 0, len(bq.meters))
+	for _, m := range bq.meters {
+		usage = append(usage, bandwidthUsage{
+			Scope:     m.scope,
+			Name:      m.name,
+			Used:      m.used(now),
+			Quota:     m.quota,
+			Rejected:  m.rejected,
+			Throttled: m.throttled,
+		})
+	}
+
+	sort.Slice(usage, func(i, j int) bool {
+		if usage[i].Scope != usage[j].Scope {
+			return usage[i].Scope < usage[j].Scope
+		}
+
+		return usage[i].Name < usage[j].Name
+	})
+
+	return usage
+}
@@ -0,0 +1,356 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/panjf2000/gnet/v2"
+	"go.uber.org/zap"
+)
+
+// Ban kinds.
+const (
+	banIP   = "ip"
+	banUser = "user"
+)
+
+var errUnknownBan = errors.New("unknown ban")
+
+// ban keeps an address or a user out until it expires. IP bans take an
+// address or a CIDR; user bans take the identity presence and dedup use,
+// such as "session:alice" or "client:42". A ban without Until never expires.
+type ban struct {
+	Kind    string     `json:"kind"`
+	Value   string     `json:"value"`
+	Reason  string     `json:"reason,omitempty"`
+	Created time.Time  `json:"created"`
+	Until   *time.Time `json:"until,omitempty"`
+
+	network *net.IPNet
+}
+
+func (b *ban) expired(now time.Time) bool {
+	return b.Until != nil && now.After(*b.Until)
+}
+
+// banList holds the active bans and writes them to file, when set, on every
+// change so they survive restarts. A nil banList bans nobody.
+type banList struct {
+	file string
+
+	mu   sync.RWMutex
+	bans map[string]*ban
+}
+
+func banKey(kind, value string) string { return kind + " " + value }
+
+func loadBanList(file string) (*banList, error) {
+	l := &banList{file: file, bans: make(map[string]*ban)}
+	if file == "" {
+		return l, nil
+	}
+
+	data, err := os.ReadFile(file)
+	if errors.Is(err, os.ErrNotExist) {
+		return l, nil
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("reading bans: %w", err)
+	}
+
+	var bans []*ban
+	if err := json.Unmarshal(data, &bans); err != nil {
+		return nil, fmt.Errorf("parsing bans %s: %w", file, err)
+	}
+
+	now := time.Now()
+
+	for _, b := range bans {
+		if err := b.validate(); err != nil {
+			return nil, fmt.Errorf("ban %s %q: %w", b.Kind, b.Value, err)
+		}
+
+		if !b.expired(now) {
+			l.bans[banKey(b.Kind, b.Value)] = b
+		}
+	}
+
+	return l, nil
+}
+
+func (b *ban) validate() error {
+	switch b.Kind {
+	case banIP:
+		nets, err := parseCIDRs(b.Value)
+		if err != nil {
+			return err
+		}
+
+		if len(nets) != 1 {
+			return errors.New("exactly one address or CIDR is required")
+		}
+
+		b.network, b.Value = nets[0], nets[0].String()
+	case banUser:
+		if b.Value == "" {
+			return errors.New("a user identity is required")
+		}
+	default:
+		return fmt.Errorf("unknown ban kind %q", b.Kind)
+	}
+
+	return nil
+}
+
+// bannedIP returns the ban covering ip, if any.
+func (l *banList) bannedIP(ip net.IP) (*ban, bool) {
+	if l == nil || ip == nil {
+		return nil, false
+	}
+
+	now := time.Now()
+
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	for _, b := range l.bans {
+		if b.Kind == banIP && !b.expired(now) && b.network.Contains(ip) {
+			return b, true
+		}
+	}
+
+	return nil, false
+}
+
+// bannedUser returns the ban on identity, if any.
+func (l *banList) bannedUser(identity string) (*ban, bool) {
+	if l == nil {
+		return nil, false
+	}
+
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	b, ok := l.bans[banKey(banUser, identity)]
+	if !ok || b.expired(time.Now()) {
+		return nil, false
+	}
+
+	return b, true
+}
+
+// covers reports whether b applies to c.
+func (b *ban) covers(c gnet.Conn) bool {
+	if b.Kind == banUser {
+		return connIdentity(c) == b.Value
+	}
+
+	ip := connIP(c)
+
+	return ip != nil && b.network.Contains(ip)
+}
+
+func (l *banList) add(b *ban) error {
+	if err := b.validate(); err != nil {
+		return err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	key := banKey(b.Kind, b.Value)
+	previous, existed := l.bans[key]
+	l.bans[key] = b
+
+	if err := l.persist(); err != nil {
+		if existed {
+			l.bans[key] = previous
+		} else {
+			delete(l.bans, key)
+		}
+
+		return err
+	}
+
+	return nil
+}
+
+func (l *banList) remove(kind, value string) error {
+	if kind == banIP {
+		if nets, err := parseCIDRs(value); err == nil && len(nets) == 1 {
+			value = nets[0].String()
+		}
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	key := banKey(kind, value)
+
+	b, ok := l.bans[key]
+	if !ok {
+		return errUnknownBan
+	}
+
+	delete(l.bans, key)
+
+	if err := l.persist(); err != nil {
+		l.bans[key] = b
+
+		return err
+	}
+
+	return nil
+}
+
+// list returns the bans in force, dropping expired ones.
+func (l *banList) list() []ban {
+	now := time.Now()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	bans := make([]ban, 0, len(l.bans))
+
+	for key, b := range l.bans {
+		if b.expired(now) {
+			delete(l.bans, key)
+
+			continue
+		}
+
+		bans = append(bans, *b)
+	}
+
+	sort.Slice(bans, func(i, j int) bool { return bans[i].Created.Before(bans[j].Created) })
+
+	return bans
+}
+
+// persist must be called with l.mu held.
+func (l *banList) persist() error {
+	if l.file == "" {
+		return nil
+	}
+
+	now := time.Now()
+
+	bans := make([]*ban, 0, len(l.bans))
+	for _, b := range l.bans {
+		if !b.expired(now) {
+			bans = append(bans, b)
+		}
+	}
+
+	sort.Slice(bans, func(i, j int) bool { return bans[i].Created.Before(bans[j].Created) })
+
+	data, err := json.MarshalIndent(bans, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err := writeFileAtomic(l.file, append(data, '\n')); err != nil {
+		return fmt.Errorf("persisting bans: %w", err)
+	}
+
+	return nil
+}
+
+// kickCovered closes every connection b applies to and returns how many.
+func (b *broadcastService) kickCovered(bn *ban) int {
+	var kicked int
+
+	for _, c := range b.snapshot() {
+		if bn.covers(c) {
+			_ = closeWith(c, closeBanned, bn.Reason)
+			kicked++
+		}
+	}
+
+	return kicked
+}
+
+type banRequest struct {
+	Kind   string `json:"kind"`
+	Value  string `json:"value"`
+	Reason string `json:"reason"`
+	// Duration is a Go duration such as "1h"; empty bans for good.
+	Duration string `json:"duration"`
+}
+
+// handleBans lists bans on GET /bans, adds one on POST /bans with a
+// banRequest body, kicking whoever it covers, and lifts one on
+// DELETE /bans?kind=&value=.
+func (a *adminServer) handleBans(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, a.bans.list())
+	case http.MethodPost:
+		var req banRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "invalid ban: "+err.Error(), http.StatusBadRequest)
+
+			return
+		}
+
+		b := &ban{Kind: req.Kind, Value: strings.TrimSpace(req.Value), Reason: req.Reason, Created: time.Now()}
+
+		if req.Duration != "" {
+			d, err := time.ParseDuration(req.Duration)
+			if err != nil || d <= 0 {
+				http.Error(w, "duration must be a positive Go duration", http.StatusBadRequest)
+
+				return
+			}
+
+			until := b.Created.Add(d)
+			b.Until = &until
+		}
+
+		if err := a.bans.add(b); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+
+			return
+		}
+
+		kicked := a.bs.kickCovered(b)
+
+		a.audit.Info("admin ban",
+			zap.String("action", "ban"),
+			zap.String("kind", b.Kind),
+			zap.String("value", b.Value),
+			zap.String("reason", b.Reason),
+			zap.String("duration", req.Duration),
+			zap.Int("kicked", kicked))
+
+		writeJSON(w, http.StatusCreated, b)
+	case http.MethodDelete:
+		kind, value := r.URL.Query().Get("kind"), r.URL.Query().Get("value")
+
+		if err := a.bans.remove(kind, value); err != nil {
+			status := http.StatusInternalServerError
+			if errors.Is(err, errUnknownBan) {
+				status = http.StatusNotFound
+			}
+
+			http.Error(w, err.Error(), status)
+
+			return
+		}
+
+		a.audit.Info("admin unban", zap.String("action", "unban"), zap.String("kind", kind), zap.String("value", value))
+
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestBansSurviveRestart checks that bans are read back from file with their
+// expiry, and that those which ran out while the server was down are gone.
+func TestBansSurviveRestart(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "bans.json")
+
+	l, err := loadBanList(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	later, soon := now.Add(time.Hour), now.Add(50*time.Millisecond)
+
+	for _, b := range []*ban{
+		{Kind: banIP, Value: "10.1.0.0/16", Created: now},
+		{Kind: banUser, Value: "session:alice", Created: now.Add(time.Millisecond), Until: &later},
+		{Kind: banUser, Value: "session:bob", Created: now.Add(2 * time.Millisecond), Until: &soon},
+		{Kind: banIP, Value: "192.168.0.1", Created: now.Add(3 * time.Millisecond), Until: &soon},
+	} {
+		if err := l.add(b); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	time.Sleep(100 * time.Millisecond)
+
+	restarted, err := loadBanList(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := restarted.bannedIP(net.ParseIP("10.1.2.3")); !ok {
+		t.Error("permanent CIDR ban lost over a restart")
+	}
+
+	b, ok := restarted.bannedUser("session:alice")
+	if !ok {
+		t.Fatal("timed user ban lost over a restart")
+	}
+
+	if b.Until == nil || !b.Until.Equal(later) {
+		t.Errorf("until = %v, want %v", b.Until, later)
+	}
+
+	if _, ok := restarted.bannedUser("session:bob"); ok {
+		t.Error("user ban still in force after it expired")
+	}
+
+	if _, ok := restarted.bannedIP(net.ParseIP("192.168.0.1")); ok {
+		t.Error("IP ban still in force after it expired")
+	}
+
+	if bans := restarted.list(); len(bans) != 2 {
+		t.Fatalf("bans = %+v, want the two unexpired ones", bans)
+	}
+
+	// What is written next leaves the expired bans out.
+	if err := restarted.remove(banIP, "10.1.0.0/16"); err != nil {
+		t.Fatal(err)
+	}
+
+	again, err := loadBanList(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if bans := again.list(); len(bans) != 1 || bans[0].Value != "session:alice" {
+		t.Fatalf("bans = %+v, want only session:alice", bans)
+	}
+}
+
+func TestBansRejectMalformedFile(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "bans.json")
+
+	if err := os.WriteFile(file, []byte(`[{"kind":"ip","value":"not an address","created":"2026-01-01T00:00:00Z"}]`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := loadBanList(file); err == nil {
+		t.Fatal("loaded a ban with an invalid address")
+	}
+}
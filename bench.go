@@ -0,0 +1,402 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math/bits"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gobwas/ws"
+	"github.com/gobwas/ws/wsutil"
+)
+
+// latencyHistogram counts durations in microseconds in buckets that keep
+// five significant bits, so percentiles are within about 3% and recording
+// is a single atomic add.
+type latencyHistogram struct {
+	buckets [64 * 32]uint64
+}
+
+func latencyBucket(us uint64) int {
+	if us < 64 {
+		return int(us)
+	}
+
+	shift := bits.Len64(us) - 6
+
+	return shift*32 + int(us>>shift)
+}
+
+func latencyBucketValue(i int) time.Duration {
+	if i < 64 {
+		return time.Duration(i) * time.Microsecond
+	}
+
+	shift := i/32 - 1
+	mantissa := uint64(i - shift*32)
+
+	return time.Duration(mantissa<<shift) * time.Microsecond
+}
+
+func (h *latencyHistogram) record(d time.Duration) {
+	if d < 0 {
+		d = 0
+	}
+
+	atomic.AddUint64(&h.buckets[latencyBucket(uint64(d/time.Microsecond))], 1)
+}
+
+func (h *latencyHistogram) count() uint64 {
+	var n uint64
+	for i := range h.buckets {
+		n += atomic.LoadUint64(&h.buckets[i])
+	}
+
+	return n
+}
+
+// percentile returns the smallest bucket value at or above the p-th
+// percentile, p in [0, 100].
+func (h *latencyHistogram) percentile(p float64) time.Duration {
+	total := h.count()
+	if total == 0 {
+		return 0
+	}
+
+	rank := uint64(p / 100 * float64(total))
+	if rank == 0 {
+		rank = 1
+	}
+
+	var seen uint64
+	for i := range h.buckets {
+		if seen += atomic.LoadUint64(&h.buckets[i]); seen >= rank {
+			return latencyBucketValue(i)
+		}
+	}
+
+	return latencyBucketValue(len(h.buckets) - 1)
+}
+
+func (h *latencyHistogram) summary() string {
+	return fmt.Sprintf("p50=%v p90=%v p99=%v p99.9=%v max=%v",
+		h.percentile(50), h.percentile(90), h.percentile(99), h.percentile(99.9), h.percentile(100))
+}
+
+// benchRunner measures a server from the outside, to size hardware: it
+// connects subscribers to one room, publishes to it at a target rate once
+// all of them are in, and reports how long connecting took, how long
+// messages took to reach subscribers and how many never did. Messages
+// carry their send time, so publishers and subscribers share a clock.
+type benchRunner struct {
+	url         string
+	room        string
+	conns       int
+	publishers  int
+	rate        float64
+	size        int
+	duration    time.Duration
+	concurrency int
+	grace       time.Duration
+	out         io.Writer
+
+	connect  latencyHistogram
+	delivery latencyHistogram
+
+	atomicSubscribed uint64
+	atomicSent       uint64
+	atomicReceived   uint64
+	atomicErrors     uint64
+}
+
+type benchPayload struct {
+	SentAt int64  `json:"sent_at"`
+	Pad    string `json:"pad,omitempty"`
+}
+
+// runBench is the "bench" subcommand.
+func runBench(args []string) int {
+	b := &benchRunner{out: os.Stdout}
+
+	fs := flag.NewFlagSet("bench", flag.ContinueOnError)
+	fs.StringVar(&b.url, "url", "ws://127.0.0.1:9000/", "websocket URL of the server under test")
+	fs.StringVar(&b.room, "room", "bench", "room subscribers join and publishers send to")
+	fs.IntVar(&b.conns, "conns", 100, "subscriber connections")
+	fs.IntVar(&b.publishers, "publishers", 1, "publisher connections, sharing -rate")
+	fs.Float64Var(&b.rate, "rate", 100, "messages per second published in total")
+	fs.IntVar(&b.size, "size", 64, "approximate payload size in bytes")
+	fs.DurationVar(&b.duration, "duration", 10*time.Second, "how long to publish")
+	fs.IntVar(&b.concurrency, "connect-concurrency", 64, "connections dialed at the same time while ramping up")
+	fs.DurationVar(&b.grace, "grace", 2*time.Second, "how long to wait for stragglers after publishing stops before counting drops")
+
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	if b.publishers < 1 || b.rate <= 0 || b.conns < 0 || b.concurrency < 1 {
+		fmt.Fprintln(os.Stderr, "bench needs at least one publisher, a positive rate and connect concurrency")
+
+		return 2
+	}
+
+	if err := b.run(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+
+		return 1
+	}
+
+	return 0
+}
+
+func (b *benchRunner) run() error {
+	fmt.Fprintf(b.out, "connecting %d subscribers to %s\n", b.conns, b.url)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var (
+		wg      sync.WaitGroup
+		readers sync.WaitGroup
+		subs    []net.Conn
+		mu      sync.Mutex
+		slots   = make(chan struct{}, b.concurrency)
+	)
+
+	started := time.Now()
+
+	for i := 0; i < b.conns; i++ {
+		wg.Add(1)
+		slots <- struct{}{}
+
+		go func() {
+			defer wg.Done()
+			defer func() { <-slots }()
+
+			conn, rw, err := b.subscribe(ctx)
+			if err != nil {
+				atomic.AddUint64(&b.atomicErrors, 1)
+
+				return
+			}
+
+			mu.Lock()
+			subs = append(subs, conn)
+			mu.Unlock()
+
+			readers.Add(1)
+
+			go func() {
+				defer readers.Done()
+				b.receive(rw)
+			}()
+		}()
+	}
+
+	wg.Wait()
+
+	subscribed := atomic.LoadUint64(&b.atomicSubscribed)
+	fmt.Fprintf(b.out, "connected %d/%d in %v, connect %s\n",
+		subscribed, b.conns, time.Since(started).Round(time.Millisecond), b.connect.summary())
+
+	fmt.Fprintf(b.out, "publishing %.0f msg/s for %v\n", b.rate, b.duration)
+
+	publishCtx, stop := context.WithTimeout(ctx, b.duration)
+	defer stop()
+
+	for i := 0; i < b.publishers; i++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			if err := b.publish(publishCtx, b.rate/float64(b.publishers)); err != nil {
+				atomic.AddUint64(&b.atomicErrors, 1)
+			}
+		}()
+	}
+
+	wg.Wait()
+	time.Sleep(b.grace)
+
+	for _, conn := range subs {
+		conn.Close()
+	}
+
+	readers.Wait()
+
+	b.report(subscribed)
+
+	return nil
+}
+
+// subscribe connects and joins the room, waiting for the ack so every
+// subscriber counts as in before publishing starts.
+func (b *benchRunner) subscribe(ctx context.Context) (net.Conn, io.ReadWriter, error) {
+	started := time.Now()
+
+	conn, rw, err := benchDial(ctx, b.url)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	b.connect.record(time.Since(started))
+
+	frame, err := json.Marshal(controlFrame{Type: frameSubscribe, ID: "bench", Room: b.room})
+	if err != nil {
+		conn.Close()
+
+		return nil, nil, fmt.Errorf("encoding subscribe frame: %w", err)
+	}
+
+	if err := writeClientFrame(rw, frame); err != nil {
+		conn.Close()
+
+		return nil, nil, err
+	}
+
+	if err := conn.SetReadDeadline(time.Now().Add(10 * time.Second)); err != nil {
+		conn.Close()
+
+		return nil, nil, err
+	}
+
+	for {
+		msg, _, err := wsutil.ReadServerData(rw)
+		if err != nil {
+			conn.Close()
+
+			return nil, nil, fmt.Errorf("waiting for subscribe ack: %w", err)
+		}
+
+		var reply controlFrame
+		if json.Unmarshal(msg, &reply) != nil || reply.ID != "bench" {
+			continue
+		}
+
+		if reply.Type == frameError {
+			conn.Close()
+
+			return nil, nil, fmt.Errorf("subscribing: %s", reply.Error)
+		}
+
+		break
+	}
+
+	if err := conn.SetReadDeadline(time.Time{}); err != nil {
+		conn.Close()
+
+		return nil, nil, err
+	}
+
+	atomic.AddUint64(&b.atomicSubscribed, 1)
+
+	return conn, rw, nil
+}
+
+func (b *benchRunner) receive(rw io.ReadWriter) {
+	for {
+		msg, _, err := wsutil.ReadServerData(rw)
+		if err != nil {
+			return
+		}
+
+		var frame controlFrame
+		if json.Unmarshal(msg, &frame) != nil || frame.Type != frameMessage || frame.Room != b.room {
+			continue
+		}
+
+		var payload benchPayload
+		if json.Unmarshal(frame.Data, &payload) != nil || payload.SentAt == 0 {
+			continue
+		}
+
+		b.delivery.record(time.Since(time.Unix(0, payload.SentAt)))
+		atomic.AddUint64(&b.atomicReceived, 1)
+	}
+}
+
+func (b *benchRunner) publish(ctx context.Context, rate float64) error {
+	conn, rw, err := benchDial(ctx, b.url)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	go func() { _, _ = io.Copy(io.Discard, rw) }()
+
+	pad := strings.Repeat("x", b.size)
+	ticker := time.NewTicker(time.Duration(float64(time.Second) / rate))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+
+		data, err := json.Marshal(benchPayload{SentAt: time.Now().UnixNano(), Pad: pad})
+		if err != nil {
+			return fmt.Errorf("encoding bench payload: %w", err)
+		}
+
+		frame, err := json.Marshal(controlFrame{Type: framePublish, Room: b.room, Data: data})
+		if err != nil {
+			return fmt.Errorf("encoding publish frame: %w", err)
+		}
+
+		if err := writeClientFrame(rw, frame); err != nil {
+			return err
+		}
+
+		atomic.AddUint64(&b.atomicSent, 1)
+	}
+}
+
+func (b *benchRunner) report(subscribed uint64) {
+	sent := atomic.LoadUint64(&b.atomicSent)
+	received := atomic.LoadUint64(&b.atomicReceived)
+	expected := sent * subscribed
+
+	var dropped uint64
+	if expected > received {
+		dropped = expected - received
+	}
+
+	fmt.Fprintf(b.out, "sent %d, delivered %d of %d, dropped %d, errors %d\n",
+		sent, received, expected, dropped, atomic.LoadUint64(&b.atomicErrors))
+	fmt.Fprintf(b.out, "delivery %s\n", b.delivery.summary())
+}
+
+func benchDial(ctx context.Context, url string) (net.Conn, io.ReadWriter, error) {
+	dialCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	conn, br, _, err := ws.Dial(dialCtx, url)
+	if err != nil {
+		if errors.Is(err, context.DeadlineExceeded) {
+			return nil, nil, fmt.Errorf("dialing %s: timed out", url)
+		}
+
+		return nil, nil, fmt.Errorf("dialing %s: %w", url, err)
+	}
+
+	var r io.Reader = conn
+	if br != nil {
+		r = br
+	}
+
+	return conn, struct {
+		io.Reader
+		io.Writer
+	}{r, conn}, nil
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+	"sync/atomic"
+)
+
+// bufferClasses are the capacities pooled buffers come in. Anything larger
+// is allocated and left to the collector, so one huge message cannot pin
+// memory in a pool.
+var bufferClasses = [...]int{256, 1 << 10, 4 << 10, 16 << 10, 64 << 10}
+
+// bufferPool recycles byte slices per size class to take per-message
+// allocations off the hot paths. A hit is a get served from the pool.
+type bufferPool struct {
+	classes [len(bufferClasses)]sync.Pool
+
+	atomicHits   uint64
+	atomicMisses uint64
+}
+
+var (
+	// framePool holds inbound frame payloads, released once the message
+	// they carry has been handled.
+	framePool = &bufferPool{}
+	// wirePool holds compiled broadcast frames, released once every
+	// write queued with them is done.
+	wirePool = &bufferPool{}
+)
+
+func bufferClass(n int) int {
+	for i, size := range bufferClasses {
+		if n <= size {
+			return i
+		}
+	}
+
+	return -1
+}
+
+// get returns a slice of length n.
+func (p *bufferPool) get(n int) []byte {
+	class := bufferClass(n)
+	if class < 0 {
+		atomic.AddUint64(&p.atomicMisses, 1)
+
+		return make([]byte, n)
+	}
+
+	if buf, ok := p.classes[class].Get().(*[]byte); ok {
+		atomic.AddUint64(&p.atomicHits, 1)
+
+		return (*buf)[:n]
+	}
+
+	atomic.AddUint64(&p.atomicMisses, 1)
+
+	return make([]byte, n, bufferClasses[class])
+}
+
+// put returns buf to the pool. Nothing may use it afterwards. Slices that
+// did not come from get are only kept if their capacity is a class size.
+func (p *bufferPool) put(buf []byte) {
+	class := bufferClass(cap(buf))
+	if class < 0 || cap(buf) != bufferClasses[class] {
+		return
+	}
+
+	buf = buf[:0]
+	p.classes[class].Put(&buf)
+}
+
+type bufferPoolStats struct {
+	Hits   uint64 `json:"hits"`
+	Misses uint64 `json:"misses"`
+}
+
+func (p *bufferPool) stats() bufferPoolStats {
+	return bufferPoolStats{Hits: atomic.LoadUint64(&p.atomicHits), Misses: atomic.LoadUint64(&p.atomicMisses)}
+}
+
+func (a *adminServer) handlePools(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]bufferPoolStats{
+		"frames": framePool.stats(),
+		"wire":   wirePool.stats(),
+	})
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/panjf2000/gnet/v2"
+)
+
+// capabilities is what client SDKs and tooling read to auto-configure
+// themselves. Features that are not implemented are reported as false rather
+// than omitted so clients never have to guess.
+type capabilities struct {
+	Rooms             bool             `json:"rooms"`
+	RawBroadcast      bool             `json:"raw_broadcast"`
+	Mode              hubMode          `json:"mode"`
+	Encodings         []string         `json:"encodings"`
+	PauseResume       bool             `json:"pause_resume"`
+	ConfidentialRooms []string         `json:"confidential_rooms"`
+	RetainedRooms     []string         `json:"retained_rooms"`
+	StateRooms        []string         `json:"state_rooms"`
+	QoS               bool             `json:"qos"`
+	Presence          bool             `json:"presence"`
+	Heartbeats        bool             `json:"heartbeats"`
+	Requests          bool             `json:"requests"`
+	Scheduling        bool             `json:"scheduling"`
+	Compression       bool             `json:"compression"`
+	HistoryDepth      int              `json:"history_depth"`
+	CloseReasons      []closeReason    `json:"close_reasons"`
+	Limits            capabilityLimits `json:"limits"`
+}
+
+type capabilityLimits struct {
+	PauseBuffer int `json:"pause_buffer"`
+	// HeartbeatAway and HeartbeatOffline are how long, in milliseconds,
+	// heartbeats may stop before a client is away and offline.
+	HeartbeatAway    int64 `json:"heartbeat_away_ms"`
+	HeartbeatOffline int64 `json:"heartbeat_offline_ms"`
+	// RequestTimeout is the longest a request waits for its reply.
+	RequestTimeout int64 `json:"request_timeout_ms"`
+	// ScheduleMaxDelay is how far ahead a publish may be scheduled.
+	ScheduleMaxDelay int64 `json:"schedule_max_delay_ms"`
+}
+
+func (b *broadcastService) capabilities() capabilities {
+	confidential := b.confidentialRooms
+	if confidential == nil {
+		confidential = []string{}
+	}
+
+	retained := b.retainedRooms
+	if retained == nil {
+		retained = []string{}
+	}
+
+	state := b.stateRooms
+	if state == nil {
+		state = []string{}
+	}
+
+	limits := capabilityLimits{PauseBuffer: b.pauseBufferSize}
+	if b.lastSeen != nil {
+		limits.HeartbeatAway = b.lastSeen.away.Milliseconds()
+		limits.HeartbeatOffline = b.lastSeen.offline.Milliseconds()
+	}
+
+	if b.scheduler != nil {
+		limits.ScheduleMaxDelay = b.scheduler.maxDelay.Milliseconds()
+	}
+
+	if b.requests != nil {
+		limits.RequestTimeout = b.requests.timeout.Milliseconds()
+	}
+
+	return capabilities{
+		Rooms:             true,
+		RawBroadcast:      b.rawBroadcast,
+		Mode:              b.currentMode(),
+		QoS:               b.qos != nil,
+		Presence:          b.presence != nil,
+		Encodings:         encodingNames(),
+		PauseResume:       true,
+		ConfidentialRooms: confidential,
+		RetainedRooms:     retained,
+		StateRooms:        state,
+		HistoryDepth:      b.historyDepth,
+		CloseReasons:      closeReasons,
+		Heartbeats:        b.lastSeen != nil,
+		Requests:          b.requests != nil,
+		Scheduling:        b.scheduler != nil,
+		Limits:            limits,
+	}
+}
+
+func (b *broadcastService) handleCapabilities(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+
+		return
+	}
+
+	writeJSON(w, http.StatusOK, b.capabilities())
+}
+
+func writeCapabilities(conn gnet.Conn, caps capabilities) error {
+	data, err := json.Marshal(caps)
+	if err != nil {
+		return fmt.Errorf("encoding capabilities: %w", err)
+	}
+
+	return writeControlFrame(conn, controlFrame{Type: frameCapabilities, Data: data})
+}
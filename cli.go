@@ -0,0 +1,308 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/nubunto/gnet-websocket/controlpb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+)
+
+const usage = `usage: wsb <command> [flags]
+
+commands:
+  serve     run the server (the default when the first argument is a flag)
+  publish   publish one message to a room of a running server
+  admin     list or kick a running server's connections
+  bench     load test a running server
+
+Run wsb <command> -h for a command's flags.
+`
+
+// adminClient is how the publish and admin subcommands reach a running
+// server: its admin listener, or its gRPC control plane when -grpc-addr is
+// set. Both take the admin bearer token.
+type adminClient struct {
+	adminURL string
+	grpcAddr string
+	token    string
+	timeout  time.Duration
+}
+
+func (c *adminClient) register(fs *flag.FlagSet) {
+	fs.StringVar(&c.adminURL, "admin-url", "http://127.0.0.1:9002", "admin listener of the server")
+	fs.StringVar(&c.grpcAddr, "grpc-addr", "", "gRPC control plane of the server, e.g. 127.0.0.1:9003; used instead of -admin-url when set")
+	fs.StringVar(&c.token, "token", os.Getenv(envName("admin-token")), "admin bearer token, defaults to $"+envName("admin-token"))
+	fs.DurationVar(&c.timeout, "timeout", 10*time.Second, "how long to wait for the server")
+}
+
+// do sends an admin API request and returns the response body, or an error
+// carrying the server's message for anything but a 2xx.
+func (c *adminClient) do(ctx context.Context, method, path string, body []byte, header http.Header) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, method, strings.TrimSuffix(c.adminURL, "/")+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("building request: %w", err)
+	}
+
+	for name, values := range header {
+		req.Header[name] = values
+	}
+
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("calling admin API: %w", err)
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("reading response: %w", err)
+	}
+
+	if resp.StatusCode/100 != 2 {
+		return nil, fmt.Errorf("%s %s: %s: %s", method, path, resp.Status, strings.TrimSpace(string(data)))
+	}
+
+	return data, nil
+}
+
+// control dials the gRPC control plane. The context carries the token.
+func (c *adminClient) control(ctx context.Context) (controlpb.ControlClient, context.Context, func(), error) {
+	conn, err := grpc.Dial(c.grpcAddr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("dialing control plane: %w", err)
+	}
+
+	if c.token != "" {
+		ctx = metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer "+c.token)
+	}
+
+	return controlpb.NewControlClient(conn), ctx, func() { conn.Close() }, nil
+}
+
+// runPublish publishes -data, or standard input when it is not given, to
+// -room and prints what the server answered.
+func runPublish(args []string) int {
+	var (
+		c              adminClient
+		room, data     string
+		text           bool
+		idempotencyKey string
+	)
+
+	fs := flag.NewFlagSet("publish", flag.ContinueOnError)
+	c.register(fs)
+	fs.StringVar(&room, "room", "", "room to publish to")
+	fs.StringVar(&data, "data", "", "message to publish, valid JSON unless -text; read from standard input when empty")
+	fs.BoolVar(&text, "text", false, "publish the message as a JSON string")
+	fs.StringVar(&idempotencyKey, "idempotency-key", "", "key that makes retrying this publish harmless; admin API only")
+
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	if room == "" {
+		fmt.Fprintln(os.Stderr, "publish needs -room")
+
+		return 2
+	}
+
+	body := []byte(data)
+	if data == "" {
+		var err error
+		if body, err = io.ReadAll(os.Stdin); err != nil {
+			fmt.Fprintln(os.Stderr, "reading message:", err)
+
+			return 1
+		}
+	}
+
+	if text {
+		body, _ = json.Marshal(string(body))
+	} else if !json.Valid(body) {
+		fmt.Fprintln(os.Stderr, "message is not valid JSON; pass -text to publish it as a string")
+
+		return 2
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+	defer cancel()
+
+	if c.grpcAddr != "" {
+		client, ctx, closeConn, err := c.control(ctx)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+
+			return 1
+		}
+		defer closeConn()
+
+		if _, err := client.PublishToRoom(ctx, &controlpb.PublishToRoomRequest{Room: room, Data: body}); err != nil {
+			fmt.Fprintln(os.Stderr, "publishing:", err)
+
+			return 1
+		}
+
+		return 0
+	}
+
+	header := http.Header{"Content-Type": {"application/json"}}
+	if idempotencyKey != "" {
+		header.Set("Idempotency-Key", idempotencyKey)
+	}
+
+	resp, err := c.do(ctx, http.MethodPost, "/publish?room="+url.QueryEscape(room), body, header)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+
+		return 1
+	}
+
+	fmt.Println(strings.TrimSpace(string(resp)))
+
+	return 0
+}
+
+// runAdmin runs "connections", listing a server's connections, or
+// "kick <id>", closing one.
+func runAdmin(args []string) int {
+	var (
+		c      adminClient
+		reason string
+		asJSON bool
+	)
+
+	fs := flag.NewFlagSet("admin", flag.ContinueOnError)
+	c.register(fs)
+	fs.StringVar(&reason, "reason", "", "what a kicked connection is told")
+	fs.BoolVar(&asJSON, "json", false, "print connections as JSON")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: wsb admin [flags] connections | kick <id>")
+		fs.PrintDefaults()
+	}
+
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+	defer cancel()
+
+	var err error
+
+	switch fs.Arg(0) {
+	case "connections":
+		err = listConnections(ctx, &c, asJSON)
+	case "kick":
+		id, perr := strconv.ParseUint(fs.Arg(1), 10, 64)
+		if perr != nil {
+			fmt.Fprintln(os.Stderr, "kick needs a connection id")
+
+			return 2
+		}
+
+		err = kickConnection(ctx, &c, id, reason)
+	default:
+		fs.Usage()
+
+		return 2
+	}
+
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+
+		return 1
+	}
+
+	return 0
+}
+
+func listConnections(ctx context.Context, c *adminClient, asJSON bool) error {
+	var infos []connectionInfo
+
+	if c.grpcAddr != "" {
+		client, ctx, closeConn, err := c.control(ctx)
+		if err != nil {
+			return err
+		}
+		defer closeConn()
+
+		resp, err := client.ListConnections(ctx, &controlpb.ListConnectionsRequest{})
+		if err != nil {
+			return fmt.Errorf("listing connections: %w", err)
+		}
+
+		for _, conn := range resp.Connections {
+			connected := conn.ConnectedAt.AsTime()
+			infos = append(infos, connectionInfo{
+				ID:          conn.Id,
+				RemoteAddr:  conn.RemoteAddr,
+				Rooms:       conn.Rooms,
+				ConnectedAt: connected,
+				Uptime:      time.Since(connected).Round(time.Second).String(),
+			})
+		}
+	} else {
+		data, err := c.do(ctx, http.MethodGet, "/connections", nil, nil)
+		if err != nil {
+			return err
+		}
+
+		if err := json.Unmarshal(data, &infos); err != nil {
+			return fmt.Errorf("decoding connections: %w", err)
+		}
+	}
+
+	if asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+
+		return enc.Encode(infos)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tREMOTE\tUSER\tUPTIME\tROOMS")
+
+	for _, info := range infos {
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\n", info.ID, info.RemoteAddr, info.User, info.Uptime, strings.Join(info.Rooms, ","))
+	}
+
+	return w.Flush()
+}
+
+func kickConnection(ctx context.Context, c *adminClient, id uint64, reason string) error {
+	if c.grpcAddr == "" {
+		_, err := c.do(ctx, http.MethodDelete, "/connections/"+strconv.FormatUint(id, 10)+"?reason="+url.QueryEscape(reason), nil, nil)
+
+		return err
+	}
+
+	client, ctx, closeConn, err := c.control(ctx)
+	if err != nil {
+		return err
+	}
+	defer closeConn()
+
+	if _, err := client.Kick(ctx, &controlpb.KickRequest{Id: id, Reason: reason}); err != nil {
+		return fmt.Errorf("kicking connection %d: %w", id, err)
+	}
+
+	return nil
+}
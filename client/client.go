@@ -0,0 +1,648 @@
+// Package client speaks the wsb room protocol over the JSON envelope. It
+// keeps the connection up by itself: after a drop it redials with
+// exponential backoff and jitter, subscribes again and resumes every room
+// from the last sequence it delivered, so handlers see each message once
+// as long as the server's history reaches back that far. A server that
+// closes it for a reason reconnecting cannot fix, such as a ban, stops it.
+package client
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gobwas/ws"
+	"github.com/gobwas/ws/wsutil"
+)
+
+var (
+	// ErrClosed is returned by calls on a closed client.
+	ErrClosed = errors.New("client closed")
+	// ErrDisconnected is returned by requests whose answer was lost to a
+	// dropped connection. Publish retries on its own instead.
+	ErrDisconnected = errors.New("disconnected before the server answered")
+)
+
+const subprotocol = "wsb.v1.json"
+
+// Options configure a Client. The zero value is usable.
+type Options struct {
+	// ClientID names the client across reconnects, so the server redelivers
+	// QoS messages it has not acknowledged.
+	ClientID string
+	// Header is sent with every handshake, e.g. a session cookie.
+	Header http.Header
+
+	// MinBackoff and MaxBackoff bound the wait between reconnect attempts;
+	// they default to 250ms and 30s.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+
+	// OnGap is called when a room could not be resumed because the
+	// server's history no longer reaches back to the last message seen.
+	OnGap func(room string, err error)
+	// OnStateChange is called with true once connected and false once the
+	// connection drops.
+	OnStateChange func(connected bool)
+	// OnClose is called when the server closes the connection, before
+	// reconnecting. The client gives up instead, as if closed, when the
+	// error is not retryable.
+	OnClose func(err *CloseError)
+}
+
+// Message is a room message.
+type Message struct {
+	Room  string
+	Seq   uint64
+	Data  json.RawMessage
+	MsgID string
+	// Retained is set on the room's retained message, delivered on
+	// subscribing rather than as it was published.
+	Retained bool
+	// Delta is set on messages of state rooms that are a JSON merge patch
+	// to the room's document rather than the whole of it.
+	Delta bool
+}
+
+// Handler is called with each message of a subscribed room, in order, from
+// the client's read loop. It should not block for long.
+type Handler func(Message)
+
+// ServerError is an error frame the server answered a request with.
+type ServerError struct {
+	Reason string
+}
+
+func (e *ServerError) Error() string { return e.Reason }
+
+// CloseError is how the server closed the connection. Reason is the
+// machine-readable reason leading its close frame, such as "banned", and
+// Detail whatever followed it.
+type CloseError struct {
+	Code   int
+	Reason string
+	Detail string
+}
+
+func (e *CloseError) Error() string {
+	if e.Detail == "" {
+		return fmt.Sprintf("closed by server: %s (%d)", e.Reason, e.Code)
+	}
+
+	return fmt.Sprintf("closed by server: %s: %s (%d)", e.Reason, e.Detail, e.Code)
+}
+
+// finalCloseReasons are the reasons reconnecting cannot fix.
+var finalCloseReasons = map[string]bool{
+	"kicked":          true,
+	"banned":          true,
+	"rejected":        true,
+	"message_too_big": true,
+	"invalid_utf8":    true,
+	"protocol_error":  true,
+}
+
+// Retryable reports whether reconnecting may succeed. Reasons the server
+// does not list as final, including ones it added after this client, are.
+func (e *CloseError) Retryable() bool { return !finalCloseReasons[e.Reason] }
+
+// ReconnectAfter is how long the server asked the client to wait before
+// reconnecting, when it moved the client away to rebalance load.
+func (e *CloseError) ReconnectAfter() time.Duration {
+	if e.Reason != "rebalance" {
+		return 0
+	}
+
+	d, err := time.ParseDuration(e.Detail)
+	if err != nil || d < 0 {
+		return 0
+	}
+
+	return d
+}
+
+func closeErrorOf(err error) *CloseError {
+	var closed wsutil.ClosedError
+	if !errors.As(err, &closed) {
+		return nil
+	}
+
+	reason, detail, _ := strings.Cut(closed.Reason, ": ")
+
+	return &CloseError{Code: int(closed.Code), Reason: reason, Detail: detail}
+}
+
+type frame struct {
+	Type           string          `json:"type"`
+	ID             string          `json:"id,omitempty"`
+	Room           string          `json:"room,omitempty"`
+	FromSeq        *uint64         `json:"from_seq,omitempty"`
+	Seq            uint64          `json:"seq,omitempty"`
+	Data           json.RawMessage `json:"data,omitempty"`
+	Error          string          `json:"error,omitempty"`
+	QoS            int             `json:"qos,omitempty"`
+	MsgID          string          `json:"msg_id,omitempty"`
+	Status         string          `json:"status,omitempty"`
+	IdempotencyKey string          `json:"idempotency_key,omitempty"`
+	Retained       bool            `json:"retained,omitempty"`
+	Delta          bool            `json:"delta,omitempty"`
+}
+
+type subscription struct {
+	handler Handler
+	// last is the sequence of the last message handed to handler.
+	last uint64
+}
+
+// Client is a connection to a wsb server that survives drops. Its methods
+// are safe for concurrent use.
+type Client struct {
+	url  string
+	opts Options
+
+	mu      sync.Mutex
+	conn    net.Conn
+	up      chan struct{}
+	closed  bool
+	subs    map[string]*subscription
+	pending map[string]chan frame
+	nextID  uint64
+
+	writeMu sync.Mutex
+	done    chan struct{}
+}
+
+// Connect dials rawURL, e.g. ws://host:9000/, and keeps the connection up
+// until Close. Only the first dial is bounded by ctx; it fails if the
+// server cannot be reached at all.
+func Connect(ctx context.Context, rawURL string, opts Options) (*Client, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("parsing url: %w", err)
+	}
+
+	if opts.ClientID != "" {
+		q := u.Query()
+		q.Set("client_id", opts.ClientID)
+		u.RawQuery = q.Encode()
+	}
+
+	if opts.MinBackoff <= 0 {
+		opts.MinBackoff = 250 * time.Millisecond
+	}
+
+	if opts.MaxBackoff <= 0 {
+		opts.MaxBackoff = 30 * time.Second
+	}
+
+	c := &Client{
+		url:     u.String(),
+		opts:    opts,
+		up:      make(chan struct{}),
+		subs:    make(map[string]*subscription),
+		pending: make(map[string]chan frame),
+		done:    make(chan struct{}),
+	}
+
+	conn, err := c.dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	c.connected(conn)
+
+	go c.run(conn)
+
+	return c, nil
+}
+
+// Close closes the connection and stops reconnecting.
+func (c *Client) Close() error {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+
+		return nil
+	}
+
+	c.closed = true
+	conn := c.conn
+	close(c.done)
+	c.mu.Unlock()
+
+	if conn == nil {
+		return nil
+	}
+
+	_ = wsutil.WriteClientMessage(conn, ws.OpClose, ws.NewCloseFrameBody(ws.StatusNormalClosure, ""))
+
+	return conn.Close()
+}
+
+// Subscribe calls handler with every message published to room from now
+// on, across reconnects. Subscribing again replaces the handler.
+func (c *Client) Subscribe(ctx context.Context, room string, handler Handler) error {
+	c.mu.Lock()
+	if sub, ok := c.subs[room]; ok {
+		sub.handler = handler
+		c.mu.Unlock()
+
+		return nil
+	}
+	c.subs[room] = &subscription{handler: handler}
+	c.mu.Unlock()
+
+	_, err := c.request(ctx, frame{Type: "subscribe", Room: room})
+	if err != nil && !errors.Is(err, ErrDisconnected) {
+		c.mu.Lock()
+		delete(c.subs, room)
+		c.mu.Unlock()
+
+		return err
+	}
+
+	// A subscription lost to a drop is made again on reconnect.
+	return nil
+}
+
+// Unsubscribe stops delivering room.
+func (c *Client) Unsubscribe(ctx context.Context, room string) error {
+	c.mu.Lock()
+	delete(c.subs, room)
+	c.mu.Unlock()
+
+	_, err := c.request(ctx, frame{Type: "unsubscribe", Room: room})
+	if errors.Is(err, ErrDisconnected) {
+		return nil
+	}
+
+	return err
+}
+
+// Publish publishes data, marshaled as JSON, to room and returns its
+// sequence. A publish cut off by a drop is retried once reconnected under
+// the same idempotency key, so it is never broadcast twice. With qos the
+// server redelivers the message until every subscriber acknowledges it.
+func (c *Client) Publish(ctx context.Context, room string, data interface{}, qos bool) (uint64, error) {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return 0, fmt.Errorf("encoding data: %w", err)
+	}
+
+	req := frame{Type: "publish", Room: room, Data: payload, IdempotencyKey: strconv.FormatInt(rand.Int63(), 36)}
+	if qos {
+		req.QoS = 1
+	}
+
+	for {
+		ack, err := c.request(ctx, req)
+		if errors.Is(err, ErrDisconnected) {
+			continue
+		}
+
+		if err != nil {
+			return 0, err
+		}
+
+		return ack.Seq, nil
+	}
+}
+
+// request sends req with a fresh id once connected and waits for the
+// server's answer.
+func (c *Client) request(ctx context.Context, req frame) (frame, error) {
+	conn, err := c.connection(ctx)
+	if err != nil {
+		return frame{}, err
+	}
+
+	answer := make(chan frame, 1)
+
+	c.mu.Lock()
+	if c.conn != conn {
+		// Dropped since; the answer would never come.
+		c.mu.Unlock()
+
+		return frame{}, ErrDisconnected
+	}
+
+	c.nextID++
+	req.ID = strconv.FormatUint(c.nextID, 10)
+	c.pending[req.ID] = answer
+	c.mu.Unlock()
+
+	defer func() {
+		c.mu.Lock()
+		delete(c.pending, req.ID)
+		c.mu.Unlock()
+	}()
+
+	if err := c.write(conn, req); err != nil {
+		// Closing ends the read loop, which reconnects.
+		conn.Close()
+
+		return frame{}, ErrDisconnected
+	}
+
+	select {
+	case resp, ok := <-answer:
+		if !ok {
+			return frame{}, ErrDisconnected
+		}
+
+		if resp.Type == "error" {
+			return frame{}, &ServerError{Reason: resp.Error}
+		}
+
+		return resp, nil
+	case <-ctx.Done():
+		return frame{}, ctx.Err()
+	case <-c.done:
+		return frame{}, ErrClosed
+	}
+}
+
+// connection waits until the client is connected.
+func (c *Client) connection(ctx context.Context) (net.Conn, error) {
+	for {
+		c.mu.Lock()
+		conn, up, closed := c.conn, c.up, c.closed
+		c.mu.Unlock()
+
+		if closed {
+			return nil, ErrClosed
+		}
+
+		if conn != nil {
+			return conn, nil
+		}
+
+		select {
+		case <-up:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-c.done:
+			return nil, ErrClosed
+		}
+	}
+}
+
+func (c *Client) write(conn net.Conn, f frame) error {
+	data, err := json.Marshal(f)
+	if err != nil {
+		return err
+	}
+
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	return wsutil.WriteClientMessage(conn, ws.OpText, data)
+}
+
+func (c *Client) dial(ctx context.Context) (net.Conn, error) {
+	dialer := ws.Dialer{Protocols: []string{subprotocol}}
+	if len(c.opts.Header) > 0 {
+		dialer.Header = ws.HandshakeHeaderHTTP(c.opts.Header)
+	}
+
+	conn, br, _, err := dialer.Dial(ctx, c.url)
+	if err != nil {
+		return nil, fmt.Errorf("dialing %s: %w", c.url, err)
+	}
+
+	if br != nil {
+		// The server may have written right after the handshake.
+		return &bufferedConn{Conn: conn, r: br}, nil
+	}
+
+	return conn, nil
+}
+
+func (c *Client) connected(conn net.Conn) {
+	c.mu.Lock()
+	c.conn = conn
+	close(c.up)
+	c.mu.Unlock()
+
+	if c.opts.OnStateChange != nil {
+		c.opts.OnStateChange(true)
+	}
+}
+
+// disconnected fails the requests waiting on the dropped connection.
+func (c *Client) disconnected() {
+	c.mu.Lock()
+	c.conn.Close()
+	c.conn = nil
+	c.up = make(chan struct{})
+
+	for id, answer := range c.pending {
+		close(answer)
+		delete(c.pending, id)
+	}
+	c.mu.Unlock()
+
+	if c.opts.OnStateChange != nil {
+		c.opts.OnStateChange(false)
+	}
+}
+
+func (c *Client) run(conn net.Conn) {
+	for {
+		closeErr := c.read(conn)
+		c.disconnected()
+
+		var after time.Duration
+
+		if closeErr != nil {
+			after = closeErr.ReconnectAfter()
+
+			if c.opts.OnClose != nil {
+				c.opts.OnClose(closeErr)
+			}
+
+			if !closeErr.Retryable() {
+				c.giveUp()
+
+				return
+			}
+		}
+
+		if conn = c.reconnect(after); conn == nil {
+			return
+		}
+
+		go c.resubscribe()
+	}
+}
+
+// giveUp stops the client after a close reconnecting cannot fix.
+func (c *Client) giveUp() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.closed {
+		c.closed = true
+		close(c.done)
+	}
+}
+
+// reconnect redials until it succeeds or the client is closed, waiting a
+// random time up to an exponentially growing bound between attempts. The
+// first attempt waits after instead, if the server asked for it.
+func (c *Client) reconnect(after time.Duration) net.Conn {
+	bound := c.opts.MinBackoff
+
+	for {
+		wait := time.Duration(rand.Int63n(int64(bound)) + 1)
+		if after > 0 {
+			wait, after = after, 0
+		}
+
+		select {
+		case <-time.After(wait):
+		case <-c.done:
+			return nil
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), c.opts.MaxBackoff)
+		conn, err := c.dial(ctx)
+		cancel()
+
+		if err == nil {
+			c.mu.Lock()
+			closed := c.closed
+			c.mu.Unlock()
+
+			if closed {
+				conn.Close()
+
+				return nil
+			}
+
+			c.connected(conn)
+
+			return conn
+		}
+
+		if bound *= 2; bound > c.opts.MaxBackoff {
+			bound = c.opts.MaxBackoff
+		}
+	}
+}
+
+// resubscribe joins every room again and replays what was missed.
+func (c *Client) resubscribe() {
+	c.mu.Lock()
+	rooms := make(map[string]uint64, len(c.subs))
+	for room, sub := range c.subs {
+		rooms[room] = sub.last
+	}
+	c.mu.Unlock()
+
+	ctx := context.Background()
+
+	for room, last := range rooms {
+		if _, err := c.request(ctx, frame{Type: "subscribe", Room: room}); err != nil {
+			continue
+		}
+
+		if last == 0 {
+			continue
+		}
+
+		from := last + 1
+		if _, err := c.request(ctx, frame{Type: "resume", Room: room, FromSeq: &from}); err != nil {
+			var serverErr *ServerError
+			if errors.As(err, &serverErr) && c.opts.OnGap != nil {
+				c.opts.OnGap(room, err)
+			}
+		}
+	}
+}
+
+// read handles frames until the connection drops, returning how the
+// server closed it if it did.
+func (c *Client) read(conn net.Conn) *CloseError {
+	for {
+		data, op, err := wsutil.ReadServerData(conn)
+		if err != nil {
+			return closeErrorOf(err)
+		}
+
+		if op != ws.OpText {
+			continue
+		}
+
+		var f frame
+		if err := json.Unmarshal(data, &f); err != nil {
+			continue
+		}
+
+		c.handle(conn, f)
+	}
+}
+
+func (c *Client) handle(conn net.Conn, f frame) {
+	if f.Type == "message" {
+		c.deliver(conn, f)
+
+		return
+	}
+
+	if f.ID == "" {
+		return
+	}
+
+	c.mu.Lock()
+	answer, ok := c.pending[f.ID]
+	c.mu.Unlock()
+
+	// Errors are answers too; frames such as delivery reports reuse the
+	// request id and are not waited for.
+	if ok && (f.Type == "ack" || f.Type == "error" || f.Type == "pong") {
+		select {
+		case answer <- f:
+		default:
+		}
+	}
+}
+
+// deliver hands a message to its room's handler unless it has been seen,
+// and acknowledges QoS messages once handled.
+func (c *Client) deliver(conn net.Conn, f frame) {
+	c.mu.Lock()
+	sub, ok := c.subs[f.Room]
+	fresh := ok && f.Seq > sub.last
+	if fresh {
+		sub.last = f.Seq
+	}
+	c.mu.Unlock()
+
+	if fresh {
+		sub.handler(Message{Room: f.Room, Seq: f.Seq, Data: f.Data, MsgID: f.MsgID, Retained: f.Retained, Delta: f.Delta})
+	}
+
+	if f.QoS > 0 {
+		_ = c.write(conn, frame{Type: "ack", Room: f.Room, Seq: f.Seq})
+	}
+}
+
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
@@ -0,0 +1,196 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gobwas/ws"
+	"github.com/gobwas/ws/wsutil"
+)
+
+// fakeServer acks every request and hands each connection to the test.
+type fakeServer struct {
+	conns  chan net.Conn
+	frames chan frame
+}
+
+func newFakeServer(t *testing.T) (*fakeServer, string) {
+	s := &fakeServer{conns: make(chan net.Conn, 4), frames: make(chan frame, 64)}
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, _, _, err := ws.UpgradeHTTP(r, w)
+		if err != nil {
+			return
+		}
+
+		s.conns <- conn
+
+		for {
+			data, _, err := wsutil.ReadClientData(conn)
+			if err != nil {
+				return
+			}
+
+			var f frame
+			if err := json.Unmarshal(data, &f); err != nil {
+				continue
+			}
+
+			s.frames <- f
+
+			if f.ID != "" {
+				ack, _ := json.Marshal(frame{Type: "ack", ID: f.ID, Room: f.Room, Seq: 7})
+				_ = wsutil.WriteServerMessage(conn, ws.OpText, ack)
+			}
+		}
+	}))
+	t.Cleanup(srv.Close)
+
+	return s, "ws" + strings.TrimPrefix(srv.URL, "http")
+}
+
+func (s *fakeServer) next(t *testing.T, typ string) frame {
+	t.Helper()
+
+	for {
+		select {
+		case f := <-s.frames:
+			if f.Type == typ {
+				return f
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("no %s frame", typ)
+		}
+	}
+}
+
+func send(t *testing.T, conn net.Conn, f frame) {
+	t.Helper()
+
+	data, _ := json.Marshal(f)
+	if err := wsutil.WriteServerMessage(conn, ws.OpText, data); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReconnectResumes(t *testing.T) {
+	srv, url := newFakeServer(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	c, err := Connect(ctx, url, Options{MinBackoff: time.Millisecond, MaxBackoff: 10 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	got := make(chan Message, 8)
+	if err := c.Subscribe(ctx, "lobby", func(m Message) { got <- m }); err != nil {
+		t.Fatal(err)
+	}
+
+	conn := <-srv.conns
+	srv.next(t, "subscribe")
+
+	send(t, conn, frame{Type: "message", Room: "lobby", Seq: 3, Data: json.RawMessage(`"hi"`)})
+	// Redeliveries must not reach the handler twice.
+	send(t, conn, frame{Type: "message", Room: "lobby", Seq: 3, Data: json.RawMessage(`"hi"`)})
+	if m := <-got; m.Seq != 3 || string(m.Data) != `"hi"` {
+		t.Fatalf("got %+v", m)
+	}
+
+	conn.Close()
+
+	<-srv.conns
+	srv.next(t, "subscribe")
+
+	resume := srv.next(t, "resume")
+	if resume.Room != "lobby" || resume.FromSeq == nil || *resume.FromSeq != 4 {
+		t.Fatalf("resume = %+v", resume)
+	}
+
+	seq, err := c.Publish(ctx, "lobby", "there", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if seq != 7 {
+		t.Fatalf("seq = %d", seq)
+	}
+
+	select {
+	case m := <-got:
+		t.Fatalf("unexpected message %+v", m)
+	default:
+	}
+}
+
+func TestFinalCloseStopsReconnecting(t *testing.T) {
+	srv, url := newFakeServer(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	closed := make(chan *CloseError, 1)
+
+	c, err := Connect(ctx, url, Options{
+		MinBackoff: time.Millisecond,
+		MaxBackoff: 10 * time.Millisecond,
+		OnClose:    func(err *CloseError) { closed <- err },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	conn := <-srv.conns
+	_ = wsutil.WriteServerMessage(conn, ws.OpClose, ws.NewCloseFrameBody(ws.StatusPolicyViolation, "banned: spam"))
+
+	if err := <-closed; err.Reason != "banned" || err.Detail != "spam" || err.Code != 1008 || err.Retryable() {
+		t.Fatalf("close error = %+v", err)
+	}
+
+	select {
+	case <-srv.conns:
+		t.Fatal("reconnected after a ban")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	if _, err := c.Publish(ctx, "lobby", "hi", false); !errors.Is(err, ErrClosed) {
+		t.Fatalf("publish after ban: %v", err)
+	}
+}
+
+func TestRebalanceWaitsBeforeReconnecting(t *testing.T) {
+	srv, url := newFakeServer(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	c, err := Connect(ctx, url, Options{MinBackoff: time.Millisecond, MaxBackoff: 10 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	conn := <-srv.conns
+	start := time.Now()
+	_ = wsutil.WriteServerMessage(conn, ws.OpClose, ws.NewCloseFrameBody(ws.StatusGoingAway, "rebalance: 300ms"))
+
+	select {
+	case <-srv.conns:
+		if waited := time.Since(start); waited < 300*time.Millisecond {
+			t.Fatalf("reconnected after %s", waited)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("did not reconnect")
+	}
+}
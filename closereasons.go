@@ -0,0 +1,93 @@
+package main
+
+import (
+	"unicode/utf8"
+
+	"github.com/gobwas/ws"
+	"github.com/panjf2000/gnet/v2"
+)
+
+// maxCloseReason is how much text fits in a close frame after its code.
+const maxCloseReason = 123
+
+// closeReason is why the server closed a connection. Every close frame it
+// sends has one, its name leading the frame's reason text and optionally
+// followed by ": " and detail for people, such as "banned: spam". Retry
+// tells clients whether reconnecting as they were may succeed; those it
+// does not should surface an error instead. Capabilities list them all.
+//
+//	reason           code  retry
+//	shutdown         1001  yes    the server is draining; reconnect elsewhere
+//	rebalance        1001  yes    an admin drain moved it; detail is how long
+//	                              to wait before reconnecting, e.g. "5s"
+//	idle_timeout     1001  yes    nothing was received for -idle-timeout
+//	too_slow         1008  yes    fell too far behind its buffer
+//	kicked           1008  no     an operator or admin closed it
+//	banned           1008  no     the address or user is banned
+//	rejected         1008  no     a connect middleware refused it, or it may
+//	                              not join the room its path names
+//	message_too_big  1009  no     a message exceeded -max-message-size
+//	invalid_utf8     1007  no     a text message was not UTF-8
+//	protocol_error   1002  no     the client broke RFC 6455
+//
+// Upgrades refused before the handshake completes, for capacity, rate or
+// credentials, are answered with an HTTP status instead.
+type closeReason struct {
+	Name  string        `json:"reason"`
+	Code  ws.StatusCode `json:"code"`
+	Retry bool          `json:"retry"`
+}
+
+var (
+	closeShutdown      = closeReason{Name: "shutdown", Code: ws.StatusGoingAway, Retry: true}
+	closeRebalance     = closeReason{Name: "rebalance", Code: ws.StatusGoingAway, Retry: true}
+	closeIdle          = closeReason{Name: "idle_timeout", Code: ws.StatusGoingAway, Retry: true}
+	closeTooSlow       = closeReason{Name: "too_slow", Code: ws.StatusPolicyViolation, Retry: true}
+	closeKicked        = closeReason{Name: "kicked", Code: ws.StatusPolicyViolation}
+	closeBanned        = closeReason{Name: "banned", Code: ws.StatusPolicyViolation}
+	closeRejected      = closeReason{Name: "rejected", Code: ws.StatusPolicyViolation}
+	closeMessageTooBig = closeReason{Name: "message_too_big", Code: ws.StatusMessageTooBig}
+	closeInvalidUTF8   = closeReason{Name: "invalid_utf8", Code: ws.StatusInvalidFramePayloadData}
+	closeProtocolError = closeReason{Name: "protocol_error", Code: ws.StatusProtocolError}
+)
+
+// closeReasons is every reason, as capabilities report them.
+var closeReasons = []closeReason{
+	closeShutdown, closeRebalance, closeIdle, closeTooSlow, closeKicked, closeBanned,
+	closeRejected, closeMessageTooBig, closeInvalidUTF8, closeProtocolError,
+}
+
+// text is the reason text of a close frame with detail, cut to fit.
+func (r closeReason) text(detail string) string {
+	text := r.Name
+	if detail != "" && detail != r.Name {
+		text += ": " + detail
+	}
+
+	if len(text) <= maxCloseReason {
+		return text
+	}
+
+	text = text[:maxCloseReason]
+	for !utf8.ValidString(text) {
+		text = text[:len(text)-1]
+	}
+
+	return text
+}
+
+func (r closeReason) body(detail string) []byte {
+	return ws.NewCloseFrameBody(r.Code, r.text(detail))
+}
+
+// writeClose sends c a close frame for reason without closing it.
+func writeClose(c gnet.Conn, reason closeReason, detail string) error {
+	return writeServerFrame(c, ws.OpClose, reason.body(detail))
+}
+
+// closeWith sends c a close frame for reason and closes it.
+func closeWith(c gnet.Conn, reason closeReason, detail string) error {
+	_ = writeClose(c, reason, detail)
+
+	return queueClose(c)
+}
@@ -0,0 +1,680 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/subtle"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Cluster links carry frames of a big-endian uint32 length, covering a
+// one-byte type and its payload. In payloads integers are uvarints, and
+// strings and byte slices a uvarint length followed by the bytes.
+//
+//   - hello, dialer to listener: node id, token
+//   - welcome, listener to dialer: last seq applied from that node id
+//   - batch, dialer to listener: first seq, count, then room and data of
+//     each message, seqs following on from the first
+//   - ack, listener to dialer: last seq applied
+const (
+	clusterHello byte = iota + 1
+	clusterWelcome
+	clusterBatch
+	clusterAck
+)
+
+const (
+	clusterMaxFrame     = 16 << 20
+	clusterMaxBatch     = 128
+	clusterDialTimeout  = 5 * time.Second
+	clusterWriteTimeout = 10 * time.Second
+	clusterMaxBackoff   = 10 * time.Second
+
+	// clusterBatchBytes is what the messages of a batch may take, leaving
+	// the frame type and the batch's first seq and count room in the frame.
+	clusterBatchBytes = clusterMaxFrame - 1 - 2*binary.MaxVarintLen64
+)
+
+var (
+	errClusterFrame     = errors.New("malformed cluster frame")
+	errClusterToken     = errors.New("cluster token mismatch")
+	errClusterOversized = errors.New("message is too large to replicate to cluster peers")
+)
+
+// clusterMesh replicates room publishes to the other nodes of a cluster,
+// so members of a room anywhere receive what is published to it on any
+// node. Every node dials each of its peers and sends over that link only;
+// what arrives on links it accepted is published locally as if by an admin,
+// with its own sequence numbers, and not sent on again.
+//
+// Each peer gets its own numbered queue of messages and a window of how
+// many may be unacknowledged, so a slow peer is sent no more than it keeps
+// up with and holds up nobody else. Messages are sent in batches of what
+// has queued up meanwhile. A queue outgrowing its buffer drops its oldest
+// messages. After a reconnect the peer says what it applied last and the
+// link resumes from there; only a restarted node, which gets a new id,
+// starts over.
+type clusterMesh struct {
+	nodeID string
+	token  string
+	window int
+	buffer int
+	bs     *broadcastService
+	logger *zap.Logger
+	peers  []*clusterPeer
+
+	mu      sync.Mutex
+	applied map[string]uint64
+	inbound map[string]string
+}
+
+type clusterMessage struct {
+	seq  uint64
+	room string
+	data json.RawMessage
+}
+
+// clusterPeer is the sending end of the link to one peer.
+type clusterPeer struct {
+	addr string
+	mesh *clusterMesh
+
+	mu   sync.Mutex
+	cond *sync.Cond
+	// queue holds the messages not acknowledged yet, oldest first, with
+	// consecutive seqs; seq is the last one queued, sent the last one
+	// written on the current link.
+	queue      []clusterMessage
+	seq        uint64
+	sent       uint64
+	acked      uint64
+	connected  bool
+	broken     bool
+	gen        uint64
+	dropped    uint64
+	reconnects uint64
+}
+
+type clusterPeerStatus struct {
+	Addr       string `json:"addr"`
+	Connected  bool   `json:"connected"`
+	Queued     int    `json:"queued"`
+	InFlight   uint64 `json:"in_flight"`
+	Acked      uint64 `json:"acked"`
+	Dropped    uint64 `json:"dropped"`
+	Reconnects uint64 `json:"reconnects"`
+}
+
+type clusterStatus struct {
+	NodeID  string              `json:"node_id"`
+	Peers   []clusterPeerStatus `json:"peers"`
+	Inbound map[string]string   `json:"inbound"`
+}
+
+// peerContextKey marks the context of publishes that came from a peer.
+type peerContextKey struct{}
+
+func fromPeer(ctx context.Context) bool {
+	return ctx.Value(peerContextKey{}) != nil
+}
+
+func newClusterMesh(peers []string, token string, window, buffer int, bs *broadcastService, logger *zap.Logger) *clusterMesh {
+	m := &clusterMesh{
+		nodeID:  newMessageID(),
+		token:   token,
+		window:  window,
+		buffer:  buffer,
+		bs:      bs,
+		logger:  logger,
+		applied: make(map[string]uint64),
+		inbound: make(map[string]string),
+	}
+
+	for _, addr := range peers {
+		p := &clusterPeer{addr: addr, mesh: m}
+		p.cond = sync.NewCond(&p.mu)
+		m.peers = append(m.peers, p)
+	}
+
+	return m
+}
+
+// clusterMessageSize is what a message takes in a batch.
+func clusterMessageSize(room string, data []byte) int {
+	return 2*binary.MaxVarintLen64 + len(room) + len(data)
+}
+
+// admit refuses a publish no batch could carry, as a peer would refuse the
+// frame and the link would resend it forever.
+func (m *clusterMesh) admit(room string, data json.RawMessage) error {
+	if m == nil || len(m.peers) == 0 || clusterMessageSize(room, data) <= clusterBatchBytes {
+		return nil
+	}
+
+	return errClusterOversized
+}
+
+// forward queues a publish for every peer, unless it came from one.
+func (m *clusterMesh) forward(ctx context.Context, room string, data json.RawMessage) {
+	if m == nil || fromPeer(ctx) {
+		return
+	}
+
+	for _, p := range m.peers {
+		p.enqueue(room, data)
+	}
+}
+
+func (p *clusterPeer) enqueue(room string, data json.RawMessage) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.seq++
+	p.queue = append(p.queue, clusterMessage{seq: p.seq, room: room, data: data})
+
+	if over := len(p.queue) - p.mesh.buffer; over > 0 {
+		p.queue = p.queue[over:]
+		p.dropped += uint64(over)
+	}
+
+	p.cond.Signal()
+}
+
+// ack forgets what the peer has applied. It must be called with p.mu held.
+func (p *clusterPeer) ack(seq uint64) {
+	if seq > p.acked {
+		p.acked = seq
+	}
+
+	i := 0
+	for i < len(p.queue) && p.queue[i].seq <= seq {
+		i++
+	}
+
+	p.queue = p.queue[i:]
+	p.cond.Broadcast()
+}
+
+func (p *clusterPeer) run() {
+	backoff := 100 * time.Millisecond
+
+	for {
+		linked, err := p.link()
+		if linked {
+			backoff = 100 * time.Millisecond
+		}
+
+		p.mesh.logger.Warn("cluster link lost", zap.String("peer", p.addr), zap.Error(err))
+
+		time.Sleep(backoff)
+
+		if backoff *= 2; backoff > clusterMaxBackoff {
+			backoff = clusterMaxBackoff
+		}
+	}
+}
+
+// link runs one connection to the peer until it fails. It reports whether
+// the handshake got through.
+func (p *clusterPeer) link() (bool, error) {
+	conn, err := net.DialTimeout("tcp", p.addr, clusterDialTimeout)
+	if err != nil {
+		return false, fmt.Errorf("dialing peer: %w", err)
+	}
+	defer conn.Close()
+
+	r, w := bufio.NewReader(conn), bufio.NewWriter(conn)
+
+	hello := appendClusterBytes(nil, []byte(p.mesh.nodeID))
+	hello = appendClusterBytes(hello, []byte(p.mesh.token))
+
+	_ = conn.SetDeadline(time.Now().Add(clusterDialTimeout))
+
+	if err := writeClusterFrame(w, clusterHello, hello); err != nil {
+		return false, fmt.Errorf("sending hello: %w", err)
+	}
+
+	typ, payload, err := readClusterFrame(r)
+	if err != nil {
+		return false, fmt.Errorf("reading welcome: %w", err)
+	}
+
+	welcome := clusterReader{b: payload}
+	last := welcome.uvarint()
+
+	if typ != clusterWelcome || welcome.err != nil {
+		return false, errClusterFrame
+	}
+
+	_ = conn.SetDeadline(time.Time{})
+
+	p.mu.Lock()
+	p.ack(last)
+	p.sent, p.connected, p.broken = last, true, false
+	p.gen++
+	p.reconnects++
+	gen := p.gen
+	p.mu.Unlock()
+
+	p.mesh.logger.Info("cluster link up", zap.String("peer", p.addr), zap.Uint64("resume_after", last))
+
+	go p.readAcks(r, gen)
+
+	err = p.send(conn, w)
+
+	p.mu.Lock()
+	p.connected, p.broken = false, true
+	p.mu.Unlock()
+
+	return true, err
+}
+
+// readAcks runs until the link of generation gen breaks, then tells send.
+func (p *clusterPeer) readAcks(r *bufio.Reader, gen uint64) {
+	var err error
+
+	for {
+		var (
+			typ     byte
+			payload []byte
+		)
+
+		if typ, payload, err = readClusterFrame(r); err != nil {
+			break
+		}
+
+		ack := clusterReader{b: payload}
+		seq := ack.uvarint()
+
+		if typ != clusterAck || ack.err != nil {
+			err = errClusterFrame
+
+			break
+		}
+
+		p.mu.Lock()
+		p.ack(seq)
+		p.mu.Unlock()
+	}
+
+	p.mesh.logger.Debug("cluster link stopped reading", zap.String("peer", p.addr), zap.Error(err))
+
+	p.mu.Lock()
+	if p.gen == gen {
+		p.broken = true
+		p.cond.Broadcast()
+	}
+	p.mu.Unlock()
+}
+
+// send writes batches while the window has room, until the link breaks.
+func (p *clusterPeer) send(conn net.Conn, w *bufio.Writer) error {
+	for {
+		batch, ok := p.nextBatch()
+		if !ok {
+			return errors.New("peer went away")
+		}
+
+		_ = conn.SetWriteDeadline(time.Now().Add(clusterWriteTimeout))
+
+		if err := writeClusterFrame(w, clusterBatch, encodeClusterBatch(batch)); err != nil {
+			return fmt.Errorf("sending batch: %w", err)
+		}
+	}
+}
+
+func encodeClusterBatch(batch []clusterMessage) []byte {
+	payload := binary.AppendUvarint(nil, batch[0].seq)
+	payload = binary.AppendUvarint(payload, uint64(len(batch)))
+
+	for _, msg := range batch {
+		payload = appendClusterBytes(payload, []byte(msg.room))
+		payload = appendClusterBytes(payload, msg.data)
+	}
+
+	return payload
+}
+
+// nextBatch waits for messages the window lets through, as many as fit in
+// a frame; it reports false once the link is broken.
+func (p *clusterPeer) nextBatch() ([]clusterMessage, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for {
+		if p.broken {
+			return nil, false
+		}
+
+		if len(p.queue) > 0 && p.sent < p.queue[0].seq-1 {
+			// Dropped before they were sent.
+			p.sent = p.queue[0].seq - 1
+		}
+
+		inFlight := p.sent - p.acked
+		if p.sent < p.seq && inFlight < uint64(p.mesh.window) {
+			break
+		}
+
+		p.cond.Wait()
+	}
+
+	first := int(p.sent + 1 - p.queue[0].seq)
+	n := len(p.queue) - first
+
+	if room := p.mesh.window - int(p.sent-p.acked); n > room {
+		n = room
+	}
+
+	if n > clusterMaxBatch {
+		n = clusterMaxBatch
+	}
+
+	// admit saw to it that every message fits on its own.
+	size := 0
+	for i, msg := range p.queue[first : first+n] {
+		if size += clusterMessageSize(msg.room, msg.data); size > clusterBatchBytes && i > 0 {
+			n = i
+
+			break
+		}
+	}
+
+	batch := append([]clusterMessage(nil), p.queue[first:first+n]...)
+	p.sent += uint64(n)
+
+	return batch, true
+}
+
+func (p *clusterPeer) status() clusterPeerStatus {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return clusterPeerStatus{
+		Addr:       p.addr,
+		Connected:  p.connected,
+		Queued:     len(p.queue),
+		InFlight:   p.sent - p.acked,
+		Acked:      p.acked,
+		Dropped:    p.dropped,
+		Reconnects: p.reconnects,
+	}
+}
+
+func (m *clusterMesh) serve(ln net.Listener) {
+	m.logger.Info("cluster listener is listening", zap.Stringer("addr", ln.Addr()))
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			m.logger.Error("cluster listener exits", zap.Error(err))
+
+			return
+		}
+
+		go m.accept(conn)
+	}
+}
+
+// accept runs the receiving end of a peer's link.
+func (m *clusterMesh) accept(conn net.Conn) {
+	defer conn.Close()
+
+	r, w := bufio.NewReader(conn), bufio.NewWriter(conn)
+
+	_ = conn.SetDeadline(time.Now().Add(clusterDialTimeout))
+
+	typ, payload, err := readClusterFrame(r)
+
+	hello := clusterReader{b: payload}
+	node, token := string(hello.bytes()), hello.bytes()
+
+	switch {
+	case err != nil:
+	case typ != clusterHello || hello.err != nil:
+		err = errClusterFrame
+	case subtle.ConstantTimeCompare(token, []byte(m.token)) != 1:
+		err = errClusterToken
+	}
+
+	if err != nil {
+		m.logger.Warn("refusing cluster link", zap.Stringer("remote_addr", conn.RemoteAddr()), zap.Error(err))
+
+		return
+	}
+
+	m.mu.Lock()
+	last := m.applied[node]
+	m.inbound[node] = conn.RemoteAddr().String()
+	m.mu.Unlock()
+
+	defer func() {
+		m.mu.Lock()
+		delete(m.inbound, node)
+		m.mu.Unlock()
+	}()
+
+	if err := writeClusterFrame(w, clusterWelcome, binary.AppendUvarint(nil, last)); err != nil {
+		return
+	}
+
+	_ = conn.SetDeadline(time.Time{})
+
+	for {
+		typ, payload, err := readClusterFrame(r)
+		if err == nil && typ != clusterBatch {
+			err = errClusterFrame
+		}
+
+		if err == nil {
+			last, err = m.apply(node, last, payload)
+		}
+
+		if err == nil {
+			_ = conn.SetWriteDeadline(time.Now().Add(clusterWriteTimeout))
+			err = writeClusterFrame(w, clusterAck, binary.AppendUvarint(nil, last))
+		}
+
+		if err != nil {
+			if !errors.Is(err, io.EOF) {
+				m.logger.Warn("cluster link from peer failed", zap.String("node", node), zap.Error(err))
+			}
+
+			return
+		}
+	}
+}
+
+// apply publishes the messages of a batch from node that follow last, and
+// returns the new last.
+func (m *clusterMesh) apply(node string, last uint64, payload []byte) (uint64, error) {
+	batch := clusterReader{b: payload}
+	first, count := batch.uvarint(), batch.uvarint()
+
+	ctx := context.WithValue(context.Background(), peerContextKey{}, node)
+
+	for i := uint64(0); i < count; i++ {
+		room, data := string(batch.bytes()), batch.bytes()
+		if batch.err != nil {
+			return last, batch.err
+		}
+
+		seq := first + i
+		if seq <= last {
+			// Sent again after a reconnect.
+			continue
+		}
+
+		if err := m.bs.publish(ctx, room, data); err != nil {
+			m.logger.Debug("publishing replicated message", zap.String("node", node), zap.String("room", room), zap.Error(err))
+		}
+
+		last = seq
+	}
+
+	m.mu.Lock()
+	m.applied[node] = last
+	m.mu.Unlock()
+
+	return last, nil
+}
+
+// checkLinked is the cluster readiness check: a node that cannot reach
+// every peer would take publishes it cannot fan out to the whole cluster.
+func (m *clusterMesh) checkLinked() error {
+	if m == nil {
+		return nil
+	}
+
+	var down []string
+
+	for _, p := range m.peers {
+		p.mu.Lock()
+		if !p.connected {
+			down = append(down, p.addr)
+		}
+		p.mu.Unlock()
+	}
+
+	if len(down) > 0 {
+		sort.Strings(down)
+
+		return fmt.Errorf("no link to peers %s", strings.Join(down, ", "))
+	}
+
+	return nil
+}
+
+func (m *clusterMesh) status() clusterStatus {
+	status := clusterStatus{NodeID: m.nodeID, Peers: make([]clusterPeerStatus, 0, len(m.peers)), Inbound: make(map[string]string)}
+
+	for _, p := range m.peers {
+		status.Peers = append(status.Peers, p.status())
+	}
+
+	sort.Slice(status.Peers, func(i, j int) bool { return status.Peers[i].Addr < status.Peers[j].Addr })
+
+	m.mu.Lock()
+	for node, addr := range m.inbound {
+		status.Inbound[node] = addr
+	}
+	m.mu.Unlock()
+
+	return status
+}
+
+// handleCluster reports the cluster links on GET /cluster.
+func (a *adminServer) handleCluster(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+
+		return
+	}
+
+	if a.bs.cluster == nil {
+		http.Error(w, "cluster mode is disabled", http.StatusNotFound)
+
+		return
+	}
+
+	writeJSON(w, http.StatusOK, a.bs.cluster.status())
+}
+
+// writeClusterFrame writes and flushes one frame.
+func writeClusterFrame(w *bufio.Writer, typ byte, payload []byte) error {
+	var header [5]byte
+
+	binary.BigEndian.PutUint32(header[:4], uint32(len(payload)+1))
+	header[4] = typ
+
+	if _, err := w.Write(header[:]); err != nil {
+		return err
+	}
+
+	if _, err := w.Write(payload); err != nil {
+		return err
+	}
+
+	return w.Flush()
+}
+
+// readClusterFrame reads one frame into a buffer of its own, so what is
+// decoded from it may be kept.
+func readClusterFrame(r *bufio.Reader) (byte, []byte, error) {
+	var header [4]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return 0, nil, err
+	}
+
+	n := binary.BigEndian.Uint32(header[:])
+	if n == 0 || n > clusterMaxFrame {
+		return 0, nil, errClusterFrame
+	}
+
+	frame := make([]byte, n)
+	if _, err := io.ReadFull(r, frame); err != nil {
+		return 0, nil, err
+	}
+
+	return frame[0], frame[1:], nil
+}
+
+func appendClusterBytes(b, s []byte) []byte {
+	b = binary.AppendUvarint(b, uint64(len(s)))
+
+	return append(b, s...)
+}
+
+// clusterReader decodes a payload field by field; once one is malformed,
+// err is set and the rest read as zero.
+type clusterReader struct {
+	b   []byte
+	err error
+}
+
+func (r *clusterReader) uvarint() uint64 {
+	if r.err != nil {
+		return 0
+	}
+
+	v, n := binary.Uvarint(r.b)
+	if n <= 0 {
+		r.err = errClusterFrame
+
+		return 0
+	}
+
+	r.b = r.b[n:]
+
+	return v
+}
+
+func (r *clusterReader) bytes() []byte {
+	n := r.uvarint()
+	if r.err != nil {
+		return nil
+	}
+
+	if n > uint64(len(r.b)) {
+		r.err = errClusterFrame
+
+		return nil
+	}
+
+	v := r.b[:n:n]
+	r.b = r.b[n:]
+
+	return v
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"go.uber.org/zap"
+)
+
+func clusterFrame(t *testing.T, typ byte, payload []byte) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+
+	if err := writeClusterFrame(bufio.NewWriter(&buf), typ, payload); err != nil {
+		t.Fatal(err)
+	}
+
+	return buf.Bytes()
+}
+
+func clusterHeader(n uint32) []byte {
+	return binary.BigEndian.AppendUint32(nil, n)
+}
+
+func TestReadClusterFrame(t *testing.T) {
+	payload := appendClusterBytes(appendClusterBytes(nil, []byte("node")), []byte("token"))
+	frame := clusterFrame(t, clusterHello, payload)
+
+	cases := []struct {
+		name string
+		in   []byte
+		err  error
+	}{
+		{name: "frame", in: frame},
+		{name: "empty stream", in: nil, err: io.EOF},
+		{name: "truncated header", in: frame[:3], err: io.ErrUnexpectedEOF},
+		{name: "truncated body", in: frame[:len(frame)-1], err: io.ErrUnexpectedEOF},
+		{name: "header only", in: frame[:4], err: io.EOF},
+		{name: "zero length", in: clusterHeader(0), err: errClusterFrame},
+		// Refused from the header alone, before anything is allocated for it.
+		{name: "oversized", in: clusterHeader(clusterMaxFrame + 1), err: errClusterFrame},
+		{name: "largest length", in: clusterHeader(^uint32(0)), err: errClusterFrame},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			typ, got, err := readClusterFrame(bufio.NewReader(bytes.NewReader(tc.in)))
+
+			if tc.err != nil {
+				if !errors.Is(err, tc.err) {
+					t.Fatalf("err = %v, want %v", err, tc.err)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if typ != clusterHello || !bytes.Equal(got, payload) {
+				t.Fatalf("frame = %d %q, want %d %q", typ, got, clusterHello, payload)
+			}
+		})
+	}
+}
+
+func TestReadClusterFrameSequence(t *testing.T) {
+	stream := append(clusterFrame(t, clusterAck, binary.AppendUvarint(nil, 7)), clusterFrame(t, clusterAck, nil)...)
+	r := bufio.NewReader(bytes.NewReader(stream))
+
+	typ, payload, err := readClusterFrame(r)
+	if err != nil || typ != clusterAck {
+		t.Fatalf("first frame = %d, %v", typ, err)
+	}
+
+	if ack := (clusterReader{b: payload}); ack.uvarint() != 7 || ack.err != nil {
+		t.Fatalf("first ack = %x", payload)
+	}
+
+	// A frame may carry no payload beyond its type.
+	if typ, payload, err = readClusterFrame(r); err != nil || typ != clusterAck || len(payload) != 0 {
+		t.Fatalf("second frame = %d %x, %v", typ, payload, err)
+	}
+
+	if _, _, err := readClusterFrame(r); !errors.Is(err, io.EOF) {
+		t.Fatalf("after the last frame err = %v, want EOF", err)
+	}
+}
+
+func TestClusterReaderMalformed(t *testing.T) {
+	complete := appendClusterBytes(binary.AppendUvarint(nil, 3), []byte("lobby"))
+
+	cases := []struct {
+		name string
+		in   []byte
+	}{
+		{name: "empty", in: nil},
+		{name: "truncated uvarint", in: []byte{0x80}},
+		{name: "uvarint overflow", in: bytes.Repeat([]byte{0xff}, binary.MaxVarintLen64+1)},
+		{name: "no length", in: complete[:1]},
+		{name: "truncated bytes", in: complete[:len(complete)-1]},
+		{name: "oversized length", in: append(binary.AppendUvarint(binary.AppendUvarint(nil, 3), 1<<40), "lobby"...)},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			r := clusterReader{b: tc.in}
+			r.uvarint()
+			room := r.bytes()
+
+			if !errors.Is(r.err, errClusterFrame) {
+				t.Fatalf("err = %v, want %v", r.err, errClusterFrame)
+			}
+
+			if room != nil {
+				t.Fatalf("bytes = %q after a malformed field, want nil", room)
+			}
+
+			// Once malformed, the rest reads as zero.
+			if v, b := r.uvarint(), r.bytes(); v != 0 || b != nil {
+				t.Fatalf("read %d %q after the error", v, b)
+			}
+		})
+	}
+
+	r := clusterReader{b: complete}
+	if seq, room := r.uvarint(), r.bytes(); r.err != nil || seq != 3 || string(room) != "lobby" {
+		t.Fatalf("complete payload = %d %q, %v", seq, room, r.err)
+	}
+}
+
+// TestClusterBatchFitsFrame queues more than a frame's worth of messages and
+// checks every batch sent is one the peer's reader accepts, in order.
+func TestClusterBatchFitsFrame(t *testing.T) {
+	const count, size = clusterMaxBatch, 150 << 10
+
+	mesh := newClusterMesh([]string{"peer"}, "token", count, count, nil, zap.NewNop())
+	p := mesh.peers[0]
+
+	data := json.RawMessage(bytes.Repeat([]byte("x"), size))
+	for i := 0; i < count; i++ {
+		if err := mesh.admit("lobby", data); err != nil {
+			t.Fatal(err)
+		}
+
+		p.enqueue("lobby", data)
+	}
+
+	var received uint64
+
+	for received < count {
+		batch, ok := p.nextBatch()
+		if !ok {
+			t.Fatal("link reported broken")
+		}
+
+		frame := clusterFrame(t, clusterBatch, encodeClusterBatch(batch))
+
+		_, payload, err := readClusterFrame(bufio.NewReader(bytes.NewReader(frame)))
+		if err != nil {
+			t.Fatalf("batch of %d messages, %d bytes: %v", len(batch), len(frame), err)
+		}
+
+		r := clusterReader{b: payload}
+		if first, n := r.uvarint(), r.uvarint(); first != received+1 || n != uint64(len(batch)) {
+			t.Fatalf("batch starts at %d with %d messages, want %d with %d", first, n, received+1, len(batch))
+		}
+
+		received += uint64(len(batch))
+	}
+
+	if received != count {
+		t.Fatalf("sent %d messages, want %d", received, count)
+	}
+}
+
+func TestClusterRefusesOversizedPublish(t *testing.T) {
+	hub := newReplicationHub(t)
+	hub.cluster = newClusterMesh([]string{"peer"}, "token", 8, 8, hub, zap.NewNop())
+
+	data := json.RawMessage(`"` + strings.Repeat("x", clusterMaxFrame) + `"`)
+
+	if err := hub.publish(context.Background(), "retained", data); !errors.Is(err, errClusterOversized) {
+		t.Fatalf("err = %v, want %v", err, errClusterOversized)
+	}
+
+	if queued := hub.cluster.peers[0].status().Queued; queued != 0 {
+		t.Fatalf("queued %d messages for the peer, want none", queued)
+	}
+
+	if _, ok := hub.retainedOf("retained"); ok {
+		t.Fatal("refused message was retained")
+	}
+}
+
+func TestClusterReadiness(t *testing.T) {
+	var none *clusterMesh
+	if err := none.checkLinked(); err != nil {
+		t.Fatalf("without a cluster: %v", err)
+	}
+
+	mesh := newClusterMesh([]string{"b:7000", "a:7000"}, "token", 8, 8, nil, zap.NewNop())
+
+	err := mesh.checkLinked()
+	if err == nil || !strings.Contains(err.Error(), "a:7000, b:7000") {
+		t.Fatalf("before any link: err = %v, want both peers named", err)
+	}
+
+	mesh.peers[0].connected = true
+	if err := mesh.checkLinked(); err == nil || strings.Contains(err.Error(), "b:7000") || !strings.Contains(err.Error(), "a:7000") {
+		t.Fatalf("with the link to b up: err = %v, want only a named", err)
+	}
+
+	mesh.peers[1].connected = true
+	if err := mesh.checkLinked(); err != nil {
+		t.Fatalf("with every link up: %v", err)
+	}
+}
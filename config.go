@@ -0,0 +1,167 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// envPrefix namespaces the environment variable for every flag: -admin-token
+// is read from WSB_ADMIN_TOKEN, -config from WSB_CONFIG.
+const envPrefix = "WSB_"
+
+// configSource resolves options with the precedence
+// flags > env > file > defaults. It remembers which flags were given on the
+// command line so the environment and the JSON config file, an object keyed
+// by flag name, can be consulted again on reload.
+type configSource struct {
+	fs       *flag.FlagSet
+	path     string
+	explicit map[string]bool
+}
+
+// configSetting is a resolved option value and where it came from, for
+// error messages.
+type configSetting struct {
+	value  string
+	origin string
+}
+
+// loadConfig fills in every flag that was not given on the command line,
+// first from its environment variable and then from the config file.
+func loadConfig(fs *flag.FlagSet, configPath string) (*configSource, error) {
+	c := &configSource{fs: fs, path: configPath, explicit: make(map[string]bool)}
+	fs.Visit(func(f *flag.Flag) { c.explicit[f.Name] = true })
+
+	if v, ok := os.LookupEnv(envName("config")); ok && !c.explicit["config"] {
+		c.path = v
+	}
+
+	settings, err := c.settings()
+	if err != nil {
+		return nil, err
+	}
+
+	for name, setting := range settings {
+		if err := fs.Set(name, setting.value); err != nil {
+			return nil, fmt.Errorf("%s: %w", setting.origin, err)
+		}
+	}
+
+	return c, nil
+}
+
+// settings reads the environment and config file afresh and returns a value
+// for every flag not given on the command line that either of them sets.
+func (c *configSource) settings() (map[string]configSetting, error) {
+	var file map[string]interface{}
+
+	if c.path != "" {
+		var err error
+		if file, err = readConfigFile(c.path); err != nil {
+			return nil, err
+		}
+
+		for name := range file {
+			if c.fs.Lookup(name) == nil {
+				return nil, fmt.Errorf("config file %s: unknown option %q", c.path, name)
+			}
+		}
+	}
+
+	settings := make(map[string]configSetting)
+
+	c.fs.VisitAll(func(f *flag.Flag) {
+		if c.explicit[f.Name] {
+			return
+		}
+
+		if v, ok := os.LookupEnv(envName(f.Name)); ok {
+			settings[f.Name] = configSetting{value: v, origin: envName(f.Name)}
+		} else if v, ok := file[f.Name]; ok {
+			settings[f.Name] = configSetting{value: configValue(v), origin: fmt.Sprintf("config file %s: %s", c.path, f.Name)}
+		}
+	})
+
+	return settings, nil
+}
+
+// lookup returns the value name should have given freshly read settings: the
+// command-line value if there was one, else the setting, else the default.
+func (c *configSource) lookup(settings map[string]configSetting, name string) string {
+	f := c.fs.Lookup(name)
+
+	if c.explicit[name] {
+		return f.Value.String()
+	}
+
+	if setting, ok := settings[name]; ok {
+		return setting.value
+	}
+
+	return f.DefValue
+}
+
+func readConfigFile(path string) (map[string]interface{}, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading config file: %w", err)
+	}
+
+	var file map[string]interface{}
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("parsing config file %s: %w", path, err)
+	}
+
+	return file, nil
+}
+
+// configValue renders a JSON value the way it would be written on the
+// command line. Arrays become comma-separated lists.
+func configValue(v interface{}) string {
+	switch v := v.(type) {
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case []interface{}:
+		items := make([]string, 0, len(v))
+		for _, item := range v {
+			items = append(items, configValue(item))
+		}
+
+		return strings.Join(items, ",")
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+func envName(flagName string) string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(flagName, "-", "_"))
+}
+
+// writeFileAtomic replaces file with data through a rename, so a crash never
+// leaves it half written.
+func writeFileAtomic(file string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(file), "."+filepath.Base(file)+"-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), file)
+}
@@ -0,0 +1,765 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gobwas/ws"
+	"github.com/nubunto/gnet-websocket/envelopepb"
+	"github.com/panjf2000/gnet/v2"
+	"github.com/vmihailenco/msgpack/v5"
+	"go.uber.org/zap"
+	"google.golang.org/protobuf/proto"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files under testdata/conformance, and the fan-out baseline with -fanout-check")
+
+// quietPeriod is how long the server has to stay silent after a step before
+// its response is considered complete.
+const quietPeriod = 150 * time.Millisecond
+
+const validHandshake = "GET / HTTP/1.1\r\n" +
+	"Host: localhost\r\n" +
+	"Upgrade: websocket\r\n" +
+	"Connection: Upgrade\r\n" +
+	"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n" +
+	"Sec-WebSocket-Version: 13\r\n\r\n"
+
+type conformanceServer struct {
+	addr string
+	// sseAddr serves the SSE transport over the same hub.
+	sseAddr string
+	wss     *wsServer
+	hub     *broadcastService
+	stop    func()
+}
+
+// Most cases run against a server in raw broadcast compatibility mode, whose
+// echo makes frame handling visible; strict cases use one without it.
+var conformanceRaw, conformanceStrict *conformanceServer
+
+// conformanceMaxMessageSize is the -max-message-size of the shared servers.
+const conformanceMaxMessageSize = 1024
+
+func TestMain(m *testing.M) {
+	flag.Parse()
+
+	limit := func(wss *wsServer) { wss.maxMessageSize = conformanceMaxMessageSize }
+
+	var err error
+	if conformanceRaw, err = startConformanceServer(true, limit); err == nil {
+		conformanceStrict, err = startConformanceServer(false, limit)
+	}
+
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	code := m.Run()
+
+	conformanceRaw.stop()
+	conformanceStrict.stop()
+	os.Exit(code)
+}
+
+// startConformanceServer runs a server on a free port. configure, if set,
+// adjusts it before it starts.
+func startConformanceServer(rawBroadcast bool, configure func(*wsServer), opts ...gnet.Option) (*conformanceServer, error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	hub := &broadcastService{
+		connections:     make(map[gnet.Conn]*trackedConnection),
+		rooms:           make(map[string]*room),
+		tagIndex:        make(map[string]map[gnet.Conn]struct{}),
+		rawBroadcast:    rawBroadcast,
+		historyDepth:    4,
+		pauseBufferSize: 4,
+		dedup:           newDedupCache(16),
+		presence:        newPresenceTracker(0, zap.NewNop()),
+		requests:        newRequestRouter(time.Second),
+	}
+
+	wss := &wsServer{
+		addrs:     []string{"tcp://" + addr},
+		bs:        hub,
+		acls:      &roomACLs{acls: []*roomACL{{Room: "private*", Visibility: roomPrivate, Subscribe: []string{"user:alice"}}}},
+		logger:    zap.NewNop(),
+		msgLogger: zap.NewNop(),
+	}
+
+	if configure != nil {
+		configure(wss)
+	}
+
+	sse := &sseTransport{
+		buffer:  4,
+		access:  wss.transportAccess(),
+		bs:      hub,
+		logger:  zap.NewNop(),
+		clients: make(map[string]map[*sseClient]struct{}),
+	}
+	sseServer := httptest.NewServer(http.HandlerFunc(sse.handle))
+
+	opts = append([]gnet.Option{gnet.WithLogger(zap.NewNop().Sugar())}, opts...)
+
+	go func() { _ = gnet.Run(wss, wss.addrs[0], opts...) }()
+
+	for i := 0; i < 100; i++ {
+		if conn, err := net.Dial("tcp", addr); err == nil {
+			conn.Close()
+
+			return &conformanceServer{
+				addr:    addr,
+				sseAddr: sseServer.Listener.Addr().String(),
+				wss:     wss,
+				hub:     hub,
+				stop: func() {
+					sseServer.Close()
+					_ = gnet.Stop(context.Background(), wss.addrs[0])
+				},
+			}, nil
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	return nil, errors.New("conformance server did not start")
+}
+
+type step struct {
+	desc string
+	data []byte
+}
+
+func clientFrame(desc string, f ws.Frame) step {
+	f = ws.MaskFrameInPlaceWith(f, [4]byte{0x1, 0x2, 0x3, 0x4})
+
+	data, err := ws.CompileFrame(f)
+	if err != nil {
+		panic(err)
+	}
+
+	return step{desc: desc, data: data}
+}
+
+func text(payload string) step {
+	return clientFrame("text "+payload, ws.NewTextFrame([]byte(payload)))
+}
+
+func protoEnvelope(desc string, env *envelopepb.Envelope) step {
+	payload, err := proto.Marshal(env)
+	if err != nil {
+		panic(err)
+	}
+
+	return clientFrame("proto "+desc, ws.NewBinaryFrame(payload))
+}
+
+func clientMsgpack(desc string, env map[string]interface{}) step {
+	enc := msgpack.GetEncoder()
+	defer msgpack.PutEncoder(enc)
+
+	var buf bytes.Buffer
+	enc.Reset(&buf)
+	enc.SetSortMapKeys(true)
+
+	if err := enc.Encode(env); err != nil {
+		panic(err)
+	}
+
+	return clientFrame("msgpack "+desc, ws.NewBinaryFrame(buf.Bytes()))
+}
+
+func raw(desc string, data ...byte) step {
+	return step{desc: desc, data: data}
+}
+
+var conformanceCases = []struct {
+	name      string
+	handshake string
+	steps     []step
+	strict    bool
+	mode      hubMode
+	// sse sends the handshake to the SSE transport instead.
+	sse bool
+}{
+	{name: "handshake_ok"},
+	{
+		name:      "handshake_missing_key",
+		handshake: strings.Replace(validHandshake, "Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n", "", 1),
+	},
+	{
+		name:      "handshake_bad_version",
+		handshake: strings.Replace(validHandshake, "Version: 13", "Version: 8", 1),
+	},
+	{
+		name:      "handshake_wrong_method",
+		handshake: strings.Replace(validHandshake, "GET", "POST", 1),
+	},
+	{
+		name:      "handshake_missing_upgrade",
+		handshake: strings.Replace(validHandshake, "Upgrade: websocket\r\n", "", 1),
+	},
+	{
+		name:      "handshake_unknown_path",
+		handshake: strings.Replace(validHandshake, "GET /", "GET /nowhere", 1),
+	},
+	{
+		name:      "handshake_room_path_without_name",
+		handshake: strings.Replace(validHandshake, "GET /", "GET /ws/room/", 1),
+	},
+	{
+		name:      "handshake_room_path",
+		handshake: strings.Replace(validHandshake, "GET /", "GET /ws/room/handshake%20room?token=x", 1),
+		steps: []step{
+			text(`{"type":"publish","room":"handshake room","data":"joined by path"}`),
+		},
+	},
+	{
+		name:      "handshake_room_path_private",
+		handshake: strings.Replace(validHandshake, "GET /", "GET /ws/room/private", 1),
+	},
+	{
+		name:      "sse_private_room",
+		handshake: "GET /events?room=lobby&room=private HTTP/1.1\r\nHost: localhost\r\n\r\n",
+		sse:       true,
+	},
+	{
+		name:      "handshake_proto_subprotocol",
+		handshake: strings.Replace(validHandshake, "\r\n\r\n", "\r\nSec-WebSocket-Protocol: mqtt, wsb.v1.proto\r\n\r\n", 1),
+		steps: []step{
+			protoEnvelope("subscribe proto id s1", &envelopepb.Envelope{Type: "subscribe", Room: "proto", Id: "s1"}),
+			protoEnvelope(`publish proto {"n":1}`, &envelopepb.Envelope{Type: "publish", Room: "proto", Data: []byte(`{"n":1}`)}),
+			text(`{"type":"ping"}`),
+		},
+		strict: true,
+	},
+	{
+		name:      "handshake_msgpack_subprotocol",
+		handshake: strings.Replace(validHandshake, "\r\n\r\n", "\r\nSec-WebSocket-Protocol: wsb.v1.msgpack\r\n\r\n", 1),
+		steps: []step{
+			clientMsgpack("subscribe mp", map[string]interface{}{"type": "subscribe", "room": "mp"}),
+			clientMsgpack(`publish mp {"n":1,"tags":["a"]}`, map[string]interface{}{
+				"type": "publish",
+				"room": "mp",
+				"data": map[string]interface{}{"n": 1, "tags": []string{"a"}},
+			}),
+		},
+		strict: true,
+	},
+	{
+		name:      "handshake_not_http",
+		handshake: "hello\r\n\r\n",
+	},
+	{
+		name:  "frame_raw_text_broadcast",
+		steps: []step{text("hello")},
+	},
+	{
+		name:  "frame_binary_broadcast",
+		steps: []step{clientFrame("binary 00ff", ws.NewBinaryFrame([]byte{0x00, 0xff}))},
+	},
+	{
+		name:  "frame_ping",
+		steps: []step{clientFrame("ping abc", ws.NewPingFrame([]byte("abc")))},
+	},
+	{
+		name:  "frame_close",
+		steps: []step{clientFrame("close 1000 bye", ws.NewCloseFrame(ws.NewCloseFrameBody(ws.StatusNormalClosure, "bye")))},
+	},
+	{
+		name:  "frame_unmasked",
+		steps: []step{raw("unmasked text hi", 0x81, 0x02, 'h', 'i')},
+	},
+	{
+		name:  "frame_reserved_bits",
+		steps: []step{raw("text with rsv1 set", 0xc1, 0x80, 0, 0, 0, 0)},
+	},
+	{
+		name: "frame_fragmented_text",
+		steps: []step{func() step {
+			first := clientFrame("", ws.NewFrame(ws.OpText, false, []byte("hel")))
+			second := clientFrame("", ws.NewFrame(ws.OpContinuation, true, []byte("lo")))
+
+			return step{desc: "text hel + continuation lo", data: append(first.data, second.data...)}
+		}()},
+	},
+	{
+		name:  "frame_invalid_utf8",
+		steps: []step{clientFrame("text ff", ws.NewTextFrame([]byte{'h', 0xff}))},
+	},
+	{
+		name: "frame_fragmented_rune",
+		steps: []step{func() step {
+			first := clientFrame("", ws.NewFrame(ws.OpText, false, []byte("caf\xc3")))
+			second := clientFrame("", ws.NewFrame(ws.OpContinuation, true, []byte("\xa9")))
+
+			return step{desc: "text caf c3 + continuation a9", data: append(first.data, second.data...)}
+		}()},
+	},
+	{
+		name:  "frame_fragment_invalid_utf8",
+		steps: []step{clientFrame("unfinished text ok ff", ws.NewFrame(ws.OpText, false, []byte("ok\xff")))},
+	},
+	{
+		name: "frame_split_across_writes",
+		steps: func() []step {
+			whole := text("hello").data
+
+			return []step{
+				{desc: "first 4 bytes of text hello", data: whole[:4]},
+				{desc: "rest of text hello", data: whole[4:]},
+			}
+		}(),
+	},
+	{
+		name: "frame_two_in_one_write",
+		steps: []step{func() step {
+			first, second := text("one"), text("two")
+
+			return step{desc: "text one + text two", data: append(first.data, second.data...)}
+		}()},
+	},
+	{
+		name:  "frame_control_too_long",
+		steps: []step{clientFrame("ping with 126 byte payload", ws.NewPingFrame(bytes.Repeat([]byte("x"), 126)))},
+	},
+	{
+		name:  "frame_reserved_opcode",
+		steps: []step{clientFrame("opcode 3", ws.NewFrame(ws.OpCode(3), true, []byte("x")))},
+	},
+	{
+		name:  "frame_fragmented_ping",
+		steps: []step{clientFrame("ping without fin", ws.NewFrame(ws.OpPing, false, nil))},
+	},
+	{
+		name:  "frame_continuation_unexpected",
+		steps: []step{clientFrame("continuation lo", ws.NewFrame(ws.OpContinuation, true, []byte("lo")))},
+	},
+	{
+		name: "frame_text_inside_fragments",
+		steps: []step{func() step {
+			first := clientFrame("", ws.NewFrame(ws.OpText, false, []byte("hel")))
+			second := clientFrame("", ws.NewTextFrame([]byte("lo")))
+
+			return step{desc: "text hel + text lo", data: append(first.data, second.data...)}
+		}()},
+	},
+	{
+		name: "frame_ping_between_fragments",
+		steps: []step{func() step {
+			first := clientFrame("", ws.NewFrame(ws.OpText, false, []byte("hel")))
+			ping := clientFrame("", ws.NewPingFrame([]byte("abc")))
+			last := clientFrame("", ws.NewFrame(ws.OpContinuation, true, []byte("lo")))
+
+			return step{desc: "text hel + ping abc + continuation lo", data: append(append(first.data, ping.data...), last.data...)}
+		}()},
+	},
+	{
+		name:  "frame_too_big",
+		steps: []step{clientFrame(fmt.Sprintf("text %d bytes", conformanceMaxMessageSize+1), ws.NewTextFrame([]byte(strings.Repeat("x", conformanceMaxMessageSize+1))))},
+	},
+	{
+		name: "frame_fragments_too_big",
+		steps: []step{func() step {
+			half := []byte(strings.Repeat("x", conformanceMaxMessageSize/2+1))
+			first := clientFrame("", ws.NewFrame(ws.OpText, false, half))
+			second := clientFrame("", ws.NewFrame(ws.OpContinuation, true, half))
+
+			return step{desc: fmt.Sprintf("text %d bytes + continuation %[1]d bytes", len(half)), data: append(first.data, second.data...)}
+		}()},
+	},
+	{
+		name:  "frame_length_msb",
+		steps: []step{raw("text with 64-bit length msb set", 0x81, 0xff, 0x80, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0)},
+	},
+	{
+		name:  "frame_close_empty",
+		steps: []step{clientFrame("close without body", ws.NewCloseFrame(nil))},
+	},
+	{
+		name:  "frame_close_one_byte",
+		steps: []step{clientFrame("close with one byte", ws.NewCloseFrame([]byte{0x03}))},
+	},
+	{
+		name:  "frame_close_reserved_code",
+		steps: []step{clientFrame("close 1005", ws.NewCloseFrame(ws.NewCloseFrameBody(ws.StatusNoStatusRcvd, "")))},
+	},
+	{
+		name:  "frame_close_unknown_code",
+		steps: []step{clientFrame("close 999", ws.NewCloseFrame(ws.NewCloseFrameBody(999, "")))},
+	},
+	{
+		name:  "frame_close_private_code",
+		steps: []step{clientFrame("close 4000", ws.NewCloseFrame(ws.NewCloseFrameBody(4000, "")))},
+	},
+	{
+		name:  "frame_close_invalid_reason",
+		steps: []step{clientFrame("close 1000 ff", ws.NewCloseFrame(append(ws.NewCloseFrameBody(ws.StatusNormalClosure, ""), 0xff)))},
+	},
+	{
+		name:   "frame_raw_text_refused",
+		steps:  []step{text("hello"), clientFrame("binary 00ff", ws.NewBinaryFrame([]byte{0x00, 0xff}))},
+		strict: true,
+	},
+	{
+		name:  "envelope_capabilities",
+		steps: []step{text(`{"type":"capabilities"}`)},
+	},
+	{
+		name:  "envelope_not_an_object",
+		steps: []step{text(`["subscribe"]`)},
+	},
+	{
+		name:  "envelope_missing_type",
+		steps: []step{text(`{"room":"envelope_missing_type"}`)},
+	},
+	{
+		name:  "envelope_missing_room",
+		steps: []step{text(`{"type":"subscribe"}`)},
+	},
+	{
+		name:  "envelope_unknown_type",
+		steps: []step{text(`{"type":"shout","room":"envelope_unknown_type"}`)},
+	},
+	{
+		name: "envelope_subscribe_publish",
+		steps: []step{
+			text(`{"type":"subscribe","room":"envelope_subscribe_publish"}`),
+			text(`{"type":"publish","room":"envelope_subscribe_publish","data":{"n":1}}`),
+			text(`{"type":"unsubscribe","room":"envelope_subscribe_publish"}`),
+			text(`{"type":"publish","room":"envelope_subscribe_publish","data":{"n":2}}`),
+		},
+	},
+	{
+		name: "envelope_ids",
+		steps: []step{
+			text(`{"type":"ping","id":"p1"}`),
+			text(`{"type":"subscribe","room":"envelope_ids","id":"s1"}`),
+			text(`{"type":"publish","room":"envelope_ids","id":"m1","data":{"n":1}}`),
+			text(`{"type":"ack","room":"envelope_ids","seq":1,"id":"a1"}`),
+			text(`{"type":"unsubscribe","room":"envelope_other","id":"u1"}`),
+		},
+		strict: true,
+	},
+	{
+		name: "envelope_idempotent_publish",
+		steps: []step{
+			text(`{"type":"subscribe","room":"envelope_idempotent_publish"}`),
+			text(`{"type":"publish","room":"envelope_idempotent_publish","id":"m1","idempotency_key":"k1","data":{"n":1}}`),
+			text(`{"type":"publish","room":"envelope_idempotent_publish","id":"m2","idempotency_key":"k1","data":{"n":1}}`),
+			text(`{"type":"publish","room":"envelope_idempotent_publish","id":"m3","idempotency_key":"k2","data":{"n":2}}`),
+		},
+		strict: true,
+	},
+	{
+		name: "envelope_who",
+		steps: []step{
+			text(`{"type":"who","room":"envelope_who","id":"w1"}`),
+			text(`{"type":"subscribe","room":"envelope_who"}`),
+			text(`{"type":"who","room":"envelope_who","id":"w2"}`),
+		},
+		strict: true,
+	},
+	{
+		name: "envelope_tag",
+		steps: []step{
+			text(`{"type":"tag","id":"t1","tags":{"region":"eu","plan":"pro"}}`),
+			text(`{"type":"tag","id":"t2","tags":{"plan":""}}`),
+			text(`{"type":"tag","id":"t3","tags":{"a=b":"c"}}`),
+		},
+		strict: true,
+	},
+	{
+		name: "envelope_request_reply",
+		steps: []step{
+			text(`{"type":"request","id":"r1","to":"service:billing","data":{}}`),
+			text(`{"type":"request","id":"r2","to":"billing","data":{}}`),
+			text(`{"type":"reply","id":"r3","correlation_id":"c1","data":{}}`),
+		},
+		strict: true,
+	},
+	{
+		name: "envelope_ack_ahead",
+		steps: []step{
+			text(`{"type":"subscribe","room":"envelope_ack_ahead"}`),
+			text(`{"type":"ack","room":"envelope_ack_ahead","seq":3}`),
+		},
+		strict: true,
+	},
+	{
+		name: "envelope_stats",
+		steps: []step{
+			text(`{"type":"subscribe","room":"envelope_stats"}`),
+			text(`{"type":"publish","room":"envelope_stats","data":1}`),
+			text(`{"type":"ack","room":"envelope_stats","seq":1}`),
+			text(`{"type":"pause","room":"envelope_stats","policy":"drop"}`),
+			text(`{"type":"publish","room":"envelope_stats","data":2}`),
+			text(`{"type":"stats","id":"st"}`),
+		},
+		strict: true,
+	},
+	{
+		name:  "envelope_unsubscribe_not_subscribed",
+		steps: []step{text(`{"type":"unsubscribe","room":"envelope_unsubscribe_not_subscribed"}`)},
+	},
+	{
+		name: "envelope_pause_unknown_policy",
+		steps: []step{
+			text(`{"type":"subscribe","room":"envelope_pause_unknown_policy"}`),
+			text(`{"type":"pause","room":"envelope_pause_unknown_policy","policy":"hoard"}`),
+		},
+	},
+	{
+		name: "envelope_pause_resume",
+		steps: []step{
+			text(`{"type":"subscribe","room":"envelope_pause_resume"}`),
+			text(`{"type":"pause","room":"envelope_pause_resume"}`),
+			text(`{"type":"publish","room":"envelope_pause_resume","data":1}`),
+			text(`{"type":"publish","room":"envelope_pause_resume","data":2}`),
+			text(`{"type":"resume","room":"envelope_pause_resume"}`),
+		},
+	},
+	{
+		name: "envelope_resume_from_seq",
+		steps: []step{
+			text(`{"type":"subscribe","room":"envelope_resume_from_seq"}`),
+			text(`{"type":"pause","room":"envelope_resume_from_seq","policy":"drop"}`),
+			text(`{"type":"publish","room":"envelope_resume_from_seq","data":1}`),
+			text(`{"type":"publish","room":"envelope_resume_from_seq","data":2}`),
+			text(`{"type":"resume","room":"envelope_resume_from_seq","from_seq":2}`),
+		},
+	},
+	{
+		name: "envelope_resume_history_expired",
+		steps: []step{
+			text(`{"type":"subscribe","room":"envelope_resume_history_expired"}`),
+			text(`{"type":"pause","room":"envelope_resume_history_expired","policy":"drop"}`),
+			text(`{"type":"publish","room":"envelope_resume_history_expired","data":1}`),
+			text(`{"type":"publish","room":"envelope_resume_history_expired","data":2}`),
+			text(`{"type":"publish","room":"envelope_resume_history_expired","data":3}`),
+			text(`{"type":"publish","room":"envelope_resume_history_expired","data":4}`),
+			text(`{"type":"publish","room":"envelope_resume_history_expired","data":5}`),
+			text(`{"type":"resume","room":"envelope_resume_history_expired","from_seq":1}`),
+		},
+	},
+	{
+		name: "mode_echo",
+		steps: []step{
+			text(`{"type":"subscribe","room":"mode_echo"}`),
+			text(`{"type":"publish","room":"mode_echo","id":"p","data":"hi"}`),
+			text("raw hello"),
+		},
+		mode: modeEcho,
+	},
+	{
+		name: "mode_sink",
+		steps: []step{
+			text(`{"type":"subscribe","room":"mode_sink"}`),
+			text(`{"type":"publish","room":"mode_sink","id":"p","data":"hi"}`),
+			text("raw hello"),
+		},
+		mode: modeSink,
+	},
+}
+
+// TestConformance replays recorded client byte sequences against a live
+// server and compares the transcript of what came back with the golden file
+// of the same name. Run with -update after an intended protocol change.
+func TestConformance(t *testing.T) {
+	for _, tc := range conformanceCases {
+		t.Run(tc.name, func(t *testing.T) {
+			srv := conformanceRaw
+			if tc.strict {
+				srv = conformanceStrict
+			}
+
+			// Sequence numbers and connection ids in the transcripts
+			// assume a fresh server.
+			atomic.StoreUint64(&srv.wss.atomicLastConnectionID, 0)
+
+			srv.hub.mu.Lock()
+			srv.hub.rooms = make(map[string]*room)
+			for _, tracked := range srv.hub.connections {
+				tracked.subscriptions = make(map[string]*subscription)
+			}
+			srv.hub.mu.Unlock()
+
+			srv.hub.dedup.mu.Lock()
+			srv.hub.dedup.order.Init()
+			srv.hub.dedup.entries = make(map[string]*list.Element)
+			srv.hub.dedup.mu.Unlock()
+
+			srv.hub.presence.mu.Lock()
+			srv.hub.presence.rooms = make(map[string]map[string]*presenceEntry)
+			srv.hub.presence.mu.Unlock()
+
+			mode := tc.mode
+			if mode == "" {
+				mode = modeBroadcast
+			}
+
+			srv.hub.setMode(mode)
+
+			handshake := tc.handshake
+			if handshake == "" {
+				handshake = validHandshake
+			}
+
+			addr := srv.addr
+			if tc.sse {
+				addr = srv.sseAddr
+			}
+
+			got := transcript(t, addr, handshake, tc.steps)
+			path := filepath.Join("testdata", "conformance", tc.name+".golden")
+
+			if *update {
+				if err := os.WriteFile(path, []byte(got), 0o644); err != nil {
+					t.Fatal(err)
+				}
+
+				return
+			}
+
+			want, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got != string(want) {
+				t.Errorf("transcript mismatch\n--- got\n%s--- want\n%s", got, want)
+			}
+		})
+	}
+}
+
+func transcript(t *testing.T, addr, handshake string, steps []step) string {
+	t.Helper()
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	var out strings.Builder
+
+	out.WriteString("> handshake\n")
+
+	resp, closed := exchange(t, conn, []byte(handshake))
+
+	// Frames sent right after a successful handshake are decoded as
+	// frames; the Date of plain HTTP responses changes every run.
+	head, frames := resp, []byte(nil)
+	if i := bytes.Index(resp, []byte("\r\n\r\n")); i >= 0 && bytes.HasPrefix(resp, []byte("HTTP/1.1 101 ")) {
+		head, frames = resp[:i+4], resp[i+4:]
+	}
+
+	for _, line := range strings.SplitAfter(string(head), "\r\n") {
+		if strings.HasPrefix(line, "Date: ") {
+			line = "Date: <date>\r\n"
+		}
+
+		if line != "" {
+			fmt.Fprintf(&out, "< %q\n", line)
+		}
+	}
+
+	writeFrames(&out, frames)
+
+	for _, s := range steps {
+		if closed {
+			break
+		}
+
+		fmt.Fprintf(&out, "> %s\n", s.desc)
+
+		resp, closed = exchange(t, conn, s.data)
+		writeFrames(&out, resp)
+	}
+
+	if closed {
+		out.WriteString("-- closed by server\n")
+	}
+
+	return out.String()
+}
+
+// exchange writes data and collects everything the server sends until it
+// goes quiet or closes the connection.
+func exchange(t *testing.T, conn net.Conn, data []byte) ([]byte, bool) {
+	t.Helper()
+
+	if _, err := conn.Write(data); err != nil {
+		t.Fatal(err)
+	}
+
+	var resp []byte
+	buf := make([]byte, 4096)
+
+	for {
+		if err := conn.SetReadDeadline(time.Now().Add(quietPeriod)); err != nil {
+			t.Fatal(err)
+		}
+
+		n, err := conn.Read(buf)
+		resp = append(resp, buf[:n]...)
+
+		var netErr net.Error
+		switch {
+		case err == nil:
+		case errors.As(err, &netErr) && netErr.Timeout():
+			return resp, false
+		case errors.Is(err, io.EOF), errors.Is(err, net.ErrClosed), strings.Contains(err.Error(), "reset by peer"):
+			return resp, true
+		default:
+			t.Fatal(err)
+		}
+	}
+}
+
+func writeFrames(out *strings.Builder, resp []byte) {
+	r := bytes.NewReader(resp)
+
+	for r.Len() > 0 {
+		offset := len(resp) - r.Len()
+
+		f, err := ws.ReadFrame(r)
+		if err != nil {
+			fmt.Fprintf(out, "< undecodable %q\n", resp[offset:])
+
+			return
+		}
+
+		switch f.Header.OpCode {
+		case ws.OpText:
+			fmt.Fprintf(out, "< text %s\n", f.Payload)
+		case ws.OpClose:
+			code, reason := ws.ParseCloseFrameData(f.Payload)
+			fmt.Fprintf(out, "< close %d %q\n", code, reason)
+		default:
+			fmt.Fprintf(out, "< op %d fin=%t %q\n", f.Header.OpCode, f.Header.Fin, f.Payload)
+		}
+	}
+}
@@ -0,0 +1,338 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/gobwas/ws"
+	"github.com/panjf2000/gnet/v2"
+	"go.uber.org/zap"
+)
+
+const (
+	frameSubscribe    = "subscribe"
+	frameUnsubscribe  = "unsubscribe"
+	framePublish      = "publish"
+	framePause        = "pause"
+	frameResume       = "resume"
+	framePing         = "ping"
+	framePong         = "pong"
+	frameAck          = "ack"
+	frameMessage      = "message"
+	frameRoomKey      = "room_key"
+	frameCapabilities = "capabilities"
+	frameWelcome      = "welcome"
+	frameReconnect    = "reconnect"
+	frameError        = "error"
+)
+
+// controlFrame is the JSON envelope of the room protocol. Clients may set ID
+// on any request; the server echoes it on the pong, ack or error answering
+// that request. A client sends ack with room and seq once it has processed a
+// room message.
+type controlFrame struct {
+	Type    string          `json:"type"`
+	ID      string          `json:"id,omitempty"`
+	Room    string          `json:"room,omitempty"`
+	Policy  pausePolicy     `json:"policy,omitempty"`
+	FromSeq *uint64         `json:"from_seq,omitempty"`
+	Seq     uint64          `json:"seq,omitempty"`
+	Data    json.RawMessage `json:"data,omitempty"`
+	KeyID   uint64          `json:"key_id,omitempty"`
+	Key     []byte          `json:"key,omitempty"`
+	Error   string          `json:"error,omitempty"`
+
+	// QoS 1 on a publish asks for at-least-once delivery; the server
+	// assigns MsgID and later reports Status with a delivery frame.
+	QoS     int    `json:"qos,omitempty"`
+	MsgID   string `json:"msg_id,omitempty"`
+	Status  string `json:"status,omitempty"`
+	Pending int    `json:"pending,omitempty"`
+
+	// IdempotencyKey on a publish makes retries of it harmless.
+	IdempotencyKey string `json:"idempotency_key,omitempty"`
+
+	// Report on a publish from an authenticated connection asks for
+	// Delivery, how the fan-out went, on its ack.
+	Report   bool            `json:"report,omitempty"`
+	Delivery *deliveryReport `json:"delivery,omitempty"`
+
+	// Reason on a kick is what the kicked connection is told.
+	Reason string `json:"reason,omitempty"`
+
+	// Retained marks the room's last retained message, delivered on
+	// subscribe rather than as it was published.
+	Retained bool `json:"retained,omitempty"`
+	// Delta marks a message of a state room that is a JSON merge patch to
+	// the room's document rather than the document itself.
+	Delta bool `json:"delta,omitempty"`
+
+	// Member and Status name who joined or left on a presence frame;
+	// Members answers a who request, and Statuses gives the heartbeat
+	// status of those of them that send heartbeats.
+	Member   string            `json:"member,omitempty"`
+	Members  []string          `json:"members,omitempty"`
+	Statuses map[string]string `json:"statuses,omitempty"`
+
+	// Tags on a tag frame set the sender's tags; an empty value removes one.
+	Tags map[string]string `json:"tags,omitempty"`
+
+	// CorrelationID pairs a request with its reply. To targets a request
+	// at "user:<subject>" or "service:<name>" rather than a room, From
+	// names who sent it and TimeoutMS is how long the requester waits.
+	CorrelationID string `json:"correlation_id,omitempty"`
+	To            string `json:"to,omitempty"`
+	From          string `json:"from,omitempty"`
+	TimeoutMS     int64  `json:"timeout_ms,omitempty"`
+
+	// DeliverAt, an RFC 3339 time, or DelayMS on a publish from an
+	// authenticated connection holds it until then; its ack and an
+	// unschedule name it by ScheduleID.
+	DeliverAt  string `json:"deliver_at,omitempty"`
+	DelayMS    int64  `json:"delay_ms,omitempty"`
+	ScheduleID string `json:"schedule_id,omitempty"`
+
+	ConnID    uint64         `json:"conn_id,omitempty"`
+	Endpoints []endpointHint `json:"endpoints,omitempty"`
+}
+
+// parseControlFrame reports whether msg is a control frame in enc. Anything
+// that is not an envelope with a type is a raw message, broadcast to everyone
+// when raw broadcast is enabled and refused otherwise.
+func parseControlFrame(enc envelopeEncoding, op ws.OpCode, msg []byte) (controlFrame, bool) {
+	if op != enc.opCode() {
+		return controlFrame{}, false
+	}
+
+	frame, err := enc.decode(msg)
+	if err != nil || frame.Type == "" {
+		return controlFrame{}, false
+	}
+
+	return frame, true
+}
+
+// handleControlFrame runs with the connection's context, canceled once the
+// connection closes.
+func (wss *wsServer) handleControlFrame(ctx context.Context, conn gnet.Conn, frame controlFrame) error {
+	switch frame.Type {
+	case frameCapabilities:
+		return writeCapabilities(conn, wss.bs.capabilities())
+	case framePing:
+		return writeControlFrame(conn, controlFrame{Type: framePong, ID: frame.ID})
+	case frameHeartbeat:
+		return wss.bs.heartbeat(conn, frame.ID)
+	case frameStats:
+		return wss.writeStats(conn, frame.ID)
+	case frameKick:
+		return wss.handleKick(conn, frame)
+	case frameTag:
+		if err := wss.bs.setTags(conn, frame.Tags); err != nil {
+			return writeControlError(conn, frame.ID, fmt.Sprintf("%s: %v", frame.Type, err))
+		}
+
+		if frame.ID != "" {
+			return writeControlFrame(conn, controlFrame{Type: frameAck, ID: frame.ID})
+		}
+
+		return nil
+	case frameRequest:
+		return wss.handleRequest(conn, frame)
+	case frameReply:
+		return wss.handleReply(conn, frame)
+	}
+
+	if frame.Room == "" {
+		return writeControlError(conn, frame.ID, fmt.Sprintf("%s: room is required", frame.Type))
+	}
+
+	var err error
+
+	switch frame.Type {
+	case frameSubscribe:
+		if err = wss.authorizeSubscribe(conn, frame.Room); err == nil {
+			err = wss.bs.subscribe(conn, frame.Room)
+		}
+
+		var moved *roomMovedError
+		if errors.As(err, &moved) {
+			return writeRedirect(conn, frame.ID, frame.Room, moved.url, 0)
+		}
+	case frameCreateRoom:
+		if err = wss.permit(conn, capAdmin); err == nil {
+			err = wss.bs.createRoomFor(frame.Room)
+		}
+	case frameUnsubscribe:
+		err = wss.bs.unsubscribe(conn, frame.Room)
+	case frameUnschedule:
+		identity := connIdentity(conn)
+		if codec, ok := codecOf(conn); ok {
+			identity = tenantRoom(codec.tenant, identity)
+		}
+
+		err = wss.bs.scheduler.cancel(frame.ScheduleID, frame.Room, identity, wss.permit(conn, capAdmin) == nil)
+	case framePublish:
+		return wss.handlePublish(ctx, conn, frame)
+	case frameWho:
+		if err = wss.permit(conn, capSubscribe); err == nil {
+			err = wss.acls.authorize(conn, frame.Room, false)
+		}
+
+		if err == nil {
+			return wss.bs.who(conn, frame.ID, frame.Room)
+		}
+	case framePause:
+		err = wss.bs.pause(conn, frame.Room, frame.Policy)
+	case frameResume:
+		err = wss.bs.resume(conn, frame.Room, frame.FromSeq)
+	case frameAck:
+		// A client's ack needs no answer of its own.
+		if err := wss.bs.ack(conn, frame.Room, frame.Seq); err != nil {
+			return writeControlError(conn, frame.ID, fmt.Sprintf("%s %q: %v", frame.Type, localRoom(frame.Room), err))
+		}
+
+		return nil
+	default:
+		return writeControlError(conn, frame.ID, fmt.Sprintf("unknown frame type %q", frame.Type))
+	}
+
+	if err != nil {
+		return writeControlError(conn, frame.ID, fmt.Sprintf("%s %q: %v", frame.Type, localRoom(frame.Room), err))
+	}
+
+	if frame.ID != "" {
+		return writeControlFrame(conn, controlFrame{Type: frameAck, ID: frame.ID, Room: frame.Room})
+	}
+
+	return nil
+}
+
+// handlePublish publishes on behalf of conn. The ack, sent when the request
+// has an id or asks for QoS, carries the sequence the message got; a publish
+// repeating an idempotency key is acked with the first one's instead.
+func (wss *wsServer) handlePublish(ctx context.Context, conn gnet.Conn, frame controlFrame) error {
+	codec, _ := codecOf(conn)
+
+	err := wss.permit(conn, capPublish)
+	if err == nil {
+		err = wss.acls.authorize(conn, frame.Room, true)
+	}
+
+	if err == nil && codec != nil {
+		err = wss.bs.tenants.publish(codec.tenant)
+	}
+
+	if err != nil {
+		return writeControlError(conn, frame.ID, fmt.Sprintf("%s %q: %v", frame.Type, localRoom(frame.Room), err))
+	}
+
+	identity := connIdentity(conn)
+	if codec != nil {
+		// Session subjects and client ids are only unique within a tenant.
+		identity = tenantRoom(codec.tenant, identity)
+	}
+
+	if frame.DeliverAt != "" || frame.DelayMS > 0 {
+		return wss.schedulePublish(conn, identity, frame)
+	}
+
+	var q *qosPublish
+
+	if frame.QoS > 0 {
+		if wss.bs.qos == nil {
+			return writeControlError(conn, frame.ID, "publish: qos is disabled")
+		}
+
+		q = &qosPublish{publisher: conn, requestID: frame.ID}
+	}
+
+	ack := controlFrame{Type: frameAck, ID: frame.ID, Room: frame.Room}
+
+	msg, fresh := wss.bs.dedup.claim(identity, frame.IdempotencyKey)
+	if fresh {
+		var (
+			report *deliveryReport
+			err    error
+		)
+
+		msg, report, err = wss.bs.clientPublish(ctx, conn, frame.Room, frame.Data, q)
+		wss.bs.dedup.settle(identity, frame.IdempotencyKey, msg, err)
+		wss.bs.msgAudit.record(connSource(conn), frame.Room, msg.seq, frame.Data, err)
+
+		var moved *roomMovedError
+		if errors.As(err, &moved) {
+			return writeRedirect(conn, frame.ID, frame.Room, moved.url, 0)
+		}
+
+		// Whatever else failed the publish, middleware and quotas included,
+		// is the publisher's to hear about; a connection that can no longer
+		// be written to fails writing the error too, and is closed then.
+		if err != nil {
+			return writeControlError(conn, frame.ID, fmt.Sprintf("%s %q: %v", frame.Type, localRoom(frame.Room), err))
+		}
+
+		if frame.Report && authenticated(conn) {
+			ack.Delivery = report
+		}
+	} else {
+		ack.Status = deliveryDuplicate
+	}
+
+	if frame.ID == "" && q == nil && ack.Delivery == nil {
+		return nil
+	}
+
+	ack.Seq, ack.MsgID = msg.seq, msg.msgID
+
+	return writeControlFrame(conn, ack)
+}
+
+// writeControlFrame writes frame to conn in the connection's encoding.
+func writeControlFrame(conn gnet.Conn, frame controlFrame) error {
+	_, err := newEncodedFrame(frame).writeTo(conn)
+
+	return err
+}
+
+func writeControlError(conn gnet.Conn, id, reason string) error {
+	return writeControlFrame(conn, controlFrame{Type: frameError, ID: id, Error: reason})
+}
+
+// authenticated reports whether conn presented a valid session, which is
+// what delivery reports are reserved for: they disclose a room's audience.
+func authenticated(conn gnet.Conn) bool {
+	codec, ok := codecOf(conn)
+
+	return ok && codec.metadata["session_subject"] != ""
+}
+
+// handleKick closes the connection ConnID names on behalf of an admin, who
+// may only kick connections of their own tenant.
+func (wss *wsServer) handleKick(conn gnet.Conn, frame controlFrame) error {
+	var tenant string
+	if codec, ok := codecOf(conn); ok {
+		tenant = codec.tenant
+	}
+
+	err := wss.permit(conn, capAdmin)
+	if err == nil {
+		err = wss.bs.kickWithin(tenant, frame.ConnID, frame.Reason)
+	}
+
+	if err != nil {
+		return writeControlError(conn, frame.ID, fmt.Sprintf("%s %d: %v", frame.Type, frame.ConnID, err))
+	}
+
+	wss.logger.Info("connection kicked",
+		zap.Uint64("conn_id", frame.ConnID),
+		zap.String("by", connIdentity(conn)),
+		zap.String("reason", frame.Reason))
+
+	if frame.ID != "" {
+		return writeControlFrame(conn, controlFrame{Type: frameAck, ID: frame.ID, ConnID: frame.ConnID})
+	}
+
+	return nil
+}
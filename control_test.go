@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gobwas/ws/wsutil"
+	"github.com/panjf2000/gnet/v2"
+)
+
+// TestPublishRejectedByMiddleware checks a broadcast middleware rejects is
+// answered with an error frame and leaves the publisher connected.
+func TestPublishRejectedByMiddleware(t *testing.T) {
+	server, err := startConformanceServer(false, func(wss *wsServer) {
+		wss.bs.middleware = middlewareChain{{
+			name: "moderation",
+			onBroadcast: func(_ context.Context, msg *outboundMessage) error {
+				if msg.room == "moderated" {
+					return errors.New("not allowed here")
+				}
+
+				return nil
+			},
+		}}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(server.stop)
+
+	conn := dialConformance(t, server)
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	for _, step := range []struct{ send, reply, id string }{
+		{send: `{"type":"publish","id":"1","room":"moderated","data":{}}`, reply: frameError, id: "1"},
+		{send: `{"type":"publish","id":"2","room":"lobby","data":{}}`, reply: frameAck, id: "2"},
+		{send: `{"type":"ping","id":"3"}`, reply: framePong, id: "3"},
+	} {
+		if err := wsutil.WriteClientText(conn, []byte(step.send)); err != nil {
+			t.Fatal(err)
+		}
+
+		payload, err := wsutil.ReadServerText(conn)
+		if err != nil {
+			t.Fatalf("reply to %s: %v", step.send, err)
+		}
+
+		var reply controlFrame
+		if err := json.Unmarshal(payload, &reply); err != nil {
+			t.Fatal(err)
+		}
+
+		if reply.Type != step.reply || reply.ID != step.id {
+			t.Fatalf("reply to %s = %s, want a %s for %s", step.send, payload, step.reply, step.id)
+		}
+
+		if reply.Type == frameError && !strings.Contains(reply.Error, "not allowed here") {
+			t.Fatalf("error = %q, want the middleware's reason", reply.Error)
+		}
+	}
+}
+
+// kickConn is a queueConn that records being closed.
+type kickConn struct {
+	queueConn
+
+	closed bool
+}
+
+func (c *kickConn) Close() error {
+	c.closed = true
+
+	return nil
+}
+
+// TestKickWithinTenant checks a tenant's admin can only kick connections of
+// their own tenant, and learns nothing of the others.
+func TestKickWithinTenant(t *testing.T) {
+	b := newHookHub(0)
+
+	conns := map[string]*kickConn{"acme": {}, "globex": {}, "": {}}
+	ids := make(map[string]uint64)
+
+	for tenant, c := range conns {
+		id := uint64(len(ids) + 1)
+		ids[tenant] = id
+		b.connections[c] = &trackedConnection{id: id}
+		openCodecs.Store(gnet.Conn(c), &wsCodec{id: id, tenant: tenant})
+	}
+
+	t.Cleanup(func() {
+		for _, c := range conns {
+			openCodecs.Delete(gnet.Conn(c))
+		}
+	})
+
+	for _, tenant := range []string{"globex", ""} {
+		if err := b.kickWithin("acme", ids[tenant], "bye"); !errors.Is(err, errUnknownConnection) {
+			t.Fatalf("acme kicking %q: err = %v, want %v", tenant, err, errUnknownConnection)
+		}
+
+		if conns[tenant].closed {
+			t.Fatalf("acme kicked a connection of %q", tenant)
+		}
+	}
+
+	if err := b.kickWithin("", ids["globex"], "bye"); !errors.Is(err, errUnknownConnection) || conns["globex"].closed {
+		t.Fatalf("untenanted admin kicking globex: err = %v, closed %v", err, conns["globex"].closed)
+	}
+
+	if err := b.kickWithin("acme", ids["acme"], "bye"); err != nil || !conns["acme"].closed {
+		t.Fatalf("acme kicking its own connection: err = %v, closed %v", err, conns["acme"].closed)
+	}
+
+	// The admin token reaches every tenant.
+	if err := b.kick(ids["globex"], "bye"); err != nil || !conns["globex"].closed {
+		t.Fatalf("admin kicking globex: err = %v, closed %v", err, conns["globex"].closed)
+	}
+}
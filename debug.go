@@ -0,0 +1,187 @@
+package main
+
+import (
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	rpprof "runtime/pprof"
+	"sort"
+	"strconv"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// debugRoomLimit is how many of the largest rooms the hub dump lists.
+const debugRoomLimit = 20
+
+// debugServer is the opt-in diagnostics listener: net/http/pprof under
+// /debug/pprof/, a full goroutine dump on /debug/goroutines and the hub's
+// state on /debug/hub. Profiles reveal a lot about the process, so requests
+// need the admin credentials whenever those are configured.
+type debugServer struct {
+	addr   string
+	auth   adminAuth
+	bs     *broadcastService
+	logger *zap.Logger
+}
+
+func (d *debugServer) handler() http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.HandleFunc("/debug/goroutines", d.handleGoroutines)
+	mux.HandleFunc("/debug/hub", d.handleHub)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if d.auth.configured() && !d.auth.allows(r) {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+
+			return
+		}
+
+		mux.ServeHTTP(w, r)
+	})
+}
+
+func (d *debugServer) serve() {
+	d.logger.Info("debug server is listening", zap.String("addr", d.addr))
+
+	if err := http.ListenAndServe(d.addr, d.handler()); err != nil {
+		d.logger.Error("debug server exits", zap.Error(err))
+	}
+}
+
+// handleGoroutines dumps every goroutine's stack, as a panic would.
+func (d *debugServer) handleGoroutines(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	_ = rpprof.Lookup("goroutine").WriteTo(w, 2)
+}
+
+type hubDump struct {
+	Runtime memoryDump   `json:"runtime"`
+	Hub     runtimeStats `json:"hub"`
+	// Loops counts connections per event loop; a loop holding far more
+	// than the rest is a likely source of stalls.
+	Loops map[string]int `json:"loops"`
+	// Hooks is how many messages each message hook has yet to process.
+	Hooks map[string]int `json:"hooks"`
+	Rooms []roomDump     `json:"rooms"`
+}
+
+type memoryDump struct {
+	HeapAlloc    uint64        `json:"heap_alloc"`
+	HeapInuse    uint64        `json:"heap_inuse"`
+	HeapObjects  uint64        `json:"heap_objects"`
+	Sys          uint64        `json:"sys"`
+	NumGC        uint32        `json:"num_gc"`
+	PauseTotal   time.Duration `json:"gc_pause_total_ns"`
+	LastGC       *time.Time    `json:"last_gc,omitempty"`
+	StackInuse   uint64        `json:"stack_inuse"`
+	NumCPU       int           `json:"num_cpu"`
+	GOMAXPROCS   int           `json:"gomaxprocs"`
+	ProcessStart time.Time     `json:"process_start"`
+}
+
+type roomDump struct {
+	Name           string `json:"name"`
+	Members        int    `json:"members"`
+	PausedBuffered int    `json:"paused_buffered"`
+	History        int    `json:"history"`
+	HistoryBytes   int    `json:"history_bytes"`
+}
+
+var processStart = time.Now()
+
+// handleHub dumps the hub's state, with the debugRoomLimit largest rooms.
+func (d *debugServer) handleHub(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+
+		return
+	}
+
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+
+	dump := hubDump{
+		Runtime: memoryDump{
+			HeapAlloc:    mem.HeapAlloc,
+			HeapInuse:    mem.HeapInuse,
+			HeapObjects:  mem.HeapObjects,
+			Sys:          mem.Sys,
+			NumGC:        mem.NumGC,
+			PauseTotal:   time.Duration(mem.PauseTotalNs),
+			StackInuse:   mem.StackInuse,
+			NumCPU:       runtime.NumCPU(),
+			GOMAXPROCS:   runtime.GOMAXPROCS(0),
+			ProcessStart: processStart,
+		},
+		Hub:   d.bs.runtimeStats(),
+		Loops: make(map[string]int),
+		Hooks: d.bs.hookBacklogs(),
+		Rooms: []roomDump{},
+	}
+
+	if mem.LastGC != 0 {
+		last := time.Unix(0, int64(mem.LastGC))
+		dump.Runtime.LastGC = &last
+	}
+
+	for _, c := range d.bs.snapshot() {
+		loop := "unknown"
+		if codec, ok := codecOf(c); ok && codec.loop >= 0 {
+			loop = strconv.Itoa(codec.loop)
+		}
+
+		dump.Loops[loop]++
+	}
+
+	d.bs.mu.RLock()
+	for name, room := range d.bs.rooms {
+		rd := roomDump{Name: name, Members: len(room.members), History: len(room.history), HistoryBytes: room.historyBytes}
+		for _, sub := range room.members {
+			rd.PausedBuffered += len(sub.buffered)
+		}
+
+		dump.Rooms = append(dump.Rooms, rd)
+	}
+	d.bs.mu.RUnlock()
+
+	sort.Slice(dump.Rooms, func(i, j int) bool {
+		if dump.Rooms[i].Members != dump.Rooms[j].Members {
+			return dump.Rooms[i].Members > dump.Rooms[j].Members
+		}
+
+		return dump.Rooms[i].Name < dump.Rooms[j].Name
+	})
+
+	if len(dump.Rooms) > debugRoomLimit {
+		dump.Rooms = dump.Rooms[:debugRoomLimit]
+	}
+
+	writeJSON(w, http.StatusOK, dump)
+}
+
+// hookBacklogs counts the messages each hook has queued.
+func (b *broadcastService) hookBacklogs() map[string]int {
+	b.mu.RLock()
+	runners := make([]*hookRunner, 0, len(b.hooks))
+	for _, h := range b.hooks {
+		runners = append(runners, h)
+	}
+	b.mu.RUnlock()
+
+	backlogs := make(map[string]int, len(runners))
+	for _, h := range runners {
+		h.mu.Lock()
+		backlogs[h.name] = len(h.pending)
+		h.mu.Unlock()
+	}
+
+	return backlogs
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"container/list"
+	"strconv"
+	"sync"
+
+	"github.com/panjf2000/gnet/v2"
+)
+
+const deliveryDuplicate = "duplicate"
+
+// dedupCache remembers the idempotency keys of recent publishes so a
+// publish retried after a flaky reconnect is not broadcast twice. Keys are
+// scoped to the publisher's identity and the least recently seen are
+// forgotten first once size is reached.
+type dedupCache struct {
+	size int
+
+	mu      sync.Mutex
+	order   *list.List
+	entries map[string]*list.Element
+}
+
+type dedupEntry struct {
+	key string
+	msg roomMessage
+}
+
+func newDedupCache(size int) *dedupCache {
+	return &dedupCache{size: size, order: list.New(), entries: make(map[string]*list.Element)}
+}
+
+// connIdentity names who is behind c, for idempotency keys and presence:
+// its session subject when it authenticated, which the client cannot pick,
+// else the client_id it gave, else the connection itself.
+func connIdentity(c gnet.Conn) string {
+	codec, ok := codecOf(c)
+	if !ok {
+		return ""
+	}
+
+	if subject := codec.metadata["session_subject"]; subject != "" {
+		return "session:" + subject
+	}
+
+	if codec.clientID != "" {
+		return "client:" + codec.clientID
+	}
+
+	return "conn:" + strconv.FormatUint(codec.id, 10)
+}
+
+// claim reports whether key is new for identity and reserves it if so.
+// Otherwise it returns what the first publish with the key recorded.
+func (d *dedupCache) claim(identity, key string) (roomMessage, bool) {
+	if d == nil || key == "" {
+		return roomMessage{}, true
+	}
+
+	k := identity + "\x00" + key
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if el, ok := d.entries[k]; ok {
+		d.order.MoveToFront(el)
+
+		return el.Value.(*dedupEntry).msg, false
+	}
+
+	d.entries[k] = d.order.PushFront(&dedupEntry{key: k})
+
+	if d.order.Len() > d.size {
+		oldest := d.order.Back()
+		d.order.Remove(oldest)
+		delete(d.entries, oldest.Value.(*dedupEntry).key)
+	}
+
+	return roomMessage{}, true
+}
+
+// settle records the message a claimed key was published as, or releases
+// the key when the publish failed so a retry can go through.
+func (d *dedupCache) settle(identity, key string, msg roomMessage, err error) {
+	if d == nil || key == "" {
+		return
+	}
+
+	k := identity + "\x00" + key
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	el, ok := d.entries[k]
+	if !ok {
+		return
+	}
+
+	if err != nil {
+		d.order.Remove(el)
+		delete(d.entries, k)
+
+		return
+	}
+
+	el.Value.(*dedupEntry).msg = msg
+}
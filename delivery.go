@@ -0,0 +1,168 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// deliveryReport says what became of one publish or broadcast. Delivered
+// counts frames handed to connections; in unordered rooms they are queued on
+// the event loops, so a failure there shows up as a closed connection
+// rather than here. Skipped members were paused, or the message was held
+// for coalescing while shedding load.
+type deliveryReport struct {
+	Recipients int   `json:"recipients" msgpack:"recipients"`
+	Delivered  int   `json:"delivered" msgpack:"delivered"`
+	Skipped    int   `json:"skipped" msgpack:"skipped"`
+	Failed     int   `json:"failed" msgpack:"failed"`
+	DurationUS int64 `json:"duration_us" msgpack:"duration_us"`
+}
+
+// deliveryTally counts one fan-out as it happens; wrote is safe for
+// concurrent use by fanoutPool workers.
+type deliveryTally struct {
+	started         time.Time
+	recipients      int
+	skipped         int
+	atomicDelivered int64
+	atomicFailed    int64
+}
+
+func newDeliveryTally(started time.Time, recipients, skipped int) *deliveryTally {
+	return &deliveryTally{started: started, recipients: recipients, skipped: skipped}
+}
+
+func (t *deliveryTally) wrote(err error) error {
+	if err != nil {
+		atomic.AddInt64(&t.atomicFailed, 1)
+	} else {
+		atomic.AddInt64(&t.atomicDelivered, 1)
+	}
+
+	return err
+}
+
+// finishDelivery records the fan-out on stats and the hub's latency histogram.
+func (b *broadcastService) finishDelivery(t *deliveryTally, stats *fanoutStats) deliveryReport {
+	elapsed := time.Since(t.started)
+
+	report := deliveryReport{
+		Recipients: t.recipients,
+		Delivered:  int(atomic.LoadInt64(&t.atomicDelivered)),
+		Skipped:    t.skipped,
+		Failed:     int(atomic.LoadInt64(&t.atomicFailed)),
+		DurationUS: elapsed.Microseconds(),
+	}
+
+	stats.delivery.record(report, elapsed)
+	b.fanoutLatency.record(elapsed)
+
+	return report
+}
+
+// deliveryStats aggregates the delivery reports of a room.
+type deliveryStats struct {
+	atomicMessages   uint64
+	atomicRecipients uint64
+	atomicDelivered  uint64
+	atomicSkipped    uint64
+	atomicFailed     uint64
+	atomicNanos      uint64
+	atomicMaxNanos   uint64
+}
+
+func (s *deliveryStats) record(r deliveryReport, elapsed time.Duration) {
+	atomic.AddUint64(&s.atomicMessages, 1)
+	atomic.AddUint64(&s.atomicRecipients, uint64(r.Recipients))
+	atomic.AddUint64(&s.atomicDelivered, uint64(r.Delivered))
+	atomic.AddUint64(&s.atomicSkipped, uint64(r.Skipped))
+	atomic.AddUint64(&s.atomicFailed, uint64(r.Failed))
+	atomic.AddUint64(&s.atomicNanos, uint64(elapsed))
+
+	for {
+		max := atomic.LoadUint64(&s.atomicMaxNanos)
+		if uint64(elapsed) <= max || atomic.CompareAndSwapUint64(&s.atomicMaxNanos, max, uint64(elapsed)) {
+			return
+		}
+	}
+}
+
+type deliveryInfo struct {
+	Room          string `json:"room"`
+	Messages      uint64 `json:"messages"`
+	Recipients    uint64 `json:"recipients"`
+	Delivered     uint64 `json:"delivered"`
+	Skipped       uint64 `json:"skipped"`
+	Failed        uint64 `json:"failed"`
+	AvgDurationUS uint64 `json:"avg_duration_us"`
+	MaxDurationUS uint64 `json:"max_duration_us"`
+}
+
+func (s *deliveryStats) info(room string) deliveryInfo {
+	info := deliveryInfo{
+		Room:          room,
+		Messages:      atomic.LoadUint64(&s.atomicMessages),
+		Recipients:    atomic.LoadUint64(&s.atomicRecipients),
+		Delivered:     atomic.LoadUint64(&s.atomicDelivered),
+		Skipped:       atomic.LoadUint64(&s.atomicSkipped),
+		Failed:        atomic.LoadUint64(&s.atomicFailed),
+		MaxDurationUS: atomic.LoadUint64(&s.atomicMaxNanos) / uint64(time.Microsecond),
+	}
+
+	if info.Messages > 0 {
+		info.AvgDurationUS = atomic.LoadUint64(&s.atomicNanos) / info.Messages / uint64(time.Microsecond)
+	}
+
+	return info
+}
+
+type deliverySummary struct {
+	// Fanout is how long fan-outs took across every room.
+	Fanout struct {
+		P50US  int64 `json:"p50_us"`
+		P90US  int64 `json:"p90_us"`
+		P99US  int64 `json:"p99_us"`
+		P999US int64 `json:"p999_us"`
+		MaxUS  int64 `json:"max_us"`
+	} `json:"fanout"`
+	Rooms []deliveryInfo `json:"rooms"`
+}
+
+func (b *broadcastService) deliverySummary() deliverySummary {
+	var summary deliverySummary
+
+	h := &b.fanoutLatency
+	summary.Fanout.P50US = h.percentile(50).Microseconds()
+	summary.Fanout.P90US = h.percentile(90).Microseconds()
+	summary.Fanout.P99US = h.percentile(99).Microseconds()
+	summary.Fanout.P999US = h.percentile(99.9).Microseconds()
+	summary.Fanout.MaxUS = h.percentile(100).Microseconds()
+
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	summary.Rooms = make([]deliveryInfo, 0, len(b.rooms)+1)
+	summary.Rooms = append(summary.Rooms, b.broadcastStats.delivery.info(broadcastRoomName))
+
+	for _, r := range b.rooms {
+		summary.Rooms = append(summary.Rooms, r.stats.delivery.info(r.name))
+	}
+
+	rooms := summary.Rooms[1:]
+	sort.Slice(rooms, func(i, j int) bool { return rooms[i].Room < rooms[j].Room })
+
+	return summary
+}
+
+// handleDelivery reports delivery aggregates on GET /delivery.
+func (a *adminServer) handleDelivery(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+
+		return
+	}
+
+	writeJSON(w, http.StatusOK, a.bs.deliverySummary())
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/gobwas/ws"
+	"github.com/nubunto/gnet-websocket/envelopepb"
+	"github.com/panjf2000/gnet/v2"
+	"google.golang.org/protobuf/proto"
+)
+
+// Subprotocols selecting the envelope encoding. Connections that negotiate
+// none speak JSON.
+const (
+	subprotocolJSON  = "wsb.v1.json"
+	subprotocolProto = "wsb.v1.proto"
+)
+
+var errDataNotJSON = errors.New("data must be valid JSON")
+
+// envelopeEncoding turns control frames into websocket messages and back.
+// The hub only ever deals in controlFrame; the encoding is chosen per
+// connection at the handshake.
+type envelopeEncoding interface {
+	opCode() ws.OpCode
+	encode(frame controlFrame) ([]byte, error)
+	decode(msg []byte) (controlFrame, error)
+}
+
+// envelopeEncodings is the registry of encodings by subprotocol.
+var envelopeEncodings = map[string]envelopeEncoding{
+	subprotocolJSON:    jsonEncoding{},
+	subprotocolProto:   protoEncoding{},
+	subprotocolMsgpack: msgpackEncoding{},
+}
+
+// encodingNames lists the registered subprotocols, sorted.
+func encodingNames() []string {
+	names := make([]string, 0, len(envelopeEncodings))
+	for name := range envelopeEncodings {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	return names
+}
+
+func encodingOf(c gnet.Conn) envelopeEncoding {
+	if codec, ok := codecOf(c); ok && codec.encoding != nil {
+		return codec.encoding
+	}
+
+	return jsonEncoding{}
+}
+
+// selectSubprotocol accepts the first offered subprotocol that names a
+// registered encoding and makes it the connection's encoding.
+func (codec *wsCodec) selectSubprotocol(p []byte) bool {
+	enc, ok := envelopeEncodings[string(p)]
+	if ok {
+		codec.encoding = enc
+	}
+
+	return ok
+}
+
+type jsonEncoding struct{}
+
+func (jsonEncoding) opCode() ws.OpCode { return ws.OpText }
+
+func (jsonEncoding) encode(frame controlFrame) ([]byte, error) {
+	return json.Marshal(frame)
+}
+
+func (jsonEncoding) decode(msg []byte) (controlFrame, error) {
+	var frame controlFrame
+	err := json.Unmarshal(msg, &frame)
+
+	return frame, err
+}
+
+// protoEncoding carries envelopepb.Envelope in binary messages. Data stays
+// JSON inside it, so a message reaches members of every encoding unchanged.
+type protoEncoding struct{}
+
+func (protoEncoding) opCode() ws.OpCode { return ws.OpBinary }
+
+func (protoEncoding) encode(frame controlFrame) ([]byte, error) {
+	env := &envelopepb.Envelope{
+		Type:    frame.Type,
+		Id:      frame.ID,
+		Room:    frame.Room,
+		Policy:  string(frame.Policy),
+		FromSeq: frame.FromSeq,
+		Seq:     frame.Seq,
+		Data:    frame.Data,
+		KeyId:   frame.KeyID,
+		Key:     frame.Key,
+		Error:   frame.Error,
+		ConnId:  frame.ConnID,
+		Qos:     uint32(frame.QoS),
+		MsgId:   frame.MsgID,
+		Status:  frame.Status,
+		Pending: int64(frame.Pending),
+
+		IdempotencyKey: frame.IdempotencyKey,
+		Member:         frame.Member,
+		Members:        frame.Members,
+		Statuses:       frame.Statuses,
+		Tags:           frame.Tags,
+		Report:         frame.Report,
+		Reason:         frame.Reason,
+		Retained:       frame.Retained,
+		Delta:          frame.Delta,
+		CorrelationId:  frame.CorrelationID,
+		To:             frame.To,
+		From:           frame.From,
+		TimeoutMs:      frame.TimeoutMS,
+		DeliverAt:      frame.DeliverAt,
+		DelayMs:        frame.DelayMS,
+		ScheduleId:     frame.ScheduleID,
+	}
+
+	if d := frame.Delivery; d != nil {
+		env.Delivery = &envelopepb.DeliveryReport{
+			Recipients: int64(d.Recipients),
+			Delivered:  int64(d.Delivered),
+			Skipped:    int64(d.Skipped),
+			Failed:     int64(d.Failed),
+			DurationUs: d.DurationUS,
+		}
+	}
+
+	for _, e := range frame.Endpoints {
+		env.Endpoints = append(env.Endpoints, &envelopepb.EndpointHint{Url: e.URL, Connections: e.Connections})
+	}
+
+	return proto.Marshal(env)
+}
+
+func (protoEncoding) decode(msg []byte) (controlFrame, error) {
+	var env envelopepb.Envelope
+	if err := proto.Unmarshal(msg, &env); err != nil {
+		return controlFrame{}, err
+	}
+
+	if len(env.Data) > 0 && !json.Valid(env.Data) {
+		return controlFrame{}, errDataNotJSON
+	}
+
+	frame := controlFrame{
+		Type:    env.Type,
+		ID:      env.Id,
+		Room:    env.Room,
+		Policy:  pausePolicy(env.Policy),
+		FromSeq: env.FromSeq,
+		Seq:     env.Seq,
+		Data:    env.Data,
+		KeyID:   env.KeyId,
+		Key:     env.Key,
+		Error:   env.Error,
+		ConnID:  env.ConnId,
+		QoS:     int(env.Qos),
+		MsgID:   env.MsgId,
+		Status:  env.Status,
+		Pending: int(env.Pending),
+
+		IdempotencyKey: env.IdempotencyKey,
+		Member:         env.Member,
+		Members:        env.Members,
+		Statuses:       env.Statuses,
+		Tags:           env.Tags,
+		Report:         env.Report,
+		Reason:         env.Reason,
+		Retained:       env.Retained,
+		Delta:          env.Delta,
+		CorrelationID:  env.CorrelationId,
+		To:             env.To,
+		From:           env.From,
+		TimeoutMS:      env.TimeoutMs,
+		DeliverAt:      env.DeliverAt,
+		DelayMS:        env.DelayMs,
+		ScheduleID:     env.ScheduleId,
+	}
+
+	if d := env.Delivery; d != nil {
+		frame.Delivery = &deliveryReport{
+			Recipients: int(d.Recipients),
+			Delivered:  int(d.Delivered),
+			Skipped:    int(d.Skipped),
+			Failed:     int(d.Failed),
+			DurationUS: d.DurationUs,
+		}
+	}
+
+	for _, e := range env.Endpoints {
+		frame.Endpoints = append(frame.Endpoints, endpointHint{URL: e.Url, Connections: e.Connections})
+	}
+
+	return frame, nil
+}
+
+// encodedFrame is one frame on its way to many connections. It is encoded
+// at most once per encoding among them.
+type encodedFrame struct {
+	frame    controlFrame
+	encoded  map[envelopeEncoding][]byte
+	compiled map[envelopeEncoding]*sharedWire
+}
+
+func newEncodedFrame(frame controlFrame) *encodedFrame {
+	frame.Room = localRoom(frame.Room)
+
+	return &encodedFrame{frame: frame, encoded: make(map[envelopeEncoding][]byte, 1)}
+}
+
+func (f *encodedFrame) encodeFor(enc envelopeEncoding) ([]byte, error) {
+	if data, ok := f.encoded[enc]; ok {
+		return data, nil
+	}
+
+	data, err := enc.encode(f.frame)
+	if err != nil {
+		return nil, fmt.Errorf("encoding %s frame: %w", f.frame.Type, err)
+	}
+
+	f.encoded[enc] = data
+
+	return data, nil
+}
+
+// compiledFor returns the whole websocket frame, header included, ready to
+// be queued.
+func (f *encodedFrame) compiledFor(enc envelopeEncoding) (*sharedWire, error) {
+	if wire, ok := f.compiled[enc]; ok {
+		return wire, nil
+	}
+
+	data, err := f.encodeFor(enc)
+	if err != nil {
+		return nil, err
+	}
+
+	wire, err := compileServerFrame(enc.opCode(), data)
+	if err != nil {
+		return nil, err
+	}
+
+	if f.compiled == nil {
+		f.compiled = make(map[envelopeEncoding]*sharedWire, 1)
+	}
+	f.compiled[enc] = wire
+
+	return wire, nil
+}
+
+// prepare compiles the frame for every encoding among targets up front, so
+// writeTo only reads and may run from several goroutines.
+func (f *encodedFrame) prepare(targets []gnet.Conn) error {
+	for _, c := range targets {
+		if _, err := f.compiledFor(encodingOf(c)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// release gives up the compiled frames, which go back to wirePool once the
+// writes queued with them are done. Call it once every write is queued.
+func (f *encodedFrame) release() {
+	for enc, wire := range f.compiled {
+		wire.release()
+		delete(f.compiled, enc)
+	}
+}
+
+// writeTo writes the frame to c in c's encoding and returns the payload size.
+// Connections sharing an encoding are written the same compiled bytes; no
+// extension that would make them differ, such as permessage-deflate, is
+// negotiated.
+func (f *encodedFrame) writeTo(c gnet.Conn) (int, error) {
+	enc := encodingOf(c)
+
+	wire, err := f.compiledFor(enc)
+	if err != nil {
+		return 0, err
+	}
+
+	return len(f.encoded[enc]), writeCompiledFrame(c, wire)
+}
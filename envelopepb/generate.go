@@ -0,0 +1,4 @@
+// Package envelopepb holds the generated types for the protobuf envelope.
+package envelopepb
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative envelope.proto
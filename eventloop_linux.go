@@ -0,0 +1,9 @@
+package main
+
+import "golang.org/x/sys/unix"
+
+// eventLoopID names the event loop running the caller. Every loop is locked
+// to its own OS thread, so the thread ID tells them apart.
+func eventLoopID() int {
+	return unix.Gettid()
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+// eventLoopID cannot tell event loops apart here; -1 makes loop-affine
+// delivery fall back to one queued write per connection.
+func eventLoopID() int {
+	return -1
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"sync"
+
+	"github.com/panjf2000/gnet/v2"
+)
+
+// fanoutPool writes large broadcasts from several goroutines at once, so
+// delivery time stops growing linearly with the audience. Targets are split
+// into one chunk per worker and every call returns only once all of its
+// chunks are written, which keeps each member's view of strict and fifo
+// rooms in order. Fan-outs below threshold, and every fan-out on a nil
+// pool, stay on the caller's goroutine.
+type fanoutPool struct {
+	workers   int
+	threshold int
+	tasks     chan func()
+}
+
+func newFanoutPool(workers, threshold int) *fanoutPool {
+	p := &fanoutPool{workers: workers, threshold: threshold, tasks: make(chan func())}
+
+	for i := 0; i < workers; i++ {
+		go func() {
+			for task := range p.tasks {
+				task()
+			}
+		}()
+	}
+
+	return p
+}
+
+// each calls write for every target and returns the first error, after
+// every target has been tried. write must be safe for concurrent use.
+func (p *fanoutPool) each(targets []gnet.Conn, write func(c gnet.Conn) error) error {
+	if p == nil || len(targets) < p.threshold || p.workers < 2 {
+		var first error
+
+		for _, c := range targets {
+			if err := write(c); err != nil && first == nil {
+				first = err
+			}
+		}
+
+		return first
+	}
+
+	var (
+		wg    sync.WaitGroup
+		mu    sync.Mutex
+		first error
+	)
+
+	run := func(part []gnet.Conn) {
+		defer wg.Done()
+
+		for _, c := range part {
+			if err := write(c); err != nil {
+				mu.Lock()
+				if first == nil {
+					first = err
+				}
+				mu.Unlock()
+			}
+		}
+	}
+
+	chunk := (len(targets) + p.workers - 1) / p.workers
+
+	for start := 0; start < len(targets); start += chunk {
+		end := start + chunk
+		if end > len(targets) {
+			end = len(targets)
+		}
+
+		part := targets[start:end]
+		wg.Add(1)
+
+		// A busy pool, say with another large broadcast, must not stall
+		// this one: the caller writes the chunk itself.
+		select {
+		case p.tasks <- func() { run(part) }:
+		default:
+			run(part)
+		}
+	}
+
+	wg.Wait()
+
+	return first
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/panjf2000/gnet/v2"
+)
+
+var (
+	fanoutCheck     = flag.Bool("fanout-check", false, "compare fan-out benchmarks against testdata/bench/fanout.json; with -update, rewrite it")
+	fanoutThreshold = flag.Float64("fanout-threshold", 1.25, "slowdown over the baseline ns/op that fails -fanout-check")
+)
+
+const fanoutBaseline = "testdata/bench/fanout.json"
+
+var (
+	fanoutConnCounts = []int{100, 1000, 10000}
+	fanoutSizes      = []int{64, 1024, 16384}
+)
+
+// fanoutStrategy is one of the ways publish delivers a room message.
+type fanoutStrategy struct {
+	name    string
+	deliver func(b *broadcastService, targets []gnet.Conn, frame *encodedFrame, stats *fanoutStats, tally *deliveryTally) error
+	// pooled gives the hub a fan-out pool, as -fanout-workers does.
+	pooled bool
+}
+
+var fanoutStrategies = []fanoutStrategy{
+	{name: "ordered", deliver: (*broadcastService).deliverOrdered},
+	{name: "ordered_pool", deliver: (*broadcastService).deliverOrdered, pooled: true},
+	{name: "unordered", deliver: func(_ *broadcastService, targets []gnet.Conn, frame *encodedFrame, stats *fanoutStats, tally *deliveryTally) error {
+		return deliverUnordered(targets, frame, stats, tally)
+	}},
+}
+
+// benchFanoutPool is shared by every pooled benchmark, as its workers are
+// never stopped. It splits every fan-out across four workers, however many
+// cores there are.
+var benchFanoutPool = sync.OnceValue(func() *fanoutPool { return newFanoutPool(4, 0) })
+
+// benchLoop stands in for a gnet event loop: tasks run one at a time on its
+// own goroutine.
+type benchLoop struct {
+	index int
+	tasks chan func()
+}
+
+func newBenchLoops(n int) []*benchLoop {
+	loops := make([]*benchLoop, n)
+	for i := range loops {
+		loops[i] = &benchLoop{index: i, tasks: make(chan func(), 64)}
+
+		go func(l *benchLoop) {
+			for task := range l.tasks {
+				task()
+			}
+		}(loops[i])
+	}
+
+	return loops
+}
+
+func (l *benchLoop) run(task func()) { l.tasks <- task }
+
+func stopBenchLoops(loops []*benchLoop) {
+	for _, l := range loops {
+		close(l.tasks)
+	}
+}
+
+// benchConn is a connection whose writes only count bytes, so benchmarks
+// measure the fan-out itself rather than the kernel. Methods fan-out does not
+// use are left to the embedded nil interface.
+type benchConn struct {
+	gnet.Conn
+
+	loop    *benchLoop
+	written int64
+}
+
+func (c *benchConn) Write(p []byte) (int, error) {
+	atomic.AddInt64(&c.written, int64(len(p)))
+
+	return len(p), nil
+}
+
+// Wake runs callback on the connection's loop, as gnet does.
+func (c *benchConn) Wake(callback gnet.AsyncCallback) error {
+	c.loop.run(func() { _ = callback(c) })
+
+	return nil
+}
+
+// benchTargets returns n upgraded connections spread over loops, whose
+// writes go through their loop's outbox.
+func benchTargets(b *testing.B, loops []*benchLoop, n int) []gnet.Conn {
+	var outboxes loopOutboxes
+
+	targets := make([]gnet.Conn, n)
+	for i := range targets {
+		loop := loops[i%len(loops)]
+		targets[i] = &benchConn{loop: loop}
+		openCodecs.Store(targets[i], &wsCodec{outbox: outboxes.of(loop.index)})
+	}
+
+	b.Cleanup(func() {
+		for _, c := range targets {
+			openCodecs.Delete(c)
+		}
+	})
+
+	return targets
+}
+
+// settle returns once every loop has run what was queued on it so far.
+func settle(loops []*benchLoop) {
+	var wg sync.WaitGroup
+
+	wg.Add(len(loops))
+
+	for _, l := range loops {
+		l.run(wg.Done)
+	}
+
+	wg.Wait()
+}
+
+func fanoutCaseName(strategy string, conns, size int) string {
+	return fmt.Sprintf("%s/conns=%d/size=%d", strategy, conns, size)
+}
+
+func benchmarkFanout(b *testing.B, s fanoutStrategy, conns, size int) {
+	loops := newBenchLoops(runtime.GOMAXPROCS(0))
+	defer stopBenchLoops(loops)
+
+	hub := &broadcastService{}
+	if s.pooled {
+		hub.fanout = benchFanoutPool()
+	}
+
+	targets := benchTargets(b, loops, conns)
+	data := json.RawMessage(strconv.Quote(strings.Repeat("x", size-2)))
+	stats := &fanoutStats{}
+
+	b.SetBytes(int64(conns * size))
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		frame := newEncodedFrame(roomMessageFrame("bench", roomMessage{seq: uint64(i + 1), data: data}))
+		tally := newDeliveryTally(time.Now(), len(targets), 0)
+
+		if err := s.deliver(hub, targets, frame, stats, tally); err != nil {
+			b.Fatal(err)
+		}
+
+		// Delivery is done once the loops have written what was queued.
+		settle(loops)
+	}
+}
+
+func BenchmarkFanout(b *testing.B) {
+	for _, s := range fanoutStrategies {
+		for _, conns := range fanoutConnCounts {
+			for _, size := range fanoutSizes {
+				s, conns, size := s, conns, size
+
+				b.Run(fanoutCaseName(s.name, conns, size), func(b *testing.B) {
+					benchmarkFanout(b, s, conns, size)
+				})
+			}
+		}
+	}
+}
+
+// TestFanoutRegression fails when a fan-out strategy got slower than the
+// recorded baseline by more than -fanout-threshold. Timings depend on the
+// machine, so it only runs with -fanout-check; record a baseline for the
+// machine it runs on with -fanout-check -update.
+func TestFanoutRegression(t *testing.T) {
+	if !*fanoutCheck {
+		t.Skip("fan-out regression check runs with -fanout-check")
+	}
+
+	results := make(map[string]float64)
+
+	for _, s := range fanoutStrategies {
+		for _, conns := range fanoutConnCounts {
+			for _, size := range fanoutSizes {
+				s, conns, size := s, conns, size
+
+				r := testing.Benchmark(func(b *testing.B) { benchmarkFanout(b, s, conns, size) })
+				results[fanoutCaseName(s.name, conns, size)] = float64(r.NsPerOp())
+			}
+		}
+	}
+
+	if *update {
+		writeFanoutBaseline(t, results)
+
+		return
+	}
+
+	data, err := os.ReadFile(fanoutBaseline)
+	if err != nil {
+		t.Fatalf("reading baseline (record one with -update): %v", err)
+	}
+
+	var baseline map[string]float64
+	if err := json.Unmarshal(data, &baseline); err != nil {
+		t.Fatalf("parsing baseline: %v", err)
+	}
+
+	names := make([]string, 0, len(results))
+	for name := range results {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		want, ok := baseline[name]
+		if !ok {
+			t.Errorf("%s: no baseline, rerun with -update", name)
+
+			continue
+		}
+
+		got := results[name]
+		if ratio := got / want; ratio > *fanoutThreshold {
+			t.Errorf("%s: %.0f ns/op, %.2fx the baseline %.0f ns/op", name, got, ratio, want)
+		} else {
+			t.Logf("%s: %.0f ns/op, %.2fx the baseline", name, got, ratio)
+		}
+	}
+}
+
+func writeFanoutBaseline(t *testing.T, results map[string]float64) {
+	for name, ns := range results {
+		results[name] = math.Round(ns)
+	}
+
+	data, err := json.MarshalIndent(results, "", "  ")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(fanoutBaseline), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(fanoutBaseline, append(data, '\n'), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/gobwas/ws"
+	"github.com/panjf2000/gnet/v2"
+	"go.uber.org/zap"
+)
+
+const (
+	filterDrop   = "drop"
+	filterRedact = "redact"
+)
+
+// filterRule matches a regular expression, or any of a list of keywords as
+// whole words regardless of case. Drop rules reject the message; redact
+// rules replace what they match and let it through.
+type filterRule struct {
+	Name        string   `json:"name"`
+	Keywords    []string `json:"keywords,omitempty"`
+	Pattern     string   `json:"pattern,omitempty"`
+	Action      string   `json:"action"`
+	Replacement string   `json:"replacement,omitempty"`
+
+	re *regexp.Regexp
+}
+
+// contentFilter screens what clients publish before anyone else sees it.
+// In JSON data only string values are matched, so redacting never breaks
+// the document; MaxDepth bounds how deeply it may nest. Raw text messages
+// are matched whole. A rejected message is answered with an error frame.
+type contentFilter struct {
+	MaxDepth int           `json:"max_depth,omitempty"`
+	Rules    []*filterRule `json:"rules"`
+
+	logger *zap.Logger
+}
+
+// loadContentFilter reads a JSON filter definition from file.
+func loadContentFilter(file string, logger *zap.Logger) (*contentFilter, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("reading content filters: %w", err)
+	}
+
+	f := &contentFilter{logger: logger}
+	if err := json.Unmarshal(data, f); err != nil {
+		return nil, fmt.Errorf("parsing content filters %s: %w", file, err)
+	}
+
+	for _, rule := range f.Rules {
+		if err := rule.compile(); err != nil {
+			return nil, fmt.Errorf("content filter %q: %w", rule.Name, err)
+		}
+	}
+
+	return f, nil
+}
+
+func (r *filterRule) compile() error {
+	if r.Name == "" {
+		return errors.New("rule without a name")
+	}
+
+	if r.Action != filterDrop && r.Action != filterRedact {
+		return fmt.Errorf("unknown action %q, want drop or redact", r.Action)
+	}
+
+	if r.Replacement == "" {
+		r.Replacement = "***"
+	}
+
+	expr := r.Pattern
+	if len(r.Keywords) > 0 {
+		if expr != "" {
+			return errors.New("set pattern or keywords, not both")
+		}
+
+		quoted := make([]string, len(r.Keywords))
+		for i, kw := range r.Keywords {
+			quoted[i] = regexp.QuoteMeta(kw)
+		}
+
+		expr = `(?i)\b(?:` + strings.Join(quoted, "|") + `)\b`
+	}
+
+	if expr == "" {
+		return errors.New("rule needs a pattern or keywords")
+	}
+
+	var err error
+	if r.re, err = regexp.Compile(expr); err != nil {
+		return fmt.Errorf("compiling pattern: %w", err)
+	}
+
+	return nil
+}
+
+type filterRejection struct {
+	rule string
+}
+
+func (e *filterRejection) Error() string {
+	return fmt.Sprintf("message rejected by content filter %q", e.rule)
+}
+
+// text applies the rules to s, returning it redacted or the drop rule that
+// matched.
+func (f *contentFilter) text(s string) (string, error) {
+	for _, rule := range f.Rules {
+		if !rule.re.MatchString(s) {
+			continue
+		}
+
+		if rule.Action == filterDrop {
+			return "", &filterRejection{rule: rule.Name}
+		}
+
+		s = rule.re.ReplaceAllLiteralString(s, rule.Replacement)
+	}
+
+	return s, nil
+}
+
+// value filters every string in v, decoded JSON inside depth containers,
+// and reports whether any changed.
+func (f *contentFilter) value(v interface{}, depth int) (interface{}, bool, error) {
+	var changed bool
+
+	switch v := v.(type) {
+	case string:
+		s, err := f.text(v)
+
+		return s, s != v, err
+	case []interface{}:
+		if err := f.nest(depth); err != nil {
+			return nil, false, err
+		}
+
+		for i, item := range v {
+			next, c, err := f.value(item, depth+1)
+			if err != nil {
+				return nil, false, err
+			}
+
+			v[i], changed = next, changed || c
+		}
+	case map[string]interface{}:
+		if err := f.nest(depth); err != nil {
+			return nil, false, err
+		}
+
+		for key, item := range v {
+			next, c, err := f.value(item, depth+1)
+			if err != nil {
+				return nil, false, err
+			}
+
+			v[key], changed = next, changed || c
+		}
+	}
+
+	return v, changed, nil
+}
+
+// nest fails when a container inside depth others would be too deep.
+func (f *contentFilter) nest(depth int) error {
+	if f.MaxDepth > 0 && depth >= f.MaxDepth {
+		return fmt.Errorf("message nests deeper than %d levels", f.MaxDepth)
+	}
+
+	return nil
+}
+
+// json filters a JSON document and returns it, re-encoded if anything was
+// redacted.
+func (f *contentFilter) json(data json.RawMessage) (json.RawMessage, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return nil, fmt.Errorf("decoding data: %w", err)
+	}
+
+	v, changed, err := f.value(v, 0)
+	if err != nil || !changed {
+		return data, err
+	}
+
+	return json.Marshal(v)
+}
+
+func (f *contentFilter) message(msg *inboundMessage) error {
+	if frame := msg.frame; frame != nil {
+		if frame.Type != framePublish || len(frame.Data) == 0 {
+			return nil
+		}
+
+		data, err := f.json(frame.Data)
+		if err != nil {
+			return err
+		}
+
+		frame.Data = data
+
+		return nil
+	}
+
+	if msg.op != ws.OpText || !utf8.Valid(msg.payload) {
+		return nil
+	}
+
+	text, err := f.text(string(msg.payload))
+	if err != nil {
+		return err
+	}
+
+	msg.payload = []byte(text)
+
+	return nil
+}
+
+func (f *contentFilter) middleware() middleware {
+	return middleware{
+		name: "content-filter",
+		onMessage: func(ctx context.Context, c gnet.Conn, msg *inboundMessage) error {
+			err := f.message(msg)
+			if err != nil {
+				f.logger.Info("message filtered", zap.String("remote_addr", c.RemoteAddr().String()), zap.Error(err))
+			}
+
+			return err
+		},
+	}
+}
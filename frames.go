@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"unicode/utf8"
+
+	"github.com/gobwas/ws"
+	"github.com/gobwas/ws/wsutil"
+	"github.com/panjf2000/gnet/v2"
+)
+
+var (
+	errInvalidUTF8   = errors.New("text message is not valid UTF-8")
+	errMessageTooBig = errors.New("message exceeds the maximum size")
+	errCloseTooShort = ws.ProtocolError("close frame payload must be empty or at least two bytes")
+)
+
+// failureClose returns the reason and detail of the close frame that fails
+// the connection for a read error, following RFC 6455 section 7.4.1. It
+// returns false for errors the client did not cause, which close without
+// one.
+func failureClose(err error) (closeReason, string, bool) {
+	var protocol ws.ProtocolError
+
+	switch {
+	case errors.Is(err, errMessageTooBig):
+		return closeMessageTooBig, "", true
+	case errors.Is(err, errInvalidUTF8), errors.Is(err, ws.ErrProtocolInvalidUTF8):
+		return closeInvalidUTF8, "", true
+	case errors.As(err, &protocol):
+		return closeProtocolError, string(protocol), true
+	case errors.Is(err, ws.ErrHeaderLengthMSB), errors.Is(err, ws.ErrHeaderLengthUnexpected):
+		return closeProtocolError, "invalid payload length", true
+	default:
+		return closeReason{}, "", false
+	}
+}
+
+// nextFrame takes one frame off the inbound buffer, but only once all of it
+// has arrived. gnet hands OnTraffic whatever bytes are there and its Read
+// never blocks, so reading a partial frame would spin the event loop. The
+// header is checked against state, and data frames longer than limit fail,
+// as soon as it is in, before any of the payload is kept; a negative limit
+// allows any length.
+func nextFrame(conn gnet.Conn, state ws.State, limit int64) (ws.Frame, bool, error) {
+	buffered := conn.InboundBuffered()
+	if buffered < 2 {
+		return ws.Frame{}, false, nil
+	}
+
+	n := ws.MaxHeaderSize
+	if buffered < n {
+		n = buffered
+	}
+
+	head, err := conn.Peek(n)
+	if err != nil {
+		return ws.Frame{}, false, fmt.Errorf("peeking frame header: %w", err)
+	}
+
+	h, err := ws.ReadHeader(bytes.NewReader(head))
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return ws.Frame{}, false, nil
+	}
+	if err != nil {
+		return ws.Frame{}, false, fmt.Errorf("reading frame header: %w", err)
+	}
+
+	if err := ws.CheckHeader(h, state); err != nil {
+		return ws.Frame{}, false, err
+	}
+
+	if limit >= 0 && !h.OpCode.IsControl() && h.Length > limit {
+		return ws.Frame{}, false, errMessageTooBig
+	}
+
+	headerSize := ws.HeaderSize(h)
+	if int64(buffered-headerSize) < h.Length {
+		return ws.Frame{}, false, nil
+	}
+
+	if _, err := conn.Discard(headerSize); err != nil {
+		return ws.Frame{}, false, fmt.Errorf("discarding frame header: %w", err)
+	}
+
+	payload := framePool.get(int(h.Length))
+	if _, err := io.ReadFull(conn, payload); err != nil {
+		return ws.Frame{}, false, fmt.Errorf("reading frame payload: %w", err)
+	}
+
+	if h.Masked {
+		ws.Cipher(payload, h.Mask, 0)
+	}
+
+	return ws.Frame{Header: h, Payload: payload}, true, nil
+}
+
+// readMessage consumes buffered frames until a whole message is available,
+// answering pings and close frames on the way. Fragments are kept on the
+// codec between calls. It returns false when more bytes are needed. The
+// message may come from framePool; the caller releases it once handled.
+// Messages, fragmented or not, may be at most maxSize bytes long. Text
+// messages must be UTF-8 unless skipUTF8 is set; fragments are checked as
+// they arrive, so a bad one fails before the rest is read.
+func (codec *wsCodec) readMessage(conn gnet.Conn, maxSize int64, skipUTF8 bool) ([]byte, ws.OpCode, bool, error) {
+	for {
+		limit := int64(-1)
+		if maxSize > 0 {
+			limit = maxSize - int64(len(codec.fragments))
+		}
+
+		state := ws.StateServerSide
+		if codec.fragmentOp != 0 {
+			state = state.Set(ws.StateFragmented)
+		}
+
+		f, ok, err := nextFrame(conn, state, limit)
+		if err != nil || !ok {
+			return nil, 0, false, err
+		}
+
+		switch op := f.Header.OpCode; {
+		case op == ws.OpPing:
+			err := writeServerFrame(conn, ws.OpPong, f.Payload)
+			framePool.put(f.Payload)
+
+			if err != nil {
+				return nil, 0, false, fmt.Errorf("writing pong: %w", err)
+			}
+		case op == ws.OpPong:
+			framePool.put(f.Payload)
+		case op == ws.OpClose:
+			code, reason := ws.ParseCloseFrameData(f.Payload)
+
+			switch len(f.Payload) {
+			case 0:
+			case 1:
+				framePool.put(f.Payload)
+
+				return nil, 0, false, errCloseTooShort
+			default:
+				if err := ws.CheckCloseFrameData(code, reason); err != nil {
+					framePool.put(f.Payload)
+
+					return nil, 0, false, err
+				}
+			}
+
+			// An empty close is answered with an empty one, else the code
+			// is echoed.
+			var body []byte
+			if len(f.Payload) > 0 {
+				body = ws.NewCloseFrameBody(code, "")
+			}
+
+			framePool.put(f.Payload)
+
+			if err := writeServerFrame(conn, ws.OpClose, body); err != nil {
+				return nil, 0, false, fmt.Errorf("writing close: %w", err)
+			}
+
+			return nil, 0, false, wsutil.ClosedError{Code: code, Reason: reason}
+		case !f.Header.Fin:
+			if op != ws.OpContinuation {
+				codec.fragmentOp = op
+			}
+
+			codec.fragments = append(codec.fragments, f.Payload...)
+			framePool.put(f.Payload)
+
+			if codec.fragmentOp == ws.OpText && !skipUTF8 {
+				n, ok := validUTF8Prefix(codec.fragments[codec.fragmentsValid:])
+				if !ok {
+					return nil, 0, false, errInvalidUTF8
+				}
+
+				codec.fragmentsValid += n
+			}
+		default:
+			msg, checked := f.Payload, 0
+			if op == ws.OpContinuation {
+				op, msg, checked = codec.fragmentOp, append(codec.fragments, f.Payload...), codec.fragmentsValid
+				codec.fragmentOp, codec.fragments, codec.fragmentsValid = 0, nil, 0
+				framePool.put(f.Payload)
+			}
+
+			if op == ws.OpText && !skipUTF8 && !utf8.Valid(msg[checked:]) {
+				return nil, 0, false, errInvalidUTF8
+			}
+
+			return msg, op, true, nil
+		}
+	}
+}
+
+// validUTF8Prefix reports whether b is UTF-8 but for a rune cut short at its
+// end, and returns how many bytes precede that rune.
+func validUTF8Prefix(b []byte) (int, bool) {
+	for i := 0; i < len(b); {
+		if b[i] < utf8.RuneSelf {
+			i++
+
+			continue
+		}
+
+		r, size := utf8.DecodeRune(b[i:])
+		if r == utf8.RuneError && size == 1 {
+			return i, !utf8.FullRune(b[i:])
+		}
+
+		i += size
+	}
+
+	return len(b), true
+}
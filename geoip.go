@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// Tags a connection gets from -geoip-db, so broadcasts can target them with
+// the usual selectors, e.g. /broadcast?where=continent=EU or
+// where=region=DE-BE.
+const (
+	geoTagCountry   = "country"
+	geoTagRegion    = "region"
+	geoTagContinent = "continent"
+)
+
+// geoTags are reserved whenever -geoip-db is set, so a client the database
+// does not locate cannot claim a location with a tag frame.
+var geoTags = []string{geoTagCountry, geoTagRegion, geoTagContinent}
+
+// geoIP resolves client addresses against a MaxMind GeoIP2 or GeoLite2
+// City or Country database. Country is the ISO 3166-1 code, region the ISO
+// 3166-2 code of the first subdivision and continent the two-letter
+// continent code; addresses the database does not know get no tags. A nil
+// *geoIP resolves nothing.
+type geoIP struct {
+	mu sync.RWMutex
+	db *maxminddb.Reader
+}
+
+type geoRecord struct {
+	Continent struct {
+		Code string `maxminddb:"code"`
+	} `maxminddb:"continent"`
+	Country struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+	Subdivisions []struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"subdivisions"`
+}
+
+// load opens file, replacing the database in use, so an updated one is
+// picked up by new connections on reload.
+func (g *geoIP) load(file string) error {
+	db, err := openGeoIP(file)
+	if err != nil {
+		return err
+	}
+
+	return g.swap(db)
+}
+
+func openGeoIP(file string) (*maxminddb.Reader, error) {
+	db, err := maxminddb.Open(file)
+	if err != nil {
+		return nil, fmt.Errorf("opening GeoIP database: %w", err)
+	}
+
+	return db, nil
+}
+
+// swap puts db in use and closes the database it replaces.
+func (g *geoIP) swap(db *maxminddb.Reader) error {
+	g.mu.Lock()
+	old := g.db
+	g.db = db
+	g.mu.Unlock()
+
+	if old != nil {
+		return old.Close()
+	}
+
+	return nil
+}
+
+func (g *geoIP) tags(ip net.IP) map[string]string {
+	if g == nil || ip == nil {
+		return nil
+	}
+
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+
+	var rec geoRecord
+	if err := g.db.Lookup(ip, &rec); err != nil {
+		return nil
+	}
+
+	tags := make(map[string]string, 3)
+	if rec.Country.ISOCode != "" {
+		tags[geoTagCountry] = rec.Country.ISOCode
+	}
+
+	if len(rec.Subdivisions) > 0 && rec.Subdivisions[0].ISOCode != "" && rec.Country.ISOCode != "" {
+		tags[geoTagRegion] = rec.Country.ISOCode + "-" + rec.Subdivisions[0].ISOCode
+	}
+
+	if rec.Continent.Code != "" {
+		tags[geoTagContinent] = rec.Continent.Code
+	}
+
+	return tags
+}
+
+// enrich adds ip's location to the metadata of a connection. What the
+// upgrade hook set wins; clients cannot change the tags with tag frames, nor
+// set them where the database had no answer.
+func (g *geoIP) enrich(metadata map[string]string, ip net.IP) map[string]string {
+	tags := g.tags(ip)
+	if len(tags) == 0 {
+		return metadata
+	}
+
+	if metadata == nil {
+		metadata = make(map[string]string, len(tags))
+	}
+
+	for key, value := range tags {
+		if _, ok := metadata[key]; !ok {
+			metadata[key] = value
+		}
+	}
+
+	return metadata
+}
@@ -1,19 +1,34 @@
 module github.com/nubunto/gnet-websocket
 
-go 1.17
+go 1.26.0
 
 require (
 	github.com/gobwas/ws v1.1.0
+	github.com/oschwald/maxminddb-golang v1.13.1
 	github.com/panjf2000/gnet/v2 v2.0.3
+	github.com/quic-go/quic-go v0.62.0
+	github.com/quic-go/webtransport-go v0.13.0
+	github.com/tetratelabs/wazero v1.0.0
+	github.com/vmihailenco/msgpack/v5 v5.3.5
+	github.com/yuin/gopher-lua v1.1.1
+	go.uber.org/zap v1.21.0
+	golang.org/x/sys v0.47.0
+	google.golang.org/grpc v1.50.1
+	google.golang.org/protobuf v1.31.0
+	gopkg.in/natefinch/lumberjack.v2 v2.2.1
 )
 
 require (
+	github.com/dunglas/httpsfv v1.1.1 // indirect
 	github.com/gobwas/httphead v0.1.0 // indirect
 	github.com/gobwas/pool v0.2.1 // indirect
-	github.com/panjf2000/ants/v2 v2.4.8 // indirect
+	github.com/golang/protobuf v1.5.2 // indirect
+	github.com/quic-go/qpack v0.6.0 // indirect
+	github.com/vmihailenco/tagparser/v2 v2.0.0 // indirect
 	go.uber.org/atomic v1.9.0 // indirect
 	go.uber.org/multierr v1.8.0 // indirect
-	go.uber.org/zap v1.21.0 // indirect
-	golang.org/x/sys v0.0.0-20220224120231-95c6836cb0e7 // indirect
-	gopkg.in/natefinch/lumberjack.v2 v2.0.0 // indirect
+	golang.org/x/crypto v0.54.0 // indirect
+	golang.org/x/net v0.56.0 // indirect
+	golang.org/x/text v0.40.0 // indirect
+	google.golang.org/genproto v0.0.0-20200526211855-cb27e3aa2013 // indirect
 )
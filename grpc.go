@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+
+	"github.com/gobwas/ws"
+	"github.com/nubunto/gnet-websocket/controlpb"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// grpcServer is the programmatic twin of the admin API. It shares the admin
+// bearer token, passed as "authorization" metadata.
+type grpcServer struct {
+	controlpb.UnimplementedControlServer
+
+	addr   string
+	token  string
+	bs     *broadcastService
+	logger *zap.Logger
+}
+
+func (g *grpcServer) Publish(ctx context.Context, req *controlpb.PublishRequest) (*controlpb.PublishResponse, error) {
+	op := ws.OpText
+	if req.Binary {
+		op = ws.OpBinary
+	}
+
+	err := g.bs.broadcastMessage(op, req.Payload)
+	g.bs.msgAudit.record(grpcSource(ctx), broadcastRoomName, 0, req.Payload, err)
+
+	if err != nil {
+		return nil, status.Error(codes.Unavailable, err.Error())
+	}
+
+	return &controlpb.PublishResponse{}, nil
+}
+
+func (g *grpcServer) PublishToRoom(ctx context.Context, req *controlpb.PublishToRoomRequest) (*controlpb.PublishResponse, error) {
+	if err := g.publishToRoom(ctx, req); err != nil {
+		return nil, err
+	}
+
+	return &controlpb.PublishResponse{}, nil
+}
+
+func (g *grpcServer) PublishStream(stream controlpb.Control_PublishStreamServer) error {
+	var published uint64
+
+	for {
+		req, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			return stream.SendAndClose(&controlpb.PublishStreamResponse{Published: published})
+		}
+		if err != nil {
+			return err
+		}
+
+		if err := g.publishToRoom(stream.Context(), req); err != nil {
+			return err
+		}
+
+		published++
+	}
+}
+
+func (g *grpcServer) publishToRoom(ctx context.Context, req *controlpb.PublishToRoomRequest) error {
+	if req.Room == "" {
+		return status.Error(codes.InvalidArgument, "room is required")
+	}
+
+	if !json.Valid(req.Data) {
+		return status.Error(codes.InvalidArgument, "room data must be valid JSON")
+	}
+
+	err := g.bs.publish(ctx, req.Room, req.Data)
+	g.bs.msgAudit.record(grpcSource(ctx), req.Room, 0, req.Data, err)
+
+	if err != nil {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return status.FromContextError(ctxErr).Err()
+		}
+
+		if errors.Is(err, errBandwidthExceeded) {
+			return status.Error(codes.ResourceExhausted, err.Error())
+		}
+
+		return status.Error(codes.Unavailable, err.Error())
+	}
+
+	return nil
+}
+
+func (g *grpcServer) ListConnections(ctx context.Context, _ *controlpb.ListConnectionsRequest) (*controlpb.ListConnectionsResponse, error) {
+	infos := g.bs.listConnections()
+
+	resp := &controlpb.ListConnectionsResponse{
+		Connections: make([]*controlpb.Connection, 0, len(infos)),
+	}
+
+	for _, info := range infos {
+		resp.Connections = append(resp.Connections, &controlpb.Connection{
+			Id:          info.ID,
+			RemoteAddr:  info.RemoteAddr,
+			Rooms:       info.Rooms,
+			ConnectedAt: timestamppb.New(info.ConnectedAt),
+		})
+	}
+
+	return resp, nil
+}
+
+func (g *grpcServer) Kick(ctx context.Context, req *controlpb.KickRequest) (*controlpb.KickResponse, error) {
+	if err := g.bs.kick(req.Id, req.Reason); err != nil {
+		if errors.Is(err, errUnknownConnection) {
+			return nil, status.Error(codes.NotFound, err.Error())
+		}
+
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	g.logger.Info("connection kicked", zap.Uint64("conn_id", req.Id), zap.String("reason", req.Reason))
+
+	return &controlpb.KickResponse{}, nil
+}
+
+func (g *grpcServer) Stats(ctx context.Context, _ *controlpb.StatsRequest) (*controlpb.StatsResponse, error) {
+	members := make(map[string]roomInfo)
+	for _, info := range g.bs.listRooms() {
+		members[info.Name] = info
+	}
+
+	amplification := g.bs.amplification()
+
+	resp := &controlpb.StatsResponse{
+		Connections: int64(len(g.bs.snapshot())),
+		Rooms:       make([]*controlpb.RoomStats, 0, len(amplification)),
+	}
+
+	for _, amp := range amplification {
+		resp.Rooms = append(resp.Rooms, &controlpb.RoomStats{
+			Room:          amp.Room,
+			Members:       uint32(members[amp.Room].Members),
+			Seq:           members[amp.Room].Seq,
+			Messages:      amp.Messages,
+			BytesIn:       amp.BytesIn,
+			BytesOut:      amp.BytesOut,
+			Amplification: amp.Amplification,
+		})
+	}
+
+	return resp, nil
+}
+
+func (g *grpcServer) authorize(ctx context.Context) error {
+	md, _ := metadata.FromIncomingContext(ctx)
+
+	for _, v := range md.Get("authorization") {
+		if token, ok := bearerToken(v); ok && secureEqual(token, g.token) {
+			return nil
+		}
+	}
+
+	return status.Error(codes.Unauthenticated, "unauthorized")
+}
+
+func (g *grpcServer) unaryAuth(ctx context.Context, req interface{}, _ *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	if err := g.authorize(ctx); err != nil {
+		return nil, err
+	}
+
+	return handler(ctx, req)
+}
+
+func (g *grpcServer) streamAuth(srv interface{}, ss grpc.ServerStream, _ *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	if err := g.authorize(ss.Context()); err != nil {
+		return err
+	}
+
+	return handler(srv, ss)
+}
+
+func (g *grpcServer) serve() {
+	ln, err := net.Listen("tcp", g.addr)
+	if err != nil {
+		g.logger.Error("grpc server exits", zap.Error(err))
+
+		return
+	}
+
+	srv := grpc.NewServer(
+		grpc.UnaryInterceptor(g.unaryAuth),
+		grpc.StreamInterceptor(g.streamAuth),
+	)
+	controlpb.RegisterControlServer(srv, g)
+
+	g.logger.Info("grpc server is listening", zap.String("addr", g.addr))
+
+	if err := srv.Serve(ln); err != nil {
+		g.logger.Error("grpc server exits", zap.Error(err))
+	}
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/panjf2000/gnet/v2"
+	"go.uber.org/zap"
+)
+
+// Shedding levels are cumulative: each one keeps shedding everything the
+// levels below it shed.
+const (
+	shedNone = iota
+	shedRejectConnections
+	shedPauseReplay
+	shedCoalesce
+)
+
+// recoverRatio is how far under budget usage has to fall before shedding
+// steps back down, so the level does not flap around the budget.
+const recoverRatio = 0.9
+
+var errReplayShed = errors.New("history replay is paused while the server is shedding load")
+
+var shedLevelNames = [...]string{"none", "reject_connections", "pause_replay", "coalesce"}
+
+// loadShedder samples process RSS and CPU against the configured budgets and
+// escalates one shedding level per sample while over budget. A nil
+// *loadShedder never sheds.
+type loadShedder struct {
+	rssBudget uint64
+	cpuBudget float64 // percent of one core
+	interval  time.Duration
+	logger    *zap.Logger
+
+	atomicLevel               int32
+	atomicRSS                 uint64
+	atomicCPUPermille         uint64
+	atomicRejectedConnections uint64
+
+	lastCPU  time.Duration
+	lastWall time.Time
+}
+
+func (s *loadShedder) level() int {
+	if s == nil {
+		return shedNone
+	}
+
+	return int(atomic.LoadInt32(&s.atomicLevel))
+}
+
+func (s *loadShedder) rejectConnection() bool {
+	if s.level() < shedRejectConnections {
+		return false
+	}
+
+	atomic.AddUint64(&s.atomicRejectedConnections, 1)
+
+	return true
+}
+
+func (s *loadShedder) run() {
+	s.lastCPU, s.lastWall = processCPU(), time.Now()
+
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		s.sample()
+	}
+}
+
+func (s *loadShedder) sample() {
+	rss := processRSS()
+
+	cpu, now := processCPU(), time.Now()
+	cpuPercent := 100 * float64(cpu-s.lastCPU) / float64(now.Sub(s.lastWall))
+	s.lastCPU, s.lastWall = cpu, now
+
+	atomic.StoreUint64(&s.atomicRSS, rss)
+	atomic.StoreUint64(&s.atomicCPUPermille, uint64(cpuPercent*10))
+
+	var ratio float64
+	if s.rssBudget > 0 {
+		ratio = float64(rss) / float64(s.rssBudget)
+	}
+	if s.cpuBudget > 0 && cpuPercent/s.cpuBudget > ratio {
+		ratio = cpuPercent / s.cpuBudget
+	}
+
+	prev := s.level()
+	next := prev
+
+	switch {
+	case ratio > 1 && prev < shedCoalesce:
+		next++
+	case ratio < recoverRatio && prev > shedNone:
+		next--
+	}
+
+	if next == prev {
+		return
+	}
+
+	atomic.StoreInt32(&s.atomicLevel, int32(next))
+
+	s.logger.Warn("load shedding level changed",
+		zap.String("from", shedLevelNames[prev]),
+		zap.String("to", shedLevelNames[next]),
+		zap.Uint64("rss_bytes", rss),
+		zap.Float64("cpu_percent", cpuPercent))
+}
+
+type guardrailInfo struct {
+	Level               string  `json:"level"`
+	RSSBytes            uint64  `json:"rss_bytes"`
+	RSSBudget           uint64  `json:"rss_budget_bytes"`
+	CPUPercent          float64 `json:"cpu_percent"`
+	CPUBudget           float64 `json:"cpu_budget_percent"`
+	RejectedConnections uint64  `json:"rejected_connections"`
+}
+
+func (s *loadShedder) info() guardrailInfo {
+	return guardrailInfo{
+		Level:               shedLevelNames[s.level()],
+		RSSBytes:            atomic.LoadUint64(&s.atomicRSS),
+		RSSBudget:           s.rssBudget,
+		CPUPercent:          float64(atomic.LoadUint64(&s.atomicCPUPermille)) / 10,
+		CPUBudget:           s.cpuBudget,
+		RejectedConnections: atomic.LoadUint64(&s.atomicRejectedConnections),
+	}
+}
+
+func (a *adminServer) handleGuardrails(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+
+		return
+	}
+
+	if a.bs.shed == nil {
+		http.Error(w, "guardrails are disabled", http.StatusNotFound)
+
+		return
+	}
+
+	writeJSON(w, http.StatusOK, a.bs.shed.info())
+}
+
+// coalescer conflates room deliveries while shedding: only the latest message
+// per room is written each interval. Everything is still recorded in history
+// and the sequence gap tells clients what they skipped.
+type coalescer struct {
+	mu      sync.Mutex
+	pending map[string]roomMessage
+}
+
+func (c *coalescer) hold(name string, msg roomMessage) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.pending[name] = msg
+}
+
+func (c *coalescer) take() map[string]roomMessage {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	pending := c.pending
+	c.pending = make(map[string]roomMessage)
+
+	return pending
+}
+
+func (b *broadcastService) flushCoalesced(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		for name, msg := range b.coalesced.take() {
+			// There is nobody to report a failed write to here; gnet
+			// closes the connection and OnClose logs it.
+			_ = b.deliverLatest(name, msg)
+		}
+	}
+}
+
+func (b *broadcastService) deliverLatest(name string, msg roomMessage) error {
+	targets, stats := b.activeMembers(name)
+	if stats == nil {
+		return nil
+	}
+
+	b.bandwidth.charge(name, int64(len(msg.data))*int64(len(targets)))
+
+	tally := newDeliveryTally(time.Now(), len(targets), 0)
+
+	for _, g := range b.framesFor(context.Background(), name, msg, targets, tally) {
+		for _, c := range g.conns {
+			n, err := g.frame.writeTo(c)
+			if err != nil {
+				return fmt.Errorf("delivering to room %q: %w", name, err)
+			}
+
+			stats.wrote(frameSize(n))
+		}
+	}
+
+	return nil
+}
+
+func (b *broadcastService) activeMembers(name string) ([]gnet.Conn, *fanoutStats) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	r, ok := b.rooms[name]
+	if !ok {
+		return nil, nil
+	}
+
+	targets := make([]gnet.Conn, 0, len(r.members))
+	for c, sub := range r.members {
+		if !sub.paused {
+			targets = append(targets, c)
+		}
+	}
+
+	return targets, r.stats
+}
+
+// processRSS reads the resident set size from procfs, falling back to what
+// the Go runtime has obtained from the OS where procfs is unavailable.
+func processRSS() uint64 {
+	f, err := os.Open("/proc/self/statm")
+	if err != nil {
+		var ms runtime.MemStats
+		runtime.ReadMemStats(&ms)
+
+		return ms.Sys
+	}
+	defer f.Close()
+
+	var size, resident uint64
+	if _, err := fmt.Fscan(bufio.NewReader(f), &size, &resident); err != nil {
+		return 0
+	}
+
+	return resident * uint64(os.Getpagesize())
+}
+
+func processCPU() time.Duration {
+	var ru syscall.Rusage
+	if err := syscall.Getrusage(syscall.RUSAGE_SELF, &ru); err != nil {
+		return 0
+	}
+
+	return time.Duration(ru.Utime.Nano() + ru.Stime.Nano())
+}
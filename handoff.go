@@ -0,0 +1,187 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// A restart goes like this: the new process binds the same port (both hold
+// SO_REUSEPORT sockets), asks the old one for a handoff over the control
+// socket and steers all new connections to its own sockets. The old process
+// gives up the control socket, drains and exits; the new one then serves the
+// control socket for the next restart and, once the old process is gone,
+// restores plain reuseport hashing.
+
+const (
+	handoffCommand = "handoff"
+
+	controlListenRetries = 50
+	controlListenBackoff = 100 * time.Millisecond
+)
+
+type handoffRequest struct {
+	Cmd string `json:"cmd"`
+}
+
+type handoffResponse struct {
+	Listeners int    `json:"listeners"`
+	Error     string `json:"error,omitempty"`
+}
+
+func (wss *wsServer) runControl() {
+	if wss.takeover {
+		if err := wss.takeOver(); err != nil {
+			wss.logger.Error("taking over", zap.Error(err))
+
+			return
+		}
+	}
+
+	if err := wss.serveControl(); err != nil {
+		wss.logger.Error("control socket exits", zap.Error(err))
+	}
+}
+
+func (wss *wsServer) takeOver() error {
+	conn, err := net.Dial("unix", wss.controlSocket)
+	if err != nil {
+		return fmt.Errorf("dialing control socket: %w", err)
+	}
+
+	if err := json.NewEncoder(conn).Encode(handoffRequest{Cmd: handoffCommand}); err != nil {
+		conn.Close()
+
+		return fmt.Errorf("requesting handoff: %w", err)
+	}
+
+	var resp handoffResponse
+	if err := json.NewDecoder(conn).Decode(&resp); err != nil {
+		conn.Close()
+
+		return fmt.Errorf("reading handoff response: %w", err)
+	}
+
+	if resp.Error != "" {
+		conn.Close()
+
+		return fmt.Errorf("handoff refused: %s", resp.Error)
+	}
+
+	fds, err := reuseportListeners(wss.port)
+	if err != nil {
+		conn.Close()
+
+		return err
+	}
+
+	if len(fds) == 0 {
+		conn.Close()
+
+		return errors.New("no reuseport listeners found")
+	}
+
+	if err := steerToNewest(fds[0], resp.Listeners, len(fds)); err != nil {
+		conn.Close()
+
+		return err
+	}
+
+	wss.logger.Info("took over listeners", zap.Int("old_listeners", resp.Listeners), zap.Int("new_listeners", len(fds)))
+
+	// The old process never writes again; EOF means it has exited and its
+	// sockets have left the group.
+	go func() {
+		defer conn.Close()
+
+		_, _ = io.Copy(io.Discard, conn)
+
+		if err := unsteer(fds[0]); err != nil {
+			wss.logger.Warn("restoring reuseport hashing", zap.Error(err))
+
+			return
+		}
+
+		wss.logger.Info("previous process exited, restored reuseport hashing")
+	}()
+
+	return nil
+}
+
+func (wss *wsServer) serveControl() error {
+	var (
+		ln  net.Listener
+		err error
+	)
+
+	// Right after a takeover the old process may still be letting go of the
+	// socket path.
+	for i := 0; i < controlListenRetries; i++ {
+		if ln, err = net.Listen("unix", wss.controlSocket); err == nil {
+			break
+		}
+
+		time.Sleep(controlListenBackoff)
+	}
+
+	if err != nil {
+		return fmt.Errorf("listening on control socket: %w", err)
+	}
+
+	wss.logger.Info("control socket is listening", zap.String("path", wss.controlSocket))
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return fmt.Errorf("accepting control connection: %w", err)
+		}
+
+		if wss.handleControl(conn, ln) {
+			return nil
+		}
+	}
+}
+
+// handleControl reports whether the control socket was handed off. The
+// connection is then kept open until the process exits.
+func (wss *wsServer) handleControl(conn net.Conn, ln net.Listener) bool {
+	var req handoffRequest
+	if err := json.NewDecoder(conn).Decode(&req); err != nil {
+		conn.Close()
+
+		return false
+	}
+
+	if req.Cmd != handoffCommand {
+		_ = json.NewEncoder(conn).Encode(handoffResponse{Error: fmt.Sprintf("unknown command %q", req.Cmd)})
+		conn.Close()
+
+		return false
+	}
+
+	fds, err := reuseportListeners(wss.port)
+	if err != nil {
+		_ = json.NewEncoder(conn).Encode(handoffResponse{Error: err.Error()})
+		conn.Close()
+
+		return false
+	}
+
+	// Closing the listener unlinks the path so the new process can bind it.
+	ln.Close()
+
+	if err := json.NewEncoder(conn).Encode(handoffResponse{Listeners: len(fds)}); err != nil {
+		wss.logger.Warn("answering handoff", zap.Error(err))
+	}
+
+	wss.handoffConn = conn
+
+	go wss.shutdown(zap.String("reason", "handoff"))
+
+	return true
+}
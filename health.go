@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+
+	"go.uber.org/zap"
+)
+
+type readinessCheck struct {
+	name  string
+	check func() error
+}
+
+// healthServer is the probe sidecar. /healthz only says the process is up,
+// /readyz runs every registered check so a node that is still booting or
+// has lost a dependency is taken out of rotation. extra carries other
+// unauthenticated read-only endpoints such as /capabilities.
+type healthServer struct {
+	addr   string
+	checks []readinessCheck
+	extra  map[string]http.HandlerFunc
+	logger *zap.Logger
+}
+
+func (h *healthServer) handler() http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, _ *http.Request) {
+		fmt.Fprintln(w, "ok")
+	})
+
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, _ *http.Request) {
+		for _, rc := range h.checks {
+			if err := rc.check(); err != nil {
+				http.Error(w, fmt.Sprintf("%s: %v", rc.name, err), http.StatusServiceUnavailable)
+
+				return
+			}
+		}
+
+		fmt.Fprintln(w, "ok")
+	})
+
+	for pattern, fn := range h.extra {
+		mux.HandleFunc(pattern, fn)
+	}
+
+	return mux
+}
+
+func (h *healthServer) serve() {
+	h.logger.Info("health server is listening", zap.String("addr", h.addr))
+
+	if err := http.ListenAndServe(h.addr, h.handler()); err != nil {
+		h.logger.Error("health server exits", zap.Error(err))
+	}
+}
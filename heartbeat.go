@@ -0,0 +1,245 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/panjf2000/gnet/v2"
+	"go.uber.org/zap"
+)
+
+const frameHeartbeat = "heartbeat"
+
+// Heartbeat statuses, announced on presence frames alongside joins and
+// leaves.
+const (
+	presenceOnline  = "online"
+	presenceAway    = "away"
+	presenceOffline = "offline"
+)
+
+var errHeartbeatsDisabled = errors.New("heartbeats are disabled")
+
+// lastSeenRegistry knows when each identity last sent a heartbeat frame.
+// Unlike websocket pings, which the client's stack answers by itself,
+// heartbeats come from the application, so a socket left open by a
+// backgrounded app or a sleeping laptop stops sending them. An identity is
+// online after a heartbeat, away once none came for away and offline after
+// offline; every change is announced to the rooms its connections are in
+// and given to onStatus. Identities that never sent a heartbeat have no
+// status.
+type lastSeenRegistry struct {
+	away, offline time.Duration
+	logger        *zap.Logger
+	// onStatus, if set, is called with every change, without locks held.
+	onStatus func(tenant, identity, status string)
+
+	mu   sync.Mutex
+	seen map[lastSeenKey]*lastSeen
+}
+
+// lastSeenKey qualifies identities by tenant; client ids and session
+// subjects are only unique within one.
+type lastSeenKey struct {
+	tenant, identity string
+}
+
+type lastSeen struct {
+	at     time.Time
+	status string
+	conns  map[gnet.Conn]struct{}
+}
+
+// statusChange is a status to announce for the connections of an identity.
+type statusChange struct {
+	lastSeenKey
+	status string
+	conns  []gnet.Conn
+}
+
+func newLastSeenRegistry(away, offline time.Duration, logger *zap.Logger) (*lastSeenRegistry, error) {
+	if offline <= away {
+		return nil, fmt.Errorf("offline threshold %s must be longer than away threshold %s", offline, away)
+	}
+
+	return &lastSeenRegistry{away: away, offline: offline, logger: logger, seen: make(map[lastSeenKey]*lastSeen)}, nil
+}
+
+func lastSeenKeyOf(c gnet.Conn) lastSeenKey {
+	key := lastSeenKey{identity: connIdentity(c)}
+	if codec, ok := codecOf(c); ok {
+		key.tenant = codec.tenant
+	}
+
+	return key
+}
+
+// beat records a heartbeat from c and returns the change it makes, if the
+// identity was not online.
+func (l *lastSeenRegistry) beat(c gnet.Conn, now time.Time) *statusChange {
+	key := lastSeenKeyOf(c)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	e, ok := l.seen[key]
+	if !ok {
+		e = &lastSeen{conns: make(map[gnet.Conn]struct{})}
+		l.seen[key] = e
+	}
+
+	e.at = now
+	e.conns[c] = struct{}{}
+
+	if e.status == presenceOnline {
+		return nil
+	}
+
+	e.status = presenceOnline
+
+	return e.change(key)
+}
+
+func (e *lastSeen) change(key lastSeenKey) *statusChange {
+	change := &statusChange{lastSeenKey: key, status: e.status, conns: make([]gnet.Conn, 0, len(e.conns))}
+	for c := range e.conns {
+		change.conns = append(change.conns, c)
+	}
+
+	return change
+}
+
+// forget drops c, and its identity once it has no connection left; the
+// presence leave speaks for it from then on. It is safe to call with b.mu
+// held.
+func (l *lastSeenRegistry) forget(c gnet.Conn) {
+	if l == nil {
+		return
+	}
+
+	key := lastSeenKeyOf(c)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	e, ok := l.seen[key]
+	if !ok {
+		return
+	}
+
+	delete(e.conns, c)
+	if len(e.conns) == 0 {
+		delete(l.seen, key)
+	}
+}
+
+// sweep moves identities whose heartbeats stopped to away or offline.
+func (l *lastSeenRegistry) sweep(now time.Time) []*statusChange {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var changes []*statusChange
+
+	for key, e := range l.seen {
+		status := presenceOnline
+
+		switch silent := now.Sub(e.at); {
+		case silent >= l.offline:
+			status = presenceOffline
+		case silent >= l.away:
+			status = presenceAway
+		}
+
+		if status != e.status {
+			e.status = status
+			changes = append(changes, e.change(key))
+		}
+	}
+
+	return changes
+}
+
+// statuses gives the status of those of members that sent heartbeats, nil
+// when there are none.
+func (l *lastSeenRegistry) statuses(tenant string, members []string) map[string]string {
+	if l == nil {
+		return nil
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var statuses map[string]string
+
+	for _, member := range members {
+		if e, ok := l.seen[lastSeenKey{tenant: tenant, identity: member}]; ok {
+			if statuses == nil {
+				statuses = make(map[string]string)
+			}
+
+			statuses[member] = e.status
+		}
+	}
+
+	return statuses
+}
+
+// heartbeat answers a heartbeat frame from c.
+func (b *broadcastService) heartbeat(c gnet.Conn, id string) error {
+	if b.lastSeen == nil {
+		return writeControlError(c, id, fmt.Sprintf("%s: %v", frameHeartbeat, errHeartbeatsDisabled))
+	}
+
+	if change := b.lastSeen.beat(c, time.Now()); change != nil {
+		b.announceStatus(change)
+	}
+
+	if id != "" {
+		return writeControlFrame(c, controlFrame{Type: frameAck, ID: id})
+	}
+
+	return nil
+}
+
+// watchLastSeen sweeps the registry until the process exits.
+func (b *broadcastService) watchLastSeen() {
+	ticker := time.NewTicker(b.lastSeen.away / 4)
+	defer ticker.Stop()
+
+	for now := range ticker.C {
+		for _, change := range b.lastSeen.sweep(now) {
+			b.announceStatus(change)
+		}
+	}
+}
+
+// announceStatus tells every room the identity's connections are in once,
+// when presence is enabled.
+func (b *broadcastService) announceStatus(change *statusChange) {
+	if b.presence == nil {
+		change.conns = nil
+	}
+
+	b.mu.RLock()
+	rooms := make(map[string]struct{})
+	for _, c := range change.conns {
+		if tc, ok := b.connections[c]; ok {
+			for name := range tc.subscriptions {
+				rooms[name] = struct{}{}
+			}
+		}
+	}
+	b.mu.RUnlock()
+
+	for name := range rooms {
+		if err := b.announcePresence(name, change.identity, change.status, nil); err != nil {
+			b.lastSeen.logger.Warn("announcing status", zap.String("room", name), zap.String("member", change.identity), zap.Error(err))
+		}
+	}
+
+	if b.lastSeen.onStatus != nil {
+		b.lastSeen.onStatus(change.tenant, change.identity, change.status)
+	}
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+
+	"go.uber.org/zap"
+)
+
+var (
+	errDuplicateHook = errors.New("hook already registered")
+	errUnknownHook   = errors.New("no such hook")
+)
+
+// messageHook is told about every message published to any room, in
+// sequence order per room. Derived systems such as bridges, search indexes
+// or analytics consume the hub through it.
+type messageHook interface {
+	onMessage(ctx context.Context, room string, msg roomMessage) error
+}
+
+type hookEvent struct {
+	room string
+	msg  roomMessage
+}
+
+// hookRunner feeds one hook from its own goroutine, so a slow hook never
+// holds up publishers. Events queue without bound until the hook catches up.
+type hookRunner struct {
+	name string
+	hook messageHook
+	// parent is what the runner's context, ctx, was derived from, to derive
+	// the next one from when the hook is replayed.
+	parent context.Context
+	ctx    context.Context
+	cancel context.CancelFunc
+	logger *zap.Logger
+	// done is closed once the goroutine feeding the hook has returned.
+	done chan struct{}
+
+	mu      sync.Mutex
+	pending []hookEvent
+	wake    chan struct{}
+}
+
+// hookReplay asks for room history to be fed to a hook before live messages,
+// for example to rebuild an index after a restart. Since maps a room to the
+// last sequence the hook already has; rooms not in it are replayed from the
+// oldest message kept. A nil hookReplay replays nothing.
+type hookReplay struct {
+	Since map[string]uint64 `json:"since"`
+}
+
+// registerHook starts feeding hook every message published from now on,
+// preceded by the requested replay. No message is missed or delivered twice
+// between the two. It returns the rooms whose history no longer reaches back
+// to the requested sequence, whose derived state has a gap.
+func (b *broadcastService) registerHook(ctx context.Context, name string, hook messageHook, replay *hookReplay, logger *zap.Logger) ([]string, error) {
+	hr := newHookRunner(ctx, name, hook, logger.With(zap.String("hook", name)))
+
+	b.mu.Lock()
+
+	if _, ok := b.hooks[name]; ok {
+		b.mu.Unlock()
+		hr.cancel()
+
+		return nil, errDuplicateHook
+	}
+
+	var gaps []string
+	hr.pending, gaps = b.replayEvents(replay)
+
+	if b.hooks == nil {
+		b.hooks = make(map[string]*hookRunner)
+	}
+	b.hooks[name] = hr
+
+	b.mu.Unlock()
+
+	hr.notify()
+
+	go hr.run(nil)
+
+	return gaps, nil
+}
+
+// replayHook starts the hook called name over from the requested replay,
+// for when the system behind it lost its derived state. Events it had
+// queued are dropped in favour of the replay, and the hook is not called
+// again until its last delivery has returned. It reports gaps as
+// registerHook does.
+func (b *broadcastService) replayHook(name string, replay *hookReplay) ([]string, error) {
+	b.mu.Lock()
+
+	prev, ok := b.hooks[name]
+	if !ok {
+		b.mu.Unlock()
+
+		return nil, errUnknownHook
+	}
+
+	hr := newHookRunner(prev.parent, name, prev.hook, prev.logger)
+
+	var gaps []string
+	hr.pending, gaps = b.replayEvents(replay)
+	b.hooks[name] = hr
+
+	b.mu.Unlock()
+
+	prev.cancel()
+	hr.notify()
+
+	go hr.run(prev.done)
+
+	return gaps, nil
+}
+
+func newHookRunner(ctx context.Context, name string, hook messageHook, logger *zap.Logger) *hookRunner {
+	hr := &hookRunner{
+		name:   name,
+		hook:   hook,
+		parent: ctx,
+		logger: logger,
+		done:   make(chan struct{}),
+		wake:   make(chan struct{}, 1),
+	}
+
+	hr.ctx, hr.cancel = context.WithCancel(ctx)
+
+	return hr
+}
+
+// replayEvents returns the history replay asks for, and the rooms whose
+// history no longer reaches back far enough. It must be called with b.mu
+// held, so no message is recorded between the replay and what follows it.
+func (b *broadcastService) replayEvents(replay *hookReplay) ([]hookEvent, []string) {
+	if replay == nil {
+		return nil, nil
+	}
+
+	var (
+		events []hookEvent
+		gaps   []string
+	)
+
+	for _, r := range b.rooms {
+		since := replay.Since[r.name]
+
+		// A room whose history was trimmed away entirely has kept nothing
+		// up to its latest sequence.
+		oldest := r.seq + 1
+		if len(r.history) > 0 {
+			oldest = r.history[0].seq
+		}
+
+		if oldest > since+1 {
+			gaps = append(gaps, r.name)
+		}
+
+		for _, msg := range r.history {
+			if msg.seq > since {
+				events = append(events, hookEvent{room: r.name, msg: msg})
+			}
+		}
+	}
+
+	sort.Strings(gaps)
+
+	return events, gaps
+}
+
+// hookNames lists the registered hooks.
+func (b *broadcastService) hookNames() []string {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	names := make([]string, 0, len(b.hooks))
+	for name := range b.hooks {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	return names
+}
+
+// handleHooks lists the registered hooks on GET. POST ?name= replays kept
+// history into that hook before it carries on with live messages, from the
+// sequences a hookReplay body gives per room, or from the oldest message
+// kept without one, and answers with the rooms whose history has a gap.
+func (a *adminServer) handleHooks(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, a.bs.hookNames())
+	case http.MethodPost:
+		name := r.URL.Query().Get("name")
+
+		replay := &hookReplay{}
+		if err := json.NewDecoder(r.Body).Decode(replay); err != nil && !errors.Is(err, io.EOF) {
+			http.Error(w, "invalid replay: "+err.Error(), http.StatusBadRequest)
+
+			return
+		}
+
+		gaps, err := a.bs.replayHook(name, replay)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+
+			return
+		}
+
+		a.audit.Info("admin hook replay", zap.String("action", "replay_hook"), zap.String("hook", name), zap.Strings("gaps", gaps))
+
+		if gaps == nil {
+			gaps = []string{}
+		}
+
+		writeJSON(w, http.StatusOK, map[string][]string{"gaps": gaps})
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (b *broadcastService) unregisterHook(name string) {
+	b.mu.Lock()
+	hr, ok := b.hooks[name]
+	delete(b.hooks, name)
+	b.mu.Unlock()
+
+	if ok {
+		hr.cancel()
+	}
+}
+
+// notifyHooks queues msg for every hook. It must be called with b.mu held,
+// in the order messages are recorded.
+func (b *broadcastService) notifyHooks(room string, msg roomMessage) {
+	for _, hr := range b.hooks {
+		hr.mu.Lock()
+		hr.pending = append(hr.pending, hookEvent{room: room, msg: msg})
+		hr.mu.Unlock()
+
+		hr.notify()
+	}
+}
+
+func (hr *hookRunner) notify() {
+	select {
+	case hr.wake <- struct{}{}:
+	default:
+	}
+}
+
+// run feeds the hook until the runner is cancelled, once after, if set,
+// is closed.
+func (hr *hookRunner) run(after <-chan struct{}) {
+	defer close(hr.done)
+
+	ctx := hr.ctx
+
+	if after != nil {
+		select {
+		case <-ctx.Done():
+			return
+		case <-after:
+		}
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hr.wake:
+		}
+
+		hr.mu.Lock()
+		events := hr.pending
+		hr.pending = nil
+		hr.mu.Unlock()
+
+		for _, ev := range events {
+			if err := hr.hook.onMessage(ctx, ev.room, ev.msg); err != nil {
+				if ctx.Err() != nil {
+					return
+				}
+
+				hr.logger.Warn("hook failed", zap.String("room", ev.room), zap.Uint64("seq", ev.msg.seq), zap.Error(err))
+			}
+		}
+	}
+}
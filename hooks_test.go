@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/panjf2000/gnet/v2"
+	"go.uber.org/zap"
+)
+
+// recordingHook keeps the sequences it is fed per room.
+type recordingHook struct {
+	mu   sync.Mutex
+	seqs map[string][]uint64
+}
+
+func (h *recordingHook) onMessage(_ context.Context, room string, msg roomMessage) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.seqs == nil {
+		h.seqs = make(map[string][]uint64)
+	}
+
+	h.seqs[room] = append(h.seqs[room], msg.seq)
+
+	return nil
+}
+
+// waitFor waits until the hook has been fed n messages of room and returns
+// their sequences.
+func (h *recordingHook) waitFor(t *testing.T, room string, n int) []uint64 {
+	t.Helper()
+
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(time.Millisecond) {
+		h.mu.Lock()
+		seqs := append([]uint64(nil), h.seqs[room]...)
+		h.mu.Unlock()
+
+		if len(seqs) >= n || time.Now().After(deadline) {
+			return seqs
+		}
+	}
+}
+
+func newHookHub(historyDepth int, rooms ...string) *broadcastService {
+	b := &broadcastService{
+		connections:  make(map[gnet.Conn]*trackedConnection),
+		rooms:        make(map[string]*room),
+		tagIndex:     make(map[string]map[gnet.Conn]struct{}),
+		historyDepth: historyDepth,
+	}
+
+	for _, name := range rooms {
+		b.rooms[name] = b.newRoom(name)
+	}
+
+	return b
+}
+
+func publishN(t *testing.T, b *broadcastService, room string, n int) {
+	t.Helper()
+
+	for i := 0; i < n; i++ {
+		if err := b.publish(context.Background(), room, json.RawMessage(fmt.Sprintf(`{"n":%d}`, i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestHookReplayGaps(t *testing.T) {
+	b := newHookHub(2, "kept", "trimmed", "quiet")
+	publishN(t, b, "kept", 2)
+	publishN(t, b, "trimmed", 5)
+
+	cases := []struct {
+		name   string
+		replay *hookReplay
+		gaps   []string
+		kept   []uint64
+	}{
+		{name: "no replay", replay: nil, gaps: nil},
+		{name: "from the start", replay: &hookReplay{}, gaps: []string{"trimmed"}, kept: []uint64{1, 2}},
+		{name: "caught up", replay: &hookReplay{Since: map[string]uint64{"kept": 2, "trimmed": 5}}, gaps: nil},
+		{name: "within history", replay: &hookReplay{Since: map[string]uint64{"kept": 1, "trimmed": 3}}, gaps: nil, kept: []uint64{2}},
+		{name: "before history", replay: &hookReplay{Since: map[string]uint64{"kept": 0, "trimmed": 2}}, gaps: []string{"trimmed"}, kept: []uint64{1, 2}},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			hook := &recordingHook{}
+
+			gaps, err := b.registerHook(context.Background(), tc.name, hook, tc.replay, zap.NewNop())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer b.unregisterHook(tc.name)
+
+			if !reflect.DeepEqual(gaps, tc.gaps) {
+				t.Fatalf("gaps = %v, want %v", gaps, tc.gaps)
+			}
+
+			if got := hook.waitFor(t, "kept", len(tc.kept)); len(tc.kept) > 0 && !reflect.DeepEqual(got, tc.kept) {
+				t.Fatalf("replayed %v, want %v", got, tc.kept)
+			}
+		})
+	}
+
+	// A room whose history was trimmed away entirely still has a gap.
+	b.rooms["trimmed"].history = nil
+
+	gaps, err := b.registerHook(context.Background(), "emptied", &recordingHook{}, &hookReplay{Since: map[string]uint64{"trimmed": 4, "kept": 2}}, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(gaps, []string{"trimmed"}) {
+		t.Fatalf("gaps = %v, want [trimmed]", gaps)
+	}
+}
+
+// TestHookReplaySwitchToLive registers a replaying hook while messages are
+// being published and checks it gets every one exactly once and in order.
+func TestHookReplaySwitchToLive(t *testing.T) {
+	const messages = 500
+
+	b := newHookHub(messages, "live")
+	hook := &recordingHook{}
+
+	published := make(chan struct{})
+
+	go func() {
+		defer close(published)
+
+		for i := 0; i < messages; i++ {
+			if err := b.publish(context.Background(), "live", json.RawMessage(`{}`)); err != nil {
+				t.Error(err)
+
+				return
+			}
+		}
+	}()
+
+	// Register part way through.
+	for {
+		b.mu.RLock()
+		seq := b.rooms["live"].seq
+		b.mu.RUnlock()
+
+		if seq >= messages/4 {
+			break
+		}
+
+		time.Sleep(time.Microsecond)
+	}
+
+	if _, err := b.registerHook(context.Background(), "live", hook, &hookReplay{}, zap.NewNop()); err != nil {
+		t.Fatal(err)
+	}
+
+	<-published
+
+	got := hook.waitFor(t, "live", messages)
+	for i, seq := range got {
+		if seq != uint64(i+1) {
+			t.Fatalf("hook got %v, want 1 to %d once each", got, messages)
+		}
+	}
+
+	if len(got) != messages {
+		t.Fatalf("hook got %d messages, want %d", len(got), messages)
+	}
+
+	// Replaying it again feeds the same history anew, then live ones.
+	hook.mu.Lock()
+	hook.seqs = nil
+	hook.mu.Unlock()
+
+	gaps, err := b.replayHook("live", &hookReplay{Since: map[string]uint64{"live": messages - 2}})
+	if err != nil || gaps != nil {
+		t.Fatalf("replay: gaps %v, err %v", gaps, err)
+	}
+
+	publishN(t, b, "live", 1)
+
+	if got := hook.waitFor(t, "live", 3); !reflect.DeepEqual(got, []uint64{messages - 1, messages, messages + 1}) {
+		t.Fatalf("after replay the hook got %v", got)
+	}
+
+	if _, err := b.replayHook("missing", nil); err != errUnknownHook {
+		t.Fatalf("replaying an unknown hook: err = %v, want %v", err, errUnknownHook)
+	}
+}
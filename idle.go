@@ -0,0 +1,44 @@
+package main
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/gobwas/ws"
+	"go.uber.org/zap"
+)
+
+// reapIdle closes upgraded connections that have sent nothing for timeout,
+// with 1001. Connections quiet for half of it are pinged first, so a live
+// client that merely has nothing to say keeps itself open with its pong;
+// long-dead NAT'd clients never answer and are dropped.
+func (wss *wsServer) reapIdle(timeout time.Duration) {
+	ticker := time.NewTicker(timeout / 4)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		now := time.Now().UnixNano()
+
+		for _, c := range wss.bs.snapshot() {
+			codec, ok := codecOf(c)
+			if !ok {
+				continue
+			}
+
+			last := atomic.LoadInt64(&codec.atomicLastActive)
+			if last == 0 {
+				// Not upgraded yet.
+				continue
+			}
+
+			switch idle := time.Duration(now - last); {
+			case idle >= timeout:
+				codec.log.Info("closing idle connection", zap.Duration("idle", idle))
+
+				_ = closeWith(c, closeIdle, "")
+			case idle >= timeout/2:
+				_ = writeServerFrame(c, ws.OpPing, nil)
+			}
+		}
+	}
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+
+	"go.uber.org/zap"
+)
+
+const (
+	ipFilterAllow = "allow"
+	ipFilterDeny  = "deny"
+)
+
+// ipFilter screens connections by source address in OnOpen, before any
+// handshake work. A denied address is always refused; once the allowlist
+// is non-empty only addresses on it get in. The lists are edited at runtime
+// through the admin API and written to file, when set, so they survive
+// restarts. A nil ipFilter lets everything through.
+type ipFilter struct {
+	file string
+
+	mu    sync.RWMutex
+	allow []*net.IPNet
+	deny  []*net.IPNet
+}
+
+// ipFilterRules is the file format and the admin API's view of the lists.
+type ipFilterRules struct {
+	Allow []string `json:"allow"`
+	Deny  []string `json:"deny"`
+}
+
+// newIPFilter starts from the allow and deny flag lists, unless file
+// exists, in which case it holds the lists as last edited.
+func newIPFilter(file, allow, deny string) (*ipFilter, error) {
+	rules := ipFilterRules{Allow: splitList(allow), Deny: splitList(deny)}
+
+	if file != "" {
+		data, err := os.ReadFile(file)
+		switch {
+		case err == nil:
+			rules = ipFilterRules{}
+			if err := json.Unmarshal(data, &rules); err != nil {
+				return nil, fmt.Errorf("parsing ip filter %s: %w", file, err)
+			}
+		case !errors.Is(err, os.ErrNotExist):
+			return nil, fmt.Errorf("reading ip filter: %w", err)
+		}
+	}
+
+	f := &ipFilter{file: file}
+
+	var err error
+	if f.allow, err = parseCIDRs(strings.Join(rules.Allow, ",")); err != nil {
+		return nil, fmt.Errorf("allowlist: %w", err)
+	}
+
+	if f.deny, err = parseCIDRs(strings.Join(rules.Deny, ",")); err != nil {
+		return nil, fmt.Errorf("denylist: %w", err)
+	}
+
+	return f, nil
+}
+
+// permits reports whether ip may connect. Connections without an IP, over
+// unix sockets, are always let through.
+func (f *ipFilter) permits(ip net.IP) bool {
+	if f == nil || ip == nil {
+		return true
+	}
+
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	if containsIP(f.deny, ip) {
+		return false
+	}
+
+	return len(f.allow) == 0 || containsIP(f.allow, ip)
+}
+
+func (f *ipFilter) rules() ipFilterRules {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	return ipFilterRules{Allow: formatCIDRs(f.allow), Deny: formatCIDRs(f.deny)}
+}
+
+// update adds cidr to or removes it from list and persists the result. The
+// change only takes effect once persisted.
+func (f *ipFilter) update(list, cidr string, add bool) error {
+	nets, err := parseCIDRs(cidr)
+	if err != nil {
+		return err
+	}
+
+	if len(nets) != 1 {
+		return errors.New("exactly one CIDR is required")
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var target *[]*net.IPNet
+	switch list {
+	case ipFilterAllow:
+		target = &f.allow
+	case ipFilterDeny:
+		target = &f.deny
+	default:
+		return fmt.Errorf("unknown list %q", list)
+	}
+
+	updated := make([]*net.IPNet, 0, len(*target)+1)
+	for _, n := range *target {
+		if n.String() != nets[0].String() {
+			updated = append(updated, n)
+		}
+	}
+
+	if add {
+		updated = append(updated, nets[0])
+	}
+
+	previous := *target
+	*target = updated
+
+	if err := f.persist(); err != nil {
+		*target = previous
+
+		return err
+	}
+
+	return nil
+}
+
+// persist must be called with f.mu held.
+func (f *ipFilter) persist() error {
+	if f.file == "" {
+		return nil
+	}
+
+	data, err := json.MarshalIndent(ipFilterRules{Allow: formatCIDRs(f.allow), Deny: formatCIDRs(f.deny)}, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err := writeFileAtomic(f.file, append(data, '\n')); err != nil {
+		return fmt.Errorf("persisting ip filter: %w", err)
+	}
+
+	return nil
+}
+
+func formatCIDRs(nets []*net.IPNet) []string {
+	out := make([]string, 0, len(nets))
+	for _, n := range nets {
+		out = append(out, n.String())
+	}
+
+	return out
+}
+
+// handleIPFilter lists both lists on GET /ipfilter and edits one with
+// POST or DELETE /ipfilter/{allow,deny}?cidr=.
+func (a *adminServer) handleIPFilter(w http.ResponseWriter, r *http.Request) {
+	list := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/ipfilter"), "/")
+
+	if list == "" {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+
+			return
+		}
+
+		writeJSON(w, http.StatusOK, a.ipFilter.rules())
+
+		return
+	}
+
+	if list != ipFilterAllow && list != ipFilterDeny {
+		http.NotFound(w, r)
+
+		return
+	}
+
+	if r.Method != http.MethodPost && r.Method != http.MethodDelete {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+
+		return
+	}
+
+	cidr := r.URL.Query().Get("cidr")
+	add := r.Method == http.MethodPost
+
+	if err := a.ipFilter.update(list, cidr, add); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+
+		return
+	}
+
+	a.audit.Info("admin ip filter",
+		zap.String("action", "ip_filter"),
+		zap.String("list", list),
+		zap.String("cidr", cidr),
+		zap.Bool("add", add))
+
+	writeJSON(w, http.StatusOK, a.ipFilter.rules())
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"net"
+	"path/filepath"
+	"testing"
+)
+
+func TestIPFilterPrecedence(t *testing.T) {
+	cases := []struct {
+		name        string
+		allow, deny string
+		permitted   []string
+		refused     []string
+	}{
+		{name: "no lists", permitted: []string{"10.0.0.1", "2001:db8::1"}},
+		{name: "denylist only", deny: "10.0.0.0/8", permitted: []string{"192.168.0.1"}, refused: []string{"10.1.2.3"}},
+		{name: "allowlist only", allow: "10.0.0.0/8", permitted: []string{"10.1.2.3"}, refused: []string{"192.168.0.1", "2001:db8::1"}},
+		{
+			name:      "deny inside allow",
+			allow:     "10.0.0.0/8",
+			deny:      "10.1.0.0/16",
+			permitted: []string{"10.2.0.1"},
+			refused:   []string{"10.1.2.3", "192.168.0.1"},
+		},
+		{name: "deny wins over the same range", allow: "10.0.0.0/8", deny: "10.0.0.0/8", refused: []string{"10.1.2.3"}},
+		{name: "deny wins over a narrower allow", allow: "10.1.2.3", deny: "10.0.0.0/8", refused: []string{"10.1.2.3"}},
+		{name: "ipv6", allow: "2001:db8::/32", permitted: []string{"2001:db8::1"}, refused: []string{"2001:db9::1", "10.0.0.1"}},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			f, err := newIPFilter("", tc.allow, tc.deny)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for _, ip := range tc.permitted {
+				if !f.permits(net.ParseIP(ip)) {
+					t.Errorf("%s refused, want permitted", ip)
+				}
+			}
+
+			for _, ip := range tc.refused {
+				if f.permits(net.ParseIP(ip)) {
+					t.Errorf("%s permitted, want refused", ip)
+				}
+			}
+
+			// Unix sockets have no address to screen.
+			if !f.permits(nil) {
+				t.Error("connection without an IP refused")
+			}
+		})
+	}
+}
+
+// TestIPFilterPersisted checks runtime edits outlive a restart and take the
+// place of the flag lists.
+func TestIPFilterPersisted(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "ipfilter.json")
+
+	f, err := newIPFilter(file, "10.0.0.0/8", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := f.update(ipFilterDeny, "10.1.0.0/16", true); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := f.update(ipFilterAllow, "10.0.0.0/8", false); err != nil {
+		t.Fatal(err)
+	}
+
+	restarted, err := newIPFilter(file, "192.168.0.0/16", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if restarted.permits(net.ParseIP("10.1.2.3")) {
+		t.Error("denied address permitted after a restart")
+	}
+
+	if !restarted.permits(net.ParseIP("172.16.0.1")) {
+		t.Error("the allowlist emptied at runtime came back from the flag after a restart")
+	}
+}
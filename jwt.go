@@ -0,0 +1,357 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/panjf2000/gnet/v2"
+)
+
+const (
+	frameKick       = "kick"
+	frameCreateRoom = "create_room"
+)
+
+// Capabilities a role can grant. Admins may kick connections and create
+// rooms; without it, subscribing only joins rooms that already exist.
+const (
+	capPublish capabilitySet = 1 << iota
+	capSubscribe
+	capAdmin
+)
+
+var capabilityNames = map[string]capabilitySet{
+	"publish":   capPublish,
+	"subscribe": capSubscribe,
+	"admin":     capAdmin,
+}
+
+var (
+	errNoToken      = errors.New("no bearer token")
+	errInvalidToken = errors.New("invalid token")
+	errTokenExpired = errors.New("token expired")
+	errNoSuchRoom   = errors.New("room does not exist")
+)
+
+type capabilitySet uint8
+
+func (s capabilitySet) String() string {
+	var names []string
+	for name, c := range capabilityNames {
+		if s&c != 0 {
+			names = append(names, name)
+		}
+	}
+
+	sort.Strings(names)
+
+	return strings.Join(names, ",")
+}
+
+func parseCapabilities(s string) (capabilitySet, error) {
+	var set capabilitySet
+
+	for _, name := range strings.FieldsFunc(s, func(r rune) bool { return r == ',' || r == '+' }) {
+		c, ok := capabilityNames[name]
+		if !ok {
+			return 0, fmt.Errorf("unknown capability %q, want publish, subscribe or admin", name)
+		}
+
+		set |= c
+	}
+
+	return set, nil
+}
+
+// parseRoleMap parses comma-separated role=capabilities pairs, capabilities
+// joined by "+", e.g. "backend=publish,browser=subscribe,ops=admin+publish".
+func parseRoleMap(s string) (map[string]capabilitySet, error) {
+	roles := make(map[string]capabilitySet)
+
+	for _, item := range splitList(s) {
+		i := strings.IndexByte(item, '=')
+		if i <= 0 {
+			return nil, fmt.Errorf("role %q: want role=capabilities", item)
+		}
+
+		caps, err := parseCapabilities(item[i+1:])
+		if err != nil {
+			return nil, fmt.Errorf("role %q: %w", item[:i], err)
+		}
+
+		roles[item[:i]] |= caps
+	}
+
+	return roles, nil
+}
+
+// jwtValidator accepts JWTs signed with HS256 under secret or RS256 under
+// key, and grants the capabilities its role map gives the token's roles:
+// those in a "roles" claim, a string or a list, and the space-separated
+// "scope" or "scp" claims. The string claim tenantClaim, when set, names
+// the connection's tenant.
+type jwtValidator struct {
+	secret      []byte
+	key         *rsa.PublicKey
+	issuer      string
+	audience    string
+	roles       map[string]capabilitySet
+	tenantClaim string
+}
+
+func loadRSAPublicKey(file string) (*rsa.PublicKey, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("reading JWT public key: %w", err)
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("JWT public key %s is not PEM", file)
+	}
+
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("parsing JWT public key: %w", err)
+	}
+
+	rsaKey, ok := key.(*rsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("JWT public key %s is not an RSA key", file)
+	}
+
+	return rsaKey, nil
+}
+
+type jwtClaims struct {
+	Subject   string          `json:"sub"`
+	Issuer    string          `json:"iss"`
+	Audience  json.RawMessage `json:"aud"`
+	Expires   int64           `json:"exp"`
+	NotBefore int64           `json:"nbf"`
+	Roles     json.RawMessage `json:"roles"`
+	Scope     string          `json:"scope"`
+	Scp       string          `json:"scp"`
+}
+
+func (v *jwtValidator) validate(token string) (map[string]string, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errInvalidToken
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+	}
+
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return nil, errInvalidToken
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errInvalidToken
+	}
+
+	signed := []byte(parts[0] + "." + parts[1])
+
+	switch {
+	case header.Alg == "HS256" && v.secret != nil:
+		mac := hmac.New(sha256.New, v.secret)
+		mac.Write(signed)
+
+		if !hmac.Equal(sig, mac.Sum(nil)) {
+			return nil, errInvalidToken
+		}
+	case header.Alg == "RS256" && v.key != nil:
+		sum := sha256.Sum256(signed)
+		if rsa.VerifyPKCS1v15(v.key, crypto.SHA256, sum[:], sig) != nil {
+			return nil, errInvalidToken
+		}
+	default:
+		return nil, fmt.Errorf("%w: unexpected alg %q", errInvalidToken, header.Alg)
+	}
+
+	var claims jwtClaims
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return nil, errInvalidToken
+	}
+
+	now := time.Now().Unix()
+	if claims.Expires != 0 && now >= claims.Expires {
+		return nil, errTokenExpired
+	}
+
+	if claims.NotBefore != 0 && now < claims.NotBefore {
+		return nil, fmt.Errorf("%w: not valid yet", errInvalidToken)
+	}
+
+	if v.issuer != "" && claims.Issuer != v.issuer {
+		return nil, fmt.Errorf("%w: wrong issuer", errInvalidToken)
+	}
+
+	if v.audience != "" && !containsString(stringOrList(claims.Audience), v.audience) {
+		return nil, fmt.Errorf("%w: wrong audience", errInvalidToken)
+	}
+
+	roles := stringOrList(claims.Roles)
+	roles = append(roles, strings.Fields(claims.Scope)...)
+	roles = append(roles, strings.Fields(claims.Scp)...)
+
+	var caps capabilitySet
+	for _, role := range roles {
+		caps |= v.roles[role]
+	}
+
+	metadata := map[string]string{
+		"session_subject": claims.Subject,
+		"roles":           strings.Join(roles, ","),
+		"capabilities":    caps.String(),
+	}
+
+	if v.tenantClaim != "" {
+		var all map[string]interface{}
+		if err := decodeJWTPart(parts[1], &all); err != nil {
+			return nil, errInvalidToken
+		}
+
+		if tenant, ok := all[v.tenantClaim].(string); ok && tenant != "" {
+			metadata["tenant"] = tenant
+		}
+	}
+
+	return metadata, nil
+}
+
+func decodeJWTPart(part string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(data, v)
+}
+
+// stringOrList decodes a claim that may be a single string or a list.
+func stringOrList(raw json.RawMessage) []string {
+	var list []string
+	if json.Unmarshal(raw, &list) == nil {
+		return list
+	}
+
+	var s string
+	if json.Unmarshal(raw, &s) == nil && s != "" {
+		return []string{s}
+	}
+
+	return nil
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+
+	return false
+}
+
+// jwtUpgradeHook authenticates upgrades with a bearer token in the
+// Authorization header or, for browsers that cannot set one, the
+// access_token query parameter. Upgrades without a valid token are
+// rejected with 401.
+func jwtUpgradeHook(v *jwtValidator) upgradeHook {
+	return func(ctx context.Context, req *upgradeRequest) (*upgradeResult, error) {
+		token, _ := bearerToken(req.Header.Get("Authorization"))
+		if token == "" {
+			token = req.Query.Get("access_token")
+		}
+
+		if token == "" {
+			return nil, unauthorized(errNoToken)
+		}
+
+		metadata, err := v.validate(token)
+		if err != nil {
+			return nil, unauthorized(err)
+		}
+
+		return &upgradeResult{Metadata: metadata}, nil
+	}
+}
+
+// permit returns an error unless conn holds capability. Without role-based
+// access control everyone may publish and subscribe and nobody is an admin.
+func (wss *wsServer) permit(conn gnet.Conn, capability capabilitySet) error {
+	if !wss.rbac {
+		if capability == capAdmin {
+			return errNotPermitted
+		}
+
+		return nil
+	}
+
+	codec, ok := codecOf(conn)
+	if !ok || codec.capabilities&capability == 0 {
+		return errNotPermitted
+	}
+
+	return nil
+}
+
+// permitSubscribe checks the capabilities subscribing to room takes: only
+// admins may create it by subscribing.
+func (wss *wsServer) permitSubscribe(conn gnet.Conn, room string) error {
+	if err := wss.permit(conn, capSubscribe); err != nil {
+		return err
+	}
+
+	if !wss.rbac || wss.permit(conn, capAdmin) == nil || wss.bs.roomExists(room) {
+		return nil
+	}
+
+	return errNoSuchRoom
+}
+
+// authorizeSubscribe runs every check joining room takes, whether conn
+// asks with a subscribe frame or by its upgrade path.
+func (wss *wsServer) authorizeSubscribe(conn gnet.Conn, room string) error {
+	if err := wss.permitSubscribe(conn, room); err != nil {
+		return err
+	}
+
+	return wss.acls.authorize(conn, room, false)
+}
+
+func (b *broadcastService) roomExists(name string) bool {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	_, ok := b.rooms[name]
+
+	return ok
+}
+
+// createRoomFor creates room on behalf of an admin connection.
+func (b *broadcastService) createRoomFor(name string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	_, err := b.roomOf(name)
+
+	return err
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/gobwas/ws"
+)
+
+var jwtTestSecret = []byte("test secret")
+
+func jwtPart(v interface{}) string {
+	data, err := json.Marshal(v)
+	if err != nil {
+		panic(err)
+	}
+
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func signHS256(claims map[string]interface{}) string {
+	signed := jwtPart(map[string]string{"alg": "HS256", "typ": "JWT"}) + "." + jwtPart(claims)
+
+	mac := hmac.New(sha256.New, jwtTestSecret)
+	mac.Write([]byte(signed))
+
+	return signed + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func signRS256(key *rsa.PrivateKey, claims map[string]interface{}) string {
+	signed := jwtPart(map[string]string{"alg": "RS256", "typ": "JWT"}) + "." + jwtPart(claims)
+
+	sum := sha256.Sum256([]byte(signed))
+
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, sum[:])
+	if err != nil {
+		panic(err)
+	}
+
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func TestJWTValidate(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	other, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	roles := map[string]capabilitySet{"reader": capSubscribe, "writer": capPublish, "ops": capAdmin}
+
+	hs := &jwtValidator{secret: jwtTestSecret, issuer: "auth", audience: "wsb", roles: roles, tenantClaim: "org"}
+	rs := &jwtValidator{key: &key.PublicKey, roles: roles}
+
+	now := time.Now().Unix()
+	valid := map[string]interface{}{"sub": "alice", "iss": "auth", "aud": "wsb", "exp": now + 60}
+
+	with := func(extra map[string]interface{}) map[string]interface{} {
+		claims := make(map[string]interface{}, len(valid)+len(extra))
+		for k, v := range valid {
+			claims[k] = v
+		}
+
+		for k, v := range extra {
+			if v == nil {
+				delete(claims, k)
+			} else {
+				claims[k] = v
+			}
+		}
+
+		return claims
+	}
+
+	unsigned := jwtPart(map[string]string{"alg": "none"}) + "." + jwtPart(valid) + "."
+
+	tampered := signHS256(valid)
+	tampered = tampered[:len(tampered)-2] + "AA"
+
+	cases := []struct {
+		name      string
+		validator *jwtValidator
+		token     string
+		err       error
+		want      map[string]string
+	}{
+		{
+			name:      "hs256",
+			validator: hs,
+			token:     signHS256(valid),
+			want:      map[string]string{"session_subject": "alice", "roles": "", "capabilities": ""},
+		},
+		{name: "alg none", validator: hs, token: unsigned, err: errInvalidToken},
+		{name: "hs256 without a secret", validator: rs, token: signHS256(valid), err: errInvalidToken},
+		{name: "rs256 without a key", validator: hs, token: signRS256(key, valid), err: errInvalidToken},
+		{name: "bad hs256 signature", validator: hs, token: tampered, err: errInvalidToken},
+		{name: "rs256 signed by another key", validator: rs, token: signRS256(other, valid), err: errInvalidToken},
+		{name: "not a jwt", validator: hs, token: "abc.def", err: errInvalidToken},
+		{name: "expired", validator: hs, token: signHS256(with(map[string]interface{}{"exp": now - 1})), err: errTokenExpired},
+		{name: "not valid yet", validator: hs, token: signHS256(with(map[string]interface{}{"nbf": now + 60})), err: errInvalidToken},
+		{name: "wrong issuer", validator: hs, token: signHS256(with(map[string]interface{}{"iss": "elsewhere"})), err: errInvalidToken},
+		{name: "no issuer", validator: hs, token: signHS256(with(map[string]interface{}{"iss": nil})), err: errInvalidToken},
+		{name: "wrong audience", validator: hs, token: signHS256(with(map[string]interface{}{"aud": "other"})), err: errInvalidToken},
+		{
+			name:      "audience list",
+			validator: hs,
+			token:     signHS256(with(map[string]interface{}{"aud": []string{"other", "wsb"}})),
+			want:      map[string]string{"session_subject": "alice", "roles": "", "capabilities": ""},
+		},
+		{
+			name:      "rs256 with roles list",
+			validator: rs,
+			token:     signRS256(key, with(map[string]interface{}{"roles": []string{"reader", "writer"}})),
+			want:      map[string]string{"session_subject": "alice", "roles": "reader,writer", "capabilities": "publish,subscribe"},
+		},
+		{
+			name:      "roles string",
+			validator: hs,
+			token:     signHS256(with(map[string]interface{}{"roles": "ops"})),
+			want:      map[string]string{"session_subject": "alice", "roles": "ops", "capabilities": "admin"},
+		},
+		{
+			name:      "scope and scp",
+			validator: hs,
+			token:     signHS256(with(map[string]interface{}{"scope": "reader unknown", "scp": "writer"})),
+			want:      map[string]string{"session_subject": "alice", "roles": "reader,unknown,writer", "capabilities": "publish,subscribe"},
+		},
+		{
+			name:      "tenant claim",
+			validator: hs,
+			token:     signHS256(with(map[string]interface{}{"org": "acme"})),
+			want:      map[string]string{"session_subject": "alice", "roles": "", "capabilities": "", "tenant": "acme"},
+		},
+		{
+			name:      "tenant claim not a string",
+			validator: hs,
+			token:     signHS256(with(map[string]interface{}{"org": 7})),
+			want:      map[string]string{"session_subject": "alice", "roles": "", "capabilities": ""},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := tc.validator.validate(tc.token)
+
+			if tc.err != nil {
+				if !errors.Is(err, tc.err) {
+					t.Fatalf("err = %v, want %v", err, tc.err)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(got) != len(tc.want) {
+				t.Fatalf("metadata = %v, want %v", got, tc.want)
+			}
+
+			for k, v := range tc.want {
+				if got[k] != v {
+					t.Fatalf("metadata = %v, want %v", got, tc.want)
+				}
+			}
+		})
+	}
+}
+
+func TestJWTUpgradeHook(t *testing.T) {
+	hook := jwtUpgradeHook(&jwtValidator{secret: jwtTestSecret})
+	token := signHS256(map[string]interface{}{"sub": "alice"})
+
+	cases := []struct {
+		name   string
+		header http.Header
+		query  url.Values
+		status int
+	}{
+		{name: "bearer header", header: http.Header{"Authorization": {"Bearer " + token}}},
+		{name: "access_token query", header: http.Header{}, query: url.Values{"access_token": {token}}},
+		{name: "no token", header: http.Header{}, status: http.StatusUnauthorized},
+		{name: "bare token header", header: http.Header{"Authorization": {token}}, status: http.StatusUnauthorized},
+		{name: "invalid token", header: http.Header{"Authorization": {"Bearer " + token + "x"}}, status: http.StatusUnauthorized},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			result, err := hook(context.Background(), &upgradeRequest{Header: tc.header, Query: tc.query})
+
+			if tc.status != 0 {
+				var rejected *ws.ConnectionRejectedError
+				if !errors.As(err, &rejected) || rejected.StatusCode() != tc.status {
+					t.Fatalf("err = %v, want status %d", err, tc.status)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if result.Metadata["session_subject"] != "alice" {
+				t.Fatalf("metadata = %v", result.Metadata)
+			}
+		})
+	}
+}
+
+func TestTransportAccessRoles(t *testing.T) {
+	hub := &broadcastService{rooms: map[string]*room{"lobby": {}}}
+	access := transportAccess{rbac: true, bs: hub}
+
+	cases := []struct {
+		name         string
+		capabilities string
+		room         string
+		err          error
+	}{
+		{name: "subscriber joins existing room", capabilities: "subscribe", room: "lobby"},
+		{name: "subscriber cannot create room", capabilities: "subscribe", room: "new", err: errNoSuchRoom},
+		{name: "admin creates room", capabilities: "admin,subscribe", room: "new"},
+		{name: "publisher cannot subscribe", capabilities: "publish", room: "lobby", err: errNotPermitted},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := access.authorizeSubscribe(map[string]string{"capabilities": tc.capabilities}, tc.room)
+			if !errors.Is(err, tc.err) {
+				t.Fatalf("err = %v, want %v", err, tc.err)
+			}
+		})
+	}
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	roomCreated = "room_created"
+	roomDeleted = "room_deleted"
+)
+
+var (
+	errTooManyRooms = errors.New("room limit reached")
+	errRoomFull     = errors.New("room is full")
+)
+
+// lifecycleBuffer is how many events a slow listener may fall behind
+// before it misses some.
+const lifecycleBuffer = 64
+
+type lifecycleEvent struct {
+	Type string    `json:"type"`
+	Room string    `json:"room"`
+	Time time.Time `json:"time"`
+}
+
+// lifecycleFeed fans room lifecycle events out to admin listeners. Events
+// are sent from under the hub's lock, so they never block: a listener
+// whose buffer is full misses them.
+type lifecycleFeed struct {
+	mu        sync.Mutex
+	listeners map[chan lifecycleEvent]struct{}
+}
+
+func (f *lifecycleFeed) listen() chan lifecycleEvent {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.listeners == nil {
+		f.listeners = make(map[chan lifecycleEvent]struct{})
+	}
+
+	ch := make(chan lifecycleEvent, lifecycleBuffer)
+	f.listeners[ch] = struct{}{}
+
+	return ch
+}
+
+func (f *lifecycleFeed) unlisten(ch chan lifecycleEvent) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	delete(f.listeners, ch)
+}
+
+func (f *lifecycleFeed) emit(typ, room string) {
+	ev := lifecycleEvent{Type: typ, Room: room, Time: time.Now()}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for ch := range f.listeners {
+		select {
+		case ch <- ev:
+		default:
+		}
+	}
+}
+
+// createRoom adds a room within -max-rooms. It must be called with the
+// hub's lock held.
+func (b *broadcastService) createRoom(name string) (*room, error) {
+	if b.maxRooms > 0 && len(b.rooms) >= b.maxRooms {
+		return nil, errTooManyRooms
+	}
+
+	r := b.newRoom(name)
+	r.emptySince = time.Now()
+	b.rooms[name] = r
+
+	b.lifecycle.emit(roomCreated, name)
+
+	return r, nil
+}
+
+// roomOf returns the room, creating it if need be. It must be called with
+// the hub's lock held.
+func (b *broadcastService) roomOf(name string) (*room, error) {
+	if err := b.checkMoved(name); err != nil {
+		return nil, err
+	}
+
+	if r, ok := b.rooms[name]; ok {
+		return r, nil
+	}
+
+	return b.createRoom(name)
+}
+
+// vacated notes when a room loses its last member or transport client. It
+// must be called with the hub's lock held.
+func (r *room) vacated() {
+	if len(r.members) == 0 && r.holders == 0 && r.emptySince.IsZero() {
+		r.emptySince = time.Now()
+	}
+}
+
+// reapRooms deletes rooms that have been empty for ttl, history and
+// sequence numbers included.
+func (b *broadcastService) reapRooms(ttl time.Duration, logger *zap.Logger) {
+	interval := ttl / 4
+	if interval < time.Second {
+		interval = time.Second
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for now := range ticker.C {
+		var reaped []string
+
+		b.mu.Lock()
+		for name, r := range b.rooms {
+			if r.emptySince.IsZero() || now.Sub(r.emptySince) < ttl {
+				continue
+			}
+
+			delete(b.rooms, name)
+			b.lifecycle.emit(roomDeleted, name)
+
+			reaped = append(reaped, name)
+		}
+		b.mu.Unlock()
+
+		if len(reaped) > 0 {
+			logger.Info("deleted empty rooms", zap.Strings("rooms", reaped))
+		}
+	}
+}
+
+// handleRoomEvents streams lifecycle events as Server-Sent Events on GET
+// /events/rooms until the listener goes away.
+func (a *adminServer) handleRoomEvents(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+
+		return
+	}
+
+	events := a.bs.lifecycle.listen()
+	defer a.bs.lifecycle.unlisten(events)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+
+	fmt.Fprint(w, ": listening\n\n")
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(sseHeartbeat)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case ev := <-events:
+			data, err := json.Marshal(ev)
+			if err != nil {
+				return
+			}
+
+			if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", ev.Type, data); err != nil {
+				return
+			}
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(w, ": ping\n\n"); err != nil {
+				return
+			}
+		}
+
+		flusher.Flush()
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gobwas/ws"
+	"github.com/panjf2000/gnet/v2"
+)
+
+// admit decides whether a handshake may complete before any OnUpgrade hook
+// runs. A server at -max-connections or above -upgrade-rate answers 503, so
+// clients back off instead of being accepted without bound; a source IP at
+// its own cap is answered 429.
+func (wss *wsServer) admit(codec *wsCodec) error {
+	if err := wss.throttle.allow(time.Now()); err != nil {
+		atomic.AddUint64(&wss.atomicRejectedConnections, 1)
+
+		return err
+	}
+
+	if wss.maxConnections > 0 && atomic.LoadInt64(&wss.atomicNumberOfConnections) > wss.maxConnections {
+		atomic.AddUint64(&wss.atomicRejectedConnections, 1)
+
+		return ws.RejectConnectionError(
+			ws.RejectionStatus(http.StatusServiceUnavailable),
+			ws.RejectionHeader(ws.HandshakeHeaderString("Retry-After: 5\r\n")),
+			ws.RejectionReason("server is at capacity"),
+		)
+	}
+
+	if wss.perIP.over(codec.ip) {
+		atomic.AddUint64(&wss.atomicRejectedConnections, 1)
+
+		return ws.RejectConnectionError(
+			ws.RejectionStatus(http.StatusTooManyRequests),
+			ws.RejectionReason("too many connections from this address"),
+		)
+	}
+
+	return nil
+}
+
+// ipLimiter caps simultaneous connections per source IP, so one client or
+// script cannot exhaust the server. Addresses in exempt, such as trusted
+// proxies that carry many clients, are not counted. A nil ipLimiter allows
+// everything.
+type ipLimiter struct {
+	max    int
+	exempt []*net.IPNet
+
+	mu     sync.Mutex
+	counts map[string]int
+}
+
+func newIPLimiter(max int, exempt []*net.IPNet) *ipLimiter {
+	return &ipLimiter{max: max, exempt: exempt, counts: make(map[string]int)}
+}
+
+// open counts a connection from ip and returns the key to close it with,
+// empty when it is not counted.
+func (l *ipLimiter) open(ip net.IP) string {
+	if l == nil || ip == nil || containsIP(l.exempt, ip) {
+		return ""
+	}
+
+	key := ip.String()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.counts[key]++
+
+	return key
+}
+
+func (l *ipLimiter) close(key string) {
+	if l == nil || key == "" {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.counts[key]--; l.counts[key] <= 0 {
+		delete(l.counts, key)
+	}
+}
+
+// over reports whether key has more connections open than allowed.
+func (l *ipLimiter) over(key string) bool {
+	if l == nil || key == "" {
+		return false
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.counts[key] > l.max
+}
+
+// connIP is the source IP of c, nil for unix sockets.
+func connIP(c gnet.Conn) net.IP {
+	if addr, ok := c.RemoteAddr().(*net.TCPAddr); ok {
+		return addr.IP
+	}
+
+	return nil
+}
+
+// parseCIDRs parses a comma-separated list of CIDRs; bare addresses stand
+// for themselves.
+func parseCIDRs(s string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+
+	for _, item := range splitList(s) {
+		if !strings.Contains(item, "/") {
+			ip := net.ParseIP(item)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid address %q", item)
+			}
+
+			bits := 128
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+
+			continue
+		}
+
+		_, n, err := net.ParseCIDR(item)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR %q: %w", item, err)
+		}
+
+		nets = append(nets, n)
+	}
+
+	return nets, nil
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync/atomic"
+
+	"github.com/panjf2000/gnet/v2"
+	"go.uber.org/zap"
+)
+
+var errUnsupportedListener = errors.New("unsupported listener address")
+
+// validateListeners checks that every address is one gnet can serve
+// websockets on: tcp, tcp4, tcp6 or unix.
+func validateListeners(addrs []string) error {
+	for _, addr := range addrs {
+		i := strings.Index(addr, "://")
+		if i < 0 || i+3 == len(addr) {
+			return fmt.Errorf("%w %q", errUnsupportedListener, addr)
+		}
+
+		switch addr[:i] {
+		case "tcp", "tcp4", "tcp6", "unix":
+		default:
+			return fmt.Errorf("%w %q", errUnsupportedListener, addr)
+		}
+	}
+
+	return nil
+}
+
+// listenerOptions returns the engine options for one listener. Only the
+// primary listener runs the ticker, so system broadcasts go out once. Unix
+// sockets skip SO_REUSEPORT: every event loop would unlink and rebind the
+// same path. Event loops keep their OS thread so connections can be told
+// apart by the loop that owns them.
+func listenerOptions(addr string, primary bool, logger *zap.Logger) []gnet.Option {
+	return []gnet.Option{
+		gnet.WithMulticore(true),
+		gnet.WithLockOSThread(true),
+		gnet.WithReusePort(!strings.HasPrefix(addr, "unix://")),
+		gnet.WithTicker(primary),
+		gnet.WithLogger(logger.Sugar()),
+	}
+}
+
+// serve runs one engine per listener, all sharing the same hub, and returns
+// once they have all stopped. A listener that fails takes the others down
+// with it.
+func (wss *wsServer) serve() error {
+	errs := make(chan error, len(wss.addrs))
+
+	for i, addr := range wss.addrs {
+		go func(addr string, primary bool) {
+			err := gnet.Run(wss, addr, listenerOptions(addr, primary, wss.logger)...)
+			if err != nil {
+				err = fmt.Errorf("listener %s: %w", addr, err)
+			}
+
+			errs <- err
+		}(addr, i == 0)
+	}
+
+	var first error
+
+	for range wss.addrs {
+		if err := <-errs; err != nil && first == nil {
+			first = err
+
+			go wss.shutdown(zap.NamedError("listener_error", err))
+		}
+	}
+
+	return first
+}
+
+func (wss *wsServer) allListenersBooted() bool {
+	return int(atomic.LoadInt32(&wss.atomicBooted)) == len(wss.addrs)
+}
+
+// connRemoteAddr names the peer of conn. Clients on a unix socket are
+// usually unbound ("@"), so they are identified by the socket they came in
+// on.
+func connRemoteAddr(conn gnet.Conn) string {
+	addr := conn.RemoteAddr()
+
+	if ua, ok := addr.(*net.UnixAddr); ok && (ua.Name == "" || ua.Name == "@") {
+		return "unix:" + conn.LocalAddr().String()
+	}
+
+	if addr == nil {
+		return ""
+	}
+
+	return addr.String()
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/panjf2000/gnet/v2"
+	"go.uber.org/zap"
+)
+
+// loadHinter ranks the endpoints a client should prefer when it (re)connects,
+// least loaded first.
+type loadHinter interface {
+	endpoints() []endpointHint
+}
+
+type endpointHint struct {
+	URL         string `json:"url"`
+	Connections int64  `json:"connections"`
+}
+
+type nodeLoad struct {
+	Endpoint            string `json:"endpoint"`
+	Connections         int64  `json:"connections"`
+	MaxConnections      int64  `json:"max_connections,omitempty"`
+	RejectedConnections uint64 `json:"rejected_connections"`
+	HandshakeTimeouts   uint64 `json:"handshake_timeouts"`
+	Draining            bool   `json:"draining"`
+}
+
+// peerLoadHinter polls every peer's /load endpoint and ranks them together
+// with the local node. Peers that stop answering drop out of the ranking.
+type peerLoadHinter struct {
+	self     func() nodeLoad
+	peers    []string
+	interval time.Duration
+	client   *http.Client
+	logger   *zap.Logger
+
+	mu     sync.RWMutex
+	latest map[string]nodeLoad
+}
+
+func (p *peerLoadHinter) endpoints() []endpointHint {
+	p.mu.RLock()
+	loads := make([]nodeLoad, 0, len(p.latest)+1)
+	for _, load := range p.latest {
+		loads = append(loads, load)
+	}
+	p.mu.RUnlock()
+
+	loads = append(loads, p.self())
+
+	hints := make([]endpointHint, 0, len(loads))
+	for _, load := range loads {
+		if load.Draining || load.Endpoint == "" {
+			continue
+		}
+
+		hints = append(hints, endpointHint{URL: load.Endpoint, Connections: load.Connections})
+	}
+
+	sort.SliceStable(hints, func(i, j int) bool { return hints[i].Connections < hints[j].Connections })
+
+	return hints
+}
+
+func (p *peerLoadHinter) run() {
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+
+	for {
+		p.poll()
+		<-ticker.C
+	}
+}
+
+func (p *peerLoadHinter) poll() {
+	latest := make(map[string]nodeLoad, len(p.peers))
+
+	for _, peer := range p.peers {
+		load, err := p.fetch(peer)
+		if err != nil {
+			p.logger.Debug("polling peer load", zap.String("peer", peer), zap.Error(err))
+			continue
+		}
+
+		latest[peer] = load
+	}
+
+	p.mu.Lock()
+	p.latest = latest
+	p.mu.Unlock()
+}
+
+func (p *peerLoadHinter) fetch(peer string) (nodeLoad, error) {
+	var load nodeLoad
+
+	ctx, cancel := context.WithTimeout(context.Background(), p.interval)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, peer+"/load", nil)
+	if err != nil {
+		return load, fmt.Errorf("building request: %w", err)
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return load, fmt.Errorf("fetching load: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return load, fmt.Errorf("fetching load: unexpected status %s", resp.Status)
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(&load); err != nil {
+		return load, fmt.Errorf("decoding load: %w", err)
+	}
+
+	return load, nil
+}
+
+func (wss *wsServer) load() nodeLoad {
+	return nodeLoad{
+		Endpoint:            wss.advertiseURL,
+		Connections:         atomic.LoadInt64(&wss.atomicNumberOfConnections),
+		MaxConnections:      wss.maxConnections,
+		RejectedConnections: atomic.LoadUint64(&wss.atomicRejectedConnections),
+		HandshakeTimeouts:   atomic.LoadUint64(&wss.atomicHandshakeTimeouts),
+		Draining:            wss.isDraining(),
+	}
+}
+
+func (wss *wsServer) handleLoad(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+
+		return
+	}
+
+	writeJSON(w, http.StatusOK, wss.load())
+}
+
+// writeEndpointHints sends a welcome or reconnect frame carrying the current
+// ranking. Reconnect frames put the warm standby first, if there is one. It
+// is a no-op when there is nothing to advise.
+func (wss *wsServer) writeEndpointHints(conn gnet.Conn, frameType string, id uint64) error {
+	var endpoints []endpointHint
+
+	if frameType == frameReconnect && wss.standbyURL != "" {
+		endpoints = append(endpoints, endpointHint{URL: wss.standbyURL})
+	}
+
+	if wss.hints != nil {
+		endpoints = append(endpoints, wss.hints.endpoints()...)
+	}
+
+	if len(endpoints) == 0 {
+		return nil
+	}
+
+	return writeControlFrame(conn, controlFrame{
+		Type:      frameType,
+		ConnID:    id,
+		Endpoints: endpoints,
+	})
+}
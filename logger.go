@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+type logConfig struct {
+	level            string
+	sampleFirst      int
+	sampleThereafter int
+}
+
+// newLogger builds the JSON process logger and a sampled child of it for
+// lines that fire once per inbound message. Both share the returned level,
+// which can be changed at runtime.
+func newLogger(cfg logConfig) (*zap.Logger, *zap.Logger, zap.AtomicLevel, error) {
+	level, err := zapcore.ParseLevel(cfg.level)
+	if err != nil {
+		return nil, nil, zap.AtomicLevel{}, fmt.Errorf("parsing log level: %w", err)
+	}
+
+	zcfg := zap.NewProductionConfig()
+	zcfg.Level = zap.NewAtomicLevelAt(level)
+	zcfg.Sampling = nil
+	zcfg.EncoderConfig.TimeKey = "time"
+	zcfg.EncoderConfig.EncodeTime = zapcore.RFC3339NanoTimeEncoder
+
+	logger, err := zcfg.Build()
+	if err != nil {
+		return nil, nil, zap.AtomicLevel{}, fmt.Errorf("building logger: %w", err)
+	}
+
+	msgLogger := logger
+	if cfg.sampleFirst > 0 {
+		msgLogger = logger.WithOptions(zap.WrapCore(func(core zapcore.Core) zapcore.Core {
+			return zapcore.NewSamplerWithOptions(core, time.Second, cfg.sampleFirst, cfg.sampleThereafter)
+		}))
+	}
+
+	return logger, msgLogger, zcfg.Level, nil
+}
+
+// newAuditLogger writes audit entries as JSON lines to file, or tags them
+// onto the process log when file is empty.
+func newAuditLogger(file string, logger *zap.Logger) (*zap.Logger, error) {
+	if file == "" {
+		return logger.With(zap.Bool("audit", true)), nil
+	}
+
+	zcfg := zap.NewProductionConfig()
+	zcfg.Sampling = nil
+	zcfg.OutputPaths = []string{file}
+	zcfg.EncoderConfig.TimeKey = "time"
+	zcfg.EncoderConfig.EncodeTime = zapcore.RFC3339NanoTimeEncoder
+	zcfg.DisableCaller = true
+	zcfg.DisableStacktrace = true
+
+	audit, err := zcfg.Build()
+	if err != nil {
+		return nil, fmt.Errorf("building audit logger: %w", err)
+	}
+
+	return audit, nil
+}
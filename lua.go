@@ -0,0 +1,358 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/panjf2000/gnet/v2"
+	lua "github.com/yuin/gopher-lua"
+	"go.uber.org/zap"
+)
+
+const frameDirect = "direct"
+
+var errNoRouteFunction = errors.New("script must define a global route or deliver function")
+
+// luaRouter lets a script route inbound publishes and raw messages instead
+// of adding a flag for each bespoke rule. The script defines
+//
+//	function route(msg) ... end
+//
+// where msg has type ("publish" or "raw"), room, data, sender and tags.
+// Returning nothing handles the message as usual and false drops it. A
+// table may set data to rewrite the payload, and rooms and users to send
+// it there instead: rooms get a plain publish, users (identities as
+// presence names them) a direct frame. Under -multi-tenant, rooms are
+// named as the sender's tenant names them and messages only go to rooms
+// and users of that tenant.
+//
+// The script may also define
+//
+//	function deliver(msg) ... end
+//
+// to transform room messages per recipient, where msg has room, data and
+// attrs, the recipient's -transform-keys tags. Returning nothing delivers
+// the message as it is, false withholds it and a string replaces its data.
+type luaRouter struct {
+	timeout time.Duration
+	bs      *broadcastService
+	logger  *zap.Logger
+
+	// An LState runs one call at a time.
+	mu    sync.Mutex
+	state *lua.LState
+}
+
+type luaRoute struct {
+	drop  bool
+	data  []byte
+	rooms []string
+	users []string
+}
+
+// load runs the script and makes it the router's. An empty file unloads it.
+func (r *luaRouter) load(file string) error {
+	state, err := openLuaScript(file)
+	if err != nil {
+		return err
+	}
+
+	r.swap(state, file)
+
+	return nil
+}
+
+// openLuaScript runs the script in a state of its own, nil for an empty
+// file, without putting it in use.
+func openLuaScript(file string) (*lua.LState, error) {
+	if file == "" {
+		return nil, nil
+	}
+
+	state := lua.NewState()
+
+	if err := state.DoFile(file); err != nil {
+		state.Close()
+
+		return nil, fmt.Errorf("loading lua script: %w", err)
+	}
+
+	if !luaDefines(state, "route") && !luaDefines(state, "deliver") {
+		state.Close()
+
+		return nil, errNoRouteFunction
+	}
+
+	return state, nil
+}
+
+// swap makes state, run from file, the router's and closes the one it
+// replaces.
+func (r *luaRouter) swap(state *lua.LState, file string) {
+	r.mu.Lock()
+	old := r.state
+	r.state = state
+	r.mu.Unlock()
+
+	if old != nil {
+		old.Close()
+	}
+
+	if file != "" {
+		r.logger.Info("lua script loaded", zap.String("file", file))
+	}
+}
+
+func (r *luaRouter) middleware() middleware {
+	return middleware{name: "lua", onMessage: r.onMessage, onDeliver: r.onDeliver}
+}
+
+func luaDefines(L *lua.LState, name string) bool {
+	return L.GetGlobal(name).Type() == lua.LTFunction
+}
+
+func (r *luaRouter) onMessage(ctx context.Context, c gnet.Conn, msg *inboundMessage) error {
+	typ, room, data := "raw", "", msg.payload
+	if msg.frame != nil {
+		if msg.frame.Type != framePublish {
+			return nil
+		}
+
+		typ, room, data = framePublish, msg.frame.Room, msg.frame.Data
+	}
+
+	route, err := r.route(ctx, typ, room, data, c)
+	if err != nil {
+		return err
+	}
+
+	if route == nil {
+		return nil
+	}
+
+	if route.drop {
+		return errDropped
+	}
+
+	if route.data != nil {
+		if msg.frame != nil && !json.Valid(route.data) {
+			return errDataNotJSON
+		}
+
+		data = route.data
+		if msg.frame != nil {
+			msg.frame.Data = data
+		} else {
+			msg.payload = data
+		}
+	}
+
+	if len(route.rooms) == 0 && len(route.users) == 0 {
+		return nil
+	}
+
+	if msg.frame == nil && route.data == nil {
+		// Rooms keep what is published in history; the payload is
+		// recycled.
+		data = append([]byte(nil), data...)
+	}
+
+	if err := r.deliver(ctx, c, route, data); err != nil {
+		return err
+	}
+
+	if msg.frame != nil && msg.frame.ID != "" {
+		if err := writeControlFrame(c, controlFrame{Type: frameAck, ID: msg.frame.ID, Room: room}); err != nil {
+			return err
+		}
+	}
+
+	// Delivered where the script said; nothing is left to handle.
+	return errDropped
+}
+
+// route calls the script. It returns nil when none is loaded or it left
+// the message alone.
+func (r *luaRouter) route(ctx context.Context, typ, room string, data []byte, c gnet.Conn) (*luaRoute, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	L := r.state
+	if L == nil || !luaDefines(L, "route") {
+		return nil, nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, r.timeout)
+	defer cancel()
+
+	L.SetContext(ctx)
+	defer L.RemoveContext()
+
+	msg := L.NewTable()
+	msg.RawSetString("type", lua.LString(typ))
+	msg.RawSetString("room", lua.LString(localRoom(room)))
+	msg.RawSetString("data", lua.LString(data))
+	msg.RawSetString("sender", lua.LString(connIdentity(c)))
+
+	tags := L.NewTable()
+	for key, value := range r.bs.tagsOf(c) {
+		tags.RawSetString(key, lua.LString(value))
+	}
+	msg.RawSetString("tags", tags)
+
+	if err := L.CallByParam(lua.P{Fn: L.GetGlobal("route"), NRet: 1, Protect: true}, msg); err != nil {
+		return nil, fmt.Errorf("lua route: %w", err)
+	}
+
+	ret := L.Get(-1)
+	L.Pop(1)
+
+	switch ret := ret.(type) {
+	case *lua.LNilType:
+		return nil, nil
+	case lua.LBool:
+		if ret {
+			return nil, nil
+		}
+
+		return &luaRoute{drop: true}, nil
+	case *lua.LTable:
+		route := &luaRoute{rooms: luaStrings(ret.RawGetString("rooms")), users: luaStrings(ret.RawGetString("users"))}
+		if s, ok := ret.RawGetString("data").(lua.LString); ok {
+			route.data = []byte(s)
+		}
+
+		return route, nil
+	default:
+		return nil, fmt.Errorf("lua route returned %s, want nil, false or a table", ret.Type())
+	}
+}
+
+// onDeliver calls the script's deliver function, when it has one.
+func (r *luaRouter) onDeliver(ctx context.Context, attrs map[string]string, out *outboundMessage) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	L := r.state
+	if L == nil || !luaDefines(L, "deliver") {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, r.timeout)
+	defer cancel()
+
+	L.SetContext(ctx)
+	defer L.RemoveContext()
+
+	msg := L.NewTable()
+	msg.RawSetString("room", lua.LString(localRoom(out.room)))
+	msg.RawSetString("data", lua.LString(out.data))
+
+	table := L.NewTable()
+	for key, value := range attrs {
+		table.RawSetString(key, lua.LString(value))
+	}
+	msg.RawSetString("attrs", table)
+
+	if err := L.CallByParam(lua.P{Fn: L.GetGlobal("deliver"), NRet: 1, Protect: true}, msg); err != nil {
+		return fmt.Errorf("lua deliver: %w", err)
+	}
+
+	ret := L.Get(-1)
+	L.Pop(1)
+
+	switch ret := ret.(type) {
+	case *lua.LNilType:
+		return nil
+	case lua.LBool:
+		if ret {
+			return nil
+		}
+
+		return errDropped
+	case lua.LString:
+		out.data = []byte(ret)
+
+		return nil
+	default:
+		return fmt.Errorf("lua deliver returned %s, want nil, false or a string", ret.Type())
+	}
+}
+
+func luaStrings(v lua.LValue) []string {
+	t, ok := v.(*lua.LTable)
+	if !ok {
+		return nil
+	}
+
+	var items []string
+	for i := 1; i <= t.Len(); i++ {
+		if s, ok := t.RawGetInt(i).(lua.LString); ok {
+			items = append(items, string(s))
+		}
+	}
+
+	return items
+}
+
+func (r *luaRouter) deliver(ctx context.Context, c gnet.Conn, route *luaRoute, data []byte) error {
+	if !json.Valid(data) {
+		return errDataNotJSON
+	}
+
+	var tenant string
+	if codec, ok := codecOf(c); ok {
+		tenant = codec.tenant
+	}
+
+	for _, room := range route.rooms {
+		if err := r.bs.publish(ctx, tenantRoom(tenant, room), data); err != nil {
+			return fmt.Errorf("routing to room %q: %w", room, err)
+		}
+	}
+
+	if len(route.users) == 0 {
+		return nil
+	}
+
+	return r.bs.sendDirect(tenant, route.users, connIdentity(c), data)
+}
+
+func (b *broadcastService) tagsOf(c gnet.Conn) map[string]string {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	if tc, ok := b.connections[c]; ok {
+		return copyTags(tc.tags)
+	}
+
+	return nil
+}
+
+// sendDirect sends data from sender to every connection of tenant with one
+// of the given identities.
+func (b *broadcastService) sendDirect(tenant string, identities []string, sender string, data []byte) error {
+	wanted := make(map[string]bool, len(identities))
+	for _, identity := range identities {
+		wanted[identity] = true
+	}
+
+	frame := newEncodedFrame(controlFrame{Type: frameDirect, Member: sender, Data: data})
+
+	for _, c := range b.snapshot() {
+		codec, ok := codecOf(c)
+		if !ok || codec.tenant != tenant || !wanted[connIdentity(c)] {
+			continue
+		}
+
+		if _, err := frame.writeTo(c); err != nil {
+			return fmt.Errorf("sending direct message: %w", err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/panjf2000/gnet/v2"
+	lua "github.com/yuin/gopher-lua"
+	"go.uber.org/zap"
+)
+
+// TestLuaRouteStaysInTenant routes a publish of a tenant's client to a room
+// and a user and checks the script saw the tenant's own room names and the
+// message went nowhere outside the tenant.
+func TestLuaRouteStaysInTenant(t *testing.T) {
+	namespacedRooms = true
+	t.Cleanup(func() { namespacedRooms = false })
+
+	script := filepath.Join(t.TempDir(), "route.lua")
+	if err := os.WriteFile(script, []byte(`
+function route(msg)
+  seen = msg.room
+  return {rooms = {"news"}, users = {"session:bob"}}
+end
+`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	b := newHookHub(4, "acme/news", "news")
+	router := &luaRouter{timeout: time.Second, bs: b, logger: zap.NewNop()}
+
+	if err := router.load(script); err != nil {
+		t.Fatal(err)
+	}
+
+	sender := &queueConn{}
+	bobs := map[string]*queueConn{"acme": {}, "globex": {}}
+
+	register := func(c gnet.Conn, codec *wsCodec) {
+		b.connections[c] = &trackedConnection{id: codec.id}
+		openCodecs.Store(c, codec)
+		t.Cleanup(func() { openCodecs.Delete(c) })
+	}
+
+	register(sender, &wsCodec{id: 1, tenant: "acme", metadata: map[string]string{"session_subject": "alice"}})
+	register(bobs["acme"], &wsCodec{id: 2, tenant: "acme", metadata: map[string]string{"session_subject": "bob"}})
+	register(bobs["globex"], &wsCodec{id: 3, tenant: "globex", metadata: map[string]string{"session_subject": "bob"}})
+
+	msg := &inboundMessage{frame: &controlFrame{Type: framePublish, Room: "acme/lobby", Data: json.RawMessage(`{}`)}}
+	if err := router.onMessage(context.Background(), sender, msg); !errors.Is(err, errDropped) {
+		t.Fatalf("err = %v, want the message handled by the route", err)
+	}
+
+	if seen := router.state.GetGlobal("seen"); seen != lua.LString("lobby") {
+		t.Fatalf("script saw room %v, want lobby", seen)
+	}
+
+	if seq := b.rooms["acme/news"].seq; seq != 1 {
+		t.Fatalf("acme/news seq = %d, want 1", seq)
+	}
+
+	if seq := b.rooms["news"].seq; seq != 0 {
+		t.Fatalf("untenanted news got %d messages from a tenant's script", seq)
+	}
+
+	if bobs["acme"].written != 1 || bobs["globex"].written != 0 {
+		t.Fatalf("direct frames written to bob of acme %d, of globex %d; want 1 and 0", bobs["acme"].written, bobs["globex"].written)
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/gobwas/ws"
+	"github.com/panjf2000/gnet/v2"
+)
+
+// errDropped, returned by a middleware hook, drops the message without
+// telling anyone. Any other error rejects it.
+var errDropped = errors.New("dropped by middleware")
+
+// middleware lets code built into the server validate, enrich or moderate
+// traffic without changing OnTraffic. Every hook is optional and the hooks
+// of a chain run in registration order; a hook may change the message it
+// is given and the next one sees the change.
+//
+// A connection onConnect rejects is closed with a policy violation. A
+// rejected inbound message is answered with an error frame; a rejected
+// broadcast fails the publish. onDeliver transforms a room message for the
+// members with the given attributes, see transforms.go; errDropped
+// withholds it from them and any other error fails their delivery. Its
+// output is shared, so it must set a new data rather than change it in
+// place.
+type middleware struct {
+	name string
+
+	onConnect    func(ctx context.Context, c gnet.Conn, req *upgradeRequest) error
+	onMessage    func(ctx context.Context, c gnet.Conn, msg *inboundMessage) error
+	onBroadcast  func(ctx context.Context, msg *outboundMessage) error
+	onDeliver    func(ctx context.Context, attrs map[string]string, msg *outboundMessage) error
+	onDisconnect func(c gnet.Conn, err error)
+}
+
+// inboundMessage is a message read from a client. Frame is set when it is
+// a protocol envelope, and is what gets handled; otherwise op and payload
+// are broadcast raw. Payload is recycled once the message is handled, so a
+// hook that keeps it must copy it.
+type inboundMessage struct {
+	op      ws.OpCode
+	payload []byte
+	frame   *controlFrame
+}
+
+// outboundMessage is on its way to many connections: a room's members when
+// room is set, otherwise every connection the broadcast targets. Only data
+// may be changed, and room data must stay JSON.
+type outboundMessage struct {
+	room string
+	op   ws.OpCode
+	data []byte
+}
+
+// middlewares are installed on the hub at startup. Files built into the
+// server register theirs from init with use.
+var middlewares middlewareChain
+
+func use(m middleware) {
+	middlewares = append(middlewares, m)
+}
+
+type middlewareChain []middleware
+
+func (chain middlewareChain) connect(ctx context.Context, c gnet.Conn, req *upgradeRequest) error {
+	for _, m := range chain {
+		if m.onConnect == nil {
+			continue
+		}
+
+		if err := m.onConnect(ctx, c, req); err != nil {
+			return fmt.Errorf("middleware %s: %w", m.name, err)
+		}
+	}
+
+	return nil
+}
+
+func (chain middlewareChain) message(ctx context.Context, c gnet.Conn, msg *inboundMessage) error {
+	for _, m := range chain {
+		if m.onMessage == nil {
+			continue
+		}
+
+		if err := m.onMessage(ctx, c, msg); err != nil {
+			return fmt.Errorf("middleware %s: %w", m.name, err)
+		}
+	}
+
+	return nil
+}
+
+func (chain middlewareChain) broadcast(ctx context.Context, msg *outboundMessage) error {
+	for _, m := range chain {
+		if m.onBroadcast == nil {
+			continue
+		}
+
+		if err := m.onBroadcast(ctx, msg); err != nil {
+			return fmt.Errorf("middleware %s: %w", m.name, err)
+		}
+	}
+
+	if msg.room != "" && !json.Valid(msg.data) {
+		return errDataNotJSON
+	}
+
+	return nil
+}
+
+func (chain middlewareChain) disconnect(c gnet.Conn, err error) {
+	for _, m := range chain {
+		if m.onDisconnect != nil {
+			m.onDisconnect(c, err)
+		}
+	}
+}
+
+// outbound runs the broadcast hooks over data and returns what should be
+// sent instead, or false if it was dropped.
+func (b *broadcastService) outbound(ctx context.Context, room string, op ws.OpCode, data []byte) ([]byte, bool, error) {
+	if len(b.middleware) == 0 {
+		return data, true, nil
+	}
+
+	msg := &outboundMessage{room: room, op: op, data: data}
+
+	err := b.middleware.broadcast(ctx, msg)
+	if errors.Is(err, errDropped) {
+		return nil, false, nil
+	}
+
+	if err != nil {
+		return nil, false, err
+	}
+
+	return msg.data, true, nil
+}
@@ -0,0 +1,435 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/panjf2000/gnet/v2"
+	"go.uber.org/zap"
+)
+
+const frameRedirect = "redirect"
+
+// migrationPace is how long a drain waits between rooms by default, so the
+// members of one room have reconnected before the next room's follow.
+const migrationPace = 250 * time.Millisecond
+
+var errNotMoved = errors.New("room has not moved")
+
+// roomMovedError refuses a room this node has handed to another.
+type roomMovedError struct {
+	url string
+}
+
+func (e *roomMovedError) Error() string {
+	return "room moved to " + e.url
+}
+
+// migrationTarget is the node a room moves to: URL is the public websocket
+// URL its members are redirected to, AdminURL the admin listener its state
+// is imported through.
+type migrationTarget struct {
+	URL      string `json:"url"`
+	AdminURL string `json:"admin_url"`
+}
+
+// roomMigrator drains a node room by room. Migrating a room refuses new
+// subscribes and publishes to it, copies its sequence and history to the
+// target's /rooms/import and then sends each member a redirect frame
+// naming the target and the room's last sequence, so it can subscribe
+// there and resume without a gap. Members stay connected for their other
+// rooms; only once a node has no rooms left does draining it disconnect
+// anyone. A room whose import fails stays here.
+type roomMigrator struct {
+	token  string
+	client *http.Client
+	bs     *broadcastService
+	logger *zap.Logger
+
+	mu      sync.Mutex
+	pending map[string]struct{}
+}
+
+type migrationRequest struct {
+	// Rooms are path.Match patterns for the hub room names to move; none
+	// moves every room.
+	Rooms []string `json:"rooms"`
+	migrationTarget
+	Pace string `json:"pace"`
+}
+
+type migrationStatus struct {
+	Moved   map[string]string `json:"moved"`
+	Pending []string          `json:"pending"`
+}
+
+// movedTo is where the room has moved, or "".
+func (b *broadcastService) movedTo(name string) string {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	return b.moved[name]
+}
+
+// checkMoved refuses a moved room. It must be called with the hub's lock
+// held.
+func (b *broadcastService) checkMoved(name string) error {
+	if url, ok := b.moved[name]; ok {
+		return &roomMovedError{url: url}
+	}
+
+	return nil
+}
+
+// markMoved refuses the room from now on and snapshots it. It reports false
+// if there is no such room.
+func (b *broadcastService) markMoved(name, url string) (replicatedRoom, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	r, ok := b.rooms[name]
+	if !ok {
+		return replicatedRoom{}, false
+	}
+
+	if b.moved == nil {
+		b.moved = make(map[string]string)
+	}
+
+	b.moved[name] = url
+
+	return r.replicate(), true
+}
+
+// unmarkMoved takes the room back.
+func (b *broadcastService) unmarkMoved(name string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if _, ok := b.moved[name]; !ok {
+		return errNotMoved
+	}
+
+	delete(b.moved, name)
+
+	return nil
+}
+
+// evict deletes a moved room, returning who was in it.
+func (b *broadcastService) evict(name string) []gnet.Conn {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	r, ok := b.rooms[name]
+	if !ok {
+		return nil
+	}
+
+	members := make([]gnet.Conn, 0, len(r.members))
+	for c := range r.members {
+		members = append(members, c)
+
+		delete(r.members, c)
+		if tc, ok := b.connections[c]; ok {
+			delete(tc.subscriptions, name)
+		}
+
+		b.depart(c, name)
+	}
+
+	delete(b.rooms, name)
+	b.lifecycle.emit(roomDeleted, name)
+
+	return members
+}
+
+// adopt takes ownership of rooms migrated here, within -max-rooms.
+func (b *broadcastService) adopt(rooms []replicatedRoom) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for _, rr := range rooms {
+		delete(b.moved, rr.Name)
+
+		r, err := b.roomOf(rr.Name)
+		if err != nil {
+			return fmt.Errorf("adopting room %q: %w", rr.Name, err)
+		}
+
+		r.overwrite(rr)
+		r.vacated()
+	}
+
+	return nil
+}
+
+func (b *broadcastService) roomNames(patterns []string) []string {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	var names []string
+
+	for name := range b.rooms {
+		if _, moved := b.moved[name]; moved {
+			continue
+		}
+
+		matched := len(patterns) == 0
+		for _, p := range patterns {
+			if ok, _ := path.Match(p, name); ok {
+				matched = true
+
+				break
+			}
+		}
+
+		if matched {
+			names = append(names, name)
+		}
+	}
+
+	sort.Strings(names)
+
+	return names
+}
+
+// writeRedirect tells conn the room now lives at url; seq is the last
+// sequence sent here, 0 when the client was not a member.
+func writeRedirect(conn gnet.Conn, id, name, url string, seq uint64) error {
+	return writeControlFrame(conn, controlFrame{
+		Type:      frameRedirect,
+		ID:        id,
+		Room:      name,
+		Seq:       seq,
+		Endpoints: []endpointHint{{URL: url}},
+	})
+}
+
+func (m *roomMigrator) migrate(name string, target migrationTarget) error {
+	snap, ok := m.bs.markMoved(name, target.URL)
+	if !ok {
+		return errUnknownRoom
+	}
+
+	if err := m.push(target.AdminURL, snap); err != nil {
+		_ = m.bs.unmarkMoved(name)
+
+		return err
+	}
+
+	redirected := 0
+	for _, c := range m.bs.evict(name) {
+		if err := writeRedirect(c, "", name, target.URL, snap.Seq); err != nil {
+			m.logger.Debug("redirecting member", zap.String("room", name), zap.Error(err))
+
+			continue
+		}
+
+		redirected++
+	}
+
+	m.logger.Info("migrated room",
+		zap.String("room", name),
+		zap.String("target", target.URL),
+		zap.Uint64("seq", snap.Seq),
+		zap.Int("redirected", redirected))
+
+	return nil
+}
+
+func (m *roomMigrator) push(adminURL string, snap replicatedRoom) error {
+	body, err := json.Marshal([]replicatedRoom{snap})
+	if err != nil {
+		return fmt.Errorf("encoding room: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, adminURL+"/rooms/import", bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("building request: %w", err)
+	}
+
+	req.Header.Set("Authorization", "Bearer "+m.token)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := m.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("importing room: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNoContent {
+		return fmt.Errorf("importing room: unexpected status %s", resp.Status)
+	}
+
+	return nil
+}
+
+// drain migrates rooms one at a time, pace apart.
+func (m *roomMigrator) drain(rooms []string, target migrationTarget, pace time.Duration, audit *zap.Logger) {
+	for i, name := range rooms {
+		if i > 0 {
+			time.Sleep(pace)
+		}
+
+		err := m.migrate(name, target)
+
+		m.mu.Lock()
+		delete(m.pending, name)
+		m.mu.Unlock()
+
+		fields := []zap.Field{zap.String("action", "migrate_room"), zap.String("room", name), zap.String("target", target.URL)}
+		if err != nil {
+			fields = append(fields, zap.Error(err))
+		}
+
+		audit.Info("admin room migration", fields...)
+	}
+}
+
+func (m *roomMigrator) status() migrationStatus {
+	m.bs.mu.RLock()
+	moved := make(map[string]string, len(m.bs.moved))
+	for name, url := range m.bs.moved {
+		moved[name] = url
+	}
+	m.bs.mu.RUnlock()
+
+	m.mu.Lock()
+	pending := make([]string, 0, len(m.pending))
+	for name := range m.pending {
+		pending = append(pending, name)
+	}
+	m.mu.Unlock()
+
+	sort.Strings(pending)
+
+	return migrationStatus{Moved: moved, Pending: pending}
+}
+
+// handleMigrations starts draining rooms to another node on POST, lists
+// moved and pending rooms on GET and takes a moved room back on DELETE
+// ?room=.
+func (a *adminServer) handleMigrations(w http.ResponseWriter, r *http.Request) {
+	if a.migrator == nil {
+		http.Error(w, "room migration is disabled", http.StatusNotFound)
+
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, a.migrator.status())
+	case http.MethodPost:
+		var req migrationRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "invalid migration: "+err.Error(), http.StatusBadRequest)
+
+			return
+		}
+
+		if req.URL == "" || req.AdminURL == "" {
+			http.Error(w, "url and admin_url are required", http.StatusBadRequest)
+
+			return
+		}
+
+		for _, p := range req.Rooms {
+			if _, err := path.Match(p, ""); err != nil {
+				http.Error(w, fmt.Sprintf("room pattern %q: %v", p, err), http.StatusBadRequest)
+
+				return
+			}
+		}
+
+		pace := migrationPace
+		if req.Pace != "" {
+			d, err := time.ParseDuration(req.Pace)
+			if err != nil || d < 0 {
+				http.Error(w, "pace must be a non-negative Go duration", http.StatusBadRequest)
+
+				return
+			}
+
+			pace = d
+		}
+
+		rooms := a.bs.roomNames(req.Rooms)
+
+		a.migrator.mu.Lock()
+		if a.migrator.pending == nil {
+			a.migrator.pending = make(map[string]struct{})
+		}
+
+		queued := rooms[:0]
+		for _, name := range rooms {
+			if _, ok := a.migrator.pending[name]; !ok {
+				a.migrator.pending[name] = struct{}{}
+				queued = append(queued, name)
+			}
+		}
+		a.migrator.mu.Unlock()
+
+		go a.migrator.drain(queued, req.migrationTarget, pace, a.audit)
+
+		writeJSON(w, http.StatusAccepted, map[string][]string{"rooms": append([]string{}, queued...)})
+	case http.MethodDelete:
+		name := r.URL.Query().Get("room")
+
+		if err := a.bs.unmarkMoved(name); err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+
+			return
+		}
+
+		a.audit.Info("admin room reclaim", zap.String("action", "reclaim_room"), zap.String("room", name))
+
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleRoomImport is the receiving end of a migration: it takes ownership
+// of the rooms posted, sequence and history included.
+func (a *adminServer) handleRoomImport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+
+		return
+	}
+
+	var rooms []replicatedRoom
+	if err := json.NewDecoder(r.Body).Decode(&rooms); err != nil {
+		http.Error(w, "invalid rooms: "+err.Error(), http.StatusBadRequest)
+
+		return
+	}
+
+	if err := a.bs.adopt(rooms); err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, errTooManyRooms) {
+			status = http.StatusInsufficientStorage
+		}
+
+		http.Error(w, err.Error(), status)
+
+		return
+	}
+
+	for _, rr := range rooms {
+		a.audit.Info("admin room import", zap.String("action", "import_room"), zap.String("room", rr.Name), zap.Uint64("seq", rr.Seq))
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/gobwas/ws"
+	"github.com/panjf2000/gnet/v2"
+)
+
+// hubMode decides what happens to what clients send: raw messages and
+// publish envelopes. Publishes made through the admin and gRPC APIs are
+// always delivered.
+type hubMode string
+
+const (
+	// modeBroadcast delivers publishes to the room and raw messages to
+	// everyone, when -raw-broadcast allows them.
+	modeBroadcast hubMode = "broadcast"
+	// modeEcho sends every message back to its sender only.
+	modeEcho hubMode = "echo"
+	// modeSink accepts messages without delivering them. Publishes still
+	// take a sequence and reach the message hooks, so an egress hook can
+	// ingest them.
+	modeSink hubMode = "sink"
+)
+
+func parseHubMode(s string) (hubMode, error) {
+	switch m := hubMode(s); m {
+	case modeBroadcast, modeEcho, modeSink:
+		return m, nil
+	default:
+		return "", fmt.Errorf("unknown mode %q, want broadcast, echo or sink", s)
+	}
+}
+
+// hubModeSwitch holds the mode of a hub, which can change while it runs.
+// Its zero value is modeBroadcast.
+type hubModeSwitch struct {
+	mode atomic.Value
+}
+
+func (s *hubModeSwitch) get() hubMode {
+	if m, ok := s.mode.Load().(hubMode); ok {
+		return m
+	}
+
+	return modeBroadcast
+}
+
+// setMode switches what the hub does with messages from clients from the
+// next one on.
+func (b *broadcastService) setMode(m hubMode) {
+	b.mode.mode.Store(m)
+}
+
+func (b *broadcastService) currentMode() hubMode {
+	return b.mode.get()
+}
+
+// clientPublish publishes data from a client according to the mode. Only
+// broadcasting fans out, so the other modes report no delivery.
+func (b *broadcastService) clientPublish(ctx context.Context, conn gnet.Conn, name string, data json.RawMessage, q *qosPublish) (roomMessage, *deliveryReport, error) {
+	switch b.currentMode() {
+	case modeEcho:
+		msg := roomMessage{data: data}
+
+		return msg, nil, deliverRoomMessage(conn, name, msg)
+	case modeSink:
+		msg, err := b.ingest(name, data)
+
+		return msg, nil, err
+	default:
+		msg, report, err := b.publishReport(ctx, name, data, q)
+
+		return msg, &report, err
+	}
+}
+
+// ingest sequences a message for the hooks alone; it is neither kept in the
+// room's history nor delivered to its members.
+func (b *broadcastService) ingest(name string, data json.RawMessage) (roomMessage, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	r, err := b.roomOf(name)
+	if err != nil {
+		return roomMessage{}, err
+	}
+
+	r.seq++
+	msg := roomMessage{seq: r.seq, data: data, at: time.Now()}
+
+	b.notifyHooks(name, msg)
+
+	return msg, nil
+}
+
+// clientRaw handles a message from a client that is not a protocol
+// envelope. It reports false when the mode leaves it to the caller.
+func (b *broadcastService) clientRaw(conn gnet.Conn, op ws.OpCode, payload []byte) (bool, error) {
+	switch b.currentMode() {
+	case modeEcho:
+		return true, writeServerFrame(conn, op, payload)
+	case modeSink:
+		return true, nil
+	default:
+		return false, nil
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/panjf2000/gnet/v2"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"google.golang.org/grpc/peer"
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+type messageAuditConfig struct {
+	file string
+	// payload is "hash" to record a SHA-256 of each message or "full" to
+	// record the message itself.
+	payload    string
+	maxSizeMB  int
+	maxBackups int
+	maxAgeDays int
+	compress   bool
+}
+
+// messageAuditor appends every inbound publish to a JSON-lines file that is
+// rotated by size, so who published what can be reconstructed later. A nil
+// *messageAuditor records nothing.
+type messageAuditor struct {
+	logger      *zap.Logger
+	fullPayload bool
+}
+
+func newMessageAuditor(cfg messageAuditConfig) (*messageAuditor, error) {
+	if cfg.file == "" {
+		return nil, nil
+	}
+
+	if cfg.payload != "hash" && cfg.payload != "full" {
+		return nil, fmt.Errorf("unknown message audit payload %q, want hash or full", cfg.payload)
+	}
+
+	encoder := zap.NewProductionEncoderConfig()
+	encoder.TimeKey = "time"
+	encoder.EncodeTime = zapcore.RFC3339NanoTimeEncoder
+
+	out := &lumberjack.Logger{
+		Filename:   cfg.file,
+		MaxSize:    cfg.maxSizeMB,
+		MaxBackups: cfg.maxBackups,
+		MaxAge:     cfg.maxAgeDays,
+		Compress:   cfg.compress,
+	}
+
+	core := zapcore.NewCore(zapcore.NewJSONEncoder(encoder), zapcore.AddSync(out), zap.InfoLevel)
+
+	return &messageAuditor{logger: zap.New(core), fullPayload: cfg.payload == "full"}, nil
+}
+
+// publishSource is who made a publish, as the message audit log records it.
+type publishSource struct {
+	// transport is how the publish came in: websocket, stream, http or grpc.
+	transport  string
+	remoteAddr string
+	connID     uint64
+	clientID   string
+	user       string
+	// token names the scoped publish token an http publish used.
+	token string
+	// where is the tag selector a broadcast was limited to.
+	where string
+}
+
+// connSource describes a publish made over the websocket conn.
+func connSource(conn gnet.Conn) publishSource {
+	src := publishSource{transport: "websocket", remoteAddr: conn.RemoteAddr().String()}
+
+	if codec, ok := codecOf(conn); ok {
+		src.connID, src.clientID = codec.id, codec.clientID
+		src.user = codec.metadata["session_subject"]
+	}
+
+	return src
+}
+
+// httpSource describes a publish made through the admin listener by r.
+func httpSource(r *http.Request) publishSource {
+	src := publishSource{transport: "http", remoteAddr: r.RemoteAddr}
+	if t := publishTokenFrom(r.Context()); t != nil {
+		src.token = t.Name
+	}
+
+	return src
+}
+
+// grpcSource describes a publish made by the gRPC call of ctx.
+func grpcSource(ctx context.Context) publishSource {
+	src := publishSource{transport: "grpc"}
+	if p, ok := peer.FromContext(ctx); ok {
+		src.remoteAddr = p.Addr.String()
+	}
+
+	return src
+}
+
+// record logs a publish made by src. Room is broadcastRoomName for raw
+// broadcasts, whose payload is not JSON and is recorded base64-encoded.
+func (a *messageAuditor) record(src publishSource, room string, seq uint64, data []byte, err error) {
+	if a == nil {
+		return
+	}
+
+	fields := []zap.Field{
+		zap.String("room", room),
+		zap.Int("size", len(data)),
+		zap.String("transport", src.transport),
+	}
+
+	for _, f := range []struct{ key, value string }{
+		{"remote_addr", src.remoteAddr},
+		{"client_id", src.clientID},
+		{"user", src.user},
+		{"token", src.token},
+		{"where", src.where},
+	} {
+		if f.value != "" {
+			fields = append(fields, zap.String(f.key, f.value))
+		}
+	}
+
+	if src.connID > 0 {
+		fields = append(fields, zap.Uint64("conn_id", src.connID))
+	}
+
+	if seq > 0 {
+		fields = append(fields, zap.Uint64("seq", seq))
+	}
+
+	switch {
+	case !a.fullPayload:
+		sum := sha256.Sum256(data)
+		fields = append(fields, zap.String("sha256", hex.EncodeToString(sum[:])))
+	case room == broadcastRoomName:
+		fields = append(fields, zap.Binary("payload", data))
+	default:
+		fields = append(fields, zap.Reflect("payload", json.RawMessage(data)))
+	}
+
+	if err != nil {
+		fields = append(fields, zap.NamedError("error", err))
+	}
+
+	a.logger.Info("publish", fields...)
+}
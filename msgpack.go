@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+
+	"github.com/gobwas/ws"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+const subprotocolMsgpack = "wsb.v1.msgpack"
+
+// msgpackEnvelope is the JSON envelope as a MessagePack map with the same
+// keys. Data is a native MessagePack value rather than embedded JSON.
+type msgpackEnvelope struct {
+	Type      string            `msgpack:"type"`
+	ID        string            `msgpack:"id,omitempty"`
+	Room      string            `msgpack:"room,omitempty"`
+	Policy    string            `msgpack:"policy,omitempty"`
+	FromSeq   *uint64           `msgpack:"from_seq,omitempty"`
+	Seq       uint64            `msgpack:"seq,omitempty"`
+	Data      interface{}       `msgpack:"data,omitempty"`
+	KeyID     uint64            `msgpack:"key_id,omitempty"`
+	Key       []byte            `msgpack:"key,omitempty"`
+	Error     string            `msgpack:"error,omitempty"`
+	ConnID    uint64            `msgpack:"conn_id,omitempty"`
+	Endpoints []msgpackEndpoint `msgpack:"endpoints,omitempty"`
+	QoS       int               `msgpack:"qos,omitempty"`
+	MsgID     string            `msgpack:"msg_id,omitempty"`
+	Status    string            `msgpack:"status,omitempty"`
+	Pending   int               `msgpack:"pending,omitempty"`
+
+	IdempotencyKey string            `msgpack:"idempotency_key,omitempty"`
+	Member         string            `msgpack:"member,omitempty"`
+	Members        []string          `msgpack:"members,omitempty"`
+	Statuses       map[string]string `msgpack:"statuses,omitempty"`
+	Tags           map[string]string `msgpack:"tags,omitempty"`
+	Report         bool              `msgpack:"report,omitempty"`
+	Delivery       *deliveryReport   `msgpack:"delivery,omitempty"`
+	Reason         string            `msgpack:"reason,omitempty"`
+	Retained       bool              `msgpack:"retained,omitempty"`
+	Delta          bool              `msgpack:"delta,omitempty"`
+	CorrelationID  string            `msgpack:"correlation_id,omitempty"`
+	To             string            `msgpack:"to,omitempty"`
+	From           string            `msgpack:"from,omitempty"`
+	TimeoutMS      int64             `msgpack:"timeout_ms,omitempty"`
+	DeliverAt      string            `msgpack:"deliver_at,omitempty"`
+	DelayMS        int64             `msgpack:"delay_ms,omitempty"`
+	ScheduleID     string            `msgpack:"schedule_id,omitempty"`
+}
+
+type msgpackEndpoint struct {
+	URL         string `msgpack:"url"`
+	Connections int64  `msgpack:"connections"`
+}
+
+// msgpackEncoding carries msgpackEnvelope in binary messages. The hub keeps
+// data as JSON, so it is converted at the edge: only recipients speaking
+// MessagePack pay for it.
+type msgpackEncoding struct{}
+
+func (msgpackEncoding) opCode() ws.OpCode { return ws.OpBinary }
+
+func (msgpackEncoding) encode(frame controlFrame) ([]byte, error) {
+	env := msgpackEnvelope{
+		Type:    frame.Type,
+		ID:      frame.ID,
+		Room:    frame.Room,
+		Policy:  string(frame.Policy),
+		FromSeq: frame.FromSeq,
+		Seq:     frame.Seq,
+		KeyID:   frame.KeyID,
+		Key:     frame.Key,
+		Error:   frame.Error,
+		ConnID:  frame.ConnID,
+		QoS:     frame.QoS,
+		MsgID:   frame.MsgID,
+		Status:  frame.Status,
+		Pending: frame.Pending,
+
+		IdempotencyKey: frame.IdempotencyKey,
+		Member:         frame.Member,
+		Members:        frame.Members,
+		Statuses:       frame.Statuses,
+		Tags:           frame.Tags,
+		Report:         frame.Report,
+		Delivery:       frame.Delivery,
+		Reason:         frame.Reason,
+		Retained:       frame.Retained,
+		Delta:          frame.Delta,
+		CorrelationID:  frame.CorrelationID,
+		To:             frame.To,
+		From:           frame.From,
+		TimeoutMS:      frame.TimeoutMS,
+		DeliverAt:      frame.DeliverAt,
+		DelayMS:        frame.DelayMS,
+		ScheduleID:     frame.ScheduleID,
+	}
+
+	if len(frame.Data) > 0 {
+		data, err := jsonToValue(frame.Data)
+		if err != nil {
+			return nil, err
+		}
+
+		env.Data = data
+	}
+
+	for _, e := range frame.Endpoints {
+		env.Endpoints = append(env.Endpoints, msgpackEndpoint{URL: e.URL, Connections: e.Connections})
+	}
+
+	var buf bytes.Buffer
+
+	enc := msgpack.NewEncoder(&buf)
+	enc.UseCompactInts(true)
+	enc.SetSortMapKeys(true)
+
+	if err := enc.Encode(&env); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+func (msgpackEncoding) decode(msg []byte) (controlFrame, error) {
+	var env msgpackEnvelope
+	if err := msgpack.Unmarshal(msg, &env); err != nil {
+		return controlFrame{}, err
+	}
+
+	frame := controlFrame{
+		Type:    env.Type,
+		ID:      env.ID,
+		Room:    env.Room,
+		Policy:  pausePolicy(env.Policy),
+		FromSeq: env.FromSeq,
+		Seq:     env.Seq,
+		KeyID:   env.KeyID,
+		Key:     env.Key,
+		Error:   env.Error,
+		ConnID:  env.ConnID,
+		QoS:     env.QoS,
+		MsgID:   env.MsgID,
+		Status:  env.Status,
+		Pending: env.Pending,
+
+		IdempotencyKey: env.IdempotencyKey,
+		Member:         env.Member,
+		Members:        env.Members,
+		Statuses:       env.Statuses,
+		Tags:           env.Tags,
+		Report:         env.Report,
+		Delivery:       env.Delivery,
+		Reason:         env.Reason,
+		Retained:       env.Retained,
+		Delta:          env.Delta,
+		CorrelationID:  env.CorrelationID,
+		To:             env.To,
+		From:           env.From,
+		TimeoutMS:      env.TimeoutMS,
+		DeliverAt:      env.DeliverAt,
+		DelayMS:        env.DelayMS,
+		ScheduleID:     env.ScheduleID,
+	}
+
+	if env.Data != nil {
+		data, err := json.Marshal(env.Data)
+		if err != nil {
+			return controlFrame{}, fmt.Errorf("%w: %v", errDataNotJSON, err)
+		}
+
+		frame.Data = data
+	}
+
+	for _, e := range env.Endpoints {
+		frame.Endpoints = append(frame.Endpoints, endpointHint{URL: e.URL, Connections: e.Connections})
+	}
+
+	return frame, nil
+}
+
+// jsonToValue decodes JSON into plain Go values, keeping integers integers
+// so they are not widened to MessagePack floats.
+func jsonToValue(data []byte) (interface{}, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return nil, fmt.Errorf("decoding data: %w", err)
+	}
+
+	return unwrapNumbers(v), nil
+}
+
+func unwrapNumbers(v interface{}) interface{} {
+	switch v := v.(type) {
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return i
+		}
+
+		f, _ := v.Float64()
+
+		return f
+	case []interface{}:
+		for i := range v {
+			v[i] = unwrapNumbers(v[i])
+		}
+	case map[string]interface{}:
+		for k := range v {
+			v[k] = unwrapNumbers(v[k])
+		}
+	}
+
+	return v
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// clientCertAuth authenticates clients of the TLS transports by their
+// certificates, so internal services that already hold one need no token.
+// A client whose certificate verifies against the CA pool is its subject:
+// the certificate's common name, or its first URI, DNS or email SAN when it
+// has none. ACLs then name it as user:<subject>, and under RBAC it holds
+// capabilities. Clients without a certificate go through the upgrade hook
+// as before, unless certificates are required.
+type clientCertAuth struct {
+	pool         *x509.CertPool
+	required     bool
+	capabilities capabilitySet
+}
+
+func loadClientCertAuth(caFile string, required bool, capabilities string) (*clientCertAuth, error) {
+	pem, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, fmt.Errorf("reading client CA: %w", err)
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, errors.New("client CA holds no PEM certificates")
+	}
+
+	caps, err := parseCapabilities(capabilities)
+	if err != nil {
+		return nil, err
+	}
+
+	return &clientCertAuth{pool: pool, required: required, capabilities: caps}, nil
+}
+
+// configure makes cfg ask for client certificates and verify them.
+func (a *clientCertAuth) configure(cfg *tls.Config) *tls.Config {
+	if a == nil {
+		return cfg
+	}
+
+	cfg.ClientCAs = a.pool
+	cfg.ClientAuth = tls.VerifyClientCertIfGiven
+
+	if a.required {
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return cfg
+}
+
+// metadata is the connection metadata a verified client certificate
+// grants, nil when the client presented none.
+func (a *clientCertAuth) metadata(state *tls.ConnectionState) map[string]string {
+	if a == nil || state == nil || len(state.VerifiedChains) == 0 {
+		return nil
+	}
+
+	cert := state.VerifiedChains[0][0]
+
+	var sans []string
+	for _, u := range cert.URIs {
+		sans = append(sans, u.String())
+	}
+
+	sans = append(sans, cert.DNSNames...)
+	sans = append(sans, cert.EmailAddresses...)
+
+	subject := cert.Subject.CommonName
+	if subject == "" && len(sans) > 0 {
+		subject = sans[0]
+	}
+
+	if subject == "" {
+		return nil
+	}
+
+	metadata := map[string]string{
+		"session_subject": subject,
+		"capabilities":    a.capabilities.String(),
+		"cert_cn":         cert.Subject.CommonName,
+	}
+
+	if len(sans) > 0 {
+		metadata["cert_sans"] = strings.Join(sans, ",")
+	}
+
+	return metadata
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/panjf2000/gnet/v2"
+)
+
+// orderingMode is the delivery ordering a room guarantees its members.
+//
+//   - strict: one publish at a time is sequenced and delivered, so every
+//     member sees the room in sequence order. Publishers wait for each other.
+//   - fifo: each publisher's messages arrive in the order it sent them, but
+//     concurrent publishers may interleave out of sequence order.
+//   - unordered: the publisher queues delivery for every member without
+//     waiting on the fan-out pool; members may see any order.
+type orderingMode string
+
+const (
+	orderStrict    orderingMode = "strict"
+	orderFIFO      orderingMode = "fifo"
+	orderUnordered orderingMode = "unordered"
+)
+
+var errUnknownOrdering = errors.New("unknown ordering mode")
+
+type orderingRule struct {
+	pattern string
+	mode    orderingMode
+}
+
+func parseOrderingMode(s string) (orderingMode, error) {
+	switch mode := orderingMode(s); mode {
+	case orderStrict, orderFIFO, orderUnordered:
+		return mode, nil
+	default:
+		return "", fmt.Errorf("%w %q", errUnknownOrdering, s)
+	}
+}
+
+// parseOrderingRules parses comma-separated pattern=mode pairs, e.g.
+// "orders.*=strict,ticks.*=unordered". Patterns use path.Match syntax and the
+// first match wins.
+func parseOrderingRules(s string) ([]orderingRule, error) {
+	var rules []orderingRule
+
+	for _, item := range splitList(s) {
+		i := strings.LastIndex(item, "=")
+		if i < 0 {
+			return nil, fmt.Errorf("ordering rule %q: want pattern=mode", item)
+		}
+
+		pattern := item[:i]
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("ordering rule %q: %w", item, err)
+		}
+
+		mode, err := parseOrderingMode(item[i+1:])
+		if err != nil {
+			return nil, fmt.Errorf("ordering rule %q: %w", item, err)
+		}
+
+		rules = append(rules, orderingRule{pattern: pattern, mode: mode})
+	}
+
+	return rules, nil
+}
+
+func (b *broadcastService) orderingFor(name string) orderingMode {
+	for _, rule := range b.orderingRules {
+		if ok, _ := path.Match(rule.pattern, name); ok {
+			return rule.mode
+		}
+	}
+
+	if b.defaultOrdering == "" {
+		return orderFIFO
+	}
+
+	return b.defaultOrdering
+}
+
+// orderingOf returns the ordering of an existing room and, for strict rooms,
+// the sequencer a publisher must hold from recording until delivery is done.
+func (b *broadcastService) orderingOf(name string) (orderingMode, *sync.Mutex) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	r, ok := b.rooms[name]
+	if !ok {
+		return "", nil
+	}
+
+	if r.ordering == orderStrict {
+		return r.ordering, &r.sequencer
+	}
+
+	return r.ordering, nil
+}
+
+// deliverOrdered queues frame for every target through b.fanout, for
+// strict and fifo rooms: it returns once all of them are queued, so the
+// next message of the room or publisher is queued after it everywhere. A
+// member that cannot be written to is already closing; it counts as failed
+// and the others still get the message.
+func (b *broadcastService) deliverOrdered(targets []gnet.Conn, frame *encodedFrame, stats *fanoutStats, tally *deliveryTally) error {
+	if err := frame.prepare(targets); err != nil {
+		return err
+	}
+	defer frame.release()
+
+	return b.fanout.each(targets, func(c gnet.Conn) error {
+		n, err := frame.writeTo(c)
+		if tally.wrote(err) == nil {
+			stats.wrote(frameSize(n))
+		}
+
+		return nil
+	})
+}
+
+// deliverUnordered queues frame for every target straight from the
+// publisher's goroutine, skipping the fan-out pool: queuing is cheap and
+// each connection's loop does the writing, so nothing waits on a slow
+// member. No order across publishers is promised.
+func deliverUnordered(targets []gnet.Conn, frame *encodedFrame, stats *fanoutStats, tally *deliveryTally) error {
+	if err := frame.prepare(targets); err != nil {
+		return err
+	}
+	defer frame.release()
+
+	for _, c := range targets {
+		wire, _ := frame.compiledFor(encodingOf(c))
+
+		// A failure only means the connection is already closing.
+		if err := tally.wrote(writeCompiledFrame(c, wire)); err != nil {
+			continue
+		}
+
+		stats.wrote(len(wire.buf))
+	}
+
+	return nil
+}
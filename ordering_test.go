@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gobwas/ws"
+	"github.com/gobwas/ws/wsutil"
+	"github.com/panjf2000/gnet/v2"
+)
+
+func dialConformance(t *testing.T, s *conformanceServer) net.Conn {
+	t.Helper()
+
+	return dialConformancePath(t, s, "/")
+}
+
+func dialConformancePath(t *testing.T, s *conformanceServer, path string) net.Conn {
+	t.Helper()
+
+	conn, _, _, err := ws.Dial(context.Background(), "ws://"+s.addr+path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { conn.Close() })
+
+	return conn
+}
+
+// TestFIFOConcurrentPublishers publishes to a fifo room from several
+// connections at once, which a server with several event loops handles on
+// different loops, and checks every member gets whole frames in each
+// publisher's order.
+func TestFIFOConcurrentPublishers(t *testing.T) {
+	server, err := startConformanceServer(false, nil, gnet.WithNumEventLoop(4))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Cleanups run last first: clients go away before the server.
+	t.Cleanup(server.stop)
+
+	const (
+		members    = 3
+		publishers = 4
+		messages   = 200
+	)
+
+	subs := make([]net.Conn, members)
+	for i := range subs {
+		subs[i] = dialConformance(t, server)
+		_ = subs[i].SetReadDeadline(time.Now().Add(10 * time.Second))
+
+		// Subscribing is not acknowledged; the pong says it is done.
+		for _, msg := range []string{`{"type":"subscribe","room":"fifo"}`, `{"type":"ping"}`} {
+			if err := wsutil.WriteClientText(subs[i], []byte(msg)); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if _, err := wsutil.ReadServerText(subs[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Members read only once everything is published, so their sockets
+	// fill up and the server has to buffer.
+	pad := strings.Repeat("x", 4096)
+
+	var wg sync.WaitGroup
+
+	for p := 0; p < publishers; p++ {
+		conn := dialConformance(t, server)
+
+		// Publish acks are not read; drain them so the server never stalls.
+		go func() {
+			for {
+				if _, _, err := wsutil.ReadServerData(conn); err != nil {
+					return
+				}
+			}
+		}()
+
+		wg.Add(1)
+
+		go func(p int) {
+			defer wg.Done()
+
+			for n := 0; n < messages; n++ {
+				msg := fmt.Sprintf(`{"type":"publish","room":"fifo","data":{"p":%d,"n":%d,"pad":%q}}`, p, n, pad)
+				if err := wsutil.WriteClientText(conn, []byte(msg)); err != nil {
+					t.Error(err)
+
+					return
+				}
+			}
+		}(p)
+	}
+
+	wg.Wait()
+
+	for i, conn := range subs {
+		next := make([]int, publishers)
+
+		for got := 0; got < publishers*messages; {
+			payload, err := wsutil.ReadServerText(conn)
+			if err != nil {
+				t.Fatalf("member %d after %d messages: %v", i, got, err)
+			}
+
+			var frame struct {
+				Type string `json:"type"`
+				Data struct {
+					P int `json:"p"`
+					N int `json:"n"`
+				} `json:"data"`
+			}
+			if err := json.Unmarshal(payload, &frame); err != nil {
+				t.Fatalf("member %d: %q: %v", i, payload, err)
+			}
+
+			if frame.Type != frameMessage {
+				continue
+			}
+
+			if frame.Data.N != next[frame.Data.P] {
+				t.Fatalf("member %d: publisher %d message %d, want %d", i, frame.Data.P, frame.Data.N, next[frame.Data.P])
+			}
+
+			next[frame.Data.P]++
+			got++
+		}
+	}
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/gobwas/ws"
+	"github.com/panjf2000/gnet/v2"
+)
+
+// loopOutbox is the write queue of one event loop. Every write to an
+// upgraded connection, from whichever goroutine, is queued on the outbox of
+// the loop owning it and written by that loop, as gnet's Conn.Write is only
+// safe there. The queue keeps each connection's frames in the order they
+// were queued, so concurrent publishers cannot interleave a frame, and a
+// broadcast costs each loop one task however many of its connections it
+// reaches. Closes are queued too, after whatever was queued before them.
+type loopOutbox struct {
+	mu      sync.Mutex
+	pending []queuedWrite
+	// scheduled is set while a drain has been asked for and not started.
+	scheduled bool
+}
+
+// queuedWrite is wire to write to c, or a close of c. final marks a close
+// frame, after which nothing else is written. done, if set, runs once the
+// entry has been handled, written or not.
+type queuedWrite struct {
+	c     gnet.Conn
+	wire  []byte
+	final bool
+	close bool
+	done  func()
+}
+
+// loopOutboxes hands out the outbox of each event loop.
+type loopOutboxes struct {
+	mu    sync.Mutex
+	loops map[int]*loopOutbox
+}
+
+// of returns loop's outbox, or nil when the loop is unknown; those
+// connections get a queued write each through gnet instead.
+func (o *loopOutboxes) of(loop int) *loopOutbox {
+	if loop < 0 {
+		return nil
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if o.loops == nil {
+		o.loops = make(map[int]*loopOutbox)
+	}
+
+	box, ok := o.loops[loop]
+	if !ok {
+		box = &loopOutbox{}
+		o.loops[loop] = box
+	}
+
+	return box
+}
+
+// push queues w and, unless a drain is already due, wakes the loop through
+// w's connection to run one. gnet runs the drain even if that connection
+// has closed in the meantime.
+func (box *loopOutbox) push(w queuedWrite) error {
+	box.mu.Lock()
+	box.pending = append(box.pending, w)
+	wake := !box.scheduled
+	box.scheduled = true
+	box.mu.Unlock()
+
+	if !wake {
+		return nil
+	}
+
+	err := w.c.Wake(func(gnet.Conn) error {
+		box.drain()
+
+		return nil
+	})
+	if err != nil {
+		// The loop has stopped; the next push tries again.
+		box.mu.Lock()
+		box.scheduled = false
+		box.mu.Unlock()
+	}
+
+	return err
+}
+
+// drain writes everything queued so far. It runs on the loop.
+func (box *loopOutbox) drain() {
+	box.mu.Lock()
+	batch := box.pending
+	box.pending = nil
+	box.scheduled = false
+	box.mu.Unlock()
+
+	for _, w := range batch {
+		w.run()
+	}
+}
+
+func (w queuedWrite) run() {
+	if w.done != nil {
+		defer w.done()
+	}
+
+	// A closed connection's descriptor may already belong to a new one.
+	codec, ok := codecOf(w.c)
+	if !ok {
+		return
+	}
+
+	if w.close {
+		codec.closing, codec.sentClose = true, true
+		_ = w.c.Close()
+
+		return
+	}
+
+	if codec.sentClose {
+		return
+	}
+
+	codec.sentClose = w.final
+	_, _ = w.c.Write(w.wire)
+}
+
+// queueWrite has c's event loop write wire after everything queued for c
+// before it. done, if set, runs once wire is no longer needed.
+func queueWrite(c gnet.Conn, wire []byte, done func()) error {
+	return queue(queuedWrite{c: c, wire: wire, done: done})
+}
+
+func queue(w queuedWrite) error {
+	c, done := w.c, w.done
+
+	if codec, ok := codecOf(c); ok && codec.outbox != nil {
+		return codec.outbox.push(w)
+	}
+
+	var callback gnet.AsyncCallback
+	if done != nil {
+		callback = func(gnet.Conn) error {
+			done()
+
+			return nil
+		}
+	}
+
+	return c.AsyncWrite(w.wire, callback)
+}
+
+// queueClose closes c once everything queued for it has been written.
+func queueClose(c gnet.Conn) error {
+	if codec, ok := codecOf(c); ok && codec.outbox != nil {
+		return codec.outbox.push(queuedWrite{c: c, close: true})
+	}
+
+	// gnet runs closes and queued writes in order.
+	return c.Close()
+}
+
+// writeServerFrame queues a single server frame carrying payload, which may
+// be reused once it returns.
+func writeServerFrame(c gnet.Conn, op ws.OpCode, payload []byte) error {
+	wire, err := ws.CompileFrame(ws.NewFrame(op, true, payload))
+	if err != nil {
+		return err
+	}
+
+	return queue(queuedWrite{c: c, wire: wire, final: op == ws.OpClose})
+}
+
+// sharedWire is a compiled frame queued for many connections. It goes back
+// to wirePool once its owner and every queued write are done with it.
+// Writes gnet drops for a closed connection never finish; their frame is
+// left to the collector.
+type sharedWire struct {
+	buf        []byte
+	atomicRefs int32
+}
+
+func newSharedWire(buf []byte) *sharedWire {
+	return &sharedWire{buf: buf, atomicRefs: 1}
+}
+
+func (w *sharedWire) hold() { atomic.AddInt32(&w.atomicRefs, 1) }
+
+func (w *sharedWire) release() {
+	if atomic.AddInt32(&w.atomicRefs, -1) == 0 {
+		wirePool.put(w.buf)
+	}
+}
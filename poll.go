@@ -0,0 +1,276 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	pollDefaultTimeout = 25 * time.Second
+	pollMaxTimeout     = 60 * time.Second
+)
+
+var errBadCursor = errors.New("invalid cursor")
+
+// pollTransport serves long-polling clients, for proxies that break both
+// websockets and streaming responses. Each poll carries the client's
+// cursor, the last sequence it has of every room, and is held open until
+// one of its rooms has something newer or the timeout passes. The answer
+// holds the messages and the cursor to poll with next. Rooms whose history
+// no longer reaches the cursor are reported expired and resume from the
+// oldest message kept.
+type pollTransport struct {
+	onUpgrade upgradeHook
+	access    transportAccess
+	bs        *broadcastService
+
+	mu      sync.Mutex
+	waiters map[string]map[chan struct{}]struct{}
+}
+
+// pollCursor maps a room to the last sequence the client has of it. It
+// travels as base64url JSON, so the server keeps no state between polls.
+type pollCursor map[string]uint64
+
+func parsePollCursor(s string) (pollCursor, error) {
+	if s == "" {
+		return nil, nil
+	}
+
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, errBadCursor
+	}
+
+	var cursor pollCursor
+	if err := json.Unmarshal(data, &cursor); err != nil {
+		return nil, errBadCursor
+	}
+
+	return cursor, nil
+}
+
+func (c pollCursor) String() string {
+	data, _ := json.Marshal(c)
+
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+type pollResponse struct {
+	Messages []controlFrame `json:"messages"`
+	Cursor   string         `json:"cursor"`
+	Expired  []string       `json:"expired,omitempty"`
+}
+
+func (p *pollTransport) pattern() string { return "/poll" }
+
+// onMessage makes the transport a messageHook; it wakes the polls waiting
+// on room.
+func (p *pollTransport) onMessage(ctx context.Context, room string, msg roomMessage) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for wake := range p.waiters[room] {
+		select {
+		case wake <- struct{}{}:
+		default:
+		}
+	}
+
+	return nil
+}
+
+func (p *pollTransport) wait(rooms []string, wake chan struct{}) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for _, room := range rooms {
+		waiters, ok := p.waiters[room]
+		if !ok {
+			waiters = make(map[chan struct{}]struct{})
+			p.waiters[room] = waiters
+		}
+
+		waiters[wake] = struct{}{}
+	}
+}
+
+func (p *pollTransport) unwait(rooms []string, wake chan struct{}) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for _, room := range rooms {
+		delete(p.waiters[room], wake)
+
+		if len(p.waiters[room]) == 0 {
+			delete(p.waiters, room)
+		}
+	}
+}
+
+// handle answers GET /poll?room=a&room=b&cursor=...&timeout=seconds, or
+// /t/{tenant}/poll under -multi-tenant. A poll without a cursor is
+// answered at once with one pointing at the newest message of each room.
+func (p *pollTransport) handle(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+
+		return
+	}
+
+	q := r.URL.Query()
+
+	rooms := q["room"]
+	if len(rooms) == 0 {
+		http.Error(w, "at least one room is required", http.StatusBadRequest)
+
+		return
+	}
+
+	cursor, err := parsePollCursor(q.Get("cursor"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+
+		return
+	}
+
+	timeout := pollDefaultTimeout
+	if s := q.Get("timeout"); s != "" {
+		seconds, err := strconv.Atoi(s)
+		if err != nil || seconds < 0 {
+			http.Error(w, "timeout must be a number of seconds", http.StatusBadRequest)
+
+			return
+		}
+
+		if timeout = time.Duration(seconds) * time.Second; timeout > pollMaxTimeout {
+			timeout = pollMaxTimeout
+		}
+	}
+
+	metadata, ok := authorizeTransport(w, r, p.onUpgrade)
+	if !ok {
+		return
+	}
+
+	metadata, tenant, ok := p.access.admitTenant(w, r, metadata)
+	if !ok {
+		return
+	}
+
+	if rooms, ok = p.access.authorizeRooms(w, metadata, tenant, rooms); !ok {
+		return
+	}
+
+	for _, room := range rooms {
+		if err := p.bs.openRoom(room); err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+
+			return
+		}
+
+		defer p.bs.closeRoom(room)
+	}
+
+	// Waiting starts before history is read, so nothing published in
+	// between is missed.
+	wake := make(chan struct{}, 1)
+	p.wait(rooms, wake)
+	defer p.unwait(rooms, wake)
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	fresh := cursor == nil
+	if fresh {
+		cursor = make(pollCursor, len(rooms))
+	}
+
+	for {
+		resp := p.collect(rooms, cursor)
+		if fresh || len(resp.Messages) > 0 || len(resp.Expired) > 0 {
+			writeJSON(w, http.StatusOK, resp)
+
+			return
+		}
+
+		select {
+		case <-wake:
+		case <-timer.C:
+			writeJSON(w, http.StatusOK, resp)
+
+			return
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// collect gathers what rooms have past cursor and advances it. Rooms new to
+// the cursor start from their newest message, with their retained one. The
+// cursor and answer name rooms as the client does.
+func (p *pollTransport) collect(rooms []string, cursor pollCursor) pollResponse {
+	resp := pollResponse{Messages: []controlFrame{}}
+
+	for _, room := range rooms {
+		local := localRoom(room)
+		after, known := cursor[local]
+
+		msgs, head, expired := p.bs.historyAfter(room, after)
+		if !known {
+			cursor[local] = head
+
+			if msg, ok := p.bs.retainedOf(room); ok {
+				frame := roomMessageFrame(local, msg)
+				frame.Retained = true
+				resp.Messages = append(resp.Messages, frame)
+			}
+
+			continue
+		}
+
+		if expired {
+			resp.Expired = append(resp.Expired, local)
+		}
+
+		for _, msg := range msgs {
+			resp.Messages = append(resp.Messages, roomMessageFrame(local, msg))
+			cursor[local] = msg.seq
+		}
+	}
+
+	resp.Cursor = cursor.String()
+
+	return resp
+}
+
+// historyAfter copies the messages of a room after seq and returns the
+// room's newest sequence. Expired reports that history no longer reaches
+// back to seq, in which case everything kept is returned.
+func (b *broadcastService) historyAfter(name string, seq uint64) ([]roomMessage, uint64, bool) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	r, ok := b.rooms[name]
+	if !ok {
+		return nil, 0, false
+	}
+
+	if seq >= r.seq {
+		return nil, r.seq, false
+	}
+
+	msgs, err := r.since(seq + 1)
+	expired := errors.Is(err, errHistoryExpired)
+	if expired {
+		msgs = r.history
+	}
+
+	return append([]roomMessage(nil), msgs...), r.seq, expired
+}
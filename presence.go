@@ -0,0 +1,214 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/panjf2000/gnet/v2"
+	"go.uber.org/zap"
+)
+
+const (
+	framePresence = "presence"
+	frameWho      = "who"
+)
+
+// Presence statuses announced to the members of a room; heartbeats add
+// their own.
+const (
+	presenceJoin  = "join"
+	presenceLeave = "leave"
+)
+
+var errPresenceDisabled = errors.New("presence is disabled")
+
+// presenceTracker knows who is in each room. Members are identities rather
+// than connections, so a client with several connections in a room is
+// present once, and one that leaves is only announced gone after debounce
+// has passed without it coming back.
+type presenceTracker struct {
+	debounce time.Duration
+	logger   *zap.Logger
+
+	mu    sync.Mutex
+	rooms map[string]map[string]*presenceEntry
+}
+
+type presenceEntry struct {
+	conns map[gnet.Conn]struct{}
+	// leave is pending while the identity has no connection left in the
+	// room; it is stopped if one arrives in time.
+	leave *time.Timer
+}
+
+func newPresenceTracker(debounce time.Duration, logger *zap.Logger) *presenceTracker {
+	return &presenceTracker{debounce: debounce, logger: logger, rooms: make(map[string]map[string]*presenceEntry)}
+}
+
+// add records c as present in room and reports whether its identity has
+// just arrived, as opposed to coming back before its leave was announced.
+func (p *presenceTracker) add(room, identity string, c gnet.Conn) bool {
+	if p == nil {
+		return false
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	members, ok := p.rooms[room]
+	if !ok {
+		members = make(map[string]*presenceEntry)
+		p.rooms[room] = members
+	}
+
+	e, present := members[identity]
+	if !present {
+		e = &presenceEntry{conns: make(map[gnet.Conn]struct{})}
+		members[identity] = e
+	}
+
+	if e.leave != nil {
+		e.leave.Stop()
+		e.leave = nil
+	}
+
+	e.conns[c] = struct{}{}
+
+	return !present
+}
+
+// remove records that c has left room. Once it was the identity's last
+// connection there, left runs after the debounce unless it comes back. It
+// never runs left itself, so it is safe to call with b.mu held.
+func (p *presenceTracker) remove(room, identity string, c gnet.Conn, left func()) {
+	if p == nil {
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	e, ok := p.rooms[room][identity]
+	if !ok {
+		return
+	}
+
+	delete(e.conns, c)
+
+	if len(e.conns) > 0 || e.leave != nil {
+		return
+	}
+
+	e.leave = time.AfterFunc(p.debounce, func() {
+		if p.expire(room, identity, e) {
+			left()
+		}
+	})
+}
+
+// expire forgets identity if e is still its entry and nothing came back.
+func (p *presenceTracker) expire(room, identity string, e *presenceEntry) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	members := p.rooms[room]
+	if members[identity] != e || len(e.conns) > 0 {
+		return false
+	}
+
+	delete(members, identity)
+	if len(members) == 0 {
+		delete(p.rooms, room)
+	}
+
+	return true
+}
+
+// who lists the identities present in room, sorted.
+func (p *presenceTracker) who(room string) []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	members := make([]string, 0, len(p.rooms[room]))
+	for identity := range p.rooms[room] {
+		members = append(members, identity)
+	}
+
+	sort.Strings(members)
+
+	return members
+}
+
+// arrive announces c to the rest of the room if its identity is new there.
+func (b *broadcastService) arrive(c gnet.Conn, name string) error {
+	identity := connIdentity(c)
+	if !b.presence.add(name, identity, c) {
+		return nil
+	}
+
+	return b.announcePresence(name, identity, presenceJoin, c)
+}
+
+// depart schedules the leave of c from the room. It may be called with
+// b.mu held.
+func (b *broadcastService) depart(c gnet.Conn, name string) {
+	identity := connIdentity(c)
+
+	b.presence.remove(name, identity, c, func() {
+		if err := b.announcePresence(name, identity, presenceLeave, nil); err != nil {
+			b.presence.logger.Warn("announcing leave", zap.String("room", name), zap.String("member", identity), zap.Error(err))
+		}
+	})
+}
+
+func (b *broadcastService) announcePresence(name, identity, status string, except gnet.Conn) error {
+	frame := newEncodedFrame(controlFrame{Type: framePresence, Room: name, Member: identity, Status: status})
+
+	for _, c := range b.roomMembers(name) {
+		if c == except {
+			continue
+		}
+
+		if _, err := frame.writeTo(c); err != nil {
+			return fmt.Errorf("announcing presence in room %q: %w", name, err)
+		}
+	}
+
+	return nil
+}
+
+func (b *broadcastService) roomMembers(name string) []gnet.Conn {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	r, ok := b.rooms[name]
+	if !ok {
+		return nil
+	}
+
+	members := make([]gnet.Conn, 0, len(r.members))
+	for c := range r.members {
+		members = append(members, c)
+	}
+
+	return members
+}
+
+// who answers a who request with the members present in the room.
+func (b *broadcastService) who(c gnet.Conn, id, name string) error {
+	if b.presence == nil {
+		return writeControlError(c, id, fmt.Sprintf("%s %q: %v", frameWho, name, errPresenceDisabled))
+	}
+
+	members := b.presence.who(name)
+
+	var tenant string
+	if codec, ok := codecOf(c); ok {
+		tenant = codec.tenant
+	}
+
+	return writeControlFrame(c, controlFrame{Type: frameWho, ID: id, Room: name, Members: members, Statuses: b.lastSeen.statuses(tenant, members)})
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	errOutOfScope  = errors.New("token may not publish to this room")
+	errRateLimited = errors.New("publish rate limit exceeded")
+)
+
+// publishToken is a least-privilege credential for POST /broadcast and
+// /publish on the admin listener. It may only publish to rooms of its
+// tenants, whose rooms are named "tenant/...", or to rooms matching one of
+// its path.Match patterns. It can never broadcast to every connection or
+// reach any other admin endpoint.
+type publishToken struct {
+	Name    string   `json:"name"`
+	Token   string   `json:"token"`
+	Tenants []string `json:"tenants"`
+	Rooms   []string `json:"rooms"`
+
+	// Rate is the messages per second the token may publish, 0 is unlimited.
+	// Burst defaults to one second's worth.
+	Rate  float64 `json:"rate"`
+	Burst int     `json:"burst"`
+
+	limiter *rateLimiter
+}
+
+type publishTokenKey struct{}
+
+// loadPublishTokens reads a JSON array of publishToken from file.
+func loadPublishTokens(file string) ([]*publishToken, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("reading publish tokens: %w", err)
+	}
+
+	var tokens []*publishToken
+	if err := json.Unmarshal(data, &tokens); err != nil {
+		return nil, fmt.Errorf("parsing publish tokens %s: %w", file, err)
+	}
+
+	for _, t := range tokens {
+		if t.Name == "" || t.Token == "" {
+			return nil, fmt.Errorf("publish token %q: name and token are required", t.Name)
+		}
+
+		if len(t.Tenants) == 0 && len(t.Rooms) == 0 {
+			return nil, fmt.Errorf("publish token %q: no tenants or rooms in scope", t.Name)
+		}
+
+		for _, pattern := range t.Rooms {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return nil, fmt.Errorf("publish token %q: room pattern %q: %w", t.Name, pattern, err)
+			}
+		}
+
+		if t.Rate < 0 || t.Burst < 0 {
+			return nil, fmt.Errorf("publish token %q: rate and burst must not be negative", t.Name)
+		}
+
+		if t.Rate > 0 {
+			burst := float64(t.Burst)
+			if burst == 0 {
+				burst = math.Max(1, t.Rate)
+			}
+
+			t.limiter = newRateLimiter(t.Rate, burst)
+		}
+	}
+
+	return tokens, nil
+}
+
+// publishTokenFor returns the scoped token r authenticates with, if any.
+func (a *adminServer) publishTokenFor(r *http.Request) *publishToken {
+	token, ok := bearerToken(r.Header.Get("Authorization"))
+	if !ok {
+		return nil
+	}
+
+	var found *publishToken
+
+	// Compare against every token so timing does not reveal which matched.
+	for _, t := range a.publishTokens {
+		if secureEqual(token, t.Token) {
+			found = t
+		}
+	}
+
+	return found
+}
+
+func withPublishToken(ctx context.Context, t *publishToken) context.Context {
+	return context.WithValue(ctx, publishTokenKey{}, t)
+}
+
+func publishTokenFrom(ctx context.Context) *publishToken {
+	t, _ := ctx.Value(publishTokenKey{}).(*publishToken)
+
+	return t
+}
+
+func (t *publishToken) covers(room string) bool {
+	for _, tenant := range t.Tenants {
+		if strings.HasPrefix(room, tenant+"/") {
+			return true
+		}
+	}
+
+	for _, pattern := range t.Rooms {
+		if ok, _ := path.Match(pattern, room); ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// authorize checks that t may publish to room now. On errRateLimited it
+// also reports how long until the next publish is allowed.
+func (t *publishToken) authorize(room string) (time.Duration, error) {
+	if room == "" || !t.covers(room) {
+		return 0, errOutOfScope
+	}
+
+	if t.limiter == nil {
+		return 0, nil
+	}
+
+	if wait := t.limiter.reserve(); wait > 0 {
+		return wait, errRateLimited
+	}
+
+	return 0, nil
+}
+
+// authorizePublish enforces the scope and rate limit of a scoped token, if
+// the request used one, and writes the error response when it is refused.
+func authorizePublish(w http.ResponseWriter, r *http.Request, room string) bool {
+	t := publishTokenFrom(r.Context())
+	if t == nil {
+		return true
+	}
+
+	wait, err := t.authorize(room)
+
+	switch {
+	case errors.Is(err, errOutOfScope):
+		http.Error(w, err.Error(), http.StatusForbidden)
+
+		return false
+	case errors.Is(err, errRateLimited):
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		http.Error(w, err.Error(), http.StatusTooManyRequests)
+
+		return false
+	}
+
+	return true
+}
+
+// rateLimiter is a token bucket refilled at rate per second up to burst.
+type rateLimiter struct {
+	rate  float64
+	burst float64
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(rate, burst float64) *rateLimiter {
+	return &rateLimiter{rate: rate, burst: burst, tokens: burst, last: time.Now()}
+}
+
+// reserve takes a token if one is available and otherwise returns how long
+// until one will be.
+func (l *rateLimiter) reserve() time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	l.tokens = math.Min(l.burst, l.tokens+now.Sub(l.last).Seconds()*l.rate)
+	l.last = now
+
+	if l.tokens < 1 {
+		return time.Duration((1 - l.tokens) / l.rate * float64(time.Second))
+	}
+
+	l.tokens--
+
+	return 0
+}
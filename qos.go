@@ -0,0 +1,293 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gobwas/ws"
+	"github.com/panjf2000/gnet/v2"
+	"go.uber.org/zap"
+)
+
+const frameDelivery = "delivery"
+
+var errClientIDInUse = errors.New("client_id is in use by another connection")
+
+// Delivery statuses reported to the publisher of a QoS message.
+const (
+	deliveryDelivered = "delivered"
+	deliveryExpired   = "expired"
+)
+
+// qosPublish marks a publish as requiring acks. The publisher is told once
+// every subscriber has acknowledged it, or once the TTL runs out.
+type qosPublish struct {
+	publisher gnet.Conn
+	requestID string
+}
+
+// qosMessage is a message some subscribers still owe an ack for. Pending
+// holds QoS identities rather than connections, so a subscriber that
+// reconnects with the same client_id gets the message again.
+type qosMessage struct {
+	id        string
+	room      string
+	msg       roomMessage
+	publisher gnet.Conn
+	requestID string
+	pending   map[string]struct{}
+	expires   time.Time
+}
+
+// qosTracker gives at-least-once delivery to subscribers that identify
+// themselves with a client_id on the upgrade request. Members without one
+// still receive QoS messages but are not waited for.
+type qosTracker struct {
+	ttl    time.Duration
+	logger *zap.Logger
+
+	mu       sync.Mutex
+	messages map[string]*qosMessage
+}
+
+func newMessageID() string {
+	id := make([]byte, 8)
+	// crypto/rand only fails when the system has no entropy source at all.
+	_, _ = rand.Read(id)
+
+	return hex.EncodeToString(id)
+}
+
+// qosIdentity is whom QoS tracks under clientID: the client id itself for
+// anonymous connections, and the client id of the session subject for
+// authenticated ones, so nobody who signs in as someone else can take over
+// their messages. Under -multi-tenant the identity is the tenant's.
+func qosIdentity(tenant, subject, clientID string) string {
+	if clientID == "" {
+		return ""
+	}
+
+	id := "client:" + clientID
+	if subject != "" {
+		// Escaping keeps slashes in the subject from faking another one.
+		id = "session:" + url.PathEscape(subject) + "/" + clientID
+	}
+
+	return tenantRoom(tenant, id)
+}
+
+func qosIDOf(c gnet.Conn) string {
+	if codec, ok := codecOf(c); ok {
+		return codec.qosID
+	}
+
+	return ""
+}
+
+// clientClaims holds the QoS identity of every live connection that gave a
+// client_id, so a second connection cannot take one over, and with it the
+// acks and redeliveries owed to the first.
+type clientClaims struct {
+	mu      sync.Mutex
+	holders map[string]*wsCodec
+}
+
+// claim gives id to codec unless another connection holds it.
+func (cc *clientClaims) claim(id string, codec *wsCodec) bool {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+
+	if holder, ok := cc.holders[id]; ok && holder != codec {
+		return false
+	}
+
+	if cc.holders == nil {
+		cc.holders = make(map[string]*wsCodec)
+	}
+
+	cc.holders[id] = codec
+
+	return true
+}
+
+// release gives up codec's claim on id, if it still holds it.
+func (cc *clientClaims) release(id string, codec *wsCodec) {
+	if id == "" {
+		return
+	}
+
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+
+	if cc.holders[id] == codec {
+		delete(cc.holders, id)
+	}
+}
+
+// claimClientID names codec by the client_id its handshake gave, refusing
+// the upgrade with 409 while another connection holds the same identity.
+func (b *broadcastService) claimClientID(codec *wsCodec, clientID string) error {
+	id := qosIdentity(codec.tenant, codec.metadata["session_subject"], clientID)
+	if id != "" && !b.clientIDs.claim(id, codec) {
+		return ws.RejectConnectionError(
+			ws.RejectionStatus(http.StatusConflict),
+			ws.RejectionReason(errClientIDInUse.Error()),
+		)
+	}
+
+	codec.clientID, codec.qosID = clientID, id
+
+	return nil
+}
+
+// track registers a message the given members must acknowledge. It returns
+// the message at once if nobody has to, so the caller can report it
+// delivered.
+func (q *qosTracker) track(name string, msg roomMessage, p *qosPublish, members []gnet.Conn) *qosMessage {
+	qm := &qosMessage{
+		id:        msg.msgID,
+		room:      name,
+		msg:       msg,
+		publisher: p.publisher,
+		requestID: p.requestID,
+		pending:   make(map[string]struct{}),
+		expires:   time.Now().Add(q.ttl),
+	}
+
+	for _, c := range members {
+		if id := qosIDOf(c); id != "" {
+			qm.pending[id] = struct{}{}
+		}
+	}
+
+	if len(qm.pending) == 0 {
+		return qm
+	}
+
+	q.mu.Lock()
+	q.messages[qm.id] = qm
+	q.mu.Unlock()
+
+	return nil
+}
+
+// acknowledge records that the QoS identity client has processed room up to seq and
+// returns the messages that are now fully delivered.
+func (q *qosTracker) acknowledge(client, room string, seq uint64) []*qosMessage {
+	if q == nil || client == "" {
+		return nil
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	var done []*qosMessage
+
+	for id, qm := range q.messages {
+		if qm.room != room || qm.msg.seq > seq {
+			continue
+		}
+
+		delete(qm.pending, client)
+
+		if len(qm.pending) == 0 {
+			delete(q.messages, id)
+			done = append(done, qm)
+		}
+	}
+
+	return done
+}
+
+// owed returns the messages of room client has yet to acknowledge, in
+// sequence order, for redelivery when it subscribes again.
+func (q *qosTracker) owed(client, room string) []roomMessage {
+	if q == nil || client == "" {
+		return nil
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	var msgs []roomMessage
+
+	for _, qm := range q.messages {
+		if _, ok := qm.pending[client]; ok && qm.room == room {
+			msgs = append(msgs, qm.msg)
+		}
+	}
+
+	sort.Slice(msgs, func(i, j int) bool { return msgs[i].seq < msgs[j].seq })
+
+	return msgs
+}
+
+func (q *qosTracker) expire(now time.Time) []*qosMessage {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	var expired []*qosMessage
+
+	for id, qm := range q.messages {
+		if now.After(qm.expires) {
+			delete(q.messages, id)
+			expired = append(expired, qm)
+		}
+	}
+
+	return expired
+}
+
+// run expires messages whose TTL has passed and tells their publishers.
+func (q *qosTracker) run(b *broadcastService) {
+	ticker := time.NewTicker(q.ttl / 10)
+	defer ticker.Stop()
+
+	for now := range ticker.C {
+		for _, qm := range q.expire(now) {
+			b.reportDelivery(qm, deliveryExpired)
+		}
+	}
+}
+
+// reportDelivery tells the publisher of qm how it went, if it is still
+// connected.
+func (b *broadcastService) reportDelivery(qm *qosMessage, status string) {
+	b.mu.RLock()
+	_, connected := b.connections[qm.publisher]
+	b.mu.RUnlock()
+
+	if !connected {
+		return
+	}
+
+	err := writeControlFrame(qm.publisher, controlFrame{
+		Type:    frameDelivery,
+		ID:      qm.requestID,
+		Room:    qm.room,
+		Seq:     qm.msg.seq,
+		MsgID:   qm.id,
+		Status:  status,
+		Pending: len(qm.pending),
+	})
+	if err != nil && b.qos.logger != nil {
+		b.qos.logger.Warn("reporting delivery", zap.String("msg_id", qm.id), zap.Error(err))
+	}
+}
+
+// redeliver sends c the QoS messages of room its client still owes acks for.
+func (b *broadcastService) redeliver(c gnet.Conn, room string) error {
+	for _, msg := range b.qos.owed(qosIDOf(c), room) {
+		if err := b.deliverTo(c, room, msg); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
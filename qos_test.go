@@ -0,0 +1,217 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gobwas/ws"
+	"github.com/gobwas/ws/wsutil"
+	"go.uber.org/zap"
+)
+
+// startQoSServer runs a conformance server with QoS messages kept for ttl.
+// Connections authenticate as the subject in their ?user= query, if any.
+func startQoSServer(t *testing.T, ttl time.Duration) *conformanceServer {
+	t.Helper()
+
+	server, err := startConformanceServer(false, func(wss *wsServer) {
+		wss.bs.qos = &qosTracker{ttl: ttl, logger: zap.NewNop(), messages: make(map[string]*qosMessage)}
+		wss.onUpgrade = func(_ context.Context, req *upgradeRequest) (*upgradeResult, error) {
+			if user := req.Query.Get("user"); user != "" {
+				return &upgradeResult{Metadata: map[string]string{"session_subject": user}}, nil
+			}
+
+			return nil, nil
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(server.stop)
+
+	return server
+}
+
+func sendFrames(t *testing.T, conn net.Conn, frames ...string) {
+	t.Helper()
+
+	for _, msg := range frames {
+		if err := wsutil.WriteClientText(conn, []byte(msg)); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// readFrame returns the next control frame of type typ conn gets, skipping
+// any others.
+func readFrame(t *testing.T, conn net.Conn, typ string) controlFrame {
+	t.Helper()
+
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	for {
+		payload, err := wsutil.ReadServerText(conn)
+		if err != nil {
+			t.Fatalf("waiting for %s: %v", typ, err)
+		}
+
+		var frame controlFrame
+		if err := json.Unmarshal(payload, &frame); err != nil {
+			t.Fatalf("%q: %v", payload, err)
+		}
+
+		if frame.Type == typ {
+			return frame
+		}
+	}
+}
+
+// subscribeQoS connects to path and joins room.
+func subscribeQoS(t *testing.T, s *conformanceServer, path, room string) net.Conn {
+	t.Helper()
+
+	conn := dialConformancePath(t, s, path)
+
+	// Subscribing is not acknowledged; the pong says it is done.
+	sendFrames(t, conn, `{"type":"subscribe","room":"`+room+`"}`, `{"type":"ping"}`)
+	readFrame(t, conn, framePong)
+
+	return conn
+}
+
+// redial connects to path once the connection that held its client_id is
+// gone, which the server learns a moment after the client closes.
+func redial(t *testing.T, s *conformanceServer, path string) net.Conn {
+	t.Helper()
+
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		conn, _, _, err := ws.Dial(context.Background(), "ws://"+s.addr+path)
+		if err == nil {
+			t.Cleanup(func() { conn.Close() })
+
+			return conn
+		}
+
+		if !errors.Is(err, ws.StatusError(http.StatusConflict)) || time.Now().After(deadline) {
+			t.Fatal(err)
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestQoSRedeliveryAndAck(t *testing.T) {
+	server := startQoSServer(t, time.Minute)
+
+	sub := subscribeQoS(t, server, "/?client_id=s1", "q")
+	pub := dialConformance(t, server)
+
+	sendFrames(t, pub, `{"type":"publish","room":"q","id":"p1","qos":1,"data":{"n":1}}`)
+
+	ack := readFrame(t, pub, frameAck)
+	if ack.MsgID == "" || ack.Seq == 0 {
+		t.Fatalf("publish ack = %+v, want a msg_id and seq", ack)
+	}
+
+	if got := readFrame(t, sub, frameMessage); got.MsgID != ack.MsgID || got.QoS != 1 {
+		t.Fatalf("message = %+v, want msg_id %s with qos 1", got, ack.MsgID)
+	}
+
+	// Going away without acking leaves the message owed.
+	sub.Close()
+
+	sub = redial(t, server, "/?client_id=s1")
+	sendFrames(t, sub, `{"type":"subscribe","room":"q"}`)
+
+	again := readFrame(t, sub, frameMessage)
+	if again.MsgID != ack.MsgID || again.Seq != ack.Seq {
+		t.Fatalf("redelivered = %+v, want msg_id %s seq %d", again, ack.MsgID, ack.Seq)
+	}
+
+	sendFrames(t, sub, fmt.Sprintf(`{"type":"ack","room":"q","seq":%d}`, ack.Seq))
+
+	report := readFrame(t, pub, frameDelivery)
+	if report.Status != deliveryDelivered || report.ID != "p1" || report.MsgID != ack.MsgID {
+		t.Fatalf("delivery report = %+v, want delivered for p1", report)
+	}
+
+	// Once acked, nothing is owed any more.
+	sub.Close()
+
+	sub = redial(t, server, "/?client_id=s1")
+	sendFrames(t, sub, `{"type":"subscribe","room":"q"}`, `{"type":"ping"}`)
+
+	_ = sub.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	payload, err := wsutil.ReadServerText(sub)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var first controlFrame
+	if err := json.Unmarshal(payload, &first); err != nil || first.Type != framePong {
+		t.Fatalf("after the ack got %s, want only the pong", payload)
+	}
+}
+
+func TestQoSExpiry(t *testing.T) {
+	server := startQoSServer(t, 50*time.Millisecond)
+
+	go server.hub.qos.run(server.hub)
+
+	subscribeQoS(t, server, "/?client_id=s1", "q")
+	pub := dialConformance(t, server)
+
+	sendFrames(t, pub, `{"type":"publish","room":"q","id":"p1","qos":1,"data":{"n":1}}`)
+
+	report := readFrame(t, pub, frameDelivery)
+	if report.Status != deliveryExpired || report.Pending != 1 {
+		t.Fatalf("delivery report = %+v, want expired with 1 pending", report)
+	}
+
+	if owed := server.hub.qos.owed(qosIdentity("", "", "s1"), "q"); len(owed) != 0 {
+		t.Fatalf("%d messages still owed after expiry", len(owed))
+	}
+}
+
+func TestQoSClientIDClaims(t *testing.T) {
+	server := startQoSServer(t, time.Minute)
+
+	dialConformancePath(t, server, "/?client_id=phone")
+
+	_, _, _, err := ws.Dial(context.Background(), "ws://"+server.addr+"/?client_id=phone")
+	if !errors.Is(err, ws.StatusError(http.StatusConflict)) {
+		t.Fatalf("second connection with a live client_id: err = %v, want 409", err)
+	}
+
+	// Under a session subject the client_id is the subject's own.
+	alice := subscribeQoS(t, server, "/?user=alice&client_id=phone", "q")
+	mallory := subscribeQoS(t, server, "/?user=mallory&client_id=phone", "q")
+
+	pub := dialConformance(t, server)
+	sendFrames(t, pub, `{"type":"publish","room":"q","id":"p1","qos":1,"data":{"n":1}}`)
+
+	ack := readFrame(t, pub, frameAck)
+	readFrame(t, alice, frameMessage)
+	readFrame(t, mallory, frameMessage)
+
+	// Acks are not answered; the pong says this one was handled.
+	sendFrames(t, mallory, fmt.Sprintf(`{"type":"ack","room":"q","seq":%d}`, ack.Seq), `{"type":"ping"}`)
+	readFrame(t, mallory, framePong)
+
+	owed := server.hub.qos.owed(qosIdentity("", "alice", "phone"), "q")
+	if len(owed) != 1 || owed[0].msgID != ack.MsgID {
+		t.Fatalf("alice's phone owed %+v after mallory's ack, want %s", owed, ack.MsgID)
+	}
+
+	if qosIdentity("", "a/client:b", "c") == qosIdentity("", "a", "client:b/c") {
+		t.Fatal("subjects with slashes share a QoS identity")
+	}
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"encoding/json"
+	"math/rand"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/panjf2000/gnet/v2"
+	"go.uber.org/zap"
+)
+
+// defaultRebalanceWindow is how long a drain spreads its closes over when
+// the request does not say.
+const defaultRebalanceWindow = 30 * time.Second
+
+// rebalanceRequest picks connections to drain: those matching the Where
+// tag selector, members of Room, or both, and of those a random Percent.
+// Percent alone picks from every connection.
+type rebalanceRequest struct {
+	Where   string  `json:"where"`
+	Room    string  `json:"room"`
+	Percent float64 `json:"percent"`
+	// Window is a Go duration the closes are spread over at random.
+	Window string `json:"window"`
+	// ReconnectAfter is a Go duration clients are told to wait before
+	// reconnecting.
+	ReconnectAfter string `json:"reconnect_after"`
+}
+
+// handleRebalance drains a subset of connections on POST
+// /connections/drain with a rebalanceRequest body, without refusing new
+// ones, so load moves to other nodes a little at a time. Each picked
+// connection is sent the reconnect endpoints and a rebalance close at a
+// random point of the window. GET reports how many closes are pending.
+func (wss *wsServer) handleRebalance(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, map[string]int64{"pending": atomic.LoadInt64(&wss.atomicRebalancing)})
+	case http.MethodPost:
+		var req rebalanceRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "invalid drain: "+err.Error(), http.StatusBadRequest)
+
+			return
+		}
+
+		if req.Where == "" && req.Room == "" && req.Percent == 0 {
+			http.Error(w, "select connections with where, room or percent", http.StatusBadRequest)
+
+			return
+		}
+
+		if req.Percent < 0 || req.Percent > 100 {
+			http.Error(w, "percent must be between 0 and 100", http.StatusBadRequest)
+
+			return
+		}
+
+		window, after := defaultRebalanceWindow, time.Duration(0)
+
+		var err error
+		if req.Window != "" {
+			if window, err = time.ParseDuration(req.Window); err != nil || window < 0 {
+				http.Error(w, "window must be a Go duration", http.StatusBadRequest)
+
+				return
+			}
+		}
+
+		if req.ReconnectAfter != "" {
+			if after, err = time.ParseDuration(req.ReconnectAfter); err != nil || after < 0 {
+				http.Error(w, "reconnect_after must be a Go duration", http.StatusBadRequest)
+
+				return
+			}
+		}
+
+		conns, err := wss.rebalanceTargets(req)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+
+			return
+		}
+
+		wss.rebalance(conns, window, after)
+
+		wss.logger.Info("admin drain",
+			zap.String("where", req.Where),
+			zap.String("room", req.Room),
+			zap.Float64("percent", req.Percent),
+			zap.Duration("window", window),
+			zap.Duration("reconnect_after", after),
+			zap.Int("connections", len(conns)))
+
+		writeJSON(w, http.StatusAccepted, map[string]int{"connections": len(conns)})
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// rebalanceTargets resolves req to the connections it picks.
+func (wss *wsServer) rebalanceTargets(req rebalanceRequest) ([]gnet.Conn, error) {
+	var conns []gnet.Conn
+
+	switch {
+	case req.Where != "":
+		sel, err := parseTagSelector(req.Where)
+		if err != nil {
+			return nil, err
+		}
+
+		conns = wss.bs.matching(sel)
+
+		if req.Room != "" {
+			members := make(map[gnet.Conn]struct{})
+			for _, c := range wss.bs.roomMembers(req.Room) {
+				members[c] = struct{}{}
+			}
+
+			kept := conns[:0]
+			for _, c := range conns {
+				if _, ok := members[c]; ok {
+					kept = append(kept, c)
+				}
+			}
+
+			conns = kept
+		}
+	case req.Room != "":
+		conns = wss.bs.roomMembers(req.Room)
+	default:
+		conns = wss.bs.snapshot()
+	}
+
+	if req.Percent > 0 && req.Percent < 100 {
+		rand.Shuffle(len(conns), func(i, j int) { conns[i], conns[j] = conns[j], conns[i] })
+		conns = conns[:int(float64(len(conns))*req.Percent/100+0.5)]
+	}
+
+	return conns, nil
+}
+
+// rebalance closes each of conns at a random point within window. Those
+// that went away meanwhile are skipped.
+func (wss *wsServer) rebalance(conns []gnet.Conn, window, after time.Duration) {
+	detail := ""
+	if after > 0 {
+		detail = after.String()
+	}
+
+	atomic.AddInt64(&wss.atomicRebalancing, int64(len(conns)))
+
+	for _, c := range conns {
+		var delay time.Duration
+		if window > 0 {
+			delay = time.Duration(rand.Int63n(int64(window)))
+		}
+
+		c := c
+		time.AfterFunc(delay, func() {
+			defer atomic.AddInt64(&wss.atomicRebalancing, -1)
+
+			wss.bs.mu.RLock()
+			_, ok := wss.bs.connections[c]
+			wss.bs.mu.RUnlock()
+
+			if !ok {
+				return
+			}
+
+			_ = wss.writeEndpointHints(c, frameReconnect, 0)
+			_ = closeWith(c, closeRebalance, detail)
+		})
+	}
+}
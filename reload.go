@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+
+	"github.com/oschwald/maxminddb-golang"
+	"github.com/tetratelabs/wazero"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// reloader re-reads the environment and config file on SIGHUP or
+// POST /reload and applies the options that can change without dropping
+// connections. Everything else keeps its startup value until a restart.
+type reloader struct {
+	config *configSource
+	level  zap.AtomicLevel
+	// certs are the key pairs of the TLS listeners.
+	certs   []reloadableCert
+	plugins *wasmPlugins
+	router  *luaRouter
+	geo     *geoIP
+	hub     *broadcastService
+	logger  *zap.Logger
+
+	mu sync.Mutex
+}
+
+// reloadableCert is a listener's key pair and the options naming its files.
+type reloadableCert struct {
+	loader            *certificateLoader
+	certFlag, keyFlag string
+}
+
+// reload applies nothing unless every reloadable option is valid: it reads
+// everything first and only then swaps it in.
+func (r *reloader) reload() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	settings, err := r.config.settings()
+	if err != nil {
+		return err
+	}
+
+	level, err := zapcore.ParseLevel(r.config.lookup(settings, "log-level"))
+	if err != nil {
+		return fmt.Errorf("parsing log level: %w", err)
+	}
+
+	mode, err := parseHubMode(r.config.lookup(settings, "mode"))
+	if err != nil {
+		return err
+	}
+
+	certs := make([]*tls.Certificate, len(r.certs))
+	for i, c := range r.certs {
+		certs[i], err = readKeyPair(r.config.lookup(settings, c.certFlag), r.config.lookup(settings, c.keyFlag))
+		if err != nil {
+			return fmt.Errorf("-%s: %w", c.certFlag, err)
+		}
+	}
+
+	ctx := context.Background()
+
+	pluginPaths := splitList(r.config.lookup(settings, "wasm-plugins"))
+
+	runtime, plugins, err := compileWasmPlugins(ctx, pluginPaths)
+	if err != nil {
+		return err
+	}
+
+	script := r.config.lookup(settings, "lua-script")
+
+	state, err := openLuaScript(script)
+	if err != nil {
+		closeWasmRuntime(ctx, runtime)
+
+		return err
+	}
+
+	var db *maxminddb.Reader
+	if r.geo != nil {
+		if db, err = openGeoIP(r.config.lookup(settings, "geoip-db")); err != nil {
+			closeWasmRuntime(ctx, runtime)
+
+			if state != nil {
+				state.Close()
+			}
+
+			return err
+		}
+	}
+
+	for i, c := range r.certs {
+		c.loader.set(certs[i])
+	}
+
+	r.plugins.swap(ctx, runtime, plugins, pluginPaths)
+	r.router.swap(state, script)
+
+	if r.geo != nil {
+		if err := r.geo.swap(db); err != nil {
+			r.logger.Warn("closing previous GeoIP database", zap.Error(err))
+		}
+	}
+
+	r.level.SetLevel(level)
+	r.hub.setMode(mode)
+
+	r.logger.Info("configuration reloaded",
+		zap.Stringer("log_level", level), zap.String("mode", string(mode)), zap.Int("certificates", len(r.certs)))
+
+	return nil
+}
+
+func closeWasmRuntime(ctx context.Context, runtime wazero.Runtime) {
+	if runtime != nil {
+		runtime.Close(ctx)
+	}
+}
+
+func (r *reloader) reloadOnSignal() {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGHUP)
+
+	for range sig {
+		if err := r.reload(); err != nil {
+			r.logger.Error("reloading configuration", zap.Error(err))
+		}
+	}
+}
+
+func (a *adminServer) handleReload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+
+		return
+	}
+
+	if err := a.reload.reload(); err != nil {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// certificateLoader serves the most recently loaded key pair, so a renewed
+// certificate is picked up by new handshakes without restarting the
+// listener.
+type certificateLoader struct {
+	mu   sync.RWMutex
+	cert *tls.Certificate
+}
+
+func (l *certificateLoader) load(certFile, keyFile string) error {
+	cert, err := readKeyPair(certFile, keyFile)
+	if err != nil {
+		return err
+	}
+
+	l.set(cert)
+
+	return nil
+}
+
+func readKeyPair(certFile, keyFile string) (*tls.Certificate, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("loading TLS key pair: %w", err)
+	}
+
+	return &cert, nil
+}
+
+func (l *certificateLoader) set(cert *tls.Certificate) {
+	l.mu.Lock()
+	l.cert = cert
+	l.mu.Unlock()
+}
+
+func (l *certificateLoader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	return l.cert, nil
+}
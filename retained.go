@@ -0,0 +1,158 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"sort"
+
+	"github.com/panjf2000/gnet/v2"
+	"go.uber.org/zap"
+)
+
+var errNothingRetained = errors.New("room has no retained message")
+
+// isRetained reports whether rooms named name keep their last message for
+// new subscribers, as -retained-rooms decides.
+func (b *broadcastService) isRetained(name string) bool {
+	for _, pattern := range b.retainedRooms {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// retain keeps msg as the room's retained message. It must be called with
+// the hub's lock held.
+func (r *room) retain(msg roomMessage) {
+	// State rooms retain their snapshot instead; see settleState.
+	if r.retains && r.state == nil {
+		r.retained = &msg
+	}
+}
+
+// holdForRetained pauses a new subscription until the retained message
+// it is owed has been written, so nothing published meanwhile overtakes
+// it. It must be called with the hub's lock held.
+func (r *room) holdForRetained(sub *subscription) {
+	if r.retained == nil {
+		return
+	}
+
+	sub.paused, sub.policy = true, pauseBuffer
+	sub.retained = r.retained
+}
+
+// deliverRetained writes c the retained message it was owed on joining,
+// then whatever was published since.
+func (b *broadcastService) deliverRetained(c gnet.Conn, name string) error {
+	b.mu.Lock()
+
+	sub, ok := b.subscriptionOf(c, name)
+	if !ok || sub.retained == nil {
+		b.mu.Unlock()
+
+		return nil
+	}
+
+	msg := *sub.retained
+	sub.retained = nil
+	b.mu.Unlock()
+
+	msg, ok, err := b.transformFor(c, name, msg)
+	if err != nil {
+		return fmt.Errorf("delivering retained message of room %q: %w", name, err)
+	}
+
+	if ok {
+		frame := roomMessageFrame(name, msg)
+		frame.Retained = true
+
+		if err := writeControlFrame(c, frame); err != nil {
+			return fmt.Errorf("delivering retained message of room %q: %w", name, err)
+		}
+	}
+
+	return b.resume(c, name, nil)
+}
+
+// retainedOf returns the room's retained message, if any.
+func (b *broadcastService) retainedOf(name string) (roomMessage, bool) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	r, ok := b.rooms[name]
+	if !ok || r.retained == nil {
+		return roomMessage{}, false
+	}
+
+	return *r.retained, true
+}
+
+func (b *broadcastService) clearRetained(name string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	r, ok := b.rooms[name]
+	if !ok || r.retained == nil {
+		return errNothingRetained
+	}
+
+	r.retained = nil
+	if r.state != nil {
+		// Without a snapshot the deltas would have nothing to apply to;
+		// the next publish starts the document over.
+		r.state = &roomState{}
+	}
+
+	return nil
+}
+
+type retainedInfo struct {
+	Room string `json:"room"`
+	Seq  uint64 `json:"seq"`
+	Size int    `json:"size"`
+}
+
+func (b *broadcastService) retainedInfos() []retainedInfo {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	infos := []retainedInfo{}
+	for name, r := range b.rooms {
+		if r.retained != nil {
+			infos = append(infos, retainedInfo{Room: name, Seq: r.retained.seq, Size: len(r.retained.data)})
+		}
+	}
+
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Room < infos[j].Room })
+
+	return infos
+}
+
+// handleRetained lists the rooms holding a retained message on GET and
+// forgets the one of ?room= on DELETE; the room's next publish retains
+// again.
+func (a *adminServer) handleRetained(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, a.bs.retainedInfos())
+	case http.MethodDelete:
+		room := r.URL.Query().Get("room")
+
+		if err := a.bs.clearRetained(room); err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+
+			return
+		}
+
+		a.audit.Info("admin cleared retained message", zap.String("action", "clear_retained"), zap.String("room", room))
+
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
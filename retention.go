@@ -0,0 +1,167 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// retentionPolicy bounds the history a room keeps for resume and replay.
+// Zero fields leave that dimension unbounded.
+type retentionPolicy struct {
+	maxMessages int
+	maxAge      time.Duration
+	maxBytes    int
+}
+
+type retentionRule struct {
+	pattern string
+	policy  retentionPolicy
+}
+
+// parseRetentionPolicy parses semicolon-separated limits such as
+// "messages:500;age:1h;bytes:1048576". Limits left out are taken from base.
+func parseRetentionPolicy(s string, base retentionPolicy) (retentionPolicy, error) {
+	policy := base
+
+	for _, limit := range strings.Split(s, ";") {
+		if limit = strings.TrimSpace(limit); limit == "" {
+			continue
+		}
+
+		i := strings.IndexByte(limit, ':')
+		if i < 0 {
+			return retentionPolicy{}, fmt.Errorf("retention limit %q: want name:value", limit)
+		}
+
+		name, value := limit[:i], limit[i+1:]
+
+		var err error
+
+		switch name {
+		case "messages":
+			policy.maxMessages, err = strconv.Atoi(value)
+		case "bytes":
+			policy.maxBytes, err = strconv.Atoi(value)
+		case "age":
+			policy.maxAge, err = time.ParseDuration(value)
+		default:
+			return retentionPolicy{}, fmt.Errorf("unknown retention limit %q, want messages, age or bytes", name)
+		}
+
+		if err != nil || strings.HasPrefix(value, "-") {
+			return retentionPolicy{}, fmt.Errorf("retention limit %q: invalid value", limit)
+		}
+	}
+
+	return policy, nil
+}
+
+// parseRetentionRules parses comma-separated pattern=limits pairs, e.g.
+// "audit.*=age:720h;bytes:67108864,ticks.*=messages:10", in the same way as
+// -room-ordering: path.Match patterns, first match wins. Limits a rule
+// leaves out come from base.
+func parseRetentionRules(s string, base retentionPolicy) ([]retentionRule, error) {
+	var rules []retentionRule
+
+	for _, item := range splitList(s) {
+		i := strings.LastIndex(item, "=")
+		if i < 0 {
+			return nil, fmt.Errorf("retention rule %q: want pattern=limits", item)
+		}
+
+		pattern := item[:i]
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("retention rule %q: %w", item, err)
+		}
+
+		policy, err := parseRetentionPolicy(item[i+1:], base)
+		if err != nil {
+			return nil, fmt.Errorf("retention rule %q: %w", item, err)
+		}
+
+		rules = append(rules, retentionRule{pattern: pattern, policy: policy})
+	}
+
+	return rules, nil
+}
+
+func (b *broadcastService) retentionFor(name string) retentionPolicy {
+	for _, rule := range b.retentionRules {
+		if ok, _ := path.Match(rule.pattern, name); ok {
+			return rule.policy
+		}
+	}
+
+	if b.retention == (retentionPolicy{}) {
+		return retentionPolicy{maxMessages: b.historyDepth}
+	}
+
+	return b.retention
+}
+
+// trim drops the oldest messages until the history fits the room's policy
+// and returns how many went. It must be called with the hub's lock held.
+func (r *room) trim(now time.Time) int {
+	p := r.retention
+
+	var drop, bytes int
+	for drop < len(r.history) {
+		msg := r.history[drop]
+
+		over := (p.maxMessages > 0 && len(r.history)-drop > p.maxMessages) ||
+			(p.maxBytes > 0 && r.historyBytes-bytes > p.maxBytes) ||
+			(p.maxAge > 0 && now.Sub(msg.at) > p.maxAge)
+		if !over {
+			break
+		}
+
+		bytes += len(msg.data)
+		drop++
+	}
+
+	if drop > 0 {
+		// In place, so a room publishing at its cap does not allocate; the
+		// tail is cleared to let go of the dropped data.
+		n := copy(r.history, r.history[drop:])
+		clear(r.history[n:])
+		r.history = r.history[:n]
+		r.historyBytes -= bytes
+	}
+
+	return drop
+}
+
+// appendHistory records msg and trims the history right away; the
+// compactor takes care of rooms nobody publishes to.
+func (r *room) appendHistory(msg roomMessage) {
+	r.history = append(r.history, msg)
+	r.historyBytes += len(msg.data)
+
+	r.trim(msg.at)
+}
+
+// compactHistory trims every room's history to its policy each interval,
+// which is what expires messages by age in rooms nobody publishes to.
+func (b *broadcastService) compactHistory(interval time.Duration, logger *zap.Logger) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for now := range ticker.C {
+		var dropped int
+
+		b.mu.Lock()
+		for _, r := range b.rooms {
+			dropped += r.trim(now)
+		}
+		b.mu.Unlock()
+
+		if dropped > 0 {
+			logger.Debug("compacted room history", zap.Int("dropped", dropped))
+		}
+	}
+}
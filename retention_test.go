@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fullRoom returns a room whose history is at the cap of policy, with
+// messages of size bytes.
+func fullRoom(policy retentionPolicy, size int) (*room, json.RawMessage) {
+	r := &room{retention: policy}
+	data := json.RawMessage(strconv.Quote(strings.Repeat("x", size-2)))
+
+	for r.seq < 1000 {
+		r.seq++
+		r.appendHistory(roomMessage{seq: r.seq, data: data, at: time.Now()})
+	}
+
+	return r, data
+}
+
+var retentionPolicies = []struct {
+	name   string
+	policy retentionPolicy
+}{
+	{name: "messages", policy: retentionPolicy{maxMessages: 100}},
+	{name: "bytes", policy: retentionPolicy{maxBytes: 100 * 64}},
+}
+
+func TestTrimKeepsNewest(t *testing.T) {
+	for _, p := range retentionPolicies {
+		t.Run(p.name, func(t *testing.T) {
+			r, _ := fullRoom(p.policy, 64)
+
+			if len(r.history) != 100 || r.history[0].seq != 901 || r.history[99].seq != 1000 {
+				t.Fatalf("history holds %d messages, %d to %d; want 100, 901 to 1000",
+					len(r.history), r.history[0].seq, r.history[len(r.history)-1].seq)
+			}
+
+			for i, msg := range r.history {
+				if msg.seq != 901+uint64(i) {
+					t.Fatalf("history[%d] seq = %d, want %d", i, msg.seq, 901+i)
+				}
+			}
+
+			if r.historyBytes != 100*64 {
+				t.Fatalf("history bytes = %d, want %d", r.historyBytes, 100*64)
+			}
+
+			// What was trimmed off the end of the backing array is let go.
+			if tail := r.history[len(r.history):cap(r.history)]; len(tail) > 0 && tail[0].data != nil {
+				t.Fatal("trimmed message still referenced past the end of history")
+			}
+		})
+	}
+}
+
+func TestAppendHistoryAtCapDoesNotAllocate(t *testing.T) {
+	for _, p := range retentionPolicies {
+		t.Run(p.name, func(t *testing.T) {
+			r, data := fullRoom(p.policy, 64)
+
+			allocs := testing.AllocsPerRun(100, func() {
+				r.seq++
+				r.appendHistory(roomMessage{seq: r.seq, data: data, at: time.Now()})
+			})
+
+			if allocs != 0 {
+				t.Fatalf("%.1f allocations per publish at the retention cap, want 0", allocs)
+			}
+		})
+	}
+}
+
+func BenchmarkAppendHistory(b *testing.B) {
+	for _, p := range retentionPolicies {
+		b.Run(p.name, func(b *testing.B) {
+			r, data := fullRoom(p.policy, 64)
+
+			b.ReportAllocs()
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				r.seq++
+				r.appendHistory(roomMessage{seq: r.seq, data: data, at: time.Now()})
+			}
+		})
+	}
+}
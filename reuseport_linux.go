@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+
+	"golang.org/x/sys/unix"
+)
+
+// skfAdRandom is SKF_AD_OFF + SKF_AD_RANDOM from linux/filter.h: the classic
+// BPF ancillary offset that loads a random u32.
+const skfAdRandom = 0xfffff000 + 56
+
+// reuseportListeners finds this process's SO_REUSEPORT listening sockets on
+// port. gnet opens one per event loop and does not expose them.
+func reuseportListeners(port int) ([]int, error) {
+	entries, err := os.ReadDir("/proc/self/fd")
+	if err != nil {
+		return nil, fmt.Errorf("listing file descriptors: %w", err)
+	}
+
+	var fds []int
+
+	for _, entry := range entries {
+		fd, err := strconv.Atoi(entry.Name())
+		if err != nil {
+			continue
+		}
+
+		if accepting, err := unix.GetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_ACCEPTCONN); err != nil || accepting != 1 {
+			continue
+		}
+
+		if reuse, err := unix.GetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_REUSEPORT); err != nil || reuse != 1 {
+			continue
+		}
+
+		sa, err := unix.Getsockname(fd)
+		if err != nil {
+			continue
+		}
+
+		switch sa := sa.(type) {
+		case *unix.SockaddrInet4:
+			if sa.Port == port {
+				fds = append(fds, fd)
+			}
+		case *unix.SockaddrInet6:
+			if sa.Port == port {
+				fds = append(fds, fd)
+			}
+		}
+	}
+
+	return fds, nil
+}
+
+// steerToNewest makes the kernel hand every new connection on the reuseport
+// group to one of the last newest sockets, skipping the older ones that
+// precede them in the group. The program applies to the whole group.
+func steerToNewest(fd, older, newest int) error {
+	if newest <= 0 {
+		return fmt.Errorf("no listeners to steer to")
+	}
+
+	prog := []unix.SockFilter{
+		{Code: unix.BPF_LD | unix.BPF_W | unix.BPF_ABS, K: skfAdRandom},
+		{Code: unix.BPF_ALU | unix.BPF_MOD | unix.BPF_K, K: uint32(newest)},
+		{Code: unix.BPF_ALU | unix.BPF_ADD | unix.BPF_K, K: uint32(older)},
+		{Code: unix.BPF_RET | unix.BPF_A},
+	}
+
+	fprog := unix.SockFprog{Len: uint16(len(prog)), Filter: &prog[0]}
+
+	if err := unix.SetsockoptSockFprog(fd, unix.SOL_SOCKET, unix.SO_ATTACH_REUSEPORT_CBPF, &fprog); err != nil {
+		return fmt.Errorf("attaching reuseport program: %w", err)
+	}
+
+	return nil
+}
+
+func unsteer(fd int) error {
+	if err := unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_DETACH_REUSEPORT_BPF, 0); err != nil {
+		return fmt.Errorf("detaching reuseport program: %w", err)
+	}
+
+	return nil
+}
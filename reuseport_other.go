@@ -0,0 +1,20 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import "errors"
+
+var errHandoffUnsupported = errors.New("reuseport handoff is only supported on linux")
+
+func reuseportListeners(port int) ([]int, error) {
+	return nil, errHandoffUnsupported
+}
+
+func steerToNewest(fd, older, newest int) error {
+	return errHandoffUnsupported
+}
+
+func unsteer(fd int) error {
+	return errHandoffUnsupported
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"crypto/rand"
+	"fmt"
+	"path"
+
+	"github.com/panjf2000/gnet/v2"
+)
+
+// roomKeySize is sized for AES-256; the server never uses the key itself, it
+// only hands it to members so they can encrypt payloads among themselves.
+const roomKeySize = 32
+
+type roomKey struct {
+	id  uint64
+	key []byte
+}
+
+type keyRotation struct {
+	room    string
+	key     roomKey
+	members []gnet.Conn
+}
+
+func (b *broadcastService) isConfidential(name string) bool {
+	for _, pattern := range b.confidentialRooms {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// rotateKey replaces the room key so that a member who just left cannot read
+// what follows and a member who just joined cannot read what came before.
+// It must be called with b.mu held.
+func (r *room) rotateKey() (*keyRotation, error) {
+	if !r.confidential {
+		return nil, nil
+	}
+
+	key := make([]byte, roomKeySize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, fmt.Errorf("generating key for room %q: %w", r.name, err)
+	}
+
+	r.key = roomKey{id: r.key.id + 1, key: key}
+
+	members := make([]gnet.Conn, 0, len(r.members))
+	for c := range r.members {
+		members = append(members, c)
+	}
+
+	return &keyRotation{room: r.name, key: r.key, members: members}, nil
+}
+
+func (kr *keyRotation) distribute() error {
+	if kr == nil {
+		return nil
+	}
+
+	frame := newEncodedFrame(controlFrame{
+		Type:  frameRoomKey,
+		Room:  kr.room,
+		KeyID: kr.key.id,
+		Key:   kr.key.key,
+	})
+
+	for _, c := range kr.members {
+		if _, err := frame.writeTo(c); err != nil {
+			return fmt.Errorf("distributing key for room %q: %w", kr.room, err)
+		}
+	}
+
+	return nil
+}
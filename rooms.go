@@ -0,0 +1,515 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/gobwas/ws"
+	"github.com/panjf2000/gnet/v2"
+)
+
+var (
+	errNotSubscribed  = errors.New("not subscribed to room")
+	errUnknownPolicy  = errors.New("unknown pause policy")
+	errHistoryExpired = errors.New("requested sequence is no longer in history")
+	errAckAhead       = errors.New("ack is ahead of the last delivered sequence")
+)
+
+type pausePolicy string
+
+const (
+	pauseBuffer pausePolicy = "buffer"
+	pauseDrop   pausePolicy = "drop"
+)
+
+type roomMessage struct {
+	seq  uint64
+	data json.RawMessage
+	// msgID is set on messages published with QoS.
+	msgID string
+	// delta is set on the merge patches of state rooms.
+	delta bool
+	// at is when the message was published, for retention by age.
+	at time.Time
+}
+
+type room struct {
+	name    string
+	seq     uint64
+	history []roomMessage
+	members map[gnet.Conn]*subscription
+
+	retention    retentionPolicy
+	historyBytes int
+
+	confidential bool
+	key          roomKey
+
+	// retains is set for rooms under -retained-rooms, retained then being
+	// their last message.
+	retains  bool
+	retained *roomMessage
+	state    *roomState
+
+	ordering  orderingMode
+	sequencer sync.Mutex
+
+	stats *fanoutStats
+
+	// holders counts transport clients waiting on the room, and emptySince
+	// is when it last had neither them nor members; see reapRooms.
+	holders    int
+	emptySince time.Time
+}
+
+type subscription struct {
+	paused   bool
+	policy   pausePolicy
+	buffered []roomMessage
+
+	// delivered is the last sequence handed to the connection and acked the
+	// highest it has acknowledged; dropped counts messages it never got.
+	delivered uint64
+	acked     uint64
+	dropped   uint64
+
+	// retained is the retained message the subscription is owed, held
+	// paused until it is written.
+	retained *roomMessage
+}
+
+func (b *broadcastService) subscribe(c gnet.Conn, name string) error {
+	rotation, err := b.join(c, name)
+	if err != nil {
+		return err
+	}
+
+	if err := rotation.distribute(); err != nil {
+		return err
+	}
+
+	if err := b.arrive(c, name); err != nil {
+		return err
+	}
+
+	if err := b.deliverRetained(c, name); err != nil {
+		return err
+	}
+
+	return b.redeliver(c, name)
+}
+
+func (b *broadcastService) join(c gnet.Conn, name string) (*keyRotation, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	r, err := b.roomOf(name)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, ok := r.members[c]; ok {
+		return nil, nil
+	}
+
+	if b.maxRoomMembers > 0 && len(r.members) >= b.maxRoomMembers {
+		return nil, errRoomFull
+	}
+
+	// Members owe nothing from before they joined.
+	sub := &subscription{delivered: r.seq, acked: r.seq}
+	r.holdForRetained(sub)
+	r.members[c] = sub
+	r.emptySince = time.Time{}
+
+	if tc, ok := b.connections[c]; ok {
+		tc.subscriptions[name] = sub
+	}
+
+	return r.rotateKey()
+}
+
+func (b *broadcastService) newRoom(name string) *room {
+	return &room{
+		name:         name,
+		members:      make(map[gnet.Conn]*subscription),
+		confidential: b.isConfidential(name),
+		retains:      b.isRetained(name),
+		state:        b.stateFor(name),
+		ordering:     b.orderingFor(name),
+		retention:    b.retentionFor(name),
+		stats:        &fanoutStats{total: b.statsTotal(name)},
+	}
+}
+
+func (b *broadcastService) unsubscribe(c gnet.Conn, name string) error {
+	rotation, err := b.leave(c, name)
+	if err != nil {
+		return err
+	}
+
+	return rotation.distribute()
+}
+
+func (b *broadcastService) leave(c gnet.Conn, name string) (*keyRotation, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	r, ok := b.rooms[name]
+	if !ok {
+		return nil, errNotSubscribed
+	}
+
+	if _, ok := r.members[c]; !ok {
+		return nil, errNotSubscribed
+	}
+
+	delete(r.members, c)
+	delete(b.connections[c].subscriptions, name)
+	b.depart(c, name)
+	r.vacated()
+
+	return r.rotateKey()
+}
+
+// publish records data in the room's history and delivers it to every
+// member as the room's ordering mode dictates. Nothing is recorded once ctx
+// is done, so a publish on behalf of a connection or stream that has gone
+// away is dropped rather than sequenced.
+func (b *broadcastService) publish(ctx context.Context, name string, data json.RawMessage) error {
+	_, err := b.publishWith(ctx, name, data, nil)
+
+	return err
+}
+
+// publishWith publishes data and returns the message as recorded. With q
+// the message requires acks from the room's subscribers and gets an id; the
+// publisher gets a delivery frame once it is acknowledged or expires.
+func (b *broadcastService) publishWith(ctx context.Context, name string, data json.RawMessage, q *qosPublish) (roomMessage, error) {
+	msg, _, err := b.publishReport(ctx, name, data, q)
+
+	return msg, err
+}
+
+// publishReport is publishWith that also reports how delivery went.
+func (b *broadcastService) publishReport(ctx context.Context, name string, data json.RawMessage, q *qosPublish) (roomMessage, deliveryReport, error) {
+	if err := ctx.Err(); err != nil {
+		return roomMessage{}, deliveryReport{}, err
+	}
+
+	if url := b.movedTo(name); url != "" {
+		return roomMessage{}, deliveryReport{}, &roomMovedError{url: url}
+	}
+
+	if err := b.cluster.admit(name, data); err != nil {
+		return roomMessage{}, deliveryReport{}, err
+	}
+
+	throttled, err := b.bandwidth.admit(name)
+	if err != nil {
+		return roomMessage{}, deliveryReport{}, err
+	}
+
+	// Peers run the message through their own middleware.
+	b.cluster.forward(ctx, name, data)
+
+	out, ok, err := b.outbound(ctx, name, ws.OpText, data)
+	if err != nil || !ok {
+		return roomMessage{}, deliveryReport{}, err
+	}
+	data = out
+
+	ordering, sequencer := b.orderingOf(name)
+	if sequencer != nil {
+		sequencer.Lock()
+		defer sequencer.Unlock()
+	}
+
+	started := time.Now()
+
+	state, err := b.diffState(name, data)
+	if err != nil {
+		return roomMessage{}, deliveryReport{}, err
+	}
+
+	if state != nil {
+		defer state.mu.Unlock()
+	}
+
+	msg, targets, paused, stats, done := b.record(name, data, q, state)
+	if stats == nil {
+		return msg, deliveryReport{}, nil
+	}
+
+	if done != nil {
+		defer b.reportDelivery(done, deliveryDelivered)
+	}
+
+	tally := newDeliveryTally(started, len(targets)+paused, paused)
+
+	stats.received(len(data))
+
+	if b.shed.level() >= shedCoalesce || throttled {
+		held := msg
+		if msg.delta {
+			// Conflating deltas would lose all but the last; a snapshot
+			// stands in for them.
+			held, _ = b.retainedOf(name)
+		}
+
+		b.coalesced.hold(name, held)
+		tally.skipped += len(targets)
+
+		return msg, b.finishDelivery(tally, stats), nil
+	}
+
+	b.bandwidth.charge(name, int64(len(data))*int64(len(targets)))
+
+	groups := b.framesFor(ctx, name, msg, targets, tally)
+
+	if ordering == orderUnordered {
+		for _, g := range groups {
+			if err = deliverUnordered(g.conns, g.frame, stats, tally); err != nil {
+				break
+			}
+		}
+
+		return msg, b.finishDelivery(tally, stats), err
+	}
+
+	for _, g := range groups {
+		if err := b.deliverOrdered(g.conns, g.frame, stats, tally); err != nil {
+			return msg, deliveryReport{}, err
+		}
+	}
+
+	return msg, b.finishDelivery(tally, stats), nil
+}
+
+// record appends data to the room history and returns the members that should
+// receive it right away, and how many are paused; those hold it according
+// to their policy. A QoS message nobody has to acknowledge is returned as
+// already done. state is what diffState readied for a state room.
+func (b *broadcastService) record(name string, data json.RawMessage, q *qosPublish, state *roomState) (roomMessage, []gnet.Conn, int, *fanoutStats, *qosMessage) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	r, ok := b.rooms[name]
+	if !ok || b.moved[name] != "" {
+		// A room being migrated has been copied already.
+		return roomMessage{}, nil, 0, nil, nil
+	}
+
+	r.seq++
+	msg := roomMessage{seq: r.seq, data: data, at: time.Now()}
+	r.settleState(state, &msg)
+
+	var done *qosMessage
+	if q != nil && b.qos != nil {
+		msg.msgID = newMessageID()
+
+		members := make([]gnet.Conn, 0, len(r.members))
+		for c := range r.members {
+			members = append(members, c)
+		}
+
+		done = b.qos.track(name, msg, q, members)
+	}
+
+	r.appendHistory(msg)
+	r.retain(msg)
+
+	b.notifyHooks(name, msg)
+
+	targets := make([]gnet.Conn, 0, len(r.members))
+	for c, sub := range r.members {
+		if sub.paused {
+			sub.hold(msg, b.pauseBufferSize)
+			continue
+		}
+
+		sub.delivered = msg.seq
+		targets = append(targets, c)
+	}
+
+	return msg, targets, len(r.members) - len(targets), r.stats, done
+}
+
+func (b *broadcastService) pause(c gnet.Conn, name string, policy pausePolicy) error {
+	switch policy {
+	case "":
+		policy = pauseBuffer
+	case pauseBuffer, pauseDrop:
+	default:
+		return errUnknownPolicy
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	sub, ok := b.subscriptionOf(c, name)
+	if !ok {
+		return errNotSubscribed
+	}
+
+	sub.paused = true
+	sub.policy = policy
+
+	return nil
+}
+
+// resume flushes whatever was buffered while paused, unless the client asks
+// to catch up from a specific sequence, in which case history is replayed
+// from there instead.
+func (b *broadcastService) resume(c gnet.Conn, name string, fromSeq *uint64) error {
+	pending, err := b.unpause(c, name, fromSeq)
+	if err != nil {
+		return err
+	}
+
+	for _, msg := range pending {
+		if err := b.deliverTo(c, name, msg); err != nil {
+			return fmt.Errorf("replaying room %q: %w", name, err)
+		}
+	}
+
+	return nil
+}
+
+// ack records that c has processed the messages of a room up to seq.
+// Acknowledgements only move forward. Publishers of QoS messages this
+// completes are told they were delivered.
+func (b *broadcastService) ack(c gnet.Conn, name string, seq uint64) error {
+	if err := b.advanceAck(c, name, seq); err != nil {
+		return err
+	}
+
+	for _, qm := range b.qos.acknowledge(qosIDOf(c), name, seq) {
+		b.reportDelivery(qm, deliveryDelivered)
+	}
+
+	return nil
+}
+
+func (b *broadcastService) advanceAck(c gnet.Conn, name string, seq uint64) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	sub, ok := b.subscriptionOf(c, name)
+	if !ok {
+		return errNotSubscribed
+	}
+
+	if seq > sub.delivered {
+		return errAckAhead
+	}
+
+	if seq > sub.acked {
+		sub.acked = seq
+	}
+
+	return nil
+}
+
+func (b *broadcastService) unpause(c gnet.Conn, name string, fromSeq *uint64) ([]roomMessage, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	sub, ok := b.subscriptionOf(c, name)
+	if !ok {
+		return nil, errNotSubscribed
+	}
+
+	pending := sub.buffered
+	if fromSeq != nil {
+		if b.shed.level() >= shedPauseReplay {
+			return nil, errReplayShed
+		}
+
+		history, err := b.rooms[name].since(*fromSeq)
+		if err != nil {
+			return nil, err
+		}
+
+		pending = append([]roomMessage(nil), history...)
+	}
+
+	sub.paused = false
+	sub.buffered = nil
+
+	if n := len(pending); n > 0 && pending[n-1].seq > sub.delivered {
+		sub.delivered = pending[n-1].seq
+	}
+
+	return pending, nil
+}
+
+// subscriptionOf must be called with b.mu held.
+func (b *broadcastService) subscriptionOf(c gnet.Conn, name string) (*subscription, bool) {
+	tc, ok := b.connections[c]
+	if !ok {
+		return nil, false
+	}
+
+	sub, ok := tc.subscriptions[name]
+
+	return sub, ok
+}
+
+// since returns the kept messages from seq on. The slice is the room's
+// history, which appending trims in place, so callers copy what they use
+// once the hub's lock is released.
+func (r *room) since(seq uint64) ([]roomMessage, error) {
+	if seq == 0 {
+		seq = 1
+	}
+
+	if seq > r.seq {
+		return nil, nil
+	}
+
+	if len(r.history) == 0 || r.history[0].seq > seq {
+		return nil, errHistoryExpired
+	}
+
+	return r.history[seq-r.history[0].seq:], nil
+}
+
+func (s *subscription) hold(msg roomMessage, limit int) {
+	if s.policy == pauseDrop {
+		s.dropped++
+
+		return
+	}
+
+	s.buffered = append(s.buffered, msg)
+	if over := len(s.buffered) - limit; over > 0 {
+		s.buffered = s.buffered[over:]
+		s.dropped += uint64(over)
+	}
+}
+
+func roomMessageFrame(name string, msg roomMessage) controlFrame {
+	frame := controlFrame{
+		Type:  frameMessage,
+		Room:  name,
+		Seq:   msg.seq,
+		Data:  msg.data,
+		MsgID: msg.msgID,
+		Delta: msg.delta,
+	}
+
+	if msg.msgID != "" {
+		frame.QoS = 1
+	}
+
+	return frame
+}
+
+func deliverRoomMessage(c gnet.Conn, name string, msg roomMessage) error {
+	return writeControlFrame(c, roomMessageFrame(name, msg))
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/panjf2000/gnet/v2"
+)
+
+// queueConn is a connection without a codec, whose queued writes happen at
+// once, or fail with err. Methods delivery does not use are left to the
+// embedded nil interface.
+type queueConn struct {
+	gnet.Conn
+
+	err error
+
+	mu      sync.Mutex
+	written int
+}
+
+func (c *queueConn) AsyncWrite(_ []byte, callback gnet.AsyncCallback) error {
+	if c.err != nil {
+		return c.err
+	}
+
+	c.mu.Lock()
+	c.written++
+	c.mu.Unlock()
+
+	if callback != nil {
+		_ = callback(c)
+	}
+
+	return nil
+}
+
+// TestPublishSkipsFailedMembers checks a member that cannot be written to
+// neither stops the fan-out nor fails the publish.
+func TestPublishSkipsFailedMembers(t *testing.T) {
+	for _, ordering := range []orderingMode{orderStrict, orderFIFO, orderUnordered} {
+		t.Run(string(ordering), func(t *testing.T) {
+			b := newHookHub(4, "room")
+			r := b.rooms["room"]
+			r.ordering = ordering
+
+			members := []*queueConn{{}, {err: errors.New("connection is closing")}, {}}
+			for _, c := range members {
+				r.members[c] = &subscription{}
+			}
+
+			_, report, err := b.publishReport(context.Background(), "room", json.RawMessage(`{}`), nil)
+			if err != nil {
+				t.Fatalf("publish failed with a closing member: %v", err)
+			}
+
+			if report.Delivered != 2 || report.Failed != 1 {
+				t.Fatalf("report = %+v, want 2 delivered and 1 failed", report)
+			}
+
+			for i, c := range members {
+				if c.err == nil && c.written != 1 {
+					t.Fatalf("member %d got %d writes, want 1", i, c.written)
+				}
+			}
+		})
+	}
+}
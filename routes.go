@@ -0,0 +1,66 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/gobwas/ws"
+)
+
+// roomRoutePrefix is the upgrade path that joins the named room straight
+// away, for clients that cannot speak the subscribe protocol.
+const roomRoutePrefix = "/ws/room/"
+
+var errUnknownRoute = ws.RejectConnectionError(
+	ws.RejectionStatus(http.StatusNotFound),
+	ws.RejectionReason("unknown websocket path"),
+)
+
+// upgradeRoute is what the request path of an upgrade asks for. The root
+// and /ws are the plain endpoint, where rooms are joined with control frames.
+// Any of them may be put under /t/{tenant} to name the tenant.
+type upgradeRoute struct {
+	tenant string
+	room   string
+}
+
+func parseRoute(uri []byte) (upgradeRoute, error) {
+	if i := bytes.IndexByte(uri, '?'); i >= 0 {
+		uri = uri[:i]
+	}
+
+	p := string(uri)
+
+	var tenant string
+
+	if strings.HasPrefix(p, tenantRoutePrefix) {
+		rest := strings.TrimPrefix(p, tenantRoutePrefix)
+
+		i := strings.IndexByte(rest, '/')
+		if i < 0 {
+			rest += "/"
+			i = len(rest) - 1
+		}
+
+		tenant, p = rest[:i], rest[i:]
+		if !validTenant.MatchString(tenant) {
+			return upgradeRoute{}, errUnknownRoute
+		}
+	}
+
+	switch {
+	case p == "/" || p == "/ws":
+		return upgradeRoute{tenant: tenant}, nil
+	case strings.HasPrefix(p, roomRoutePrefix):
+		name, err := url.PathUnescape(strings.TrimPrefix(p, roomRoutePrefix))
+		if err != nil || name == "" || strings.Contains(name, "/") {
+			return upgradeRoute{}, errUnknownRoute
+		}
+
+		return upgradeRoute{tenant: tenant, room: name}, nil
+	default:
+		return upgradeRoute{}, errUnknownRoute
+	}
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/panjf2000/gnet/v2"
+)
+
+const (
+	frameRequest = "request"
+	frameReply   = "reply"
+)
+
+// replyTimedOut is the status of the reply a requester gets when nobody
+// answered in time.
+const replyTimedOut = "timeout"
+
+var (
+	errRequestsDisabled = errors.New("requests are disabled")
+	errNoResponder      = errors.New("nobody to answer the request")
+	errRequestTarget    = errors.New(`a request targets a room or "user:<subject>" or "service:<name>"`)
+	errCorrelationInUse = errors.New("correlation id is already pending")
+	errUnknownRequest   = errors.New("no pending request with this correlation id")
+)
+
+// requestRouter carries request/response over the hub. A request goes to
+// the other members of a room, to every connection of a user or to one
+// connection of a service, any of those tagged service=<name>, always
+// within the requester's tenant. Responders see it with a correlation id,
+// the requester's id unless it chose one, and answer with a reply frame
+// carrying that id. The first reply goes back to the requester alone, with
+// the id of its request; later ones are refused. A requester nobody
+// answers within its timeout gets a reply with status timeout instead.
+type requestRouter struct {
+	// timeout is both how long a request waits by default and the most it
+	// may ask for.
+	timeout time.Duration
+
+	mu      sync.Mutex
+	pending map[string]*pendingRequest
+}
+
+type pendingRequest struct {
+	requester  gnet.Conn
+	id, room   string
+	responders map[gnet.Conn]struct{}
+	timer      *time.Timer
+}
+
+func newRequestRouter(timeout time.Duration) *requestRouter {
+	return &requestRouter{timeout: timeout, pending: make(map[string]*pendingRequest)}
+}
+
+func (rr *requestRouter) timeoutFor(ms int64) time.Duration {
+	if requested := time.Duration(ms) * time.Millisecond; requested > 0 && requested < rr.timeout {
+		return requested
+	}
+
+	return rr.timeout
+}
+
+// open tracks a request until it is answered or times out.
+func (rr *requestRouter) open(correlationID string, p *pendingRequest, timeout time.Duration) error {
+	rr.mu.Lock()
+	defer rr.mu.Unlock()
+
+	if _, ok := rr.pending[correlationID]; ok {
+		return errCorrelationInUse
+	}
+
+	rr.pending[correlationID] = p
+	p.timer = time.AfterFunc(timeout, func() {
+		if p := rr.take(correlationID, nil); p != nil {
+			_ = writeControlFrame(p.requester, controlFrame{
+				Type:          frameReply,
+				ID:            p.id,
+				Room:          p.room,
+				CorrelationID: correlationID,
+				Status:        replyTimedOut,
+			})
+		}
+	})
+
+	return nil
+}
+
+// take stops tracking a request, if responder, when not nil, is one it was
+// sent to.
+func (rr *requestRouter) take(correlationID string, responder gnet.Conn) *pendingRequest {
+	rr.mu.Lock()
+	defer rr.mu.Unlock()
+
+	p, ok := rr.pending[correlationID]
+	if !ok {
+		return nil
+	}
+
+	if _, sent := p.responders[responder]; responder != nil && !sent {
+		return nil
+	}
+
+	delete(rr.pending, correlationID)
+	p.timer.Stop()
+
+	return p
+}
+
+// forget drops the requests c is waiting on.
+func (rr *requestRouter) forget(c gnet.Conn) {
+	if rr == nil {
+		return
+	}
+
+	rr.mu.Lock()
+	defer rr.mu.Unlock()
+
+	for id, p := range rr.pending {
+		if p.requester == c {
+			p.timer.Stop()
+			delete(rr.pending, id)
+		}
+	}
+}
+
+// responders is who a request from c is sent to.
+func (b *broadcastService) responders(c gnet.Conn, room, to string) ([]gnet.Conn, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	var tenant string
+	if codec, ok := codecOf(c); ok {
+		tenant = codec.tenant
+	}
+
+	sameTenant := func(other gnet.Conn) bool {
+		codec, ok := codecOf(other)
+
+		return ok && other != c && codec.tenant == tenant
+	}
+
+	var conns []gnet.Conn
+
+	switch kind, name, _ := strings.Cut(to, ":"); {
+	case room != "" && to == "":
+		if r, ok := b.rooms[room]; ok {
+			for member := range r.members {
+				if member != c {
+					conns = append(conns, member)
+				}
+			}
+		}
+	case room == "" && kind == "user" && name != "":
+		for other := range b.connections {
+			if codec, _ := codecOf(other); sameTenant(other) && codec.metadata["session_subject"] == name {
+				conns = append(conns, other)
+			}
+		}
+	case room == "" && kind == "service" && name != "":
+		var candidates []gnet.Conn
+		for other := range b.tagIndex[tagTerm{key: "service", value: name}.String()] {
+			if sameTenant(other) {
+				candidates = append(candidates, other)
+			}
+		}
+
+		if len(candidates) > 0 {
+			conns = append(conns, candidates[rand.Intn(len(candidates))])
+		}
+	default:
+		return nil, errRequestTarget
+	}
+
+	return conns, nil
+}
+
+// request sends c's request to its responders.
+func (b *broadcastService) request(c gnet.Conn, frame controlFrame) error {
+	if b.requests == nil {
+		return errRequestsDisabled
+	}
+
+	responders, err := b.responders(c, frame.Room, frame.To)
+	if err != nil {
+		return err
+	}
+
+	if len(responders) == 0 {
+		return errNoResponder
+	}
+
+	correlationID := frame.CorrelationID
+	if correlationID == "" {
+		correlationID = newMessageID()
+	}
+
+	p := &pendingRequest{requester: c, id: frame.ID, room: frame.Room, responders: make(map[gnet.Conn]struct{}, len(responders))}
+	for _, r := range responders {
+		p.responders[r] = struct{}{}
+	}
+
+	if err := b.requests.open(correlationID, p, b.requests.timeoutFor(frame.TimeoutMS)); err != nil {
+		return err
+	}
+
+	out := newEncodedFrame(controlFrame{
+		Type:          frameRequest,
+		Room:          frame.Room,
+		CorrelationID: correlationID,
+		From:          connIdentity(c),
+		Data:          frame.Data,
+	})
+
+	// A responder that cannot be written to is closing; the others, or
+	// the timeout, answer instead.
+	for _, r := range responders {
+		_, _ = out.writeTo(r)
+	}
+
+	return nil
+}
+
+// reply routes c's answer back to the requester. Error on the reply is
+// passed on, for responders that could not serve the request.
+func (b *broadcastService) reply(c gnet.Conn, frame controlFrame) error {
+	if b.requests == nil {
+		return errRequestsDisabled
+	}
+
+	p := b.requests.take(frame.CorrelationID, c)
+	if p == nil {
+		return errUnknownRequest
+	}
+
+	if err := writeControlFrame(p.requester, controlFrame{
+		Type:          frameReply,
+		ID:            p.id,
+		Room:          p.room,
+		CorrelationID: frame.CorrelationID,
+		From:          connIdentity(c),
+		Data:          frame.Data,
+		Error:         frame.Error,
+	}); err != nil {
+		return fmt.Errorf("requester went away: %w", err)
+	}
+
+	return nil
+}
+
+func (wss *wsServer) handleRequest(conn gnet.Conn, frame controlFrame) error {
+	err := wss.permit(conn, capPublish)
+	if err == nil && frame.Room != "" {
+		err = wss.acls.authorize(conn, frame.Room, true)
+	}
+
+	if err == nil {
+		err = wss.bs.request(conn, frame)
+		wss.bs.msgAudit.record(connSource(conn), frame.Room, 0, frame.Data, err)
+	}
+
+	if err != nil {
+		return writeControlError(conn, frame.ID, fmt.Sprintf("%s: %v", frame.Type, err))
+	}
+
+	return nil
+}
+
+func (wss *wsServer) handleReply(conn gnet.Conn, frame controlFrame) error {
+	if err := wss.bs.reply(conn, frame); err != nil {
+		return writeControlError(conn, frame.ID, fmt.Sprintf("%s: %v", frame.Type, err))
+	}
+
+	if frame.ID != "" {
+		return writeControlFrame(conn, controlFrame{Type: frameAck, ID: frame.ID})
+	}
+
+	return nil
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"net/http"
+	"runtime"
+	"sync"
+	"time"
+)
+
+// statsSampleInterval is how often the hub's counters are sampled for rates;
+// statsWindows are the windows rates are reported over.
+const statsSampleInterval = 5 * time.Second
+
+var statsWindows = [...]struct {
+	name   string
+	length time.Duration
+}{
+	{"1m", time.Minute},
+	{"5m", 5 * time.Minute},
+}
+
+type counterSample struct {
+	at       time.Time
+	messages uint64
+	bytesIn  uint64
+	bytesOut uint64
+}
+
+// rateSampler keeps enough samples of the hub's cumulative counters to
+// compute rates over the longest window.
+type rateSampler struct {
+	mu      sync.Mutex
+	samples []counterSample
+}
+
+func (s *rateSampler) add(sample counterSample) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.samples = append(s.samples, sample)
+
+	keep := int(statsWindows[len(statsWindows)-1].length/statsSampleInterval) + 1
+	if over := len(s.samples) - keep; over > 0 {
+		s.samples = append(s.samples[:0:0], s.samples[over:]...)
+	}
+}
+
+// since returns the oldest sample no older than window before now, or false
+// before any sample was taken.
+func (s *rateSampler) since(now time.Time, window time.Duration) (counterSample, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, sample := range s.samples {
+		if now.Sub(sample.at) <= window {
+			return sample, true
+		}
+	}
+
+	return counterSample{}, false
+}
+
+// counters adds up what every room and the raw broadcast path have seen,
+// including rooms that have since been removed.
+func (b *broadcastService) counters() counterSample {
+	rooms, broadcast := b.roomTotals.info(""), b.broadcastStats.info("")
+
+	return counterSample{
+		at:       time.Now(),
+		messages: rooms.Messages + broadcast.Messages,
+		bytesIn:  rooms.BytesIn + broadcast.BytesIn,
+		bytesOut: rooms.BytesOut + broadcast.BytesOut,
+	}
+}
+
+func (b *broadcastService) sampleRates() {
+	b.rates.add(b.counters())
+
+	ticker := time.NewTicker(statsSampleInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		b.rates.add(b.counters())
+	}
+}
+
+// windowRates are per-second rates keyed by window, "1m" and "5m".
+type windowRates map[string]float64
+
+type runtimeStats struct {
+	Connections    int         `json:"connections"`
+	Rooms          int         `json:"rooms"`
+	Subscriptions  int         `json:"subscriptions"`
+	Messages       uint64      `json:"messages"`
+	BytesIn        uint64      `json:"bytes_in"`
+	BytesOut       uint64      `json:"bytes_out"`
+	MessagesPerSec windowRates `json:"messages_per_sec"`
+	BytesInPerSec  windowRates `json:"bytes_in_per_sec"`
+	BytesOutPerSec windowRates `json:"bytes_out_per_sec"`
+	Queues         queueDepths `json:"queues"`
+	Goroutines     int         `json:"goroutines"`
+	// Bandwidth is the quota consumption of rooms and tenants that have a
+	// bandwidth quota and broadcast within the last window.
+	Bandwidth []bandwidthUsage `json:"bandwidth,omitempty"`
+}
+
+// queueDepths counts messages waiting somewhere in the hub: buffered for
+// paused members, published with QoS and not acknowledged by everyone yet,
+// and held for coalescing while shedding load.
+type queueDepths struct {
+	PausedBuffered int `json:"paused_buffered"`
+	QoSUnacked     int `json:"qos_unacked"`
+	Coalesced      int `json:"coalesced"`
+}
+
+func (b *broadcastService) runtimeStats() runtimeStats {
+	now := b.counters()
+
+	stats := runtimeStats{
+		Messages:       now.messages,
+		BytesIn:        now.bytesIn,
+		BytesOut:       now.bytesOut,
+		MessagesPerSec: windowRates{},
+		BytesInPerSec:  windowRates{},
+		BytesOutPerSec: windowRates{},
+		Goroutines:     runtime.NumGoroutine(),
+	}
+
+	for _, window := range statsWindows {
+		then, ok := b.rates.since(now.at, window.length)
+		elapsed := now.at.Sub(then.at).Seconds()
+
+		if !ok || elapsed <= 0 {
+			elapsed = 1
+			then = now
+		}
+
+		stats.MessagesPerSec[window.name] = float64(now.messages-then.messages) / elapsed
+		stats.BytesInPerSec[window.name] = float64(now.bytesIn-then.bytesIn) / elapsed
+		stats.BytesOutPerSec[window.name] = float64(now.bytesOut-then.bytesOut) / elapsed
+	}
+
+	b.mu.RLock()
+	stats.Connections = len(b.connections)
+	stats.Rooms = len(b.rooms)
+
+	for _, r := range b.rooms {
+		stats.Subscriptions += len(r.members)
+
+		for _, sub := range r.members {
+			stats.Queues.PausedBuffered += len(sub.buffered)
+		}
+	}
+	b.mu.RUnlock()
+
+	stats.Queues.QoSUnacked = b.qos.pending()
+	stats.Queues.Coalesced = b.coalesced.held()
+	stats.Bandwidth = b.bandwidth.usage()
+
+	return stats
+}
+
+// pending counts messages still waiting on acknowledgements.
+func (q *qosTracker) pending() int {
+	if q == nil {
+		return 0
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return len(q.messages)
+}
+
+func (c *coalescer) held() int {
+	if c == nil {
+		return 0
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return len(c.pending)
+}
+
+// handleStats reports a runtime snapshot on GET /stats; the same snapshot is
+// published through expvar as "wsb" on /debug/vars.
+func (a *adminServer) handleStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+
+		return
+	}
+
+	writeJSON(w, http.StatusOK, a.bs.runtimeStats())
+}
@@ -0,0 +1,389 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/panjf2000/gnet/v2"
+	"go.uber.org/zap"
+)
+
+const frameUnschedule = "unschedule"
+
+// deliveryScheduled is the status of the ack for a publish held for later.
+const deliveryScheduled = "scheduled"
+
+// The timer wheel turns one slot every scheduleTick, so messages go out up
+// to that late, and a full turn covers wheelSlots ticks; messages further
+// ahead wait out whole turns.
+const (
+	scheduleTick = 100 * time.Millisecond
+	wheelSlots   = 512
+)
+
+var (
+	errSchedulingDisabled = errors.New("scheduled delivery is disabled")
+	errScheduleNeedsAuth  = errors.New("scheduling needs an authenticated connection")
+	errScheduleTooFar     = errors.New("delivery is further ahead than -schedule-max-delay")
+	errTooManyScheduled   = errors.New("too many messages are scheduled")
+	errUnknownSchedule    = errors.New("unknown scheduled message")
+	errBadDeliverAt       = errors.New("deliver_at must be an RFC 3339 time")
+)
+
+// scheduledMessage is a publish held until DeliverAt. Owner, the identity
+// that scheduled it qualified by tenant, may cancel it, as may admins.
+type scheduledMessage struct {
+	ID        string          `json:"id"`
+	Room      string          `json:"room"`
+	Data      json.RawMessage `json:"data"`
+	DeliverAt time.Time       `json:"deliver_at"`
+	Owner     string          `json:"owner"`
+	Created   time.Time       `json:"created"`
+
+	slot, rounds int
+}
+
+// scheduler holds scheduled publishes on a hashed timer wheel and publishes
+// each when it is due. With a file, every change is written to it and
+// messages still pending on restart are loaded back; those that fell due
+// meanwhile go out on the first tick.
+type scheduler struct {
+	maxDelay time.Duration
+	max      int
+	file     string
+	publish  func(room string, data json.RawMessage) error
+	logger   *zap.Logger
+
+	// atomicHeld keeps the wheel still on a warm standby, whose messages
+	// are the primary's until it is promoted.
+	atomicHeld int32
+
+	mu    sync.Mutex
+	pos   int
+	slots [wheelSlots]map[string]*scheduledMessage
+	byID  map[string]*scheduledMessage
+}
+
+func loadScheduler(file string, maxDelay time.Duration, max int, logger *zap.Logger) (*scheduler, error) {
+	s := &scheduler{maxDelay: maxDelay, max: max, file: file, logger: logger, byID: make(map[string]*scheduledMessage)}
+	for i := range s.slots {
+		s.slots[i] = make(map[string]*scheduledMessage)
+	}
+
+	if file == "" {
+		return s, nil
+	}
+
+	data, err := os.ReadFile(file)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("reading scheduled messages: %w", err)
+	}
+
+	var messages []*scheduledMessage
+	if err := json.Unmarshal(data, &messages); err != nil {
+		return nil, fmt.Errorf("parsing scheduled messages %s: %w", file, err)
+	}
+
+	now := time.Now()
+	for _, m := range messages {
+		s.place(m, now)
+	}
+
+	return s, nil
+}
+
+// place puts m on the wheel. It must be called with s.mu held.
+func (s *scheduler) place(m *scheduledMessage, now time.Time) {
+	ticks := int((m.DeliverAt.Sub(now) + scheduleTick - 1) / scheduleTick)
+	if ticks < 1 {
+		ticks = 1
+	}
+
+	m.slot, m.rounds = (s.pos+ticks)%wheelSlots, (ticks-1)/wheelSlots
+	s.slots[m.slot][m.ID] = m
+	s.byID[m.ID] = m
+}
+
+func (s *scheduler) unplace(m *scheduledMessage) {
+	delete(s.slots[m.slot], m.ID)
+	delete(s.byID, m.ID)
+}
+
+func (s *scheduler) add(m *scheduledMessage) error {
+	if s == nil {
+		return errSchedulingDisabled
+	}
+
+	now := time.Now()
+	if m.DeliverAt.Sub(now) > s.maxDelay {
+		return errScheduleTooFar
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.max > 0 && len(s.byID) >= s.max {
+		return errTooManyScheduled
+	}
+
+	s.place(m, now)
+
+	if err := s.persist(); err != nil {
+		s.unplace(m)
+
+		return err
+	}
+
+	return nil
+}
+
+// cancel drops a pending message of room, if owner scheduled it or admin
+// is set.
+func (s *scheduler) cancel(id, room, owner string, admin bool) error {
+	if s == nil {
+		return errSchedulingDisabled
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	m, ok := s.byID[id]
+	if !ok || (room != "" && m.Room != room) || (!admin && m.Owner != owner) {
+		return errUnknownSchedule
+	}
+
+	s.unplace(m)
+
+	if err := s.persist(); err != nil {
+		s.slots[m.slot][m.ID] = m
+		s.byID[m.ID] = m
+
+		return err
+	}
+
+	return nil
+}
+
+// replace swaps the pending messages for messages, as a standby does with
+// its primary's.
+func (s *scheduler) replace(messages []scheduledMessage) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, m := range s.byID {
+		s.unplace(m)
+	}
+
+	now := time.Now()
+	for i := range messages {
+		m := messages[i]
+		s.place(&m, now)
+	}
+
+	return s.persist()
+}
+
+// hold stops the wheel, or with held false starts it again. A nil
+// scheduler has nothing to hold.
+func (s *scheduler) hold(held bool) {
+	if s == nil {
+		return
+	}
+
+	var v int32
+	if held {
+		v = 1
+	}
+
+	atomic.StoreInt32(&s.atomicHeld, v)
+}
+
+func (s *scheduler) list() []scheduledMessage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	messages := make([]scheduledMessage, 0, len(s.byID))
+	for _, m := range s.byID {
+		messages = append(messages, *m)
+	}
+
+	sort.Slice(messages, func(i, j int) bool { return messages[i].DeliverAt.Before(messages[j].DeliverAt) })
+
+	return messages
+}
+
+// persist must be called with s.mu held.
+func (s *scheduler) persist() error {
+	if s.file == "" {
+		return nil
+	}
+
+	messages := make([]*scheduledMessage, 0, len(s.byID))
+	for _, m := range s.byID {
+		messages = append(messages, m)
+	}
+
+	sort.Slice(messages, func(i, j int) bool { return messages[i].DeliverAt.Before(messages[j].DeliverAt) })
+
+	data, err := json.MarshalIndent(messages, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err := writeFileAtomic(s.file, append(data, '\n')); err != nil {
+		return fmt.Errorf("persisting scheduled messages: %w", err)
+	}
+
+	return nil
+}
+
+// advance turns the wheel one slot and returns what fell due.
+func (s *scheduler) advance() []*scheduledMessage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.pos = (s.pos + 1) % wheelSlots
+
+	var due []*scheduledMessage
+
+	for _, m := range s.slots[s.pos] {
+		if m.rounds > 0 {
+			m.rounds--
+
+			continue
+		}
+
+		due = append(due, m)
+		s.unplace(m)
+	}
+
+	if len(due) > 0 {
+		if err := s.persist(); err != nil {
+			// The messages go out regardless; a restart before the next
+			// successful write would send them again.
+			s.logger.Error("persisting scheduled messages", zap.Error(err))
+		}
+	}
+
+	sort.Slice(due, func(i, j int) bool { return due[i].DeliverAt.Before(due[j].DeliverAt) })
+
+	return due
+}
+
+func (s *scheduler) run() {
+	ticker := time.NewTicker(scheduleTick)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if atomic.LoadInt32(&s.atomicHeld) == 1 {
+			continue
+		}
+
+		for _, m := range s.advance() {
+			if err := s.publish(m.Room, m.Data); err != nil {
+				s.logger.Warn("publishing scheduled message", zap.String("id", m.ID), zap.String("room", m.Room), zap.Error(err))
+
+				continue
+			}
+
+			s.logger.Debug("published scheduled message", zap.String("id", m.ID), zap.String("room", m.Room),
+				zap.Duration("late", time.Since(m.DeliverAt)))
+		}
+	}
+}
+
+// publishScheduled publishes a message that fell due. Nobody waits on it,
+// so it is not bound to any connection's context.
+func (b *broadcastService) publishScheduled(room string, data json.RawMessage) error {
+	return b.publish(context.Background(), room, data)
+}
+
+// schedulePublish holds conn's publish for deliver_at, or delay_ms from
+// now, and acks it with the schedule id.
+func (wss *wsServer) schedulePublish(conn gnet.Conn, owner string, frame controlFrame) error {
+	deliverAt := time.Now().Add(time.Duration(frame.DelayMS) * time.Millisecond)
+
+	var err error
+	if frame.DeliverAt != "" {
+		if deliverAt, err = time.Parse(time.RFC3339Nano, frame.DeliverAt); err != nil {
+			err = errBadDeliverAt
+		}
+	}
+
+	if err == nil && !authenticated(conn) {
+		err = errScheduleNeedsAuth
+	}
+
+	m := &scheduledMessage{
+		ID:        newMessageID(),
+		Room:      frame.Room,
+		Data:      frame.Data,
+		DeliverAt: deliverAt,
+		Owner:     owner,
+		Created:   time.Now(),
+	}
+
+	if err == nil {
+		err = wss.bs.scheduler.add(m)
+		wss.bs.msgAudit.record(connSource(conn), frame.Room, 0, frame.Data, err)
+	}
+
+	if err != nil {
+		return writeControlError(conn, frame.ID, fmt.Sprintf("%s %q: %v", frame.Type, localRoom(frame.Room), err))
+	}
+
+	return writeControlFrame(conn, controlFrame{
+		Type:       frameAck,
+		ID:         frame.ID,
+		Room:       frame.Room,
+		Status:     deliveryScheduled,
+		ScheduleID: m.ID,
+		DeliverAt:  m.DeliverAt.UTC().Format(time.RFC3339Nano),
+	})
+}
+
+// handleSchedules lists pending scheduled messages on GET and cancels one on
+// DELETE ?id=.
+func (a *adminServer) handleSchedules(w http.ResponseWriter, r *http.Request) {
+	if a.bs.scheduler == nil {
+		http.Error(w, errSchedulingDisabled.Error(), http.StatusNotFound)
+
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, a.bs.scheduler.list())
+	case http.MethodDelete:
+		id := r.URL.Query().Get("id")
+
+		if err := a.bs.scheduler.cancel(id, "", "", true); err != nil {
+			status := http.StatusInternalServerError
+			if errors.Is(err, errUnknownSchedule) {
+				status = http.StatusNotFound
+			}
+
+			http.Error(w, err.Error(), status)
+
+			return
+		}
+
+		a.audit.Info("admin unschedule", zap.String("action", "unschedule"), zap.String("id", id))
+
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
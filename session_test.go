@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gobwas/ws"
+)
+
+var sessionTestSecret = []byte("session secret")
+
+func signSession(secret []byte, claims sessionClaims) string {
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		panic(err)
+	}
+
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(payload)
+
+	return base64.RawURLEncoding.EncodeToString(payload) + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func TestSessionValidate(t *testing.T) {
+	v := &hmacSessionValidator{secret: sessionTestSecret}
+
+	now := time.Now().Unix()
+	valid := sessionClaims{Subject: "alice", Expires: now + 60, Data: map[string]string{"plan": "pro"}}
+
+	// A payload naming someone else under alice's signature.
+	signed := signSession(sessionTestSecret, valid)
+	forged := jwtPart(sessionClaims{Subject: "mallory", Expires: now + 60}) + signed[len(jwtPart(valid)):]
+
+	cases := []struct {
+		name  string
+		value string
+		err   error
+		want  map[string]string
+	}{
+		{name: "valid", value: signed, want: map[string]string{"session_subject": "alice", "plan": "pro"}},
+		{name: "no expiry", value: signSession(sessionTestSecret, sessionClaims{Subject: "alice"}), want: map[string]string{"session_subject": "alice"}},
+		{name: "payload swapped", value: forged, err: errInvalidSession},
+		{name: "signed with another secret", value: signSession([]byte("other secret"), valid), err: errInvalidSession},
+		{name: "signature truncated", value: signed[:len(signed)-4], err: errInvalidSession},
+		{name: "no signature", value: jwtPart(valid), err: errInvalidSession},
+		{name: "not base64", value: "!!!." + signed[len(jwtPart(valid))+1:], err: errInvalidSession},
+		{name: "expired", value: signSession(sessionTestSecret, sessionClaims{Subject: "alice", Expires: now - 1}), err: errSessionExpired},
+		{name: "expires now", value: signSession(sessionTestSecret, sessionClaims{Subject: "alice", Expires: now}), err: errSessionExpired},
+		{
+			name:  "data cannot name the subject",
+			value: signSession(sessionTestSecret, sessionClaims{Subject: "alice", Data: map[string]string{"session_subject": "root"}}),
+			want:  map[string]string{"session_subject": "alice"},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := v.validateSession(context.Background(), tc.value)
+
+			if tc.err != nil {
+				if !errors.Is(err, tc.err) {
+					t.Fatalf("err = %v, want %v", err, tc.err)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(got) != len(tc.want) {
+				t.Fatalf("metadata = %v, want %v", got, tc.want)
+			}
+
+			for k, val := range tc.want {
+				if got[k] != val {
+					t.Fatalf("metadata = %v, want %v", got, tc.want)
+				}
+			}
+		})
+	}
+}
+
+func TestSessionUpgradeHook(t *testing.T) {
+	hook := sessionUpgradeHook("sid", &hmacSessionValidator{secret: sessionTestSecret})
+	cookie := signSession(sessionTestSecret, sessionClaims{Subject: "alice"})
+	expired := signSession(sessionTestSecret, sessionClaims{Subject: "alice", Expires: time.Now().Unix() - 1})
+
+	cases := []struct {
+		name   string
+		header http.Header
+		status int
+	}{
+		{name: "session cookie", header: http.Header{"Cookie": {"sid=" + cookie}}},
+		{name: "no cookie", header: http.Header{}, status: http.StatusUnauthorized},
+		{name: "another cookie", header: http.Header{"Cookie": {"other=" + cookie}}, status: http.StatusUnauthorized},
+		{name: "forged cookie", header: http.Header{"Cookie": {"sid=" + cookie + "x"}}, status: http.StatusUnauthorized},
+		{name: "expired cookie", header: http.Header{"Cookie": {"sid=" + expired}}, status: http.StatusUnauthorized},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			result, err := hook(context.Background(), &upgradeRequest{Header: tc.header})
+
+			if tc.status != 0 {
+				var rejected *ws.ConnectionRejectedError
+				if !errors.As(err, &rejected) || rejected.StatusCode() != tc.status {
+					t.Fatalf("err = %v, want status %d", err, tc.status)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if result.Metadata["session_subject"] != "alice" {
+				t.Fatalf("metadata = %v", result.Metadata)
+			}
+		})
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/gobwas/ws"
+	"github.com/panjf2000/gnet/v2"
+	"go.uber.org/zap"
+)
+
+const drainPollInterval = 100 * time.Millisecond
+
+func (wss *wsServer) isDraining() bool {
+	return atomic.LoadInt32(&wss.atomicDraining) == 1
+}
+
+func (wss *wsServer) checkNotDraining() error {
+	if wss.isDraining() {
+		return errors.New("server is draining")
+	}
+
+	return nil
+}
+
+// shutdownOnSignal drains and stops the engine on the first SIGTERM or
+// SIGINT. A second signal is left to the default handler.
+func (wss *wsServer) shutdownOnSignal() {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGTERM, syscall.SIGINT)
+
+	s := <-sig
+	signal.Stop(sig)
+
+	wss.shutdown(zap.Stringer("signal", s))
+}
+
+// shutdown drains for up to the drain timeout and then stops the engine. Only
+// the first call does anything.
+func (wss *wsServer) shutdown(reason zap.Field) {
+	wss.shutdownOnce.Do(func() {
+		wss.logger.Info("shutting down", reason, zap.Duration("drain_timeout", wss.drainTimeout))
+
+		ctx, cancel := context.WithTimeout(context.Background(), wss.drainTimeout)
+		defer cancel()
+
+		wss.drain(ctx)
+
+		for _, addr := range wss.addrs {
+			if err := gnet.Stop(context.Background(), addr); err != nil {
+				wss.logger.Warn("stopping engine", zap.String("addr", addr), zap.Error(err))
+			}
+		}
+	})
+}
+
+// drain stops new upgrades and asks every client to go away, then waits for
+// them to close their side until ctx expires.
+func (wss *wsServer) drain(ctx context.Context) {
+	atomic.StoreInt32(&wss.atomicDraining, 1)
+
+	body := closeShutdown.body("")
+	for _, c := range wss.bs.snapshot() {
+		_ = wss.writeEndpointHints(c, frameReconnect, 0)
+		_ = writeServerFrame(c, ws.OpClose, body)
+	}
+
+	ticker := time.NewTicker(drainPollInterval)
+	defer ticker.Stop()
+
+	for atomic.LoadInt64(&wss.atomicNumberOfConnections) > 0 {
+		select {
+		case <-ctx.Done():
+			wss.logger.Warn("drain timed out",
+				zap.Int64("connected_count", atomic.LoadInt64(&wss.atomicNumberOfConnections)))
+
+			return
+		case <-ticker.C:
+		}
+	}
+
+	wss.logger.Info("drained all connections")
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestDrainRejectionsLeaveCountAlone refuses connections while draining and
+// checks they did not take the connection count below the connections still
+// open, so drain keeps waiting for those.
+func TestDrainRejectionsLeaveCountAlone(t *testing.T) {
+	server, err := startConformanceServer(false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(server.stop)
+
+	// Stays open and never answers the close frame drain sends.
+	dialConformance(t, server)
+
+	wss := server.wss
+	atomic.StoreInt32(&wss.atomicDraining, 1)
+
+	for i := 0; i < 3; i++ {
+		conn, err := net.Dial("tcp", server.addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+		if _, err := conn.Read(make([]byte, 1)); err == nil {
+			t.Fatal("connection opened while draining was not refused")
+		}
+
+		conn.Close()
+	}
+
+	// Let OnClose run for the refused connections.
+	time.Sleep(50 * time.Millisecond)
+
+	if n := atomic.LoadInt64(&wss.atomicNumberOfConnections); n != 1 {
+		t.Fatalf("connections = %d after refusing 3 while draining, want 1", n)
+	}
+
+	const timeout = 200 * time.Millisecond
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	start := time.Now()
+	wss.drain(ctx)
+
+	if elapsed := time.Since(start); elapsed < timeout {
+		t.Fatalf("drain returned after %v with a connection still open, want it to wait %v", elapsed, timeout)
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gobwas/ws"
+)
+
+// upgradeThrottle paces upgrades with a token bucket so a reconnect storm
+// after a restart is admitted over a few seconds instead of at once, when
+// every upgrade and its auth lookup would compete with every other. The
+// bucket refills at start upgrades per second when the ramp begins, rising
+// linearly to rate over ramp; it holds one second's worth. The ramp begins
+// when the server boots and again when a standby is promoted. A nil
+// upgradeThrottle admits everything.
+type upgradeThrottle struct {
+	start, rate float64
+	ramp        time.Duration
+
+	mu       sync.Mutex
+	began    time.Time
+	tokens   float64
+	refilled time.Time
+}
+
+func newUpgradeThrottle(start, rate float64, ramp time.Duration) *upgradeThrottle {
+	if start <= 0 || start > rate {
+		start = rate
+	}
+
+	return &upgradeThrottle{start: start, rate: rate, ramp: ramp}
+}
+
+// restart begins the ramp again from now.
+func (t *upgradeThrottle) restart(now time.Time) {
+	if t == nil {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.began, t.refilled = now, now
+	t.tokens = t.start
+}
+
+// rateAt is the refill rate at now.
+func (t *upgradeThrottle) rateAt(now time.Time) float64 {
+	elapsed := now.Sub(t.began)
+	if t.ramp <= 0 || elapsed >= t.ramp {
+		return t.rate
+	}
+
+	return t.start + (t.rate-t.start)*float64(elapsed)/float64(t.ramp)
+}
+
+// allow takes a token, or returns the rejection to answer the upgrade with.
+// Its Retry-After is spread over the rest of the ramp, so rejected clients
+// do not all come back together.
+func (t *upgradeThrottle) allow(now time.Time) error {
+	if t == nil {
+		return nil
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	rate := t.rateAt(now)
+	t.tokens = math.Min(t.tokens+now.Sub(t.refilled).Seconds()*rate, rate)
+	t.refilled = now
+
+	if t.tokens >= 1 {
+		t.tokens--
+
+		return nil
+	}
+
+	window := 2
+	if remaining := t.ramp - now.Sub(t.began); remaining > 2*time.Second {
+		window = int(remaining / time.Second)
+	}
+
+	return ws.RejectConnectionError(
+		ws.RejectionStatus(http.StatusServiceUnavailable),
+		ws.RejectionHeader(ws.HandshakeHeaderString("Retry-After: "+strconv.Itoa(1+rand.Intn(window))+"\r\n")),
+		ws.RejectionReason("server is accepting connections slowly after starting"),
+	)
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"net"
+	"runtime"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/gobwas/ws"
+	"github.com/gobwas/ws/wsutil"
+	"go.uber.org/zap"
+)
+
+const (
+	soakSteady = "steady"
+	soakBurst  = "burst"
+)
+
+var errUnknownSoakPattern = errors.New("unknown soak pattern")
+
+// soakRunner drives the server with in-process synthetic clients over
+// loopback so long-running stability tests need no external load machines.
+// Subscribers join one room and count what they receive; publishers send to
+// it at a fixed rate, either spread evenly (steady) or once a second all at
+// once (burst). With churn set, subscribers reconnect after a random
+// lifetime of up to churn.
+type soakRunner struct {
+	url            string
+	room           string
+	subscribers    int
+	publishers     int
+	rate           float64
+	size           int
+	pattern        string
+	churn          time.Duration
+	reportInterval time.Duration
+	stopped        func() bool
+	logger         *zap.Logger
+
+	atomicConnected uint64
+	atomicSent      uint64
+	atomicReceived  uint64
+	atomicErrors    uint64
+}
+
+func (s *soakRunner) validate() error {
+	if s.pattern != soakSteady && s.pattern != soakBurst {
+		return fmt.Errorf("%w %q", errUnknownSoakPattern, s.pattern)
+	}
+
+	if s.publishers > 0 && s.rate <= 0 {
+		return errors.New("soak publishers need a positive rate")
+	}
+
+	return nil
+}
+
+func (s *soakRunner) run() {
+	s.logger.Info("soak test starting",
+		zap.Int("subscribers", s.subscribers),
+		zap.Int("publishers", s.publishers),
+		zap.Float64("rate", s.rate),
+		zap.String("pattern", s.pattern))
+
+	for i := 0; i < s.subscribers; i++ {
+		go s.keep(s.subscribe)
+	}
+
+	for i := 0; i < s.publishers; i++ {
+		go s.keep(s.publish)
+	}
+
+	ticker := time.NewTicker(s.reportInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		s.report()
+
+		if s.stopped() {
+			return
+		}
+	}
+}
+
+// keep reruns a client whenever it ends, pausing after failures so a server
+// that is refusing connections is not hammered. It gives up once the server
+// is shutting down.
+func (s *soakRunner) keep(client func() error) {
+	for !s.stopped() {
+		if err := client(); err != nil {
+			atomic.AddUint64(&s.atomicErrors, 1)
+			s.logger.Debug("soak client failed", zap.Error(err))
+
+			time.Sleep(time.Second)
+		}
+	}
+}
+
+func (s *soakRunner) subscribe() error {
+	conn, rw, err := s.dial()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if s.churn > 0 {
+		lifetime := time.Duration(rand.Int63n(int64(s.churn))) + time.Millisecond
+		if err := conn.SetDeadline(time.Now().Add(lifetime)); err != nil {
+			return fmt.Errorf("setting lifetime: %w", err)
+		}
+	}
+
+	frame, err := json.Marshal(controlFrame{Type: frameSubscribe, Room: s.room})
+	if err != nil {
+		return fmt.Errorf("encoding subscribe frame: %w", err)
+	}
+
+	if err := writeClientFrame(rw, frame); err != nil {
+		return err
+	}
+
+	err = s.count(rw)
+
+	var netErr net.Error
+	if s.churn > 0 && errors.As(err, &netErr) && netErr.Timeout() {
+		return nil
+	}
+
+	return err
+}
+
+func (s *soakRunner) publish() error {
+	conn, rw, err := s.dial()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	// Publishers still get the system broadcasts; drain them so the server
+	// never has to buffer on their behalf.
+	go func() { _, _ = io.Copy(io.Discard, rw) }()
+
+	data, err := json.Marshal(map[string]string{"pad": strings.Repeat("x", s.size)})
+	if err != nil {
+		return fmt.Errorf("encoding soak payload: %w", err)
+	}
+
+	frame, err := json.Marshal(controlFrame{Type: framePublish, Room: s.room, Data: data})
+	if err != nil {
+		return fmt.Errorf("encoding publish frame: %w", err)
+	}
+
+	interval, batch := time.Duration(float64(time.Second)/s.rate), 1
+	if s.pattern == soakBurst {
+		// Bursts are whole messages, spaced out so they still average rate.
+		batch = int(math.Ceil(s.rate))
+		interval = time.Duration(float64(batch) * float64(time.Second) / s.rate)
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		for i := 0; i < batch; i++ {
+			if err := writeClientFrame(rw, frame); err != nil {
+				return err
+			}
+
+			atomic.AddUint64(&s.atomicSent, 1)
+		}
+	}
+
+	return nil
+}
+
+func (s *soakRunner) dial() (net.Conn, io.ReadWriter, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	conn, br, _, err := ws.Dial(ctx, s.url)
+	if err != nil {
+		return nil, nil, fmt.Errorf("dialing %s: %w", s.url, err)
+	}
+
+	atomic.AddUint64(&s.atomicConnected, 1)
+
+	var r io.Reader = conn
+	if br != nil {
+		r = br
+	}
+
+	return conn, struct {
+		io.Reader
+		io.Writer
+	}{r, conn}, nil
+}
+
+func (s *soakRunner) count(rw io.ReadWriter) error {
+	for {
+		msg, _, err := wsutil.ReadServerData(rw)
+		if err != nil {
+			return err
+		}
+
+		var frame controlFrame
+		if json.Unmarshal(msg, &frame) == nil && frame.Type == frameMessage {
+			atomic.AddUint64(&s.atomicReceived, 1)
+		}
+	}
+}
+
+func (s *soakRunner) report() {
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+
+	s.logger.Info("soak test progress",
+		zap.Uint64("connects", atomic.LoadUint64(&s.atomicConnected)),
+		zap.Uint64("sent", atomic.LoadUint64(&s.atomicSent)),
+		zap.Uint64("received", atomic.LoadUint64(&s.atomicReceived)),
+		zap.Uint64("errors", atomic.LoadUint64(&s.atomicErrors)),
+		zap.Uint64("rss_bytes", processRSS()),
+		zap.Uint64("heap_bytes", ms.HeapAlloc),
+		zap.Int("goroutines", runtime.NumGoroutine()))
+}
+
+// writeClientFrame writes a masked text frame in a single write so it never
+// reaches the server split across segments.
+func writeClientFrame(w io.Writer, payload []byte) error {
+	bw := bufio.NewWriterSize(w, ws.MaxHeaderSize+len(payload))
+
+	if err := wsutil.WriteClientMessage(bw, ws.OpText, payload); err != nil {
+		return fmt.Errorf("writing frame: %w", err)
+	}
+
+	return bw.Flush()
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const sseHeartbeat = 15 * time.Second
+
+// sseTransport streams room messages as Server-Sent Events for clients
+// behind middleboxes that block websockets. It is receive-only: such
+// clients publish through POST /publish.
+type sseTransport struct {
+	buffer    int
+	onUpgrade upgradeHook
+	access    transportAccess
+	bs        *broadcastService
+	logger    *zap.Logger
+
+	mu      sync.Mutex
+	clients map[string]map[*sseClient]struct{}
+}
+
+type sseClient struct {
+	events chan []byte
+	// evicted is closed once the client fell too far behind.
+	evicted chan struct{}
+	once    sync.Once
+}
+
+func (c *sseClient) evict() {
+	c.once.Do(func() { close(c.evicted) })
+}
+
+// onMessage makes the transport a messageHook. The event data is the message
+// frame a JSON websocket client would get.
+func (s *sseTransport) onMessage(ctx context.Context, room string, msg roomMessage) error {
+	event, err := sseEvent(roomMessageFrame(room, msg))
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for c := range s.clients[room] {
+		select {
+		case c.events <- event:
+		default:
+			c.evict()
+		}
+	}
+
+	return nil
+}
+
+func sseEvent(frame controlFrame) ([]byte, error) {
+	frame.Room = localRoom(frame.Room)
+
+	payload, err := jsonEncoding{}.encode(frame)
+	if err != nil {
+		return nil, err
+	}
+
+	return []byte(fmt.Sprintf("id: %d\nevent: message\ndata: %s\n\n", frame.Seq, payload)), nil
+}
+
+func (s *sseTransport) add(rooms []string, c *sseClient) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, room := range rooms {
+		clients, ok := s.clients[room]
+		if !ok {
+			clients = make(map[*sseClient]struct{})
+			s.clients[room] = clients
+		}
+
+		clients[c] = struct{}{}
+	}
+}
+
+func (s *sseTransport) remove(rooms []string, c *sseClient) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, room := range rooms {
+		delete(s.clients[room], c)
+
+		if len(s.clients[room]) == 0 {
+			delete(s.clients, room)
+		}
+	}
+}
+
+func (s *sseTransport) pattern() string { return "/events" }
+
+// handle streams the rooms named by repeated ?room= parameters. Under
+// -multi-tenant they are rooms of the client's tenant, which its
+// credentials or a /t/{tenant}/events path name.
+func (s *sseTransport) handle(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+
+		return
+	}
+
+	rooms := r.URL.Query()["room"]
+	if len(rooms) == 0 {
+		http.Error(w, "at least one room is required", http.StatusBadRequest)
+
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+
+		return
+	}
+
+	metadata, ok := authorizeTransport(w, r, s.onUpgrade)
+	if !ok {
+		return
+	}
+
+	metadata, tenant, ok := s.access.admitTenant(w, r, metadata)
+	if !ok {
+		return
+	}
+
+	if rooms, ok = s.access.authorizeRooms(w, metadata, tenant, rooms); !ok {
+		return
+	}
+
+	if err := s.bs.tenants.open(tenant); err != nil {
+		http.Error(w, err.Error(), rejectionStatus(err))
+
+		return
+	}
+	defer s.bs.tenants.close(tenant)
+
+	c := &sseClient{events: make(chan []byte, s.buffer), evicted: make(chan struct{})}
+
+	for _, room := range rooms {
+		if err := s.bs.openRoom(room); err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+
+			return
+		}
+
+		defer s.bs.closeRoom(room)
+	}
+
+	s.add(rooms, c)
+	defer s.remove(rooms, c)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	fmt.Fprint(w, ": subscribed\n\n")
+
+	for _, room := range rooms {
+		msg, ok := s.bs.retainedOf(room)
+		if !ok {
+			continue
+		}
+
+		frame := roomMessageFrame(room, msg)
+		frame.Retained = true
+
+		if event, err := sseEvent(frame); err == nil {
+			_, _ = w.Write(event)
+		}
+	}
+
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(sseHeartbeat)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-c.evicted:
+			s.logger.Info("sse client evicted for falling behind", zap.String("remote_addr", r.RemoteAddr))
+
+			return
+		case event := <-c.events:
+			if _, err := w.Write(event); err != nil {
+				return
+			}
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(w, ": ping\n\n"); err != nil {
+				return
+			}
+		}
+
+		flusher.Flush()
+	}
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// replicationSnapshot is the state a warm standby copies from its primary.
+// Draining tells the standby the primary is going away on purpose.
+type replicationSnapshot struct {
+	Rooms     []replicatedRoom   `json:"rooms"`
+	Scheduled []scheduledMessage `json:"scheduled,omitempty"`
+	Draining  bool               `json:"draining"`
+}
+
+// replicatedRoom is a room's sequence, history and retained message; for a
+// state room the retained message is its document.
+type replicatedRoom struct {
+	Name     string              `json:"name"`
+	Seq      uint64              `json:"seq"`
+	History  []replicatedMessage `json:"history"`
+	Retained *replicatedMessage  `json:"retained,omitempty"`
+}
+
+type replicatedMessage struct {
+	Seq  uint64          `json:"seq"`
+	Data json.RawMessage `json:"data"`
+	At   time.Time       `json:"at,omitempty"`
+}
+
+func (b *broadcastService) replicatedRooms() []replicatedRoom {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	rooms := make([]replicatedRoom, 0, len(b.rooms))
+	for _, r := range b.rooms {
+		rooms = append(rooms, r.replicate())
+	}
+
+	return rooms
+}
+
+// replicate copies the room's sequence, history and retained message. It
+// must be called with the hub's lock held.
+func (r *room) replicate() replicatedRoom {
+	history := make([]replicatedMessage, 0, len(r.history))
+	for _, msg := range r.history {
+		history = append(history, replicatedMessage{Seq: msg.seq, Data: msg.data, At: msg.at})
+	}
+
+	rr := replicatedRoom{Name: r.name, Seq: r.seq, History: history}
+	if r.retained != nil {
+		rr.Retained = &replicatedMessage{Seq: r.retained.seq, Data: r.retained.data, At: r.retained.at}
+	}
+
+	return rr
+}
+
+// restore overwrites rooms and scheduled messages with the primary's, so
+// that clients failing over can resume from the last sequence they saw and
+// nothing retained or scheduled is lost.
+func (b *broadcastService) restore(snap replicationSnapshot) error {
+	b.mu.Lock()
+	for _, rr := range snap.Rooms {
+		r, ok := b.rooms[rr.Name]
+		if !ok {
+			r = b.newRoom(rr.Name)
+			b.rooms[rr.Name] = r
+		}
+
+		r.overwrite(rr)
+	}
+	b.mu.Unlock()
+
+	if b.scheduler == nil {
+		return nil
+	}
+
+	return b.scheduler.replace(snap.Scheduled)
+}
+
+// overwrite replaces the room's sequence, history and retained message with
+// rr's. A state room picks its document up from the retained message. It
+// must be called with the hub's lock held.
+func (r *room) overwrite(rr replicatedRoom) {
+	r.seq = rr.Seq
+	r.history, r.historyBytes = r.history[:0], 0
+	for _, msg := range rr.History {
+		r.appendHistory(msg.message())
+	}
+
+	if !r.retains && r.state == nil {
+		return
+	}
+
+	r.retained = nil
+	if rr.Retained != nil {
+		msg := rr.Retained.message()
+		r.retained = &msg
+	}
+
+	if r.state != nil {
+		r.state = restoredState(r.retained)
+	}
+}
+
+func (m replicatedMessage) message() roomMessage {
+	at := m.At
+	if at.IsZero() {
+		at = time.Now()
+	}
+
+	return roomMessage{seq: m.Seq, data: m.Data, at: at}
+}
+
+func (wss *wsServer) handleReplication(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+
+		return
+	}
+
+	snap := replicationSnapshot{
+		Rooms:    wss.bs.replicatedRooms(),
+		Draining: wss.isDraining(),
+	}
+
+	if wss.bs.scheduler != nil {
+		snap.Scheduled = wss.bs.scheduler.list()
+	}
+
+	writeJSON(w, http.StatusOK, snap)
+}
+
+// handleFailover drains this node, pointing clients at the standby, which
+// promotes itself once it sees the primary draining.
+func (wss *wsServer) handleFailover(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+
+		return
+	}
+
+	go wss.shutdown(zap.String("reason", "failover"))
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func (wss *wsServer) handlePromote(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+
+		return
+	}
+
+	if !wss.promote("manual") {
+		http.Error(w, "not a standby", http.StatusConflict)
+
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (wss *wsServer) isStandby() bool {
+	return atomic.LoadInt32(&wss.atomicStandby) == 1
+}
+
+func (wss *wsServer) checkNotStandby() error {
+	if wss.isStandby() {
+		return errors.New("server is a standby")
+	}
+
+	return nil
+}
+
+// promote turns a standby into a serving node. It reports whether this call
+// did the promotion.
+func (wss *wsServer) promote(reason string) bool {
+	if !atomic.CompareAndSwapInt32(&wss.atomicStandby, 1, 0) {
+		return false
+	}
+
+	wss.logger.Warn("promoted to primary", zap.String("reason", reason))
+	wss.throttle.restart(time.Now())
+	wss.bs.scheduler.hold(false)
+
+	return true
+}
+
+// standbyReplicator keeps a standby's rooms in step with the primary by
+// polling its admin /replication endpoint. After failoverAfter polls fail in
+// a row, or as soon as the primary reports it is draining, the standby
+// promotes itself.
+type standbyReplicator struct {
+	primary       string
+	token         string
+	interval      time.Duration
+	failoverAfter int
+	client        *http.Client
+	wss           *wsServer
+	logger        *zap.Logger
+}
+
+func (s *standbyReplicator) run() {
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+
+	failures := 0
+
+	for s.wss.isStandby() {
+		snap, err := s.fetch()
+
+		switch {
+		case err != nil:
+			failures++
+			s.logger.Warn("replicating from primary", zap.Int("failures", failures), zap.Error(err))
+
+			if s.failoverAfter > 0 && failures >= s.failoverAfter {
+				s.wss.promote("primary unreachable")
+			}
+		case snap.Draining:
+			s.restore(snap)
+			s.wss.promote("primary draining")
+		default:
+			failures = 0
+			s.restore(snap)
+		}
+
+		<-ticker.C
+	}
+}
+
+func (s *standbyReplicator) restore(snap replicationSnapshot) {
+	if err := s.wss.bs.restore(snap); err != nil {
+		s.logger.Warn("restoring scheduled messages", zap.Error(err))
+	}
+}
+
+func (s *standbyReplicator) fetch() (replicationSnapshot, error) {
+	var snap replicationSnapshot
+
+	ctx, cancel := context.WithTimeout(context.Background(), s.interval)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.primary+"/replication", nil)
+	if err != nil {
+		return snap, fmt.Errorf("building request: %w", err)
+	}
+
+	req.Header.Set("Authorization", "Bearer "+s.token)
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return snap, fmt.Errorf("fetching snapshot: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return snap, fmt.Errorf("fetching snapshot: unexpected status %s", resp.Status)
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(&snap); err != nil {
+		return snap, fmt.Errorf("decoding snapshot: %w", err)
+	}
+
+	return snap, nil
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/panjf2000/gnet/v2"
+	"go.uber.org/zap"
+)
+
+func newReplicationHub(t *testing.T) *broadcastService {
+	t.Helper()
+
+	sched, err := loadScheduler("", time.Hour, 0, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b := &broadcastService{
+		connections:   make(map[gnet.Conn]*trackedConnection),
+		rooms:         make(map[string]*room),
+		tagIndex:      make(map[string]map[gnet.Conn]struct{}),
+		historyDepth:  4,
+		retainedRooms: []string{"retained"},
+		stateRooms:    []string{"state"},
+		scheduler:     sched,
+	}
+
+	for _, name := range []string{"retained", "state"} {
+		b.rooms[name] = b.newRoom(name)
+	}
+
+	return b
+}
+
+// TestStandbyPromotion replicates a draining primary's retained message,
+// state document and scheduled messages to a standby and checks the
+// standby carries on from them once promoted.
+func TestStandbyPromotion(t *testing.T) {
+	ctx := context.Background()
+
+	primary := newReplicationHub(t)
+
+	for _, step := range []struct{ room, data string }{
+		{"retained", `{"n":1}`},
+		{"retained", `{"n":2}`},
+		{"state", `{"a":1,"b":2}`},
+	} {
+		if err := primary.publish(ctx, step.room, json.RawMessage(step.data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	deliverAt := time.Now().Add(time.Hour).UTC().Truncate(time.Second)
+	if err := primary.scheduler.add(&scheduledMessage{ID: "s1", Room: "retained", Data: json.RawMessage(`{"n":3}`), DeliverAt: deliverAt, Owner: "alice"}); err != nil {
+		t.Fatal(err)
+	}
+
+	primaryServer := &wsServer{bs: primary, logger: zap.NewNop()}
+	atomic.StoreInt32(&primaryServer.atomicDraining, 1)
+
+	admin := httptest.NewServer(http.HandlerFunc(primaryServer.handleReplication))
+	defer admin.Close()
+
+	standby := newReplicationHub(t)
+	standby.scheduler.hold(true)
+
+	standbyServer := &wsServer{bs: standby, logger: zap.NewNop()}
+	atomic.StoreInt32(&standbyServer.atomicStandby, 1)
+
+	replicator := &standbyReplicator{
+		primary:  admin.URL,
+		token:    "token",
+		interval: 10 * time.Millisecond,
+		client:   admin.Client(),
+		wss:      standbyServer,
+		logger:   zap.NewNop(),
+	}
+	replicator.run()
+
+	if standbyServer.isStandby() {
+		t.Fatal("standby was not promoted when the primary drained")
+	}
+
+	retained, ok := standby.retainedOf("retained")
+	if !ok || retained.seq != 2 || string(retained.data) != `{"n":2}` {
+		t.Fatalf("retained = %d %s, %v; want 2 {\"n\":2}", retained.seq, retained.data, ok)
+	}
+
+	// The next publish must diff from the primary's document.
+	if err := standby.publish(ctx, "state", json.RawMessage(`{"a":1,"b":3}`)); err != nil {
+		t.Fatal(err)
+	}
+
+	history := standby.rooms["state"].history
+	if last := history[len(history)-1]; !last.delta || last.seq != 2 || string(last.data) != `{"b":3}` {
+		t.Fatalf("state publish after promotion = %d %s delta %v; want 2 {\"b\":3} delta", last.seq, last.data, last.delta)
+	}
+
+	scheduled := standby.scheduler.list()
+	if len(scheduled) != 1 || scheduled[0].ID != "s1" || !scheduled[0].DeliverAt.Equal(deliverAt) || scheduled[0].Owner != "alice" {
+		t.Fatalf("scheduled = %+v", scheduled)
+	}
+
+	if atomic.LoadInt32(&standby.scheduler.atomicHeld) != 0 {
+		t.Fatal("promotion left the scheduler held")
+	}
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"path"
+	"reflect"
+	"sync"
+)
+
+// roomState is the JSON document a room under -state-rooms holds. Every
+// publish to such a room is the whole new document; members get the JSON
+// merge patch (RFC 7386) from the previous one, flagged delta, and new
+// subscribers the whole document as the room's retained message. A member
+// that misses a delta, say through a dropped buffer, subscribes again to
+// start over from a snapshot. Merge patches cannot tell null apart from
+// removal, so the document should not hold nulls.
+type roomState struct {
+	// mu is held from diffing a publish until it has been delivered, so
+	// deltas go out in the order they chain.
+	mu sync.Mutex
+
+	// doc is the current document, nil before the first publish, and
+	// pending the publish diffed but not yet recorded.
+	doc     interface{}
+	pending *pendingState
+}
+
+type pendingState struct {
+	doc   interface{}
+	full  json.RawMessage
+	patch json.RawMessage
+}
+
+func (b *broadcastService) isStateRoom(name string) bool {
+	for _, pattern := range b.stateRooms {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// diffState readies a publish of data to room name if it is a state room,
+// returning its state locked; the caller unlocks it once the message is
+// delivered.
+func (b *broadcastService) diffState(name string, data json.RawMessage) (*roomState, error) {
+	b.mu.RLock()
+	var s *roomState
+	if r, ok := b.rooms[name]; ok {
+		s = r.state
+	}
+	b.mu.RUnlock()
+
+	if s == nil {
+		return nil, nil
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+
+	var doc interface{}
+	if err := dec.Decode(&doc); err != nil {
+		return nil, fmt.Errorf("state of room %q: %w", name, err)
+	}
+
+	s.mu.Lock()
+
+	patch, err := json.Marshal(mergePatch(s.doc, doc))
+	if err != nil {
+		s.mu.Unlock()
+
+		return nil, fmt.Errorf("state of room %q: %w", name, err)
+	}
+
+	s.pending = &pendingState{doc: doc, full: data, patch: patch}
+
+	return s, nil
+}
+
+// settleState turns msg into the delta of the publish diffState readied
+// in s and keeps the new document as the room's snapshot. The first
+// document is sent whole. It must be called with the hub's lock held.
+func (r *room) settleState(s *roomState, msg *roomMessage) {
+	if s == nil || r.state != s {
+		return
+	}
+
+	p := s.pending
+	s.pending = nil
+
+	if s.doc != nil {
+		msg.data, msg.delta = p.patch, true
+	}
+
+	snapshot := *msg
+	snapshot.data, snapshot.delta = p.full, false
+	r.retained = &snapshot
+
+	s.doc = p.doc
+}
+
+// mergePatch returns the JSON merge patch that turns from into to.
+func mergePatch(from, to interface{}) interface{} {
+	f, ok := from.(map[string]interface{})
+	t, tok := to.(map[string]interface{})
+
+	if !ok || !tok {
+		return to
+	}
+
+	patch := make(map[string]interface{})
+
+	for key := range f {
+		if _, ok := t[key]; !ok {
+			patch[key] = nil
+		}
+	}
+
+	for key, tv := range t {
+		fv, ok := f[key]
+		switch {
+		case !ok:
+			patch[key] = tv
+		case !reflect.DeepEqual(fv, tv):
+			patch[key] = mergePatch(fv, tv)
+		}
+	}
+
+	return patch
+}
+
+// restoredState is the state of a room whose document was copied from
+// elsewhere as its retained message, so the next publish diffs from it. A
+// document that does not parse is dropped and the next publish goes whole.
+func restoredState(retained *roomMessage) *roomState {
+	s := &roomState{}
+	if retained == nil {
+		return s
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(retained.data))
+	dec.UseNumber()
+
+	var doc interface{}
+	if err := dec.Decode(&doc); err == nil {
+		s.doc = doc
+	}
+
+	return s
+}
+
+func (b *broadcastService) stateFor(name string) *roomState {
+	if !b.isStateRoom(name) {
+		return nil
+	}
+
+	return &roomState{}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync/atomic"
+
+	"github.com/gobwas/ws"
+	"github.com/panjf2000/gnet/v2"
+)
+
+const frameStats = "stats"
+
+// connCounters counts the data messages of one connection. Control frames
+// such as pings and closes are not included.
+type connCounters struct {
+	sent     uint64
+	received uint64
+}
+
+// connectionStats is what a client sees in reply to a stats frame, and the
+// admin API under /connections/{id}/stats.
+type connectionStats struct {
+	ConnID   uint64              `json:"conn_id"`
+	Sent     uint64              `json:"sent"`
+	Received uint64              `json:"received"`
+	Dropped  uint64              `json:"dropped"`
+	Rooms    []subscriptionStats `json:"rooms"`
+}
+
+// subscriptionStats reports how far a member is behind its room. Lag counts
+// messages not handed to the connection, because it is paused or dropped
+// them; Unacked counts those handed over but not acknowledged yet.
+type subscriptionStats struct {
+	Room      string `json:"room"`
+	Seq       uint64 `json:"seq"`
+	Delivered uint64 `json:"delivered"`
+	Acked     uint64 `json:"acked"`
+	Lag       uint64 `json:"lag"`
+	Unacked   uint64 `json:"unacked"`
+	Paused    bool   `json:"paused"`
+	Buffered  int    `json:"buffered"`
+	Dropped   uint64 `json:"dropped"`
+}
+
+func countersOf(c gnet.Conn) *connCounters {
+	if codec, ok := codecOf(c); ok {
+		return &codec.counters
+	}
+
+	return nil
+}
+
+func countSent(c gnet.Conn) {
+	if counters := countersOf(c); counters != nil {
+		atomic.AddUint64(&counters.sent, 1)
+	}
+}
+
+// writeCompiledFrame queues a frame compiled once for many connections,
+// header included, as a single write, and counts it as sent.
+func writeCompiledFrame(c gnet.Conn, wire *sharedWire) error {
+	wire.hold()
+
+	if err := queueWrite(c, wire.buf, wire.release); err != nil {
+		wire.release()
+
+		return err
+	}
+
+	countSent(c)
+
+	return nil
+}
+
+// compileServerFrame builds the unmasked frame for payload once so a
+// broadcast can hand the same bytes to every recipient. The frame comes
+// from wirePool; the caller releases it once everything is queued.
+func compileServerFrame(op ws.OpCode, payload []byte) (*sharedWire, error) {
+	h := ws.Header{Fin: true, OpCode: op, Length: int64(len(payload))}
+
+	buf := bytes.NewBuffer(wirePool.get(ws.HeaderSize(h) + len(payload))[:0])
+	if err := ws.WriteHeader(buf, h); err != nil {
+		return nil, fmt.Errorf("compiling frame: %w", err)
+	}
+
+	buf.Write(payload)
+
+	return newSharedWire(buf.Bytes()), nil
+}
+
+func (b *broadcastService) connectionStats(c gnet.Conn) (connectionStats, bool) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	tc, ok := b.connections[c]
+	if !ok {
+		return connectionStats{}, false
+	}
+
+	stats := connectionStats{ConnID: tc.id, Rooms: make([]subscriptionStats, 0, len(tc.subscriptions))}
+
+	if counters := countersOf(c); counters != nil {
+		stats.Sent = atomic.LoadUint64(&counters.sent)
+		stats.Received = atomic.LoadUint64(&counters.received)
+	}
+
+	for name, sub := range tc.subscriptions {
+		seq := b.rooms[name].seq
+
+		stats.Dropped += sub.dropped
+		stats.Rooms = append(stats.Rooms, subscriptionStats{
+			Room:      name,
+			Seq:       seq,
+			Delivered: sub.delivered,
+			Acked:     sub.acked,
+			Lag:       seq - sub.delivered,
+			Unacked:   sub.delivered - sub.acked,
+			Paused:    sub.paused,
+			Buffered:  len(sub.buffered),
+			Dropped:   sub.dropped,
+		})
+	}
+
+	sort.Slice(stats.Rooms, func(i, j int) bool { return stats.Rooms[i].Room < stats.Rooms[j].Room })
+
+	return stats, true
+}
+
+func (wss *wsServer) writeStats(conn gnet.Conn, id string) error {
+	stats, ok := wss.bs.connectionStats(conn)
+	if !ok {
+		return errUnknownConnection
+	}
+
+	data, err := json.Marshal(stats)
+	if err != nil {
+		return fmt.Errorf("encoding stats: %w", err)
+	}
+
+	return writeControlFrame(conn, controlFrame{Type: frameStats, ID: id, Data: data})
+}
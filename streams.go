@@ -0,0 +1,381 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"sync"
+
+	"go.uber.org/zap"
+)
+
+var errFrameTooLarge = errors.New("frame exceeds the maximum message size")
+
+// streamFraming delimits control frames on a byte stream.
+type streamFraming interface {
+	// frame returns data ready to be written as one frame.
+	frame(data []byte) []byte
+	// next reads the next frame, which may be at most limit bytes.
+	next(r *bufio.Reader, limit int) ([]byte, error)
+}
+
+// lineFraming ends every frame with a newline, which JSON never contains
+// outside strings, so `nc` is a client.
+type lineFraming struct{}
+
+func (lineFraming) frame(data []byte) []byte { return append(data, '\n') }
+
+func (lineFraming) next(r *bufio.Reader, limit int) ([]byte, error) {
+	var line []byte
+
+	for {
+		chunk, err := r.ReadSlice('\n')
+		line = append(line, chunk...)
+
+		if len(line) > limit {
+			return nil, errFrameTooLarge
+		}
+
+		switch {
+		case err == nil:
+			return line[:len(line)-1], nil
+		case errors.Is(err, bufio.ErrBufferFull):
+			continue
+		case errors.Is(err, io.EOF) && len(line) > 0:
+			return line, nil
+		default:
+			return nil, err
+		}
+	}
+}
+
+// lengthFraming puts the length of every frame before it as a 4-byte
+// big-endian integer, for clients that would rather not scan for newlines.
+type lengthFraming struct{}
+
+func (lengthFraming) frame(data []byte) []byte {
+	framed := make([]byte, 4+len(data))
+	binary.BigEndian.PutUint32(framed, uint32(len(data)))
+	copy(framed[4:], data)
+
+	return framed
+}
+
+func (lengthFraming) next(r *bufio.Reader, limit int) ([]byte, error) {
+	var prefix [4]byte
+	if _, err := io.ReadFull(r, prefix[:]); err != nil {
+		return nil, err
+	}
+
+	n := binary.BigEndian.Uint32(prefix[:])
+	if uint64(n) > uint64(limit) {
+		return nil, errFrameTooLarge
+	}
+
+	data := make([]byte, n)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, err
+	}
+
+	return data, nil
+}
+
+func parseFraming(name string) (streamFraming, error) {
+	switch name {
+	case "line":
+		return lineFraming{}, nil
+	case "length":
+		return lengthFraming{}, nil
+	default:
+		return nil, fmt.Errorf("unknown framing %q, want line or length", name)
+	}
+}
+
+// streamTransport speaks the room protocol over byte streams that are not
+// websockets. Both sides exchange JSON control frames; subscribe,
+// unsubscribe, publish and ping are understood. Like the HTTP transports
+// its clients are fed through a message hook rather than being room
+// members. Under -multi-tenant a session only sees the rooms of its
+// tenant, and its publishes count against the tenant's quota.
+type streamTransport struct {
+	framing        streamFraming
+	access         transportAccess
+	buffer         int
+	maxMessageSize int
+	bs             *broadcastService
+	logger         *zap.Logger
+	// clientCerts authenticates clients on TLS streams by certificate.
+	clientCerts *clientCertAuth
+
+	mu       sync.Mutex
+	sessions map[string]map[*streamSession]struct{}
+}
+
+type streamSession struct {
+	metadata   map[string]string
+	remoteAddr string
+	// tenant is the one the client's rooms belong to under -multi-tenant.
+	tenant string
+	// rooms is only touched by the goroutine reading the session.
+	rooms map[string]struct{}
+
+	framing streamFraming
+	events  chan []byte
+	// evicted is closed once the session fell too far behind.
+	evicted chan struct{}
+	once    sync.Once
+}
+
+func (s *streamSession) evict() {
+	s.once.Do(func() { close(s.evicted) })
+}
+
+// send queues frame for the session, evicting it if its buffer is full.
+func (s *streamSession) send(frame controlFrame) {
+	frame.Room = localRoom(frame.Room)
+
+	data, err := jsonEncoding{}.encode(frame)
+	if err != nil {
+		return
+	}
+
+	s.queue(s.framing.frame(data))
+}
+
+func (s *streamSession) queue(framed []byte) {
+	select {
+	case s.events <- framed:
+	default:
+		s.evict()
+	}
+}
+
+// onMessage makes the transport a messageHook.
+func (t *streamTransport) onMessage(ctx context.Context, room string, msg roomMessage) error {
+	data, err := jsonEncoding{}.encode(roomMessageFrame(localRoom(room), msg))
+	if err != nil {
+		return err
+	}
+
+	framed := t.framing.frame(data)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for s := range t.sessions[room] {
+		s.queue(framed)
+	}
+
+	return nil
+}
+
+// serve runs a session of tenant over r and w, first joining rooms, until
+// reading fails or ctx is done. closeStream is called once the session is
+// evicted or its writes fail, with the reason to give the client, and
+// must make reading fail.
+func (t *streamTransport) serve(ctx context.Context, r *bufio.Reader, w io.Writer, metadata map[string]string, tenant string, rooms []string, remoteAddr string, closeStream func(reason string)) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	s := &streamSession{
+		metadata:   metadata,
+		remoteAddr: remoteAddr,
+		tenant:     tenant,
+		rooms:      make(map[string]struct{}),
+		framing:    t.framing,
+		events:     make(chan []byte, t.buffer),
+		evicted:    make(chan struct{}),
+	}
+	defer t.leaveAll(s)
+
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-s.evicted:
+				t.logger.Info("stream client evicted for falling behind", zap.String("remote_addr", remoteAddr))
+				closeStream(closeTooSlow.Name)
+
+				return
+			case framed := <-s.events:
+				if _, err := w.Write(framed); err != nil {
+					closeStream("")
+
+					return
+				}
+			}
+		}
+	}()
+
+	for _, room := range rooms {
+		t.handleFrame(ctx, s, controlFrame{Type: frameSubscribe, Room: room})
+	}
+
+	for {
+		data, err := t.framing.next(r, t.frameLimit())
+		if err != nil {
+			if !errors.Is(err, io.EOF) && ctx.Err() == nil {
+				t.logger.Info("reading stream client", zap.String("remote_addr", remoteAddr), zap.Error(err))
+			}
+
+			return
+		}
+
+		var frame controlFrame
+		if err := json.Unmarshal(data, &frame); err != nil || frame.Type == "" {
+			s.send(controlFrame{Type: frameError, Error: "not a protocol envelope"})
+
+			continue
+		}
+
+		t.handleFrame(ctx, s, frame)
+	}
+}
+
+// frameLimit is the largest frame clients may send.
+func (t *streamTransport) frameLimit() int {
+	if t.maxMessageSize <= 0 {
+		return math.MaxInt32
+	}
+
+	return t.maxMessageSize
+}
+
+func (t *streamTransport) handleFrame(ctx context.Context, s *streamSession, frame controlFrame) {
+	if frame.Type == framePing {
+		s.send(controlFrame{Type: framePong, ID: frame.ID})
+
+		return
+	}
+
+	if frame.Room == "" {
+		s.send(controlFrame{Type: frameError, ID: frame.ID, Error: fmt.Sprintf("%s: room is required", frame.Type)})
+
+		return
+	}
+
+	local := frame.Room
+	frame.Room = tenantRoom(s.tenant, frame.Room)
+
+	var err error
+
+	switch frame.Type {
+	case frameSubscribe:
+		err = t.join(s, frame.Room)
+	case frameUnsubscribe:
+		err = t.leave(s, frame.Room)
+	case framePublish:
+		var msg roomMessage
+		if msg, err = t.publish(ctx, s, frame); err == nil {
+			if frame.ID != "" {
+				s.send(controlFrame{Type: frameAck, ID: frame.ID, Room: frame.Room, Seq: msg.seq})
+			}
+
+			return
+		}
+	default:
+		err = errors.New("unsupported on this transport")
+	}
+
+	if err != nil {
+		s.send(controlFrame{Type: frameError, ID: frame.ID, Error: fmt.Sprintf("%s %q: %v", frame.Type, local, err)})
+
+		return
+	}
+
+	s.send(controlFrame{Type: frameAck, ID: frame.ID, Room: frame.Room})
+}
+
+func (t *streamTransport) join(s *streamSession, room string) error {
+	if _, ok := s.rooms[room]; ok {
+		return nil
+	}
+
+	if err := t.access.authorizeSubscribe(s.metadata, room); err != nil {
+		return err
+	}
+
+	if err := t.bs.openRoom(room); err != nil {
+		return err
+	}
+
+	s.rooms[room] = struct{}{}
+
+	t.mu.Lock()
+	if t.sessions[room] == nil {
+		t.sessions[room] = make(map[*streamSession]struct{})
+	}
+	t.sessions[room][s] = struct{}{}
+	t.mu.Unlock()
+
+	if msg, ok := t.bs.retainedOf(room); ok {
+		frame := roomMessageFrame(room, msg)
+		frame.Retained = true
+		s.send(frame)
+	}
+
+	return nil
+}
+
+func (t *streamTransport) leave(s *streamSession, room string) error {
+	if _, ok := s.rooms[room]; !ok {
+		return errNotSubscribed
+	}
+
+	delete(s.rooms, room)
+
+	t.mu.Lock()
+	delete(t.sessions[room], s)
+	if len(t.sessions[room]) == 0 {
+		delete(t.sessions, room)
+	}
+	t.mu.Unlock()
+
+	t.bs.closeRoom(room)
+
+	return nil
+}
+
+func (t *streamTransport) leaveAll(s *streamSession) {
+	for room := range s.rooms {
+		_ = t.leave(s, room)
+	}
+}
+
+func (t *streamTransport) publish(ctx context.Context, s *streamSession, frame controlFrame) (roomMessage, error) {
+	if err := t.access.authorizePublish(s.metadata, frame.Room); err != nil {
+		return roomMessage{}, err
+	}
+
+	if len(frame.Data) == 0 {
+		return roomMessage{}, errors.New("data is required")
+	}
+
+	if err := t.bs.tenants.publish(s.tenant); err != nil {
+		return roomMessage{}, err
+	}
+
+	msg, err := t.bs.publishWith(ctx, frame.Room, frame.Data, nil)
+	t.bs.msgAudit.record(publishSource{transport: "stream", remoteAddr: s.remoteAddr, user: s.metadata["session_subject"]}, frame.Room, msg.seq, frame.Data, err)
+
+	return msg, err
+}
+
+// streamTransport returns a stream transport holding clients to the same
+// ACLs and roles as websocket connections.
+func (wss *wsServer) streamTransport(buffer int, clientCerts *clientCertAuth, logger *zap.Logger) *streamTransport {
+	return &streamTransport{
+		access:         wss.transportAccess(),
+		buffer:         buffer,
+		maxMessageSize: int(wss.maxMessageSize),
+		bs:             wss.bs,
+		logger:         logger,
+		clientCerts:    clientCerts,
+	}
+}
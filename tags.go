@@ -0,0 +1,226 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/gobwas/ws"
+	"github.com/panjf2000/gnet/v2"
+)
+
+const frameTag = "tag"
+
+var (
+	errBadSelector  = errors.New("selector must be key=value terms joined by AND")
+	errTagProtected = errors.New("tag was set by the server and cannot be changed")
+)
+
+// Connections carry key/value tags, seeded from the metadata the upgrade
+// hook and -geoip-db gave them and extended by the client with tag frames.
+// Metadata keys stay as the server set them, and b.reservedTags are never
+// the client's to set. b.tagIndex maps each key=value pair to the
+// connections carrying it, so a selector only visits connections that match
+// its most selective term.
+
+// tagSelector matches connections carrying every one of its tags.
+type tagSelector []tagTerm
+
+type tagTerm struct {
+	key, value string
+}
+
+func (t tagTerm) String() string { return t.key + "=" + t.value }
+
+// parseTagSelector parses selectors such as "region=eu AND plan=pro".
+func parseTagSelector(s string) (tagSelector, error) {
+	fields := strings.Fields(s)
+	if len(fields)%2 == 0 {
+		return nil, errBadSelector
+	}
+
+	var sel tagSelector
+
+	for i, field := range fields {
+		if i%2 == 1 {
+			if !strings.EqualFold(field, "AND") {
+				return nil, errBadSelector
+			}
+
+			continue
+		}
+
+		key, value, ok := cutTag(field)
+		if !ok || key == "" {
+			return nil, errBadSelector
+		}
+
+		sel = append(sel, tagTerm{key: key, value: value})
+	}
+
+	return sel, nil
+}
+
+func cutTag(s string) (string, string, bool) {
+	i := strings.IndexByte(s, '=')
+	if i < 0 {
+		return "", "", false
+	}
+
+	return s[:i], s[i+1:], true
+}
+
+func (sel tagSelector) String() string {
+	terms := make([]string, len(sel))
+	for i, t := range sel {
+		terms[i] = t.String()
+	}
+
+	return strings.Join(terms, " AND ")
+}
+
+func (sel tagSelector) matches(tags map[string]string) bool {
+	for _, t := range sel {
+		if v, ok := tags[t.key]; !ok || v != t.value {
+			return false
+		}
+	}
+
+	return true
+}
+
+// indexTag and unindexTag must be called with b.mu held.
+func (b *broadcastService) indexTag(c gnet.Conn, key, value string) {
+	term := tagTerm{key: key, value: value}.String()
+
+	conns, ok := b.tagIndex[term]
+	if !ok {
+		conns = make(map[gnet.Conn]struct{})
+		b.tagIndex[term] = conns
+	}
+
+	conns[c] = struct{}{}
+}
+
+func (b *broadcastService) unindexTag(c gnet.Conn, key, value string) {
+	term := tagTerm{key: key, value: value}.String()
+
+	delete(b.tagIndex[term], c)
+
+	if len(b.tagIndex[term]) == 0 {
+		delete(b.tagIndex, term)
+	}
+}
+
+// setTags applies a client's tag frame: a tag with an empty value is
+// removed, the rest are set.
+func (b *broadcastService) setTags(c gnet.Conn, tags map[string]string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	tc, ok := b.connections[c]
+	if !ok {
+		return errUnknownConnection
+	}
+
+	for key := range tags {
+		if key == "" || strings.ContainsAny(key, "= \t") {
+			return fmt.Errorf("tag %q: key must be non-empty without spaces or =", key)
+		}
+
+		if _, ok := tc.metadata[key]; ok || containsString(b.reservedTags, key) {
+			return fmt.Errorf("tag %q: %w", key, errTagProtected)
+		}
+	}
+
+	for key, value := range tags {
+		if old, ok := tc.tags[key]; ok {
+			b.unindexTag(c, key, old)
+			delete(tc.tags, key)
+		}
+
+		if value != "" {
+			tc.tags[key] = value
+			b.indexTag(c, key, value)
+		}
+	}
+
+	return nil
+}
+
+// matching returns the connections sel selects.
+func (b *broadcastService) matching(sel tagSelector) []gnet.Conn {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	var smallest map[gnet.Conn]struct{}
+
+	for i, t := range sel {
+		conns := b.tagIndex[t.String()]
+		if i == 0 || len(conns) < len(smallest) {
+			smallest = conns
+		}
+	}
+
+	matched := make([]gnet.Conn, 0, len(smallest))
+	for c := range smallest {
+		if tc, ok := b.connections[c]; ok && sel.matches(tc.tags) {
+			matched = append(matched, c)
+		}
+	}
+
+	return matched
+}
+
+// broadcastWhere sends msg to the connections sel selects and returns how
+// many there were.
+func (b *broadcastService) broadcastWhere(sel tagSelector, op ws.OpCode, msg []byte) (int, error) {
+	msg, ok, err := b.outbound(context.Background(), "", op, msg)
+	if err != nil || !ok {
+		return 0, err
+	}
+
+	b.broadcastStats.received(len(msg))
+
+	wire, err := compileServerFrame(op, msg)
+	if err != nil {
+		return 0, err
+	}
+
+	targets := b.matching(sel)
+	tally := newDeliveryTally(time.Now(), len(targets), 0)
+
+	err = b.fanout.each(targets, func(c gnet.Conn) error {
+		if err := tally.wrote(writeCompiledFrame(c, wire)); err != nil {
+			return err
+		}
+
+		b.broadcastStats.wrote(frameSize(len(msg)))
+
+		return nil
+	})
+	wire.release()
+	b.finishDelivery(tally, &b.broadcastStats)
+
+	if err != nil {
+		return 0, fmt.Errorf("writing server message: %w", err)
+	}
+
+	return len(targets), nil
+}
+
+// copyTags lets tags be listed without holding b.mu.
+func copyTags(tags map[string]string) map[string]string {
+	if len(tags) == 0 {
+		return nil
+	}
+
+	copied := make(map[string]string, len(tags))
+	for key, value := range tags {
+		copied[key] = value
+	}
+
+	return copied
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const frameAuth = "auth"
+
+var errAuthRequired = errors.New(`authenticate first with {"type":"auth","data":"<token>"}`)
+
+// tcpTransport serves the stream protocol on plain TCP, for embedded
+// devices and scripts without a websocket stack. When upgrades are
+// authenticated the first frame must be an auth frame whose data is the
+// token, checked as the bearer token of an upgrade would be; a client
+// that authenticates in time is acked. Over TLS a client certificate
+// stands in for the auth frame. Under -multi-tenant the credentials must
+// name the tenant, as a TCP stream has no path.
+type tcpTransport struct {
+	*streamTransport
+
+	addr        string
+	onUpgrade   upgradeHook
+	authTimeout time.Duration
+	// tlsConfig, if set, makes the listener speak TLS.
+	tlsConfig *tls.Config
+}
+
+func newTCPTransport(addr string, framing streamFraming, tlsConfig *tls.Config, onUpgrade upgradeHook, authTimeout time.Duration, st *streamTransport) *tcpTransport {
+	st.framing = framing
+	st.sessions = make(map[string]map[*streamSession]struct{})
+
+	return &tcpTransport{streamTransport: st, addr: addr, onUpgrade: onUpgrade, authTimeout: authTimeout, tlsConfig: st.clientCerts.configure(tlsConfig)}
+}
+
+func (t *tcpTransport) listen() {
+	ln, err := net.Listen("tcp", t.addr)
+	if err != nil {
+		t.logger.Error("tcp transport exits", zap.Error(err))
+
+		return
+	}
+
+	if t.tlsConfig != nil {
+		ln = tls.NewListener(ln, t.tlsConfig)
+	}
+
+	t.logger.Info("tcp transport is listening", zap.String("addr", t.addr), zap.Bool("tls", t.tlsConfig != nil))
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			t.logger.Error("tcp transport exits", zap.Error(err))
+
+			return
+		}
+
+		go t.handle(conn)
+	}
+}
+
+func (t *tcpTransport) handle(conn net.Conn) {
+	defer conn.Close()
+
+	r := bufio.NewReader(conn)
+	remoteAddr := conn.RemoteAddr().String()
+
+	metadata, err := t.certificateMetadata(conn)
+	if err == nil && metadata == nil {
+		metadata, err = t.authenticate(r, remoteAddr, conn)
+	}
+
+	var tenant string
+	if err == nil {
+		metadata, tenant, err = t.bs.transportTenant(metadata, "")
+	}
+
+	if err == nil {
+		err = t.bs.tenants.open(tenant)
+	}
+
+	if err != nil {
+		t.logger.Info("tcp client rejected", zap.String("remote_addr", remoteAddr), zap.Error(err))
+
+		if data, encErr := (jsonEncoding{}).encode(controlFrame{Type: frameError, Error: err.Error()}); encErr == nil {
+			_, _ = conn.Write(t.framing.frame(data))
+		}
+
+		return
+	}
+
+	defer t.bs.tenants.close(tenant)
+
+	t.serve(context.Background(), r, conn, metadata, tenant, nil, remoteAddr, func(string) { _ = conn.Close() })
+}
+
+// certificateMetadata completes the TLS handshake, if conn is TLS, and
+// returns the metadata its client certificate grants.
+func (t *tcpTransport) certificateMetadata(conn net.Conn) (map[string]string, error) {
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		return nil, nil
+	}
+
+	ctx := context.Background()
+	if t.authTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, t.authTimeout)
+		defer cancel()
+	}
+
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		return nil, fmt.Errorf("tls handshake: %w", err)
+	}
+
+	state := tlsConn.ConnectionState()
+
+	return t.clientCerts.metadata(&state), nil
+}
+
+// authenticate reads the auth frame, if upgrades are authenticated, and
+// returns the metadata the upgrade hook gives its token.
+func (t *tcpTransport) authenticate(r *bufio.Reader, remoteAddr string, conn net.Conn) (map[string]string, error) {
+	if t.onUpgrade == nil {
+		return nil, nil
+	}
+
+	if t.authTimeout > 0 {
+		_ = conn.SetReadDeadline(time.Now().Add(t.authTimeout))
+		defer func() { _ = conn.SetReadDeadline(time.Time{}) }()
+	}
+
+	data, err := t.framing.next(r, t.frameLimit())
+	if err != nil {
+		return nil, errAuthRequired
+	}
+
+	var (
+		frame controlFrame
+		token string
+	)
+
+	if json.Unmarshal(data, &frame) != nil || frame.Type != frameAuth || json.Unmarshal(frame.Data, &token) != nil || token == "" {
+		return nil, errAuthRequired
+	}
+
+	req := &upgradeRequest{
+		Method:     http.MethodGet,
+		URI:        "/",
+		Path:       "/",
+		Query:      url.Values{"access_token": {token}},
+		Header:     http.Header{"Authorization": {"Bearer " + token}},
+		RemoteAddr: remoteAddr,
+	}
+
+	result, err := t.onUpgrade(context.Background(), req)
+	if err != nil {
+		return nil, err
+	}
+
+	ack, err := jsonEncoding{}.encode(controlFrame{Type: frameAck, ID: frame.ID})
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := conn.Write(t.framing.frame(ack)); err != nil {
+		return nil, err
+	}
+
+	if result == nil {
+		return nil, nil
+	}
+
+	return result.Metadata, nil
+}
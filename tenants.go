@@ -0,0 +1,430 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gobwas/ws"
+	"github.com/panjf2000/gnet/v2"
+)
+
+// tenantRoutePrefix is the upgrade path prefix naming a tenant, as in
+// /t/acme/ws or /t/acme/ws/room/lobby.
+const tenantRoutePrefix = "/t/"
+
+var validTenant = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+
+var errTenantRateLimited = errors.New("tenant publish rate exceeded")
+
+// namespacedRooms is set once at startup with -multi-tenant. Hub rooms are
+// then named "tenant/room" and clients only ever see the part after the
+// tenant; see tenantRoom and localRoom.
+var namespacedRooms bool
+
+// tenantRoom is the hub room a client of tenant calls name.
+func tenantRoom(tenant, name string) string {
+	if tenant == "" {
+		return name
+	}
+
+	return tenant + "/" + name
+}
+
+// localRoom is how a hub room is named to its tenant's clients.
+func localRoom(name string) string {
+	if !namespacedRooms {
+		return name
+	}
+
+	if i := strings.IndexByte(name, '/'); i >= 0 {
+		return name[i+1:]
+	}
+
+	return name
+}
+
+// tenantQuota bounds a tenant; zero fields are unlimited. PublishRate is
+// client publishes per second, with bursts of as many; Bandwidth is bytes
+// broadcast per second, metered over -bandwidth-window.
+type tenantQuota struct {
+	MaxConnections int     `json:"max_connections,omitempty"`
+	PublishRate    float64 `json:"publish_rate,omitempty"`
+	Bandwidth      int64   `json:"bandwidth,omitempty"`
+}
+
+type tenantQuotaRule struct {
+	pattern string
+	quota   tenantQuota
+}
+
+// parseTenantQuotas parses comma-separated pattern=limits pairs such as
+// "acme=conns:1000;rate:200,trial-*=conns:10", path.Match patterns, first
+// match wins. Limits a rule leaves out come from base.
+func parseTenantQuotas(s string, base tenantQuota) ([]tenantQuotaRule, error) {
+	var rules []tenantQuotaRule
+
+	for _, item := range splitList(s) {
+		i := strings.LastIndex(item, "=")
+		if i < 0 {
+			return nil, fmt.Errorf("tenant quota %q: want pattern=limits", item)
+		}
+
+		pattern := item[:i]
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("tenant quota %q: %w", item, err)
+		}
+
+		quota := base
+
+		for _, limit := range strings.Split(item[i+1:], ";") {
+			j := strings.IndexByte(limit, ':')
+			if j < 0 {
+				return nil, fmt.Errorf("tenant quota %q: limit %q wants name:value", item, limit)
+			}
+
+			var err error
+
+			switch limit[:j] {
+			case "conns":
+				quota.MaxConnections, err = strconv.Atoi(limit[j+1:])
+			case "rate":
+				quota.PublishRate, err = strconv.ParseFloat(limit[j+1:], 64)
+			case "bw":
+				quota.Bandwidth, err = strconv.ParseInt(limit[j+1:], 10, 64)
+			default:
+				return nil, fmt.Errorf("tenant quota %q: unknown limit %q, want conns, rate or bw", item, limit[:j])
+			}
+
+			if err != nil || strings.HasPrefix(limit[j+1:], "-") {
+				return nil, fmt.Errorf("tenant quota %q: invalid value in %q", item, limit)
+			}
+		}
+
+		rules = append(rules, tenantQuotaRule{pattern: pattern, quota: quota})
+	}
+
+	return rules, nil
+}
+
+type tenantState struct {
+	name  string
+	quota tenantQuota
+
+	// connections, tokens and refilled are guarded by the registry's lock.
+	connections int
+	tokens      float64
+	refilled    time.Time
+
+	// stats counts the fan-out of every room of the tenant, including
+	// rooms since deleted.
+	stats fanoutStats
+
+	atomicRateLimited uint64
+	atomicRejected    uint64
+}
+
+// tenantRegistry tracks the tenants seen so far and holds them to their
+// quotas. A nil *tenantRegistry means the hub is single-tenant.
+type tenantRegistry struct {
+	defaults tenantQuota
+	rules    []tenantQuotaRule
+	// totals is what tenant stats add up into, the hub's room totals.
+	totals *fanoutStats
+
+	mu      sync.Mutex
+	tenants map[string]*tenantState
+}
+
+func (t *tenantRegistry) quotaFor(name string) tenantQuota {
+	for _, rule := range t.rules {
+		if ok, _ := path.Match(rule.pattern, name); ok {
+			return rule.quota
+		}
+	}
+
+	return t.defaults
+}
+
+// bandwidthOf is the tenant's bytes per second, 0 for unlimited.
+func (t *tenantRegistry) bandwidthOf(name string) int64 {
+	return t.quotaFor(name).Bandwidth
+}
+
+// state returns the tenant's state, creating it if need be. It must be
+// called with t.mu held.
+func (t *tenantRegistry) state(name string) *tenantState {
+	ts, ok := t.tenants[name]
+	if !ok {
+		ts = &tenantState{name: name, quota: t.quotaFor(name), refilled: time.Now()}
+		ts.tokens = ts.quota.PublishRate
+		ts.stats.total = t.totals
+		t.tenants[name] = ts
+	}
+
+	return ts
+}
+
+// open takes a connection slot of the tenant.
+func (t *tenantRegistry) open(name string) error {
+	if t == nil || name == "" {
+		return nil
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	ts := t.state(name)
+	if ts.quota.MaxConnections > 0 && ts.connections >= ts.quota.MaxConnections {
+		atomic.AddUint64(&ts.atomicRejected, 1)
+
+		return ws.RejectConnectionError(
+			ws.RejectionStatus(http.StatusTooManyRequests),
+			ws.RejectionReason("tenant is at its connection quota"),
+		)
+	}
+
+	ts.connections++
+
+	return nil
+}
+
+func (t *tenantRegistry) close(name string) {
+	if t == nil || name == "" {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.state(name).connections--
+}
+
+// publish takes one token from the tenant's publish bucket.
+func (t *tenantRegistry) publish(name string) error {
+	if t == nil || name == "" {
+		return nil
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	ts := t.state(name)
+	if ts.quota.PublishRate <= 0 {
+		return nil
+	}
+
+	now := time.Now()
+	ts.tokens += now.Sub(ts.refilled).Seconds() * ts.quota.PublishRate
+	ts.refilled = now
+
+	if ts.tokens > ts.quota.PublishRate {
+		ts.tokens = ts.quota.PublishRate
+	}
+
+	if ts.tokens < 1 {
+		atomic.AddUint64(&ts.atomicRateLimited, 1)
+
+		return errTenantRateLimited
+	}
+
+	ts.tokens--
+
+	return nil
+}
+
+// statsFor returns what a new hub room's stats add up into: its tenant's
+// when it has one, the hub's totals otherwise.
+func (t *tenantRegistry) statsFor(room string) *fanoutStats {
+	i := strings.IndexByte(room, '/')
+	if t == nil || i < 0 {
+		return nil
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return &t.state(room[:i]).stats
+}
+
+// tenantOf settles which tenant an upgrade belongs to: the one its
+// authentication named in the "tenant" metadata, else the one in its path.
+// Under -multi-tenant every connection needs one, and they must agree.
+func (wss *wsServer) tenantOf(codec *wsCodec, route upgradeRoute) (string, error) {
+	return resolveTenant(codec.metadata["tenant"], route.tenant)
+}
+
+func resolveTenant(tenant, pathTenant string) (string, error) {
+	switch {
+	case tenant == "":
+		tenant = pathTenant
+	case pathTenant != "" && pathTenant != tenant:
+		return "", ws.RejectConnectionError(
+			ws.RejectionStatus(http.StatusForbidden),
+			ws.RejectionReason("path names another tenant than the credentials"),
+		)
+	}
+
+	if !validTenant.MatchString(tenant) {
+		return "", ws.RejectConnectionError(
+			ws.RejectionStatus(http.StatusForbidden),
+			ws.RejectionReason("a valid tenant is required"),
+		)
+	}
+
+	return tenant, nil
+}
+
+// transportTenant is tenantOf for a transport client, pathTenant being
+// what a /t/{tenant}/ prefix of its path named. The tenant is recorded in
+// metadata, as for upgrades; single-tenant hubs return "".
+func (b *broadcastService) transportTenant(metadata map[string]string, pathTenant string) (map[string]string, string, error) {
+	if b.tenants == nil {
+		if pathTenant != "" {
+			return nil, "", errUnknownRoute
+		}
+
+		return metadata, "", nil
+	}
+
+	tenant, err := resolveTenant(metadata["tenant"], pathTenant)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if metadata == nil {
+		metadata = make(map[string]string, 1)
+	}
+
+	metadata["tenant"] = tenant
+
+	return metadata, tenant, nil
+}
+
+// admitTenant binds the upgrade to its tenant and takes a connection slot
+// of it. The tenant is kept in the connection's metadata, where clients
+// cannot change it, so tag selectors and ACLs can match on it.
+func (wss *wsServer) admitTenant(codec *wsCodec, route upgradeRoute) error {
+	if wss.bs.tenants == nil {
+		if route.tenant != "" {
+			return errUnknownRoute
+		}
+
+		return nil
+	}
+
+	tenant, err := wss.tenantOf(codec, route)
+	if err != nil {
+		return err
+	}
+
+	if err := wss.bs.tenants.open(tenant); err != nil {
+		return err
+	}
+
+	if codec.metadata == nil {
+		codec.metadata = make(map[string]string, 1)
+	}
+
+	codec.metadata["tenant"] = tenant
+	codec.tenant = tenant
+
+	return nil
+}
+
+type tenantInfo struct {
+	Tenant              string      `json:"tenant"`
+	Connections         int         `json:"connections"`
+	Rooms               int         `json:"rooms"`
+	Messages            uint64      `json:"messages"`
+	BytesIn             uint64      `json:"bytes_in"`
+	BytesOut            uint64      `json:"bytes_out"`
+	RateLimited         uint64      `json:"rate_limited"`
+	RejectedConnections uint64      `json:"rejected_connections"`
+	Quota               tenantQuota `json:"quota"`
+}
+
+func (b *broadcastService) tenantInfos() []tenantInfo {
+	rooms := make(map[string]int)
+
+	b.mu.RLock()
+	for name := range b.rooms {
+		if i := strings.IndexByte(name, '/'); i >= 0 {
+			rooms[name[:i]]++
+		}
+	}
+	b.mu.RUnlock()
+
+	t := b.tenants
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	infos := make([]tenantInfo, 0, len(t.tenants))
+	for _, ts := range t.tenants {
+		amp := ts.stats.info(ts.name)
+
+		infos = append(infos, tenantInfo{
+			Tenant:              ts.name,
+			Connections:         ts.connections,
+			Rooms:               rooms[ts.name],
+			Messages:            amp.Messages,
+			BytesIn:             amp.BytesIn,
+			BytesOut:            amp.BytesOut,
+			RateLimited:         atomic.LoadUint64(&ts.atomicRateLimited),
+			RejectedConnections: atomic.LoadUint64(&ts.atomicRejected),
+			Quota:               ts.quota,
+		})
+	}
+
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Tenant < infos[j].Tenant })
+
+	return infos
+}
+
+// handleTenants reports per-tenant usage and quotas on GET /tenants.
+func (a *adminServer) handleTenants(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+
+		return
+	}
+
+	if a.bs.tenants == nil {
+		http.Error(w, "multi-tenancy is disabled", http.StatusNotFound)
+
+		return
+	}
+
+	writeJSON(w, http.StatusOK, a.bs.tenantInfos())
+}
+
+// statsTotal is what the stats of the new room name add up into.
+func (b *broadcastService) statsTotal(name string) *fanoutStats {
+	if total := b.tenants.statsFor(name); total != nil {
+		return total
+	}
+
+	return &b.roomTotals
+}
+
+// clientBroadcast relays a raw client message to every connection or,
+// under -multi-tenant, every connection of the sender's tenant.
+func (b *broadcastService) clientBroadcast(conn gnet.Conn, op ws.OpCode, msg []byte) error {
+	codec, _ := codecOf(conn)
+	if b.tenants == nil || codec == nil || codec.tenant == "" {
+		return b.broadcastMessage(op, msg)
+	}
+
+	_, err := b.broadcastWhere(tagSelector{{key: "tenant", value: codec.tenant}}, op, msg)
+
+	return err
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/gobwas/ws"
+	"github.com/panjf2000/gnet/v2"
+)
+
+// Per-recipient transforms rewrite room messages on their way to each
+// websocket member, to localize them, say, or strip fields the member's
+// role may not see. The deliver hooks never see the member itself, only its
+// attributes: the tags -transform-keys names. Members agreeing on all of
+// them get the same output, so a fan-out runs the hooks and encodes once
+// per distinct combination of attributes instead of once per member.
+// Without -transform-keys no transforms run.
+
+// recipientGroup is the targets of a fan-out that share attributes.
+type recipientGroup struct {
+	attrs map[string]string
+	conns []gnet.Conn
+}
+
+// frameGroup is a frame and the targets it is for.
+type frameGroup struct {
+	frame *encodedFrame
+	conns []gnet.Conn
+}
+
+func (chain middlewareChain) deliver(ctx context.Context, attrs map[string]string, msg *outboundMessage) error {
+	for _, m := range chain {
+		if m.onDeliver == nil {
+			continue
+		}
+
+		if err := m.onDeliver(ctx, attrs, msg); err != nil {
+			return fmt.Errorf("middleware %s: %w", m.name, err)
+		}
+	}
+
+	if !json.Valid(msg.data) {
+		return errDataNotJSON
+	}
+
+	return nil
+}
+
+// groupRecipients splits targets by their transform attributes.
+func (b *broadcastService) groupRecipients(targets []gnet.Conn) []recipientGroup {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	index := make(map[string]int)
+
+	var (
+		groups []recipientGroup
+		key    strings.Builder
+	)
+
+	for _, c := range targets {
+		var tags map[string]string
+		if tc, ok := b.connections[c]; ok {
+			tags = tc.tags
+		}
+
+		key.Reset()
+
+		for _, name := range b.transformKeys {
+			if value, ok := tags[name]; ok {
+				key.WriteByte(1)
+				key.WriteString(value)
+			}
+
+			key.WriteByte(0)
+		}
+
+		i, ok := index[key.String()]
+		if !ok {
+			attrs := make(map[string]string, len(b.transformKeys))
+			for _, name := range b.transformKeys {
+				if value, ok := tags[name]; ok {
+					attrs[name] = value
+				}
+			}
+
+			i = len(groups)
+			index[key.String()] = i
+			groups = append(groups, recipientGroup{attrs: attrs})
+		}
+
+		groups[i].conns = append(groups[i].conns, c)
+	}
+
+	return groups
+}
+
+// transform runs the deliver hooks over msg for members with attrs. It
+// reports false if they withheld it.
+func (b *broadcastService) transform(ctx context.Context, name string, msg roomMessage, attrs map[string]string) (roomMessage, bool, error) {
+	out := &outboundMessage{room: name, op: ws.OpText, data: msg.data}
+
+	err := b.middleware.deliver(ctx, attrs, out)
+	if errors.Is(err, errDropped) {
+		return msg, false, nil
+	}
+
+	if err != nil {
+		return msg, false, err
+	}
+
+	msg.data = out.data
+
+	return msg, true, nil
+}
+
+// framesFor encodes msg for targets, once per distinct transform output.
+// Targets it is withheld from count as skipped and those whose transform
+// failed as failed.
+func (b *broadcastService) framesFor(ctx context.Context, name string, msg roomMessage, targets []gnet.Conn, tally *deliveryTally) []frameGroup {
+	if len(b.transformKeys) == 0 {
+		return []frameGroup{{frame: newEncodedFrame(roomMessageFrame(name, msg)), conns: targets}}
+	}
+
+	groups := b.groupRecipients(targets)
+	frames := make([]frameGroup, 0, len(groups))
+
+	for _, g := range groups {
+		out, ok, err := b.transform(ctx, name, msg, g.attrs)
+
+		switch {
+		case err != nil:
+			for range g.conns {
+				tally.wrote(err)
+			}
+		case !ok:
+			tally.skipped += len(g.conns)
+		default:
+			frames = append(frames, frameGroup{frame: newEncodedFrame(roomMessageFrame(name, out)), conns: g.conns})
+		}
+	}
+
+	return frames
+}
+
+// transformFor is msg as c should see it, or false if c should not get it.
+func (b *broadcastService) transformFor(c gnet.Conn, name string, msg roomMessage) (roomMessage, bool, error) {
+	if len(b.transformKeys) == 0 {
+		return msg, true, nil
+	}
+
+	groups := b.groupRecipients([]gnet.Conn{c})
+
+	return b.transform(context.Background(), name, msg, groups[0].attrs)
+}
+
+// deliverTo sends one member of a room a message, transformed for it.
+func (b *broadcastService) deliverTo(c gnet.Conn, name string, msg roomMessage) error {
+	msg, ok, err := b.transformFor(c, name, msg)
+	if err != nil || !ok {
+		return err
+	}
+
+	return deliverRoomMessage(c, name, msg)
+}
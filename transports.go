@@ -0,0 +1,226 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gobwas/ws"
+	"go.uber.org/zap"
+)
+
+// transport is a subscriber type for clients that cannot hold a websocket.
+// The hub feeds it every room message through its message hook rather than
+// making its clients room members, so they do not show up in presence or
+// connection listings. Requests pass the same OnUpgrade hook as websocket
+// handshakes.
+type transport interface {
+	messageHook
+	pattern() string
+	handle(w http.ResponseWriter, r *http.Request)
+}
+
+// transportServer serves the HTTP transports on their own listener.
+type transportServer struct {
+	addr       string
+	transports []transport
+	logger     *zap.Logger
+}
+
+// addTransport starts feeding the transport called name the messages of
+// every room.
+func (b *broadcastService) addTransport(name string, hook messageHook, logger *zap.Logger) error {
+	if _, err := b.registerHook(context.Background(), "transport "+name, hook, nil, logger); err != nil {
+		return fmt.Errorf("adding transport %s: %w", name, err)
+	}
+
+	return nil
+}
+
+func (s *transportServer) serve() {
+	mux := http.NewServeMux()
+	for _, t := range s.transports {
+		handleTransport(mux, t)
+	}
+
+	s.logger.Info("transport server is listening", zap.String("addr", s.addr))
+
+	err := http.ListenAndServe(s.addr, mux)
+
+	s.logger.Error("transport server exits", zap.Error(err))
+}
+
+// handleTransport routes the transport's pattern, and the same under a
+// /t/{tenant} prefix, to it.
+func handleTransport(mux *http.ServeMux, t transport) {
+	mux.HandleFunc(t.pattern(), t.handle)
+	mux.HandleFunc(tenantRoutePrefix+"{tenant}"+t.pattern(), t.handle)
+}
+
+// authorizeTransport runs hook over r and answers the request itself if
+// the hook rejects it, or grants capabilities that do not include
+// subscribing. It returns the metadata the hook set.
+func authorizeTransport(w http.ResponseWriter, r *http.Request, hook upgradeHook) (map[string]string, bool) {
+	if hook == nil {
+		return nil, true
+	}
+
+	var metadata map[string]string
+
+	result, err := hook(r.Context(), upgradeRequestFromHTTP(r))
+	if err == nil && result != nil {
+		metadata = result.Metadata
+
+		if caps, ok := result.Metadata["capabilities"]; ok {
+			if set, _ := parseCapabilities(caps); set&capSubscribe == 0 {
+				err = ws.RejectConnectionError(ws.RejectionStatus(http.StatusForbidden), ws.RejectionReason(errNotPermitted.Error()))
+			}
+		}
+	}
+
+	if err != nil {
+		http.Error(w, err.Error(), rejectionStatus(err))
+
+		return nil, false
+	}
+
+	return metadata, true
+}
+
+// rejectionStatus is the HTTP status err rejects a request with.
+func rejectionStatus(err error) int {
+	var rejected *ws.ConnectionRejectedError
+	if errors.As(err, &rejected) {
+		return rejected.StatusCode()
+	}
+
+	return http.StatusForbidden
+}
+
+// transportAccess holds transport clients, known by their metadata
+// alone, to the same ACLs and roles as websocket connections.
+type transportAccess struct {
+	acls *roomACLs
+	rbac bool
+	bs   *broadcastService
+}
+
+func (wss *wsServer) transportAccess() transportAccess {
+	return transportAccess{acls: wss.acls, rbac: wss.rbac, bs: wss.bs}
+}
+
+// permit is wsServer.permit for a transport client.
+func (a transportAccess) permit(metadata map[string]string, capability capabilitySet) error {
+	if !a.rbac {
+		if capability == capAdmin {
+			return errNotPermitted
+		}
+
+		return nil
+	}
+
+	if caps, _ := parseCapabilities(metadata["capabilities"]); caps&capability == 0 {
+		return errNotPermitted
+	}
+
+	return nil
+}
+
+// authorizeSubscribe is wsServer.authorizeSubscribe for a transport client.
+func (a transportAccess) authorizeSubscribe(metadata map[string]string, room string) error {
+	if err := a.permit(metadata, capSubscribe); err != nil {
+		return err
+	}
+
+	if a.rbac && a.permit(metadata, capAdmin) != nil && !a.bs.roomExists(room) {
+		return errNoSuchRoom
+	}
+
+	return a.acls.authorizeMetadata(metadata, room, false)
+}
+
+func (a transportAccess) authorizePublish(metadata map[string]string, room string) error {
+	if err := a.permit(metadata, capPublish); err != nil {
+		return err
+	}
+
+	return a.acls.authorizeMetadata(metadata, room, true)
+}
+
+// admitTenant binds the client to its tenant, as admitTenant does an
+// upgrade, answering the request itself if it has no valid one.
+func (a transportAccess) admitTenant(w http.ResponseWriter, r *http.Request, metadata map[string]string) (map[string]string, string, bool) {
+	metadata, tenant, err := a.bs.transportTenant(metadata, r.PathValue("tenant"))
+	if err != nil {
+		http.Error(w, err.Error(), rejectionStatus(err))
+
+		return nil, "", false
+	}
+
+	return metadata, tenant, true
+}
+
+// authorizeRooms maps the rooms the client named into its tenant, and
+// answers the request itself unless the client may join every one.
+func (a transportAccess) authorizeRooms(w http.ResponseWriter, metadata map[string]string, tenant string, rooms []string) ([]string, bool) {
+	hubRooms := make([]string, len(rooms))
+
+	for i, room := range rooms {
+		hubRooms[i] = tenantRoom(tenant, room)
+
+		if err := a.authorizeSubscribe(metadata, hubRooms[i]); err != nil {
+			status := http.StatusForbidden
+			if errors.Is(err, errNoSuchRoom) {
+				status = http.StatusNotFound
+			}
+
+			http.Error(w, fmt.Sprintf("room %q: %v", room, err), status)
+
+			return nil, false
+		}
+	}
+
+	return hubRooms, true
+}
+
+func upgradeRequestFromHTTP(r *http.Request) *upgradeRequest {
+	return &upgradeRequest{
+		Method:     r.Method,
+		URI:        r.URL.RequestURI(),
+		Path:       r.URL.Path,
+		Query:      r.URL.Query(),
+		Host:       r.Host,
+		Header:     r.Header,
+		RemoteAddr: r.RemoteAddr,
+	}
+}
+
+// openRoom creates the room if nobody has joined it yet, so messages
+// published to it are recorded and reach transports, and keeps it from
+// being deleted as empty until closeRoom.
+func (b *broadcastService) openRoom(name string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	r, err := b.roomOf(name)
+	if err != nil {
+		return err
+	}
+
+	r.holders++
+	r.emptySince = time.Time{}
+
+	return nil
+}
+
+func (b *broadcastService) closeRoom(name string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if r, ok := b.rooms[name]; ok {
+		r.holders--
+		r.vacated()
+	}
+}
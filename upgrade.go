@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+
+	"github.com/gobwas/ws"
+	"github.com/panjf2000/gnet/v2"
+)
+
+// upgradeRequest is what the client sent with its handshake. It stays on the
+// connection for hooks and handlers that need per-request decisions. The
+// websocket handshake headers themselves are not included.
+type upgradeRequest struct {
+	Method     string
+	URI        string
+	Path       string
+	Query      url.Values
+	Host       string
+	Header     http.Header
+	RemoteAddr string
+}
+
+// Cookies parses the Cookie headers of the request.
+func (r *upgradeRequest) Cookies() []*http.Cookie {
+	return (&http.Request{Header: r.Header}).Cookies()
+}
+
+func (r *upgradeRequest) Cookie(name string) (*http.Cookie, error) {
+	return (&http.Request{Header: r.Header}).Cookie(name)
+}
+
+// upgradeResult is what an OnUpgrade hook attaches to the connection it
+// accepted: metadata kept with the connection and extra response headers
+// for the handshake.
+type upgradeResult struct {
+	Metadata map[string]string
+	Header   http.Header
+}
+
+// upgradeHook runs once the request is fully read, before the handshake is
+// answered. Returning an error rejects the upgrade, with 403 unless the error
+// is a ws.RejectConnectionError carrying its own status. ctx is the
+// connection's context.
+type upgradeHook func(ctx context.Context, req *upgradeRequest) (*upgradeResult, error)
+
+// upgrade performs the websocket handshake, recording the request on the
+// codec and consulting the OnUpgrade hook. It reports the route the request
+// path selected; unknown paths are answered with 404.
+func (wss *wsServer) upgrade(conn gnet.Conn, codec *wsCodec) (upgradeRoute, error) {
+	var route upgradeRoute
+
+	req := &upgradeRequest{
+		Method:     http.MethodGet,
+		Header:     make(http.Header),
+		RemoteAddr: connRemoteAddr(conn),
+	}
+
+	u := ws.Upgrader{
+		Protocol: codec.selectSubprotocol,
+		OnRequest: func(uri []byte) (err error) {
+			req.URI = string(uri)
+
+			parsed, err := url.ParseRequestURI(req.URI)
+			if err != nil {
+				return errUnknownRoute
+			}
+
+			req.Path, req.Query = parsed.Path, parsed.Query()
+
+			route, err = parseRoute(uri)
+
+			return err
+		},
+		OnHost: func(host []byte) error {
+			req.Host = string(host)
+
+			return nil
+		},
+		OnHeader: func(key, value []byte) error {
+			req.Header.Add(string(key), string(value))
+
+			return nil
+		},
+		OnBeforeUpgrade: func() (ws.HandshakeHeader, error) {
+			if err := wss.admit(codec); err != nil {
+				return nil, err
+			}
+
+			var header ws.HandshakeHeader
+
+			if wss.onUpgrade != nil {
+				result, err := wss.onUpgrade(codec.ctx, req)
+				if err != nil {
+					var rejected *ws.ConnectionRejectedError
+					if errors.As(err, &rejected) {
+						return nil, rejected
+					}
+
+					return nil, ws.RejectConnectionError(
+						ws.RejectionStatus(http.StatusForbidden),
+						ws.RejectionReason(err.Error()),
+					)
+				}
+
+				if result != nil {
+					codec.metadata = result.Metadata
+
+					if len(result.Header) > 0 {
+						header = ws.HandshakeHeaderHTTP(result.Header)
+					}
+				}
+			}
+
+			if err := wss.admitTenant(codec, route); err != nil {
+				return nil, err
+			}
+
+			if err := wss.bs.claimClientID(codec, req.Query.Get("client_id")); err != nil {
+				return nil, err
+			}
+
+			return header, nil
+		},
+	}
+
+	if _, err := u.Upgrade(conn); err != nil {
+		return route, err
+	}
+
+	codec.request = req
+	codec.metadata = wss.geo.enrich(codec.metadata, connIP(conn))
+	// Capabilities only matter under -jwt-roles; malformed ones grant none.
+	codec.capabilities, _ = parseCapabilities(codec.metadata["capabilities"])
+	wss.bs.annotate(conn, req.Path, codec.metadata)
+
+	return route, nil
+}
@@ -0,0 +1,308 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/api"
+	"github.com/tetratelabs/wazero/imports/wasi_snapshot_preview1"
+	"github.com/tetratelabs/wazero/sys"
+	"go.uber.org/zap"
+)
+
+// WASM plugins transform broadcasts as middleware, so operators can drop in
+// filtering and rewriting without rebuilding the server. A plugin exports
+// its memory and
+//
+//	alloc(size i32) -> ptr i32
+//	transform(room_ptr, room_len, data_ptr, data_len i32) -> i64
+//
+// The server allocs a buffer in the plugin, writes room and data into it
+// and calls transform, whose result is 0 to keep the message, -1 to drop
+// it, and otherwise ptr<<32|len of the replacement. The buffer is reused
+// for the next message and only allocated anew when that one is larger; a
+// plugin may export free(ptr, size i32) to get back the buffers it
+// outgrows. Raw broadcasts have an empty room. WASI is available and
+// reactor modules get _initialize called once.
+//
+// A call running past -wasm-timeout is stopped and fails the broadcast;
+// the plugin is then instantiated again for the next one.
+const (
+	wasmKeep = 0
+	wasmDrop = ^uint64(0)
+
+	wasmMinScratch = 1 << 10
+)
+
+var (
+	errWasmOutOfRange  = errors.New("plugin memory access out of range")
+	errWasmUnavailable = errors.New("plugin could not be instantiated again")
+)
+
+// wasmPlugins is the set of loaded plugins, swapped whole on reload.
+type wasmPlugins struct {
+	timeout time.Duration
+	logger  *zap.Logger
+
+	mu      sync.RWMutex
+	runtime wazero.Runtime
+	plugins []*wasmPlugin
+}
+
+type wasmPlugin struct {
+	name     string
+	file     string
+	runtime  wazero.Runtime
+	compiled wazero.CompiledModule
+
+	// A module instance runs one call at a time.
+	mu        sync.Mutex
+	module    api.Module
+	alloc     api.Function
+	free      api.Function
+	transform api.Function
+	// scratch is the buffer in the plugin's memory messages are written
+	// to, of scratchSize bytes.
+	scratch     uint32
+	scratchSize uint32
+}
+
+// load compiles the plugins in paths, in order, and replaces the loaded set
+// with them. Nothing changes unless all of them load.
+func (p *wasmPlugins) load(ctx context.Context, paths []string) error {
+	runtime, plugins, err := compileWasmPlugins(ctx, paths)
+	if err != nil {
+		return err
+	}
+
+	p.swap(ctx, runtime, plugins, paths)
+
+	return nil
+}
+
+// compileWasmPlugins loads the plugins in paths, in order, into a runtime of
+// their own, without putting them in use. The runtime is nil without
+// paths; the caller closes it if the plugins are not swapped in.
+func compileWasmPlugins(ctx context.Context, paths []string) (wazero.Runtime, []*wasmPlugin, error) {
+	if len(paths) == 0 {
+		return nil, nil, nil
+	}
+
+	// Closing on a done context is what stops a call at -wasm-timeout.
+	runtime := wazero.NewRuntimeWithConfig(ctx, wazero.NewRuntimeConfig().WithCloseOnContextDone(true))
+
+	if _, err := wasi_snapshot_preview1.Instantiate(ctx, runtime); err != nil {
+		runtime.Close(ctx)
+
+		return nil, nil, fmt.Errorf("instantiating WASI: %w", err)
+	}
+
+	plugins := make([]*wasmPlugin, 0, len(paths))
+
+	for _, file := range paths {
+		plugin, err := loadWasmPlugin(ctx, runtime, file)
+		if err != nil {
+			runtime.Close(ctx)
+
+			return nil, nil, err
+		}
+
+		plugins = append(plugins, plugin)
+	}
+
+	return runtime, plugins, nil
+}
+
+// swap puts plugins, compiled in runtime from paths, in use and closes the
+// runtime of the set they replace.
+func (p *wasmPlugins) swap(ctx context.Context, runtime wazero.Runtime, plugins []*wasmPlugin, paths []string) {
+	p.mu.Lock()
+	old := p.runtime
+	p.runtime, p.plugins = runtime, plugins
+	p.mu.Unlock()
+
+	if old != nil {
+		old.Close(ctx)
+	}
+
+	if len(paths) > 0 {
+		p.logger.Info("wasm plugins loaded", zap.Strings("plugins", paths))
+	}
+}
+
+func loadWasmPlugin(ctx context.Context, runtime wazero.Runtime, file string) (*wasmPlugin, error) {
+	binary, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("reading plugin: %w", err)
+	}
+
+	compiled, err := runtime.CompileModule(ctx, binary)
+	if err != nil {
+		return nil, fmt.Errorf("compiling plugin %s: %w", file, err)
+	}
+
+	plugin := &wasmPlugin{name: filepath.Base(file), file: file, runtime: runtime, compiled: compiled}
+	if err := plugin.instantiate(ctx); err != nil {
+		return nil, err
+	}
+
+	return plugin, nil
+}
+
+// instantiate gives the plugin a fresh module instance. It must be called
+// with plugin.mu held, once the plugin is in use.
+func (plugin *wasmPlugin) instantiate(ctx context.Context) error {
+	// Module names must be unique within the runtime; a closed instance
+	// gives its name up.
+	config := wazero.NewModuleConfig().WithName(plugin.file).WithStartFunctions("_initialize").WithStderr(os.Stderr)
+
+	module, err := plugin.runtime.InstantiateModule(ctx, plugin.compiled, config)
+	if err != nil {
+		return fmt.Errorf("instantiating plugin %s: %w", plugin.file, err)
+	}
+
+	plugin.module = module
+	plugin.alloc = module.ExportedFunction("alloc")
+	plugin.free = module.ExportedFunction("free")
+	plugin.transform = module.ExportedFunction("transform")
+	plugin.scratch, plugin.scratchSize = 0, 0
+
+	if plugin.alloc == nil || plugin.transform == nil || module.Memory() == nil {
+		module.Close(ctx)
+
+		return fmt.Errorf("plugin %s must export memory, alloc and transform", plugin.file)
+	}
+
+	return nil
+}
+
+// middleware runs every loaded plugin over each broadcast.
+func (p *wasmPlugins) middleware() middleware {
+	return middleware{name: "wasm", onBroadcast: p.onBroadcast}
+}
+
+func (p *wasmPlugins) onBroadcast(ctx context.Context, msg *outboundMessage) error {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	for _, plugin := range p.plugins {
+		data, keep, err := plugin.call(ctx, p.timeout, msg.room, msg.data)
+		if err != nil {
+			return fmt.Errorf("plugin %s: %w", plugin.name, err)
+		}
+
+		if !keep {
+			return errDropped
+		}
+
+		msg.data = data
+	}
+
+	return nil
+}
+
+// call runs the plugin over one message for at most timeout, if set. A
+// call that exits the module, by running out of time or through WASI,
+// leaves the next message a new instance.
+func (plugin *wasmPlugin) call(ctx context.Context, timeout time.Duration, room string, data []byte) ([]byte, bool, error) {
+	plugin.mu.Lock()
+	defer plugin.mu.Unlock()
+
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	out, keep, err := plugin.run(ctx, room, data)
+
+	var exit *sys.ExitError
+	if errors.As(err, &exit) {
+		if err := plugin.instantiate(context.Background()); err != nil {
+			plugin.module = nil
+		}
+	}
+
+	return out, keep, err
+}
+
+// run must be called with plugin.mu held.
+func (plugin *wasmPlugin) run(ctx context.Context, room string, data []byte) ([]byte, bool, error) {
+	if plugin.module == nil {
+		return nil, false, errWasmUnavailable
+	}
+
+	ptr, err := plugin.buffer(ctx, len(room)+len(data))
+	if err != nil {
+		return nil, false, err
+	}
+
+	memory := plugin.module.Memory()
+	if !memory.Write(ptr, []byte(room)) || !memory.Write(ptr+uint32(len(room)), data) {
+		return nil, false, errWasmOutOfRange
+	}
+
+	results, err := plugin.transform.Call(ctx, uint64(ptr), uint64(len(room)), uint64(ptr)+uint64(len(room)), uint64(len(data)))
+	if err != nil {
+		return nil, false, fmt.Errorf("calling transform: %w", err)
+	}
+
+	switch result := results[0]; result {
+	case wasmKeep:
+		return data, true, nil
+	case wasmDrop:
+		return nil, false, nil
+	default:
+		out, ok := plugin.module.Memory().Read(uint32(result>>32), uint32(result))
+		if !ok {
+			return nil, false, errWasmOutOfRange
+		}
+
+		// The plugin's memory may be reused by the next call.
+		return append([]byte(nil), out...), true, nil
+	}
+}
+
+// buffer returns the scratch buffer, allocating a larger one when it holds
+// fewer than size bytes. The buffer at least doubles when it grows, so a
+// plugin allocates a handful of times however many messages it sees.
+func (plugin *wasmPlugin) buffer(ctx context.Context, size int) (uint32, error) {
+	if plugin.scratchSize > 0 && uint64(size) <= uint64(plugin.scratchSize) {
+		return plugin.scratch, nil
+	}
+
+	grown := uint64(plugin.scratchSize) * 2
+	if grown < uint64(size) {
+		grown = uint64(size)
+	}
+
+	if grown < wasmMinScratch {
+		grown = wasmMinScratch
+	}
+
+	if grown > math.MaxUint32 {
+		return 0, errWasmOutOfRange
+	}
+
+	results, err := plugin.alloc.Call(ctx, grown)
+	if err != nil {
+		return 0, fmt.Errorf("calling alloc: %w", err)
+	}
+
+	if plugin.free != nil && plugin.scratchSize > 0 {
+		if _, err := plugin.free.Call(ctx, uint64(plugin.scratch), uint64(plugin.scratchSize)); err != nil {
+			return 0, fmt.Errorf("calling free: %w", err)
+		}
+	}
+
+	plugin.scratch, plugin.scratchSize = uint32(results[0]), uint32(grown)
+
+	return plugin.scratch, nil
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/panjf2000/gnet/v2"
+	"go.uber.org/zap"
+)
+
+// Webhook event types.
+const (
+	webhookConnect       = "connect"
+	webhookAuthenticated = "authenticated"
+	webhookDisconnect    = "disconnect"
+	webhookMessage       = "message"
+	webhookPresence      = "presence"
+)
+
+const (
+	webhookBackoff    = 500 * time.Millisecond
+	webhookMaxBackoff = 30 * time.Second
+)
+
+type webhookEvent struct {
+	Type       string            `json:"type"`
+	Time       time.Time         `json:"time"`
+	ConnID     uint64            `json:"conn_id,omitempty"`
+	Identity   string            `json:"identity,omitempty"`
+	RemoteAddr string            `json:"remote_addr,omitempty"`
+	Path       string            `json:"path,omitempty"`
+	Metadata   map[string]string `json:"metadata,omitempty"`
+	Error      string            `json:"error,omitempty"`
+
+	// Tenant and Status are an identity's heartbeat status on presence
+	// events.
+	Tenant string `json:"tenant,omitempty"`
+	Status string `json:"status,omitempty"`
+
+	Room string          `json:"room,omitempty"`
+	Seq  uint64          `json:"seq,omitempty"`
+	Data json.RawMessage `json:"data,omitempty"`
+}
+
+// webhookSender posts events to the backend one at a time, in order, so it
+// can tell who is connected without polling the admin API. Events wait in a
+// bounded queue and are dropped once it is full; a failed post is retried
+// with exponential backoff. Each request is signed with
+// X-Wsb-Signature: sha256=hex(HMAC-SHA256(secret, timestamp + "." + body))
+// where timestamp is X-Wsb-Timestamp, in Unix seconds.
+type webhookSender struct {
+	url     string
+	secret  string
+	events  map[string]bool
+	retries int
+	client  *http.Client
+	logger  *zap.Logger
+
+	queue   chan webhookEvent
+	dropped uint64
+}
+
+func newWebhookSender(url, secret string, events []string, queueSize, retries int, logger *zap.Logger) (*webhookSender, error) {
+	w := &webhookSender{
+		url:     url,
+		secret:  secret,
+		events:  make(map[string]bool),
+		retries: retries,
+		client:  &http.Client{Timeout: 10 * time.Second},
+		logger:  logger,
+		queue:   make(chan webhookEvent, queueSize),
+	}
+
+	for _, event := range events {
+		switch event {
+		case webhookConnect, webhookAuthenticated, webhookDisconnect, webhookMessage, webhookPresence:
+			w.events[event] = true
+		default:
+			return nil, fmt.Errorf("unknown webhook event %q", event)
+		}
+	}
+
+	return w, nil
+}
+
+func (w *webhookSender) enqueue(ev webhookEvent) {
+	if !w.events[ev.Type] {
+		return
+	}
+
+	ev.Time = time.Now()
+
+	select {
+	case w.queue <- ev:
+	default:
+		if n := atomic.AddUint64(&w.dropped, 1); n&(n-1) == 0 {
+			w.logger.Warn("webhook queue full, dropping events", zap.Uint64("dropped", n))
+		}
+	}
+}
+
+func (w *webhookSender) run() {
+	for ev := range w.queue {
+		if err := w.deliver(ev); err != nil {
+			w.logger.Warn("webhook delivery failed", zap.String("event", ev.Type), zap.Error(err))
+		}
+	}
+}
+
+func (w *webhookSender) deliver(ev webhookEvent) error {
+	body, err := json.Marshal(ev)
+	if err != nil {
+		return fmt.Errorf("encoding event: %w", err)
+	}
+
+	backoff := webhookBackoff
+
+	for attempt := 0; ; attempt++ {
+		retry, err := w.post(ev.Type, body)
+		if err == nil {
+			return nil
+		}
+
+		if !retry || attempt >= w.retries {
+			return err
+		}
+
+		time.Sleep(backoff)
+
+		if backoff *= 2; backoff > webhookMaxBackoff {
+			backoff = webhookMaxBackoff
+		}
+	}
+}
+
+// post reports whether a failure is worth retrying: the backend was not
+// reached, or it answered 429 or 5xx.
+func (w *webhookSender) post(event string, body []byte) (bool, error) {
+	req, err := http.NewRequest(http.MethodPost, w.url, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Wsb-Event", event)
+	req.Header.Set("X-Wsb-Timestamp", timestamp)
+
+	if w.secret != "" {
+		mac := hmac.New(sha256.New, []byte(w.secret))
+		mac.Write([]byte(timestamp + "."))
+		mac.Write(body)
+		req.Header.Set("X-Wsb-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		retry := resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500
+
+		return retry, fmt.Errorf("webhook answered %s", resp.Status)
+	}
+
+	return false, nil
+}
+
+// middleware reports connects, authentications and disconnects.
+func (w *webhookSender) middleware() middleware {
+	return middleware{
+		name: "webhook",
+		onConnect: func(ctx context.Context, c gnet.Conn, req *upgradeRequest) error {
+			ev := connectionEvent(webhookConnect, c)
+			w.enqueue(ev)
+
+			// Only an upgrade hook gives connections metadata.
+			if len(ev.Metadata) > 0 {
+				ev.Type = webhookAuthenticated
+				w.enqueue(ev)
+			}
+
+			return nil
+		},
+		onDisconnect: func(c gnet.Conn, err error) {
+			ev := connectionEvent(webhookDisconnect, c)
+			if err != nil {
+				ev.Error = err.Error()
+			}
+
+			w.enqueue(ev)
+		},
+	}
+}
+
+// onMessage makes the sender a messageHook for message events.
+func (w *webhookSender) onMessage(ctx context.Context, room string, msg roomMessage) error {
+	w.enqueue(webhookEvent{Type: webhookMessage, Room: room, Seq: msg.seq, Data: msg.data})
+
+	return nil
+}
+
+// onStatus reports heartbeat status changes as presence events.
+func (w *webhookSender) onStatus(tenant, identity, status string) {
+	w.enqueue(webhookEvent{Type: webhookPresence, Tenant: tenant, Identity: identity, Status: status})
+}
+
+func connectionEvent(typ string, c gnet.Conn) webhookEvent {
+	ev := webhookEvent{Type: typ, Identity: connIdentity(c), RemoteAddr: connRemoteAddr(c)}
+
+	if codec, ok := codecOf(c); ok {
+		ev.ConnID = codec.id
+		ev.Metadata = codec.metadata
+
+		if codec.request != nil {
+			ev.Path = codec.request.Path
+		}
+	}
+
+	return ev
+}
@@ -1,158 +1,1525 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"expvar"
 	"flag"
 	"fmt"
-	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/gobwas/ws"
 	"github.com/gobwas/ws/wsutil"
 	"github.com/panjf2000/gnet/v2"
-	"github.com/panjf2000/gnet/v2/pkg/logging"
+	"go.uber.org/zap"
 )
 
 type wsServer struct {
 	gnet.BuiltinEventEngine
 
-	addr                      string
+	addrs                     []string
+	port                      int
 	atomicNumberOfConnections int64
+	atomicRejectedConnections uint64
+	atomicHandshakeTimeouts   uint64
+	atomicLastConnectionID    uint64
+	atomicBooted              int32
+	atomicDraining            int32
+	atomicStandby             int32
+	// atomicRebalancing counts admin drain closes not yet sent.
+	atomicRebalancing int64
 
-	bs *broadcastService
+	bs       *broadcastService
+	outboxes loopOutboxes
+
+	advertiseURL string
+	standbyURL   string
+	hints        loadHinter
+	onUpgrade    upgradeHook
+
+	// maxConnections caps open connections, counting this one; 0 is no
+	// limit.
+	maxConnections int64
+	throttle       *upgradeThrottle
+	perIP          *ipLimiter
+	ipFilter       *ipFilter
+	bans           *banList
+	geo            *geoIP
+	acls           *roomACLs
+	// rbac enforces the capabilities JWT roles grant.
+	rbac bool
+	// handshakeTimeout bounds how long a connection may take to upgrade.
+	handshakeTimeout time.Duration
+	// maxMessageSize caps inbound messages, fragments included; 0 is no
+	// limit.
+	maxMessageSize int64
+	// skipUTF8 trusts text messages to be UTF-8 rather than checking.
+	skipUTF8 bool
+
+	drainTimeout  time.Duration
+	idleTimeout   time.Duration
+	shutdownOnce  sync.Once
+	controlSocket string
+	takeover      bool
+	handoffConn   net.Conn
+
+	soak      *soakRunner
+	announcer *announcer
+
+	logger    *zap.Logger
+	msgLogger *zap.Logger
 }
 
 type broadcastService struct {
-	connections map[gnet.Conn]struct{}
+	mu sync.RWMutex
+
+	connections map[gnet.Conn]*trackedConnection
+	rooms       map[string]*room
+	// moved maps rooms handed to another node to its websocket URL.
+	moved    map[string]string
+	tagIndex map[string]map[gnet.Conn]struct{}
+
+	rawBroadcast      bool
+	mode              hubModeSwitch
+	historyDepth      int
+	pauseBufferSize   int
+	confidentialRooms []string
+	retainedRooms     []string
+	stateRooms        []string
+	orderingRules     []orderingRule
+	defaultOrdering   orderingMode
+	retention         retentionPolicy
+	retentionRules    []retentionRule
+	maxRooms          int
+	maxRoomMembers    int
+	lifecycle         lifecycleFeed
+	tenants           *tenantRegistry
+
+	broadcastStats fanoutStats
+	roomTotals     fanoutStats
+	fanoutLatency  latencyHistogram
+	rates          rateSampler
+
+	shed      *loadShedder
+	coalesced *coalescer
+	fanout    *fanoutPool
+	bandwidth *bandwidthQuotas
+	cluster   *clusterMesh
+
+	// transformKeys are the connection tags per-recipient transforms
+	// depend on.
+	transformKeys []string
+	// reservedTags are tag keys only the server sets, even on connections
+	// where it left them unset.
+	reservedTags []string
+
+	hooks map[string]*hookRunner
+	qos   *qosTracker
+	dedup *dedupCache
+	// clientIDs are the QoS identities live connections hold.
+	clientIDs clientClaims
+	// msgAudit records every publish made from outside the server, over
+	// any transport.
+	msgAudit *messageAuditor
+
+	presence *presenceTracker
+	lastSeen *lastSeenRegistry
+	requests *requestRouter
+	// scheduler holds publishes for later delivery.
+	scheduler *scheduler
+
+	middleware middlewareChain
+}
+
+type trackedConnection struct {
+	id            uint64
+	remoteAddr    string
+	connectedAt   time.Time
+	subscriptions map[string]*subscription
+
+	path     string
+	metadata map[string]string
+	tags     map[string]string
 }
 
 func (b *broadcastService) broadcastMessage(op ws.OpCode, msg []byte) error {
-	for c, _ := range b.connections {
-		err := wsutil.WriteServerMessage(c, op, msg)
-		if err != nil {
-			return fmt.Errorf("writing server message: %w", err)
+	msg, ok, err := b.outbound(context.Background(), "", op, msg)
+	if err != nil || !ok {
+		return err
+	}
+
+	b.broadcastStats.received(len(msg))
+
+	wire, err := compileServerFrame(op, msg)
+	if err != nil {
+		return err
+	}
+
+	targets := b.snapshot()
+	tally := newDeliveryTally(time.Now(), len(targets), 0)
+
+	err = b.fanout.each(targets, func(c gnet.Conn) error {
+		if err := tally.wrote(writeCompiledFrame(c, wire)); err != nil {
+			return err
 		}
+
+		b.broadcastStats.wrote(frameSize(len(msg)))
+
+		return nil
+	})
+	wire.release()
+	b.finishDelivery(tally, &b.broadcastStats)
+
+	if err != nil {
+		return fmt.Errorf("writing server message: %w", err)
 	}
+
 	return nil
 }
 
-func (b *broadcastService) trackConnection(c gnet.Conn) {
-	b.connections[c] = struct{}{}
+// snapshot copies the tracked connections so writes happen without holding
+// the lock: gnet fires OnClose synchronously when a write fails.
+func (b *broadcastService) snapshot() []gnet.Conn {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	conns := make([]gnet.Conn, 0, len(b.connections))
+	for c := range b.connections {
+		conns = append(conns, c)
+	}
+
+	return conns
+}
+
+func (b *broadcastService) trackConnection(c gnet.Conn, id uint64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.connections[c] = &trackedConnection{
+		id:            id,
+		remoteAddr:    connRemoteAddr(c),
+		connectedAt:   time.Now(),
+		subscriptions: make(map[string]*subscription),
+		tags:          make(map[string]string),
+	}
 }
 
-func (b *broadcastService) untrackConnection(c gnet.Conn) {
+// annotate records what the handshake of c asked for, for connection
+// listings.
+func (b *broadcastService) annotate(c gnet.Conn, path string, metadata map[string]string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	tc, ok := b.connections[c]
+	if !ok {
+		return
+	}
+
+	tc.path, tc.metadata = path, metadata
+
+	for key, value := range metadata {
+		tc.tags[key] = value
+		b.indexTag(c, key, value)
+	}
+}
+
+func (b *broadcastService) untrackConnection(c gnet.Conn) error {
+	for _, rotation := range b.forget(c) {
+		if err := rotation.distribute(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (b *broadcastService) forget(c gnet.Conn) []*keyRotation {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var rotations []*keyRotation
+
+	tc, ok := b.connections[c]
+	if !ok {
+		return nil
+	}
+
+	for name := range tc.subscriptions {
+		r := b.rooms[name]
+		delete(r.members, c)
+		b.depart(c, name)
+		r.vacated()
+
+		// A failed rotation leaves the old key in place until the next
+		// membership change; there is nobody left to report it to here.
+		if rotation, err := r.rotateKey(); err == nil && rotation != nil {
+			rotations = append(rotations, rotation)
+		}
+	}
+
+	for key, value := range tc.tags {
+		b.unindexTag(c, key, value)
+	}
+
 	delete(b.connections, c)
+	b.lastSeen.forget(c)
+	b.requests.forget(c)
+
+	return rotations
 }
 
 type wsCodec struct {
 	upgradedWebsocketConnection bool
+
+	// ctx is canceled when the connection closes. Work started on the
+	// connection's behalf, such as hooks, auth lookups and bridge
+	// publishes, should take it so it is abandoned once nobody is waiting.
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// request and metadata are set once the handshake has been accepted.
+	request  *upgradeRequest
+	metadata map[string]string
+	// clientID names the client across reconnects, for QoS redelivery.
+	clientID string
+	// qosID is what QoS tracks the client by; see qosIdentity.
+	qosID string
+	// capabilities are what the connection's roles grant; see permit.
+	capabilities capabilitySet
+	// tenant owns the connection under -multi-tenant; its rooms are the
+	// tenant's rooms and it counts against the tenant's quotas.
+	tenant string
+
+	counters connCounters
+
+	// atomicLastActive is when the client last sent anything, in Unix
+	// nanoseconds, zero until upgraded.
+	atomicLastActive int64
+
+	// loop is the event loop that owns the connection, -1 if unknown.
+	loop int
+	// outbox queues the connection's writes on its loop, nil if the loop
+	// is unknown.
+	outbox *loopOutbox
+	// closing is set, on the loop, once the server has decided to close;
+	// whatever the client sends afterwards is dropped.
+	closing bool
+	// sentClose is set, on the loop, once a close frame has been written;
+	// frames queued after it are dropped.
+	sentClose bool
+
+	// ip is the source address counted against the per-IP cap, empty when
+	// it is not counted.
+	ip string
+
+	// handshakeTimer closes the connection if it has not upgraded in time.
+	handshakeTimer *time.Timer
+
+	// encoding is the envelope encoding negotiated by subprotocol, nil for
+	// the JSON default.
+	encoding envelopeEncoding
+
+	fragmentOp ws.OpCode
+	fragments  []byte
+	// fragmentsValid is how much of a fragmented text message is known to
+	// be UTF-8.
+	fragmentsValid int
+
+	id     uint64
+	log    *zap.Logger
+	msgLog *zap.Logger
+}
+
+// openCodecs maps every open connection to its codec. gnet clears a
+// connection's context on its loop as it closes, so other goroutines, which
+// may still hold the connection, look the codec up here instead.
+var openCodecs sync.Map
+
+// codecOf returns c's codec, or false once c has closed.
+func codecOf(c gnet.Conn) (*wsCodec, bool) {
+	codec, ok := openCodecs.Load(c)
+	if !ok {
+		return nil, false
+	}
+
+	return codec.(*wsCodec), true
 }
 
 func (wss *wsServer) OnBoot(eng gnet.Engine) gnet.Action {
-	logging.Infof("echo server with multi-core=true is listening on %s", wss.addr)
+	// Every listener boots its own engine; the rest only starts once all of
+	// them are up.
+	atomic.AddInt32(&wss.atomicBooted, 1)
+	if !wss.allListenersBooted() {
+		return gnet.None
+	}
+
+	wss.logger.Info("server is listening", zap.Strings("addrs", wss.addrs), zap.Bool("multicore", true))
+
+	wss.throttle.restart(time.Now())
+
+	if wss.controlSocket != "" {
+		go wss.runControl()
+	}
+
+	if wss.soak != nil {
+		go wss.soak.run()
+	}
+
+	if wss.announcer != nil {
+		wss.announcer.run()
+	}
+
+	if wss.idleTimeout > 0 {
+		go wss.reapIdle(wss.idleTimeout)
+	}
 
 	return gnet.None
 }
 
+func (wss *wsServer) OnShutdown(eng gnet.Engine) {
+	atomic.AddInt32(&wss.atomicBooted, -1)
+}
+
+func (wss *wsServer) checkBooted() error {
+	if !wss.allListenersBooted() {
+		return errors.New("not every listener is running")
+	}
+
+	return nil
+}
+
 func (wss *wsServer) OnOpen(conn gnet.Conn) ([]byte, gnet.Action) {
-	conn.SetContext(new(wsCodec))
+	if wss.isDraining() {
+		return nil, gnet.Close
+	}
+
+	if wss.isStandby() {
+		return nil, gnet.Close
+	}
+
+	if !wss.ipFilter.permits(connIP(conn)) {
+		atomic.AddUint64(&wss.atomicRejectedConnections, 1)
+		wss.logger.Debug("refusing filtered address", zap.String("remote_addr", connRemoteAddr(conn)))
+
+		return nil, gnet.Close
+	}
+
+	if b, banned := wss.bans.bannedIP(connIP(conn)); banned {
+		atomic.AddUint64(&wss.atomicRejectedConnections, 1)
+		wss.logger.Debug("refusing banned address",
+			zap.String("remote_addr", connRemoteAddr(conn)), zap.String("ban", b.Value))
+
+		return nil, gnet.Close
+	}
+
+	if wss.bs.shed.rejectConnection() {
+		wss.logger.Debug("rejecting connection while shedding load",
+			zap.String("remote_addr", connRemoteAddr(conn)))
+
+		return nil, gnet.Close
+	}
+
+	id := atomic.AddUint64(&wss.atomicLastConnectionID, 1)
+	fields := []zap.Field{
+		zap.Uint64("conn_id", id),
+		zap.String("remote_addr", connRemoteAddr(conn)),
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	loop := eventLoopID()
+
+	codec := &wsCodec{
+		ctx:    ctx,
+		cancel: cancel,
+		loop:   loop,
+		outbox: wss.outboxes.of(loop),
+		ip:     wss.perIP.open(connIP(conn)),
+		id:     id,
+		log:    wss.logger.With(fields...),
+		msgLog: wss.msgLogger.With(fields...),
+	}
+
+	if wss.handshakeTimeout > 0 {
+		codec.handshakeTimer = time.AfterFunc(wss.handshakeTimeout, func() {
+			if atomic.LoadInt64(&codec.atomicLastActive) != 0 {
+				return
+			}
+
+			atomic.AddUint64(&wss.atomicHandshakeTimeouts, 1)
+			codec.log.Info("closing connection that did not upgrade in time")
+
+			_ = conn.Close()
+		})
+	}
+
+	conn.SetContext(codec)
+	openCodecs.Store(conn, codec)
 
 	atomic.AddInt64(&wss.atomicNumberOfConnections, 1)
 
-	wss.bs.trackConnection(conn)
+	wss.bs.trackConnection(conn, id)
 
 	return nil, gnet.None
 }
 
 func (wss *wsServer) OnClose(conn gnet.Conn, err error) gnet.Action {
+	codec, ok := codecOf(conn)
+	if !ok {
+		// OnOpen refused the connection before counting or tracking it,
+		// but gnet still reports its close.
+		return gnet.None
+	}
+
+	codec.cancel()
+	wss.perIP.close(codec.ip)
+	wss.bs.tenants.close(codec.tenant)
+	wss.bs.clientIDs.release(codec.qosID, codec)
+
+	if codec.handshakeTimer != nil {
+		codec.handshakeTimer.Stop()
+	}
+
+	log := codec.log
+
 	if err != nil {
-		logging.Warnf("error occurred on connection=%s, %v\n", conn.RemoteAddr().String(), err)
+		log.Warn("connection error", zap.Error(err))
 	}
 
 	atomic.AddInt64(&wss.atomicNumberOfConnections, -1)
-	logging.Infof("conn[%v] disconnected", conn.RemoteAddr().String())
+	log.Info("disconnected")
 
-	wss.bs.untrackConnection(conn)
+	if err := wss.bs.untrackConnection(conn); err != nil {
+		log.Warn("untracking connection", zap.Error(err))
+	}
+
+	if codec.upgradedWebsocketConnection {
+		wss.bs.middleware.disconnect(conn, err)
+	}
+
+	openCodecs.Delete(conn)
 
 	return gnet.None
 }
 
+// OnTraffic closes through the connection's outbox, so replies queued while
+// handling the traffic, such as a close frame, are written first.
 func (wss *wsServer) OnTraffic(conn gnet.Conn) gnet.Action {
-	codec, ok := conn.Context().(*wsCodec)
+	codec, ok := codecOf(conn)
+	if !ok || codec.outbox == nil {
+		return wss.traffic(conn)
+	}
+
+	if codec.closing {
+		_, _ = conn.Discard(conn.InboundBuffered())
+
+		return gnet.None
+	}
+
+	if wss.traffic(conn) == gnet.Close {
+		codec.closing = true
+		_ = queueClose(conn)
+	}
+
+	return gnet.None
+}
+
+func (wss *wsServer) traffic(conn gnet.Conn) gnet.Action {
+	codec, ok := codecOf(conn)
 	if !ok {
-		logging.Errorf("unexpected context type, shutting down connection")
+		wss.logger.Error("unexpected context type, shutting down connection",
+			zap.String("remote_addr", connRemoteAddr(conn)))
 
 		return gnet.Close
 	}
 
 	if !codec.upgradedWebsocketConnection {
-		logging.Infof("conn[%v] upgrade websocket protocol", conn.RemoteAddr().String())
+		if wss.isDraining() {
+			codec.log.Info("rejecting upgrade while draining")
 
-		_, err := ws.Upgrade(conn)
+			return gnet.Close
+		}
+
+		codec.log.Info("upgrading websocket protocol")
+
+		route, err := wss.upgrade(conn, codec)
 		if err != nil {
-			logging.Warnf("conn[%v] [err=%v]", conn.RemoteAddr().String(), err.Error())
+			codec.log.Warn("upgrade failed", zap.Error(err))
 
 			return gnet.Close
 		}
 
 		codec.upgradedWebsocketConnection = true
+		atomic.StoreInt64(&codec.atomicLastActive, time.Now().UnixNano())
 
-		return gnet.None
+		if err := wss.bs.middleware.connect(codec.ctx, conn, codec.request); err != nil {
+			codec.log.Info("connection rejected", zap.Error(err))
+			_ = writeClose(conn, closeRejected, "")
+
+			return gnet.Close
+		}
+
+		if b, banned := wss.bans.bannedUser(connIdentity(conn)); banned {
+			codec.log.Info("refusing banned user", zap.String("ban", b.Value))
+			_ = writeClose(conn, closeBanned, b.Reason)
+
+			return gnet.Close
+		}
+
+		if route.room != "" {
+			room := tenantRoom(codec.tenant, route.room)
+
+			err := wss.authorizeSubscribe(conn, room)
+			if err == nil {
+				err = wss.bs.subscribe(conn, room)
+			}
+
+			if err != nil {
+				codec.log.Warn("joining room from upgrade path", zap.String("room", route.room), zap.Error(err))
+				_ = writeClose(conn, closeRejected, err.Error())
+
+				return gnet.Close
+			}
+		}
+
+		if err := wss.writeEndpointHints(conn, frameWelcome, codec.id); err != nil {
+			codec.log.Warn("writing welcome", zap.Error(err))
+
+			return gnet.Close
+		}
 	}
 
-	msg, op, err := wsutil.ReadClientData(conn)
-	if err != nil {
-		if _, ok := err.(wsutil.ClosedError); !ok {
-			logging.Warnf("conn[%v] [err=%v]", conn.RemoteAddr().String(), err.Error())
+	// Loop-affine deliveries wake connections with nothing to read; that
+	// is not activity.
+	if conn.InboundBuffered() > 0 {
+		atomic.StoreInt64(&codec.atomicLastActive, time.Now().UnixNano())
+	}
+
+	for {
+		msg, op, ok, err := codec.readMessage(conn, wss.maxMessageSize, wss.skipUTF8)
+		if err != nil {
+			if _, ok := err.(wsutil.ClosedError); !ok {
+				codec.log.Warn("reading client data", zap.Error(err))
+			}
+
+			if reason, detail, ok := failureClose(err); ok {
+				_ = writeClose(conn, reason, detail)
+			}
+
+			return gnet.Close
 		}
 
-		return gnet.Close
+		if !ok {
+			return gnet.None
+		}
+
+		err = wss.handleMessage(conn, codec, op, msg)
+		framePool.put(msg)
+
+		if err != nil {
+			codec.log.Warn("handling message", zap.Error(err))
+
+			return gnet.Close
+		}
 	}
+}
 
-	logging.Infof("conn[%v] receive [op=%v] [msg=%v]", conn.RemoteAddr().String(), op, string(msg))
+func (wss *wsServer) handleMessage(conn gnet.Conn, codec *wsCodec, op ws.OpCode, msg []byte) error {
+	var err error
 
-	err = wss.bs.broadcastMessage(op, msg)
+	atomic.AddUint64(&codec.counters.received, 1)
 
-	if err != nil {
-		logging.Warnf("conn[%v] [err=%v]", conn.RemoteAddr().String(), err.Error())
+	in := &inboundMessage{op: op, payload: msg}
+	if frame, ok := parseControlFrame(encodingOf(conn), op, msg); ok {
+		if frame.Room != "" {
+			frame.Room = tenantRoom(codec.tenant, frame.Room)
+		}
 
-		return gnet.Close
+		in.frame = &frame
 	}
 
-	return gnet.None
+	if err := wss.bs.middleware.message(codec.ctx, conn, in); err != nil {
+		if errors.Is(err, errDropped) {
+			return nil
+		}
+
+		var id string
+		if in.frame != nil {
+			id = in.frame.ID
+		}
+
+		return writeControlError(conn, id, err.Error())
+	}
+
+	if frame := in.frame; frame != nil {
+		codec.msgLog.Info("control frame received",
+			zap.String("type", frame.Type), zap.String("room", frame.Room), zap.Int("size", len(msg)))
+
+		err = wss.handleControlFrame(codec.ctx, conn, *frame)
+	} else if handled, rawErr := wss.bs.clientRaw(conn, in.op, in.payload); handled {
+		err = rawErr
+	} else if !wss.bs.rawBroadcast {
+		err = writeControlError(conn, "", "not a protocol envelope; raw broadcast is disabled")
+	} else if permitErr := wss.permit(conn, capPublish); permitErr != nil {
+		err = writeControlError(conn, "", fmt.Sprintf("broadcast: %v", permitErr))
+	} else if rateErr := wss.bs.tenants.publish(codec.tenant); rateErr != nil {
+		err = writeControlError(conn, "", fmt.Sprintf("broadcast: %v", rateErr))
+	} else {
+		codec.msgLog.Info("message received", zap.Uint8("op", byte(in.op)), zap.Int("size", len(in.payload)))
+
+		err = wss.bs.clientBroadcast(conn, in.op, in.payload)
+		wss.bs.msgAudit.record(connSource(conn), broadcastRoomName, 0, in.payload, err)
+	}
+
+	return err
 }
 
 func (wss *wsServer) OnTick() (time.Duration, gnet.Action) {
-	logging.Infof("[connected-count=%v]", atomic.LoadInt64(&wss.atomicNumberOfConnections))
-
-	wss.bs.broadcastMessage(ws.OpText, []byte("system: This is a broadcasted system message!"))
+	wss.logger.Info("tick", zap.Int64("connected_count", atomic.LoadInt64(&wss.atomicNumberOfConnections)))
 
 	return 3 * time.Second, gnet.None
 }
 
+func splitList(s string) []string {
+	var items []string
+
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+
+	return items
+}
+
 func main() {
-	var port int
+	cmd, args := "serve", os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		cmd, args = args[0], args[1:]
+	}
 
-	flag.IntVar(&port, "port", 9000, "server port")
-	flag.Parse()
+	switch cmd {
+	case "serve":
+		runServe(args)
+	case "publish":
+		os.Exit(runPublish(args))
+	case "admin":
+		os.Exit(runAdmin(args))
+	case "bench":
+		os.Exit(runBench(args))
+	case "help":
+		fmt.Print(usage)
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n%s", cmd, usage)
+		os.Exit(2)
+	}
+}
+
+// runServe runs the server; it is what wsb does without a subcommand.
+func runServe(args []string) {
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+
+	var (
+		port, healthPort, grpcPort    int
+		debugAddr                     string
+		maxConnections                int64
+		upgradeRate, upgradeRateStart float64
+		upgradeRamp                   time.Duration
+		maxMessageSize                int64
+		skipUTF8                      bool
+		maxPerIP                      int
+		perIPExempt                   string
+		ipAllow, ipDeny, ipFilterFile string
+		geoIPFile                     string
+		drainTimeout, idleTimeout     time.Duration
+		handshakeTimeout              time.Duration
+		banFile                       string
+		roomACLFile                   string
+		controlSocket                 string
+		takeover                      bool
+		rssBudgetMB                   uint64
+		cpuBudget                     float64
+		guardInterval                 time.Duration
+		coalesceInterval              time.Duration
+		advertiseURL, peers           string
+		migrationToken                string
+		clusterAddr, clusterPeers     string
+		clusterToken                  string
+		clusterWindow, clusterBuffer  int
+		peerPollInterval              time.Duration
+		admin                         adminServer
+		historyDepth, pauseBufferSize int
+		maxRooms, maxRoomMembers      int
+		emptyRoomTTL                  time.Duration
+		fanoutWorkers, fanoutMin      int
+		confidentialRooms             string
+		retainedRooms, stateRooms     string
+		roomOrdering, defaultOrdering string
+		roomRetention                 string
+		historyMaxAge, compactEvery   time.Duration
+		historyMaxBytes               int
+		logCfg                        logConfig
+		msgAudit                      messageAuditConfig
+		configPath                    string
+		publishTokensFile             string
+		rawBroadcast                  bool
+		mode                          string
+		auditLog                      string
+		qosTTL                        time.Duration
+		dedupSize                     int
+		presence                      bool
+		presenceDebounce              time.Duration
+		heartbeatAway                 time.Duration
+		requestTimeout                time.Duration
+		scheduleMaxDelay              time.Duration
+		scheduleFile                  string
+		maxScheduled                  int
+		heartbeatOffline              time.Duration
+		wasmPluginFiles               string
+		luaScript                     string
+		transformKeys                 string
+		contentFilters                string
+		luaTimeout                    time.Duration
+		wasmTimeout                   time.Duration
+		webhookURL, webhookSecret     string
+		webhookEvents                 string
+		webhookQueue, webhookRetries  int
+		transportAddr                 string
+		wtAddr, wtCert, wtKey         string
+		tcpAddr, tcpFraming           string
+		tcpCert, tcpKey               string
+		clientCA, clientCertCaps      string
+		clientCertRequired            bool
+		sseBuffer                     int
+		jwtSecret, jwtPublicKey       string
+		jwtIssuer, jwtAudience        string
+		jwtRoles, jwtTenantClaim      string
+		multiTenant                   bool
+		tenantDefaults                tenantQuota
+		tenantQuotas                  string
+		roomBandwidth, bandwidthMode  string
+		bandwidthWindow               time.Duration
+		sessionCookie, sessionSecret  string
+		listen                        string
+		standby                       standbyReplicator
+		standbyURL                    string
+		soak                          soakRunner
+		announcementsFile             string
+	)
+
+	fs.StringVar(&configPath, "config", "", "JSON config file keyed by flag name; flags override WSB_* environment variables, which override the file")
+
+	fs.IntVar(&port, "port", 9000, "server port")
+	fs.StringVar(&listen, "listen", "", "comma-separated extra listeners sharing the hub, e.g. tcp6://[::1]:9000,unix:///var/run/wsb.sock")
+	fs.Int64Var(&maxConnections, "max-connections", 0, "open connections beyond which upgrades are answered 503, 0 is unlimited")
+	fs.Float64Var(&upgradeRate, "upgrade-rate", 0, "upgrades admitted per second, beyond which they are answered 503 with a spread-out Retry-After so reconnect storms are smoothed; 0 is unlimited")
+	fs.Float64Var(&upgradeRateStart, "upgrade-rate-start", 0, "upgrades per second admitted right after starting or being promoted, rising to -upgrade-rate over -upgrade-ramp; 0 starts at -upgrade-rate")
+	fs.DurationVar(&upgradeRamp, "upgrade-ramp", 30*time.Second, "how long the upgrade rate takes to rise from -upgrade-rate-start to -upgrade-rate")
+	fs.IntVar(&maxPerIP, "max-connections-per-ip", 0, "open connections per source IP beyond which upgrades are answered 429, 0 is unlimited")
+	fs.StringVar(&perIPExempt, "per-ip-exempt", "", "comma-separated CIDRs exempt from -max-connections-per-ip, such as trusted proxies")
+	fs.StringVar(&ipAllow, "ip-allow", "", "comma-separated CIDRs that alone may connect; empty allows every address not denied")
+	fs.StringVar(&ipDeny, "ip-deny", "", "comma-separated CIDRs refused before the handshake")
+	fs.StringVar(&roomACLFile, "room-acls", "", "JSON file of room ACLs deciding who may subscribe and publish; edits through the admin API are written back to it")
+	fs.StringVar(&banFile, "ban-file", "", "JSON file user and IP bans made through the admin API are kept in, so they survive restarts")
+	fs.StringVar(&geoIPFile, "geoip-db", "", "MaxMind GeoIP2 or GeoLite2 City or Country database; connections are tagged with their country, region and continent, reopened on reload")
+	fs.StringVar(&ipFilterFile, "ip-filter-file", "", "JSON file the allow and deny lists are persisted to when edited through the admin API; once it exists it replaces -ip-allow and -ip-deny")
+	fs.IntVar(&healthPort, "health-port", 9001, "health and readiness probe port, 0 disables")
+	fs.StringVar(&debugAddr, "debug-addr", "", "diagnostics listener serving pprof, goroutine dumps and a hub state dump, guarded by the admin credentials when set, e.g. 127.0.0.1:9003; empty disables")
+	fs.StringVar(&admin.addr, "admin-addr", "", "admin, metrics and debug listener address, e.g. 127.0.0.1:9002; empty disables")
+	fs.StringVar(&admin.tlsCert, "admin-tls-cert", "", "TLS certificate for the admin listener; reloadable")
+	fs.StringVar(&admin.tlsKey, "admin-tls-key", "", "TLS key for the admin listener")
+	fs.StringVar(&admin.auth.token, "admin-token", "", "bearer token accepted by the admin listener and gRPC control plane")
+	fs.StringVar(&admin.auth.user, "admin-user", "", "basic-auth user accepted by the admin listener")
+	fs.StringVar(&admin.auth.password, "admin-password", "", "basic-auth password accepted by the admin listener")
+	fs.StringVar(&publishTokensFile, "publish-tokens", "", "JSON file of tenant- and room-scoped tokens allowed only to publish through the admin /broadcast and /publish endpoints")
+	fs.StringVar(&sessionCookie, "session-cookie", "wsb_session", "cookie carrying the HMAC-signed session that authenticates upgrades")
+	fs.StringVar(&sessionSecret, "session-secret", "", "HMAC-SHA256 secret session cookies are signed with; requires a valid session on every upgrade, empty disables")
+	fs.StringVar(&jwtSecret, "jwt-secret", "", "HS256 secret JWT bearer tokens are signed with; requires a valid token on every upgrade and enforces -jwt-roles")
+	fs.StringVar(&jwtPublicKey, "jwt-public-key", "", "PEM file of the RSA key RS256 JWT bearer tokens are verified with; like -jwt-secret")
+	fs.StringVar(&jwtIssuer, "jwt-issuer", "", "iss claim JWTs must carry; empty accepts any")
+	fs.StringVar(&jwtAudience, "jwt-audience", "", "aud claim JWTs must include; empty accepts any")
+	fs.StringVar(&jwtTenantClaim, "jwt-tenant-claim", "", "JWT claim naming the connection's tenant under -multi-tenant, which then need not be in the upgrade path")
+	fs.StringVar(&jwtRoles, "jwt-roles", "publish=publish,subscribe=subscribe,admin=admin+publish+subscribe", "comma-separated role=capabilities pairs mapping JWT roles and scopes to publish, subscribe and admin, joined by +")
+	fs.StringVar(&auditLog, "audit-log", "", "file admin audit entries are appended to as JSON lines; empty logs them with the process log")
+	fs.StringVar(&msgAudit.file, "message-audit-log", "", "file every inbound publish, from clients, the admin API or gRPC, is appended to as JSON lines, with transport, connection, user, room and size; empty disables")
+	fs.StringVar(&msgAudit.payload, "message-audit-payload", "hash", "what -message-audit-log records of each payload: hash (SHA-256) or full")
+	fs.IntVar(&msgAudit.maxSizeMB, "message-audit-max-size", 100, "megabytes -message-audit-log grows to before it is rotated")
+	fs.IntVar(&msgAudit.maxBackups, "message-audit-max-backups", 0, "rotated message audit files kept, 0 keeps all")
+	fs.IntVar(&msgAudit.maxAgeDays, "message-audit-max-age", 0, "days rotated message audit files are kept, 0 keeps them regardless of age")
+	fs.BoolVar(&msgAudit.compress, "message-audit-compress", true, "gzip rotated message audit files")
+	fs.IntVar(&grpcPort, "grpc-port", 0, "gRPC control plane port, 0 disables")
+	fs.DurationVar(&drainTimeout, "drain-timeout", 10*time.Second, "how long to wait for clients to disconnect on shutdown")
+	fs.DurationVar(&idleTimeout, "idle-timeout", 0, "close connections that send nothing, not even a pong to the server's pings, for this long; 0 disables")
+	fs.Int64Var(&maxMessageSize, "max-message-size", 1<<20, "largest inbound message in bytes, fragmented ones counted whole; bigger ones close the connection with 1009, 0 is unlimited")
+	fs.BoolVar(&skipUTF8, "skip-utf8-validation", false, "trust text messages to be UTF-8 instead of closing with 1007 on invalid ones, for trusted internal clients")
+	fs.DurationVar(&handshakeTimeout, "handshake-timeout", 10*time.Second, "close connections that have not completed the websocket upgrade this long after connecting; 0 disables")
+	fs.StringVar(&controlSocket, "control-socket", "", "unix socket used to coordinate zero-downtime restarts")
+	fs.BoolVar(&takeover, "takeover", false, "take over the port from the process serving -control-socket, which then drains and exits")
+	fs.StringVar(&advertiseURL, "advertise-url", "", "public websocket URL of this node; enables welcome and reconnect endpoint hints")
+	fs.StringVar(&peers, "peers", "", "comma-separated health listener URLs of peer nodes, e.g. http://node2:9001")
+	fs.DurationVar(&peerPollInterval, "peer-poll-interval", 5*time.Second, "how often peer load is polled")
+	fs.StringVar(&standby.primary, "standby-of", "", "admin URL of the primary to replicate from as a warm standby, e.g. https://primary:9002")
+	fs.StringVar(&standby.token, "standby-token", "", "admin bearer token of the primary, defaults to -admin-token")
+	fs.DurationVar(&standby.interval, "replication-interval", time.Second, "how often a standby copies state from its primary")
+	fs.IntVar(&standby.failoverAfter, "failover-after", 3, "failed replication polls in a row before a standby promotes itself, 0 only promotes manually or when the primary drains")
+	fs.StringVar(&standbyURL, "standby-url", "", "public websocket URL of this node's warm standby, advertised first in reconnect frames")
+	fs.StringVar(&clusterAddr, "cluster-addr", "", "address peer nodes replicate room publishes to, e.g. :9004; empty disables cluster mode")
+	fs.StringVar(&clusterPeers, "cluster-peers", "", "comma-separated -cluster-addr of the other nodes, every room publish here is replicated to")
+	fs.StringVar(&clusterToken, "cluster-token", "", "shared secret cluster links authenticate with")
+	fs.IntVar(&clusterWindow, "cluster-window", 256, "messages per peer sent and not acknowledged yet before sending waits")
+	fs.IntVar(&clusterBuffer, "cluster-buffer", 65536, "messages queued per peer beyond which the oldest are dropped")
+	fs.StringVar(&migrationToken, "migration-token", "", "admin bearer token of the peers rooms are migrated to, defaults to -admin-token")
+	fs.Uint64Var(&rssBudgetMB, "rss-budget-mb", 0, "resident memory budget in MiB before load shedding starts, 0 disables")
+	fs.Float64Var(&cpuBudget, "cpu-budget", 0, "CPU budget in percent of one core before load shedding starts, 0 disables")
+	fs.DurationVar(&guardInterval, "guard-interval", time.Second, "how often memory and CPU are sampled against their budgets")
+	fs.DurationVar(&coalesceInterval, "coalesce-interval", 100*time.Millisecond, "delivery interval for conflated room messages while shedding")
+	fs.StringVar(&announcementsFile, "announcements", "", "JSON file of scheduled announcements, each with a name, a cron or \"@every <duration>\" schedule, an optional room and a payload template; without one the server sends none")
+	fs.StringVar(&mode, "mode", string(modeBroadcast), "what to do with messages from clients: broadcast them, echo them to the sender only, or sink them, accepting them for the message hooks alone; reloadable")
+	fs.BoolVar(&rawBroadcast, "raw-broadcast", false, "broadcast messages that are not protocol envelopes to every connection, as before rooms existed")
+	fs.DurationVar(&qosTTL, "qos-ttl", 5*time.Minute, "how long QoS messages are redelivered to subscribers that have not acked them, 0 disables QoS")
+	fs.BoolVar(&presence, "presence", true, "announce room joins and leaves to members and answer who requests")
+	fs.DurationVar(&presenceDebounce, "presence-debounce", 2*time.Second, "how long a member may be gone before its leave is announced, so quick reconnects stay quiet")
+	fs.DurationVar(&heartbeatAway, "heartbeat-away", 0, "accept heartbeat frames and report members that stop sending them for this long as away, to presence, who and webhooks; 0 disables")
+	fs.DurationVar(&scheduleMaxDelay, "schedule-max-delay", 24*time.Hour, "furthest ahead an authenticated publisher may schedule a message with deliver_at or delay_ms; 0 disables scheduled delivery")
+	fs.StringVar(&scheduleFile, "schedule-file", "", "JSON file pending scheduled messages are persisted to, so they survive restarts")
+	fs.IntVar(&maxScheduled, "max-scheduled", 10000, "scheduled messages pending at once, 0 is unlimited")
+	fs.DurationVar(&requestTimeout, "request-timeout", 30*time.Second, "longest a request frame waits for its reply, and how long when it sets no timeout_ms; 0 disables requests")
+	fs.DurationVar(&heartbeatOffline, "heartbeat-offline", 2*time.Minute, "how long heartbeats may stop before a member is reported offline, longer than -heartbeat-away")
+	fs.StringVar(&wasmPluginFiles, "wasm-plugins", "", "comma-separated WASM modules run in order over every broadcast to filter or rewrite it; reloadable")
+	fs.DurationVar(&wasmTimeout, "wasm-timeout", 50*time.Millisecond, "how long each WASM plugin may run per broadcast before it fails it, 0 is unlimited")
+	fs.StringVar(&contentFilters, "content-filters", "", "JSON file of keyword and regex rules that drop or redact client publishes before they reach anyone, and the deepest JSON nesting allowed")
+	fs.StringVar(&luaScript, "lua-script", "", "Lua script whose route function decides where inbound publishes and raw messages go, and whose deliver function transforms room messages per recipient; reloadable")
+	fs.StringVar(&transformKeys, "transform-keys", "", "comma-separated connection tags per-recipient transforms depend on, e.g. role,lang; recipients agreeing on them share one transformed message, empty disables transforms")
+	fs.DurationVar(&luaTimeout, "lua-timeout", 50*time.Millisecond, "how long the Lua route function may run per message")
+	fs.StringVar(&webhookURL, "webhook-url", "", "URL lifecycle events are POSTed to as JSON; empty disables webhooks")
+	fs.StringVar(&webhookSecret, "webhook-secret", "", "HMAC-SHA256 key webhook requests are signed with")
+	fs.StringVar(&webhookEvents, "webhook-events", "connect,authenticated,disconnect", "comma-separated webhook events: connect, authenticated, disconnect, message, presence")
+	fs.IntVar(&webhookQueue, "webhook-queue", 1000, "webhook events held while the backend is slow before new ones are dropped")
+	fs.IntVar(&webhookRetries, "webhook-retries", 5, "times a failed webhook post is retried with exponential backoff")
+	fs.StringVar(&transportAddr, "transport-addr", "", "listener for clients without websockets: Server-Sent Events on /events and long-polling on /poll, under /t/{tenant}/ with -multi-tenant, e.g. :9003; empty disables")
+	fs.StringVar(&wtAddr, "webtransport-addr", "", "UDP listener for WebTransport over HTTP/3 on /wt, e.g. :9443; empty disables")
+	fs.StringVar(&wtCert, "webtransport-cert", "", "TLS certificate for -webtransport-addr, which QUIC requires; reloadable")
+	fs.StringVar(&wtKey, "webtransport-key", "", "TLS key for -webtransport-addr")
+	fs.StringVar(&tcpAddr, "tcp-addr", "", "listener for plain TCP clients speaking JSON control frames, for devices and scripts without websockets, e.g. :9004; empty disables")
+	fs.StringVar(&tcpFraming, "tcp-framing", "line", "how -tcp-addr delimits frames: line for one per line, length for a 4-byte big-endian length before each")
+	fs.StringVar(&tcpCert, "tcp-tls-cert", "", "TLS certificate that makes -tcp-addr speak TLS; reloadable")
+	fs.StringVar(&tcpKey, "tcp-tls-key", "", "TLS key for -tcp-tls-cert")
+	fs.StringVar(&clientCA, "tls-client-ca", "", "PEM CA bundle client certificates on -webtransport-addr and a TLS -tcp-addr are verified against; a verified client is authenticated as its certificate's CN or SAN without a token")
+	fs.BoolVar(&clientCertRequired, "tls-client-cert-required", false, "refuse TLS clients without a certificate -tls-client-ca verifies, rather than falling back to the upgrade hook")
+	fs.StringVar(&clientCertCaps, "tls-client-capabilities", "publish+subscribe", "capabilities clients authenticated by certificate hold, joined by +")
+	fs.IntVar(&sseBuffer, "sse-buffer", 256, "events an SSE client may fall behind by before it is disconnected")
+	fs.IntVar(&dedupSize, "dedup-size", 10000, "recent publish idempotency keys remembered across all publishers, 0 disables deduplication")
+	fs.IntVar(&fanoutWorkers, "fanout-workers", 0, "goroutines large broadcasts are written from in parallel, 0 or 1 writes from the publisher alone")
+	fs.IntVar(&fanoutMin, "fanout-parallel-min", 1000, "recipients a broadcast needs before it is split across -fanout-workers")
+	fs.IntVar(&historyDepth, "history-depth", 128, "messages kept per room for resume catch-up")
+	fs.DurationVar(&historyMaxAge, "history-max-age", 0, "drop history older than this from every room, 0 keeps it until -history-depth pushes it out")
+	fs.IntVar(&historyMaxBytes, "history-max-bytes", 0, "payload bytes of history kept per room, 0 is unlimited")
+	fs.StringVar(&roomRetention, "room-retention", "", "comma-separated pattern=limits rules overriding history retention per room, limits being messages:N;age:D;bytes:N, e.g. audit.*=age:720h;messages:100000")
+	fs.DurationVar(&compactEvery, "history-compact-interval", 30*time.Second, "how often history is trimmed to its retention limits in rooms nobody publishes to")
+	fs.IntVar(&pauseBufferSize, "pause-buffer", 256, "messages buffered per paused subscription")
+	fs.IntVar(&maxRooms, "max-rooms", 0, "rooms the hub holds at once; joining or opening another fails, 0 is unlimited")
+	fs.IntVar(&maxRoomMembers, "max-room-members", 0, "members per room beyond which subscribing fails, 0 is unlimited")
+	fs.BoolVar(&multiTenant, "multi-tenant", false, "isolate rooms, presence, history and metrics per tenant, named by -jwt-tenant-claim or an upgrade path under /t/{tenant}/")
+	fs.IntVar(&tenantDefaults.MaxConnections, "tenant-max-connections", 0, "connections per tenant under -multi-tenant, 0 is unlimited")
+	fs.Float64Var(&tenantDefaults.PublishRate, "tenant-publish-rate", 0, "client publishes per second per tenant under -multi-tenant, 0 is unlimited")
+	fs.Int64Var(&tenantDefaults.Bandwidth, "tenant-bandwidth", 0, "bytes per second each tenant may broadcast under -multi-tenant, payload times recipients, 0 is unlimited")
+	fs.StringVar(&tenantQuotas, "tenant-quotas", "", "comma-separated pattern=limits rules overriding tenant quotas, limits being conns:N;rate:R;bw:B, e.g. trial-*=conns:10;rate:5;bw:100000")
+	fs.StringVar(&roomBandwidth, "room-bandwidth", "", "comma-separated pattern=bytes rules bounding the bytes per second a room broadcasts, payload times recipients, e.g. video.*=5000000")
+	fs.DurationVar(&bandwidthWindow, "bandwidth-window", 10*time.Second, "sliding window bandwidth quotas are metered over")
+	fs.StringVar(&bandwidthMode, "bandwidth-action", bandwidthReject, "what happens to publishes over a bandwidth quota: reject refuses them, throttle delivers only the latest every -coalesce-interval")
+	fs.DurationVar(&emptyRoomTTL, "empty-room-ttl", 0, "delete rooms, history and sequence numbers included, once they have had no members or transport clients for this long; 0 keeps them")
+	fs.StringVar(&roomOrdering, "room-ordering", "", "comma-separated pattern=mode rules choosing room ordering (strict, fifo, unordered), e.g. orders.*=strict")
+	fs.StringVar(&defaultOrdering, "default-ordering", string(orderFIFO), "ordering of rooms no -room-ordering rule matches")
+	fs.StringVar(&retainedRooms, "retained-rooms", "", "comma-separated room name patterns that keep their last message and deliver it to new subscribers straight away")
+	fs.StringVar(&stateRooms, "state-rooms", "", "comma-separated room name patterns whose publishes are whole JSON documents, delivered as merge-patch deltas with the whole document going to new subscribers only")
+	fs.StringVar(&confidentialRooms, "confidential-rooms", "", "comma-separated room name patterns whose members receive a rotating room key")
+	fs.IntVar(&soak.subscribers, "soak-subscribers", 0, "synthetic in-process subscribers to run against this server, for soak testing")
+	fs.IntVar(&soak.publishers, "soak-publishers", 0, "synthetic in-process publishers to run against this server, for soak testing")
+	fs.Float64Var(&soak.rate, "soak-rate", 10, "messages per second sent by each soak publisher")
+	fs.IntVar(&soak.size, "soak-size", 256, "approximate payload size in bytes of soak messages")
+	fs.StringVar(&soak.room, "soak-room", "soak", "room soak clients publish to and subscribe to")
+	fs.StringVar(&soak.pattern, "soak-pattern", soakSteady, "soak publishing pattern: steady, or burst, which sends whole bursts averaging -soak-rate")
+	fs.DurationVar(&soak.churn, "soak-churn", 0, "reconnect soak subscribers after a random lifetime up to this long, 0 keeps them connected")
+	fs.DurationVar(&soak.reportInterval, "soak-report-interval", 10*time.Second, "how often soak progress is logged")
+	fs.StringVar(&logCfg.level, "log-level", "info", "log level (debug, info, warn, error)")
+	fs.IntVar(&logCfg.sampleFirst, "log-sample-first", 100, "per-message log lines logged each second before sampling kicks in, 0 disables sampling")
+	fs.IntVar(&logCfg.sampleThereafter, "log-sample-thereafter", 100, "once sampling, log every Nth per-message line")
+	_ = fs.Parse(args)
+
+	config, err := loadConfig(fs, configPath)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	logger, msgLogger, logLevel, err := newLogger(logCfg)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	defer logger.Sync()
 
 	bs := &broadcastService{
-		connections: make(map[gnet.Conn]struct{}),
+		connections:       make(map[gnet.Conn]*trackedConnection),
+		rooms:             make(map[string]*room),
+		tagIndex:          make(map[string]map[gnet.Conn]struct{}),
+		rawBroadcast:      rawBroadcast,
+		historyDepth:      historyDepth,
+		pauseBufferSize:   pauseBufferSize,
+		maxRooms:          maxRooms,
+		maxRoomMembers:    maxRoomMembers,
+		confidentialRooms: splitList(confidentialRooms),
+		retainedRooms:     splitList(retainedRooms),
+		stateRooms:        splitList(stateRooms),
+		transformKeys:     splitList(transformKeys),
+		coalesced:         &coalescer{pending: make(map[string]roomMessage)},
+	}
+
+	if multiTenant {
+		rules, err := parseTenantQuotas(tenantQuotas, tenantDefaults)
+		if err != nil {
+			logger.Fatal("invalid -tenant-quotas", zap.Error(err))
+		}
+
+		bs.tenants = &tenantRegistry{
+			defaults: tenantDefaults,
+			rules:    rules,
+			totals:   &bs.roomTotals,
+			tenants:  make(map[string]*tenantState),
+		}
+		namespacedRooms = true
+	}
+
+	roomBandwidthRules, err := parseBandwidthRules(roomBandwidth)
+	if err != nil {
+		logger.Fatal("invalid -room-bandwidth", zap.Error(err))
+	}
+
+	if bandwidthMode != bandwidthReject && bandwidthMode != bandwidthThrottle {
+		logger.Fatal("invalid -bandwidth-action", zap.String("action", bandwidthMode))
+	}
+
+	if len(roomBandwidthRules) > 0 || bs.tenants != nil {
+		bs.bandwidth = &bandwidthQuotas{
+			window: bandwidthWindow,
+			action: bandwidthMode,
+			rooms:  roomBandwidthRules,
+			meters: make(map[string]*bandwidthMeter),
+		}
+
+		if bs.tenants != nil {
+			bs.bandwidth.tenantRate = bs.tenants.bandwidthOf
+		}
+	}
+
+	initialMode, err := parseHubMode(mode)
+	if err != nil {
+		logger.Fatal("invalid -mode", zap.Error(err))
+	}
+
+	bs.setMode(initialMode)
+
+	plugins := &wasmPlugins{timeout: wasmTimeout, logger: logger}
+	if err := plugins.load(context.Background(), splitList(wasmPluginFiles)); err != nil {
+		logger.Fatal("loading wasm plugins", zap.Error(err))
+	}
+
+	router := &luaRouter{timeout: luaTimeout, bs: bs, logger: logger}
+	if err := router.load(luaScript); err != nil {
+		logger.Fatal("loading lua script", zap.Error(err))
+	}
+
+	bs.middleware = append(middlewareChain{}, middlewares...)
+
+	if contentFilters != "" {
+		filter, err := loadContentFilter(contentFilters, logger)
+		if err != nil {
+			logger.Fatal("loading content filters", zap.Error(err))
+		}
+
+		bs.middleware = append(bs.middleware, filter.middleware())
+	}
+
+	bs.middleware = append(bs.middleware, router.middleware(), plugins.middleware())
+
+	if scheduleMaxDelay > 0 {
+		if bs.scheduler, err = loadScheduler(scheduleFile, scheduleMaxDelay, maxScheduled, logger); err != nil {
+			logger.Fatal("loading scheduled messages", zap.Error(err))
+		}
+
+		bs.scheduler.publish = bs.publishScheduled
+		// A standby's wheel waits for promotion.
+		bs.scheduler.hold(standby.primary != "")
+
+		go bs.scheduler.run()
+	}
+
+	if requestTimeout > 0 {
+		bs.requests = newRequestRouter(requestTimeout)
+	}
+
+	if heartbeatAway > 0 {
+		if bs.lastSeen, err = newLastSeenRegistry(heartbeatAway, heartbeatOffline, logger); err != nil {
+			logger.Fatal("invalid -heartbeat-offline", zap.Error(err))
+		}
+
+		go bs.watchLastSeen()
+	}
+
+	if webhookURL != "" {
+		webhooks, err := newWebhookSender(webhookURL, webhookSecret, splitList(webhookEvents), webhookQueue, webhookRetries, logger)
+		if err != nil {
+			logger.Fatal("invalid -webhook-events", zap.Error(err))
+		}
+
+		bs.middleware = append(bs.middleware, webhooks.middleware())
+
+		if webhooks.events[webhookMessage] {
+			if _, err := bs.registerHook(context.Background(), "webhook", webhooks, nil, logger); err != nil {
+				logger.Fatal("registering webhook", zap.Error(err))
+			}
+		}
+
+		if bs.lastSeen != nil && webhooks.events[webhookPresence] {
+			bs.lastSeen.onStatus = webhooks.onStatus
+		}
+
+		go webhooks.run()
+	}
+
+	if fanoutWorkers > 1 {
+		bs.fanout = newFanoutPool(fanoutWorkers, fanoutMin)
+	}
+
+	if presence {
+		bs.presence = newPresenceTracker(presenceDebounce, logger)
+	}
+
+	if dedupSize > 0 {
+		bs.dedup = newDedupCache(dedupSize)
+	}
+
+	if qosTTL > 0 {
+		bs.qos = &qosTracker{ttl: qosTTL, logger: logger, messages: make(map[string]*qosMessage)}
+
+		go bs.qos.run(bs)
+	}
+
+	if bs.orderingRules, err = parseOrderingRules(roomOrdering); err != nil {
+		logger.Fatal("invalid -room-ordering", zap.Error(err))
+	}
+
+	if bs.defaultOrdering, err = parseOrderingMode(defaultOrdering); err != nil {
+		logger.Fatal("invalid -default-ordering", zap.Error(err))
+	}
+
+	bs.retention = retentionPolicy{maxMessages: historyDepth, maxAge: historyMaxAge, maxBytes: historyMaxBytes}
+	if bs.retentionRules, err = parseRetentionRules(roomRetention, bs.retention); err != nil {
+		logger.Fatal("invalid -room-retention", zap.Error(err))
+	}
+
+	if compactEvery > 0 {
+		go bs.compactHistory(compactEvery, logger)
+	}
+
+	if emptyRoomTTL > 0 {
+		go bs.reapRooms(emptyRoomTTL, logger)
+	}
+
+	go bs.sampleRates()
+	expvar.Publish("wsb", expvar.Func(func() interface{} { return bs.runtimeStats() }))
+
+	if rssBudgetMB > 0 || cpuBudget > 0 {
+		if guardInterval <= 0 {
+			logger.Fatal("-guard-interval must be positive", zap.Duration("guard_interval", guardInterval))
+		}
+
+		bs.shed = &loadShedder{
+			rssBudget: rssBudgetMB << 20,
+			cpuBudget: cpuBudget,
+			interval:  guardInterval,
+			logger:    logger,
+		}
+
+		go bs.shed.run()
+	}
+
+	if bs.shed != nil || bs.bandwidth.throttles() {
+		if coalesceInterval <= 0 {
+			logger.Fatal("-coalesce-interval must be positive", zap.Duration("coalesce_interval", coalesceInterval))
+		}
+
+		go bs.flushCoalesced(coalesceInterval)
 	}
 
 	wss := &wsServer{
-		addr: fmt.Sprintf("tcp://0.0.0.0:%d", port),
-		bs:   bs,
-	}
-
-	log.Println(
-		"server exits:",
-		gnet.Run(
-			wss,
-			wss.addr,
-			gnet.WithMulticore(true),
-			gnet.WithReusePort(true),
-			gnet.WithTicker(true),
-		),
-	)
+		addrs:            append([]string{fmt.Sprintf("tcp://0.0.0.0:%d", port)}, splitList(listen)...),
+		port:             port,
+		bs:               bs,
+		drainTimeout:     drainTimeout,
+		idleTimeout:      idleTimeout,
+		handshakeTimeout: handshakeTimeout,
+		controlSocket:    controlSocket,
+		takeover:         takeover,
+		advertiseURL:     advertiseURL,
+		standbyURL:       standbyURL,
+		maxConnections:   maxConnections,
+		maxMessageSize:   maxMessageSize,
+		skipUTF8:         skipUTF8,
+		logger:           logger,
+		msgLogger:        msgLogger,
+	}
+
+	if upgradeRate > 0 {
+		wss.throttle = newUpgradeThrottle(upgradeRateStart, upgradeRate, upgradeRamp)
+	}
+
+	if bs.msgAudit, err = newMessageAuditor(msgAudit); err != nil {
+		logger.Fatal("opening message audit log", zap.Error(err))
+	}
+
+	if standby.primary != "" {
+		if standby.token == "" {
+			standby.token = admin.auth.token
+		}
+
+		if standby.token == "" {
+			logger.Fatal("-standby-of requires -standby-token or -admin-token")
+		}
+
+		standby.client = &http.Client{}
+		standby.wss = wss
+		standby.logger = logger
+		atomic.StoreInt32(&wss.atomicStandby, 1)
+
+		go standby.run()
+	}
+
+	if clusterAddr != "" {
+		if clusterToken == "" {
+			logger.Fatal("-cluster-addr requires -cluster-token")
+		}
+
+		if clusterWindow < 1 || clusterBuffer < 1 {
+			logger.Fatal("-cluster-window and -cluster-buffer must be positive")
+		}
+
+		ln, err := net.Listen("tcp", clusterAddr)
+		if err != nil {
+			logger.Fatal("listening on -cluster-addr", zap.Error(err))
+		}
+
+		bs.cluster = newClusterMesh(splitList(clusterPeers), clusterToken, clusterWindow, clusterBuffer, bs, logger)
+
+		go bs.cluster.serve(ln)
+
+		for _, p := range bs.cluster.peers {
+			go p.run()
+		}
+	}
+
+	if wss.ipFilter, err = newIPFilter(ipFilterFile, ipAllow, ipDeny); err != nil {
+		logger.Fatal("loading ip filter", zap.Error(err))
+	}
+
+	if geoIPFile != "" {
+		wss.geo = &geoIP{}
+		if err := wss.geo.load(geoIPFile); err != nil {
+			logger.Fatal("loading -geoip-db", zap.Error(err))
+		}
+
+		bs.reservedTags = append(bs.reservedTags, geoTags...)
+	}
+
+	if wss.bans, err = loadBanList(banFile); err != nil {
+		logger.Fatal("loading bans", zap.Error(err))
+	}
+
+	if wss.acls, err = loadRoomACLs(roomACLFile); err != nil {
+		logger.Fatal("loading room ACLs", zap.Error(err))
+	}
+
+	if maxPerIP > 0 {
+		exempt, err := parseCIDRs(perIPExempt)
+		if err != nil {
+			logger.Fatal("invalid -per-ip-exempt", zap.Error(err))
+		}
+
+		wss.perIP = newIPLimiter(maxPerIP, exempt)
+	}
+
+	if err := validateListeners(wss.addrs); err != nil {
+		logger.Fatal("invalid -listen", zap.Error(err))
+	}
+
+	if sessionSecret != "" {
+		wss.onUpgrade = sessionUpgradeHook(sessionCookie, &hmacSessionValidator{secret: []byte(sessionSecret)})
+	}
+
+	if jwtSecret != "" || jwtPublicKey != "" {
+		if sessionSecret != "" {
+			logger.Fatal("-session-secret and JWT authentication are mutually exclusive")
+		}
+
+		v := &jwtValidator{issuer: jwtIssuer, audience: jwtAudience, tenantClaim: jwtTenantClaim}
+		if jwtSecret != "" {
+			v.secret = []byte(jwtSecret)
+		}
+
+		if jwtPublicKey != "" {
+			if v.key, err = loadRSAPublicKey(jwtPublicKey); err != nil {
+				logger.Fatal("loading JWT public key", zap.Error(err))
+			}
+		}
+
+		if v.roles, err = parseRoleMap(jwtRoles); err != nil {
+			logger.Fatal("invalid -jwt-roles", zap.Error(err))
+		}
+
+		wss.onUpgrade = jwtUpgradeHook(v)
+		wss.rbac = true
+	}
+
+	if transportAddr != "" {
+		ts := &transportServer{
+			addr: transportAddr,
+			transports: []transport{
+				&sseTransport{
+					buffer:    sseBuffer,
+					onUpgrade: wss.onUpgrade,
+					access:    wss.transportAccess(),
+					bs:        bs,
+					logger:    logger,
+					clients:   make(map[string]map[*sseClient]struct{}),
+				},
+				&pollTransport{
+					onUpgrade: wss.onUpgrade,
+					access:    wss.transportAccess(),
+					bs:        bs,
+					waiters:   make(map[string]map[chan struct{}]struct{}),
+				},
+			},
+			logger: logger,
+		}
+
+		for _, t := range ts.transports {
+			if err := bs.addTransport(t.pattern(), t, logger); err != nil {
+				logger.Fatal("starting transports", zap.Error(err))
+			}
+		}
+
+		go ts.serve()
+	}
+
+	var clientCerts *clientCertAuth
+
+	// listenerCerts are the key pairs reload re-reads.
+	var listenerCerts []reloadableCert
+
+	if clientCA != "" {
+		if clientCerts, err = loadClientCertAuth(clientCA, clientCertRequired, clientCertCaps); err != nil {
+			logger.Fatal("invalid -tls-client-ca", zap.Error(err))
+		}
+	}
+
+	if wtAddr != "" {
+		if wtCert == "" || wtKey == "" {
+			logger.Fatal("-webtransport-addr requires -webtransport-cert and -webtransport-key")
+		}
+
+		certs := &certificateLoader{}
+		if err := certs.load(wtCert, wtKey); err != nil {
+			logger.Fatal("invalid -webtransport-cert", zap.Error(err))
+		}
+
+		listenerCerts = append(listenerCerts, reloadableCert{loader: certs, certFlag: "webtransport-cert", keyFlag: "webtransport-key"})
+
+		wt := newWebTransport(wtAddr, certs, wss.onUpgrade, wss.streamTransport(sseBuffer, clientCerts, logger))
+
+		if err := bs.addTransport(wt.pattern(), wt, logger); err != nil {
+			logger.Fatal("starting webtransport", zap.Error(err))
+		}
+
+		go wt.listen()
+	}
+
+	if tcpAddr != "" {
+		framing, err := parseFraming(tcpFraming)
+		if err != nil {
+			logger.Fatal("invalid -tcp-framing", zap.Error(err))
+		}
+
+		var tlsConfig *tls.Config
+
+		if tcpCert != "" || tcpKey != "" {
+			certs := &certificateLoader{}
+			if err := certs.load(tcpCert, tcpKey); err != nil {
+				logger.Fatal("invalid -tcp-tls-cert", zap.Error(err))
+			}
+
+			listenerCerts = append(listenerCerts, reloadableCert{loader: certs, certFlag: "tcp-tls-cert", keyFlag: "tcp-tls-key"})
+
+			tlsConfig = &tls.Config{MinVersion: tls.VersionTLS12, GetCertificate: certs.getCertificate}
+		}
+
+		tt := newTCPTransport(tcpAddr, framing, tlsConfig, wss.onUpgrade, handshakeTimeout, wss.streamTransport(sseBuffer, clientCerts, logger))
+
+		if err := bs.addTransport("tcp", tt, logger); err != nil {
+			logger.Fatal("starting tcp transport", zap.Error(err))
+		}
+
+		go tt.listen()
+	}
+
+	if advertiseURL != "" {
+		if peerPollInterval <= 0 {
+			logger.Fatal("-peer-poll-interval must be positive", zap.Duration("peer_poll_interval", peerPollInterval))
+		}
+
+		hinter := &peerLoadHinter{
+			self:     wss.load,
+			peers:    splitList(peers),
+			interval: peerPollInterval,
+			client:   &http.Client{},
+			logger:   logger,
+		}
+		wss.hints = hinter
+
+		go hinter.run()
+	}
+
+	if debugAddr != "" {
+		ds := &debugServer{addr: debugAddr, auth: admin.auth, bs: bs, logger: logger}
+
+		go ds.serve()
+	}
+
+	if healthPort != 0 {
+		hs := &healthServer{
+			addr: fmt.Sprintf(":%d", healthPort),
+			checks: []readinessCheck{
+				{name: "engine", check: wss.checkBooted},
+				{name: "drain", check: wss.checkNotDraining},
+				{name: "standby", check: wss.checkNotStandby},
+				{name: "cluster", check: bs.cluster.checkLinked},
+			},
+			extra: map[string]http.HandlerFunc{
+				"/capabilities": bs.handleCapabilities,
+				"/load":         wss.handleLoad,
+			},
+			logger: logger,
+		}
+
+		go hs.serve()
+	}
+
+	reload := &reloader{
+		config:  config,
+		certs:   listenerCerts,
+		hub:     bs,
+		level:   logLevel,
+		plugins: plugins,
+		router:  router,
+		geo:     wss.geo,
+		logger:  logger,
+	}
+
+	if admin.addr != "" {
+		if !admin.auth.configured() {
+			logger.Fatal("admin listener requires -admin-token or -admin-user and -admin-password")
+		}
+
+		if (admin.tlsCert == "") != (admin.tlsKey == "") {
+			logger.Fatal("-admin-tls-cert and -admin-tls-key must be set together")
+		}
+
+		if admin.tlsCert != "" {
+			admin.certs = &certificateLoader{}
+			if err := admin.certs.load(admin.tlsCert, admin.tlsKey); err != nil {
+				logger.Fatal("admin listener TLS", zap.Error(err))
+			}
+
+			reload.certs = append(reload.certs, reloadableCert{loader: admin.certs, certFlag: "admin-tls-cert", keyFlag: "admin-tls-key"})
+		}
+
+		if publishTokensFile != "" {
+			if admin.publishTokens, err = loadPublishTokens(publishTokensFile); err != nil {
+				logger.Fatal("loading publish tokens", zap.Error(err))
+			}
+		}
+
+		admin.reload = reload
+		admin.ipFilter = wss.ipFilter
+		admin.bans = wss.bans
+		admin.acls = wss.acls
+		admin.bs = bs
+		admin.migrator = &roomMigrator{token: migrationToken, client: &http.Client{}, bs: bs, logger: logger}
+		if admin.migrator.token == "" {
+			admin.migrator.token = admin.auth.token
+		}
+		admin.extra = map[string]http.HandlerFunc{
+			"/replication": wss.handleReplication,
+			"/failover":    wss.handleFailover,
+			"/promote":     wss.handlePromote,
+			// More specific than /connections/, so it wins.
+			"/connections/drain": wss.handleRebalance,
+		}
+		admin.logger = logger
+		if admin.audit, err = newAuditLogger(auditLog, logger); err != nil {
+			logger.Fatal("opening audit log", zap.Error(err))
+		}
+
+		go admin.serve()
+	}
+
+	if grpcPort != 0 && admin.auth.token == "" {
+		logger.Fatal("gRPC control plane requires -admin-token")
+	}
+
+	if grpcPort != 0 {
+		gs := &grpcServer{
+			addr:   fmt.Sprintf(":%d", grpcPort),
+			token:  admin.auth.token,
+			bs:     bs,
+			logger: logger,
+		}
+
+		go gs.serve()
+	}
+
+	if takeover && controlSocket == "" {
+		logger.Fatal("-takeover requires -control-socket")
+	}
+
+	if soak.subscribers > 0 || soak.publishers > 0 {
+		if err := soak.validate(); err != nil {
+			logger.Fatal("invalid soak test options", zap.Error(err))
+		}
+
+		soak.url = fmt.Sprintf("ws://127.0.0.1:%d", port)
+		soak.stopped = wss.isDraining
+		soak.logger = logger
+		wss.soak = &soak
+	}
+
+	if announcementsFile != "" {
+		wss.announcer = &announcer{bs: bs, logger: logger}
+		if err := wss.announcer.loadAnnouncements(announcementsFile); err != nil {
+			logger.Fatal("loading announcements", zap.Error(err))
+		}
+	}
+
+	go reload.reloadOnSignal()
+	go wss.shutdownOnSignal()
+
+	err = wss.serve()
+
+	logger.Info("server exits", zap.Error(err))
 }
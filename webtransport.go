@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"net/http"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+	"github.com/quic-go/webtransport-go"
+	"go.uber.org/zap"
+)
+
+// webTransport serves the stream protocol over WebTransport sessions on
+// HTTP/3. QUIC recovers from loss and network changes without stalling
+// the whole connection, which suits mobile clients better than TCP.
+//
+// A client opens a session on /wt, or /t/{tenant}/wt, optionally joining
+// rooms with ?room= as on /events, and then one bidirectional stream carrying control
+// frames, one per line.
+type webTransport struct {
+	*streamTransport
+
+	server    *webtransport.Server
+	onUpgrade upgradeHook
+}
+
+// newWebTransport serves on addr with the key pair certs holds, which QUIC
+// requires.
+func newWebTransport(addr string, certs *certificateLoader, onUpgrade upgradeHook, st *streamTransport) *webTransport {
+	st.framing = lineFraming{}
+	st.sessions = make(map[string]map[*streamSession]struct{})
+
+	wt := &webTransport{streamTransport: st, onUpgrade: onUpgrade}
+
+	mux := http.NewServeMux()
+	handleTransport(mux, wt)
+
+	h3 := &http3.Server{
+		Addr:       addr,
+		Handler:    mux,
+		TLSConfig:  http3.ConfigureTLSConfig(st.clientCerts.configure(&tls.Config{MinVersion: tls.VersionTLS13, GetCertificate: certs.getCertificate})),
+		QUICConfig: &quic.Config{EnableDatagrams: true, EnableStreamResetPartialDelivery: true},
+	}
+	webtransport.ConfigureHTTP3Server(h3)
+
+	wt.server = &webtransport.Server{H3: h3}
+
+	return wt
+}
+
+// listen serves until the server fails.
+func (t *webTransport) listen() {
+	t.logger.Info("webtransport server is listening", zap.String("addr", t.server.H3.Addr))
+
+	err := t.server.ListenAndServe()
+
+	t.logger.Error("webtransport server exits", zap.Error(err))
+}
+
+func (t *webTransport) pattern() string { return "/wt" }
+
+func (t *webTransport) handle(w http.ResponseWriter, r *http.Request) {
+	metadata := t.clientCerts.metadata(r.TLS)
+	if metadata == nil {
+		var ok bool
+		if metadata, ok = authorizeTransport(w, r, t.onUpgrade); !ok {
+			return
+		}
+	}
+
+	metadata, tenant, ok := t.access.admitTenant(w, r, metadata)
+	if !ok {
+		return
+	}
+
+	if err := t.bs.tenants.open(tenant); err != nil {
+		http.Error(w, err.Error(), rejectionStatus(err))
+
+		return
+	}
+	defer t.bs.tenants.close(tenant)
+
+	sess, err := t.server.Upgrade(w, r)
+	if err != nil {
+		t.logger.Info("webtransport upgrade failed", zap.String("remote_addr", r.RemoteAddr), zap.Error(err))
+		w.WriteHeader(http.StatusBadRequest)
+
+		return
+	}
+
+	ctx := sess.Context()
+
+	stream, err := sess.AcceptStream(ctx)
+	if err != nil {
+		_ = sess.CloseWithError(0, "no stream")
+
+		return
+	}
+
+	closeSession := func(reason string) { _ = sess.CloseWithError(0, reason) }
+
+	t.serve(ctx, bufio.NewReader(stream), stream, metadata, tenant, r.URL.Query()["room"], r.RemoteAddr, closeSession)
+	closeSession("")
+}
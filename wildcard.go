@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+
+	"go.uber.org/zap"
+)
+
+// templateVars are what a wildcard broadcast template can refer to for each
+// room it expands for. Name is the room name within the tenant.
+type templateVars struct {
+	Room    string
+	Tenant  string
+	Name    string
+	Members int
+}
+
+// wildcardDelivery is one room a wildcard broadcast sends to, with exactly
+// the data it sends.
+type wildcardDelivery struct {
+	Room       string          `json:"room"`
+	Recipients int             `json:"recipients"`
+	Data       json.RawMessage `json:"data"`
+}
+
+type wildcardResult struct {
+	DryRun     bool               `json:"dry_run"`
+	Rooms      int                `json:"rooms"`
+	Recipients int                `json:"recipients"`
+	Deliveries []wildcardDelivery `json:"deliveries"`
+}
+
+// templateFuncs lets templates quote values into JSON safely, e.g.
+// {"text":"hello","room":{{json .Name}}}.
+var templateFuncs = template.FuncMap{
+	"json": func(v interface{}) (string, error) {
+		data, err := json.Marshal(v)
+
+		return string(data), err
+	},
+}
+
+// roomsMatching returns the rooms of tenant whose name within the tenant
+// matches pattern, sorted by name.
+func (b *broadcastService) roomsMatching(tenant, pattern string) []templateVars {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	prefix := tenant + "/"
+
+	var rooms []templateVars
+
+	for name, r := range b.rooms {
+		if !strings.HasPrefix(name, prefix) {
+			continue
+		}
+
+		if ok, _ := path.Match(pattern, name[len(prefix):]); ok {
+			rooms = append(rooms, templateVars{
+				Room:    name,
+				Tenant:  tenant,
+				Name:    name[len(prefix):],
+				Members: len(r.members),
+			})
+		}
+	}
+
+	sort.Slice(rooms, func(i, j int) bool { return rooms[i].Room < rooms[j].Room })
+
+	return rooms
+}
+
+// expandTemplate renders tmpl once per room. Every expansion must be valid
+// JSON before anything is sent.
+func expandTemplate(tmpl *template.Template, rooms []templateVars) ([]wildcardDelivery, error) {
+	deliveries := make([]wildcardDelivery, 0, len(rooms))
+
+	for _, vars := range rooms {
+		var buf bytes.Buffer
+		if err := tmpl.Execute(&buf, vars); err != nil {
+			return nil, fmt.Errorf("expanding template for room %q: %w", vars.Room, err)
+		}
+
+		if !json.Valid(buf.Bytes()) {
+			return nil, fmt.Errorf("expanding template for room %q: result is not valid JSON", vars.Room)
+		}
+
+		deliveries = append(deliveries, wildcardDelivery{Room: vars.Room, Recipients: vars.Members, Data: buf.Bytes()})
+	}
+
+	return deliveries, nil
+}
+
+// handleWildcardBroadcast publishes the templated body to every room of
+// ?tenant= matching ?pattern=, e.g. game-*. With ?dry_run=true it only
+// reports what would be sent. A real send is recorded in the audit log room
+// by room.
+func (a *adminServer) handleWildcardBroadcast(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+
+		return
+	}
+
+	q := r.URL.Query()
+
+	tenant, pattern := q.Get("tenant"), q.Get("pattern")
+	if tenant == "" || pattern == "" {
+		http.Error(w, "tenant and pattern are required", http.StatusBadRequest)
+
+		return
+	}
+
+	if _, err := path.Match(pattern, ""); err != nil {
+		http.Error(w, fmt.Sprintf("invalid pattern: %v", err), http.StatusBadRequest)
+
+		return
+	}
+
+	dryRun, err := strconv.ParseBool(q.Get("dry_run"))
+	if err != nil && q.Get("dry_run") != "" {
+		http.Error(w, "invalid dry_run", http.StatusBadRequest)
+
+		return
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("reading body: %v", err), http.StatusBadRequest)
+
+		return
+	}
+
+	tmpl, err := template.New("broadcast").Funcs(templateFuncs).Option("missingkey=error").Parse(string(body))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("parsing template: %v", err), http.StatusBadRequest)
+
+		return
+	}
+
+	deliveries, err := expandTemplate(tmpl, a.bs.roomsMatching(tenant, pattern))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+
+		return
+	}
+
+	result := wildcardResult{DryRun: dryRun, Rooms: len(deliveries), Deliveries: deliveries}
+	for _, d := range deliveries {
+		result.Recipients += d.Recipients
+	}
+
+	if dryRun {
+		writeJSON(w, http.StatusOK, result)
+
+		return
+	}
+
+	for i, d := range deliveries {
+		err := a.bs.publish(r.Context(), d.Room, d.Data)
+		a.bs.msgAudit.record(httpSource(r), d.Room, 0, d.Data, err)
+
+		if err != nil {
+			a.auditWildcard(tenant, pattern, deliveries[:i], err)
+			http.Error(w, fmt.Sprintf("publishing to room %q: %v", d.Room, err), http.StatusBadGateway)
+
+			return
+		}
+	}
+
+	a.auditWildcard(tenant, pattern, deliveries, nil)
+
+	writeJSON(w, http.StatusAccepted, result)
+}
+
+func (a *adminServer) auditWildcard(tenant, pattern string, sent []wildcardDelivery, err error) {
+	fields := []zap.Field{
+		zap.String("action", "wildcard_broadcast"),
+		zap.String("tenant", tenant),
+		zap.String("pattern", pattern),
+		zap.Int("rooms", len(sent)),
+		zap.Any("deliveries", sent),
+	}
+
+	if err != nil {
+		fields = append(fields, zap.Error(err))
+	}
+
+	a.audit.Info("admin broadcast", fields...)
+}